@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+)
+
+// ackSuffix is added to the batch file name for its acknowledgment file.
+const ackSuffix = ".ack"
+
+// AckFile is written next to the batch file at the end of a run, for
+// integrators that drop a batch and poll for its acknowledgment: one entry
+// per record, in the order of the batch, with the record's final disposition
+// and the messages published for it. The file is renamed into place once
+// complete, so it never appears half written.
+type AckFile struct {
+	path    string
+	input   []SearchRequest
+	results map[string][]AckRecord
+	pending map[string][]AckMessage
+	mutex   sync.Mutex
+}
+
+type AckRecord struct {
+	Index             int          `json:"index"`
+	VRM               string       `json:"vrm"`
+	Company           string       `json:"company"`
+	ContraventionDate string       `json:"contravention_date,omitempty"`
+	DateFrom          string       `json:"date_from,omitempty"`
+	DateTo            string       `json:"date_to,omitempty"`
+	Disposition       string       `json:"disposition"`
+	Error             string       `json:"error,omitempty"`
+	Messages          []AckMessage `json:"messages,omitempty"`
+}
+
+// AckMessage is a published result. The message ID is the one assigned by
+// Pub/Sub, and is empty for other sinks and results sent through -outbox.
+type AckMessage struct {
+	MessageID string `json:"message_id,omitempty"`
+	Reference string `json:"reference"`
+}
+
+// acks is nil unless -ack is set.
+var acks *AckFile
+
+// NewAckFile acknowledges the records of a batch file, as read, before
+// -dedupe-batch.
+func NewAckFile(batchFile string, input []SearchRequest) *AckFile {
+	return &AckFile{
+		path:    batchFile + ackSuffix,
+		input:   input,
+		results: make(map[string][]AckRecord),
+		pending: make(map[string][]AckMessage),
+	}
+}
+
+// Published adds a result confirmed by the sink to its record.
+func (a *AckFile) Published(request SearchRequest, contravention *VehicleContravention) {
+	key := requestKey(request)
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.pending[key] = append(a.pending[key], AckMessage{MessageID: contravention.MessageID, Reference: contravention.Reference})
+}
+
+// Record stores the final disposition of a record, with the results
+// published for it.
+func (a *AckFile) Record(request SearchRequest, outcome string, err error) {
+	key := requestKey(request)
+	result := AckRecord{Disposition: outcome}
+	if err != nil {
+		result.Error = anonymizeText(err.Error())
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	result.Messages = a.pending[key]
+	delete(a.pending, key)
+	a.results[key] = append(a.results[key], result)
+}
+
+// Write writes the acknowledgment. Records removed by -dedupe-batch get the
+// disposition of the record they were collapsed into; records that were
+// never checked are skipped.
+func (a *AckFile) Write() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	records := make([]AckRecord, 0, len(a.input))
+	used := make(map[string]int)
+	for i, request := range a.input {
+		key := requestKey(request)
+		record := AckRecord{Disposition: outcomeSkipped}
+		if results := a.results[key]; len(results) > 0 {
+			record = results[min(used[key], len(results)-1)]
+			used[key]++
+		}
+		record.Index = i
+		record.VRM = anonymizeVRM(request.VRM)
+		record.Company = request.Company
+		record.ContraventionDate = request.ContraventionDate
+		record.DateFrom = request.DateFrom
+		record.DateTo = request.DateTo
+		records = append(records, record)
+	}
+
+	body, err := json.MarshalIndent(records, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := a.path + ".tmp"
+	if err := os.WriteFile(tmp, append(body, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.path)
+}
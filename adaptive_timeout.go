@@ -0,0 +1,97 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// defaultSearchTimeout bounds a search when timeouts are not adaptive, and
+// until a source has answered often enough for its latency to be known.
+const defaultSearchTimeout = 2 * time.Second
+
+const (
+	// latencyWindow is how many recent successful searches a source's
+	// timeout is based on.
+	latencyWindow = 100
+	// minLatencySamples is how many searches are needed before the timeout
+	// adapts.
+	minLatencySamples = 20
+	// timeoutFactor is how much slower than its p99 a search may be.
+	timeoutFactor = 2
+)
+
+// AdaptiveTimeout gives each source a timeout of timeoutFactor times the
+// p99 latency of its last successful searches, bounded by min and max, so
+// consistently slow providers stop timing out while dead ones still fail
+// fast.
+type AdaptiveTimeout struct {
+	min       time.Duration
+	max       time.Duration
+	mutex     sync.Mutex
+	latencies map[string][]time.Duration
+	next      map[string]int
+}
+
+// adaptiveTimeout is nil unless -adaptive-timeout is set.
+var adaptiveTimeout *AdaptiveTimeout
+
+func NewAdaptiveTimeout(min time.Duration, max time.Duration) *AdaptiveTimeout {
+	return &AdaptiveTimeout{
+		min:       min,
+		max:       max,
+		latencies: make(map[string][]time.Duration),
+		next:      make(map[string]int),
+	}
+}
+
+// Observe records the latency of a successful search.
+func (a *AdaptiveTimeout) Observe(sourceID string, latency time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	latencies := a.latencies[sourceID]
+	if len(latencies) < latencyWindow {
+		a.latencies[sourceID] = append(latencies, latency)
+		return
+	}
+	latencies[a.next[sourceID]] = latency
+	a.next[sourceID] = (a.next[sourceID] + 1) % latencyWindow
+}
+
+func (a *AdaptiveTimeout) Timeout(sourceID string) time.Duration {
+	a.mutex.Lock()
+	latencies := append([]time.Duration(nil), a.latencies[sourceID]...)
+	a.mutex.Unlock()
+
+	timeout := defaultSearchTimeout
+	if len(latencies) >= minLatencySamples {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		timeout = percentile(latencies, 0.99) * timeoutFactor
+	}
+	return min(max(timeout, a.min), a.max)
+}
+
+// searchClientTimeout is the timeout of the HTTP clients of the sources.
+// Adaptive timeouts are applied per request, within the upper bound.
+func searchClientTimeout() time.Duration {
+	if adaptiveTimeout != nil {
+		return adaptiveTimeout.max
+	}
+	return defaultSearchTimeout
+}
+
+// searchTimeout is how long a search of source may take.
+func searchTimeout(source DataSource) time.Duration {
+	if adaptiveTimeout == nil {
+		return defaultSearchTimeout
+	}
+	return adaptiveTimeout.Timeout(source.ID())
+}
+
+// observeSearchLatency records the latency of a successful search.
+func observeSearchLatency(source DataSource, latency time.Duration) {
+	if adaptiveTimeout != nil {
+		adaptiveTimeout.Observe(source.ID(), latency)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
+)
+
+// connectionFlags are the flags shared by commands that talk to Pub/Sub
+// without running a batch.
+type connectionFlags struct {
+	projectID    string
+	useEmulator  bool
+	emulatorHost string
+	credFile     string
+}
+
+func addConnectionFlags(fs *flag.FlagSet) *connectionFlags {
+	c := &connectionFlags{}
+	fs.StringVar(&c.projectID, "project", "", "Google Cloud Project ID (required)")
+	fs.BoolVar(&c.useEmulator, "emulator", false, "Connect to a running Pub/Sub emulator")
+	emulatorHost := runningEmulatorHost()
+	if emulatorHost == "" {
+		emulatorHost = "localhost:8085"
+	}
+	fs.StringVar(&c.emulatorHost, "emulator-host", emulatorHost, "Address of the running Pub/Sub emulator, from PUBSUB_EMULATOR_HOST if set")
+	fs.StringVar(&c.credFile, "creds", "", "Path to service account credentials JSON file")
+	return c
+}
+
+func (c *connectionFlags) newClient(ctx context.Context) (*pubsub.Client, error) {
+	if c.projectID == "" {
+		return nil, fmt.Errorf("missing required flag: -project")
+	}
+
+	client, err := pubsub.NewClient(ctx, c.projectID, c.options()...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pubsub client: %v", err)
+	}
+	return client, nil
+}
+
+func (c *connectionFlags) emulator() bool {
+	return c.useEmulator || runningEmulatorHost() != ""
+}
+
+// options are the client options of the connection, which also serve the
+// other Google APIs the commands call.
+func (c *connectionFlags) options() []option.ClientOption {
+	var opts []option.ClientOption
+	if c.emulator() {
+		opts = append(opts, option.WithEndpoint(c.emulatorHost))
+		opts = append(opts, option.WithoutAuthentication())
+	} else if c.credFile != "" {
+		opts = append(opts, option.WithCredentialsFile(c.credFile))
+	}
+	return opts
+}
+
+func runTopicsCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: t360 topics create|delete|list [flags] [topic...]")
+	}
+
+	fs := flag.NewFlagSet("topics "+args[0], flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	retention := fs.String("retention", "", "Message retention of created topics, e.g. 168h (default: none)")
+	fs.Parse(args[1:])
+
+	retentionDuration, err := parseRetention(*retention, maxTopicRetention)
+	if err != nil {
+		return err
+	}
+	topicConfig := &pubsub.TopicConfig{}
+	if retentionDuration > 0 {
+		topicConfig.RetentionDuration = retentionDuration
+	}
+
+	ctx := context.Background()
+	client, err := conn.newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	switch args[0] {
+	case "list":
+		topics := client.Topics(ctx)
+		for {
+			topic, err := topics.Next()
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Println(topic.ID())
+		}
+	case "create":
+		if fs.NArg() == 0 {
+			return fmt.Errorf("usage: t360 topics create [flags] topic...")
+		}
+		for _, name := range fs.Args() {
+			if _, err := client.CreateTopicWithConfig(ctx, name, topicConfig); err != nil {
+				return fmt.Errorf("failed to create topic %s: %v", name, err)
+			}
+			fmt.Printf("Created topic %s\n", name)
+		}
+	case "delete":
+		if fs.NArg() == 0 {
+			return fmt.Errorf("usage: t360 topics delete [flags] topic...")
+		}
+		for _, name := range fs.Args() {
+			if err := client.Topic(name).Delete(ctx); err != nil {
+				return fmt.Errorf("failed to delete topic %s: %v", name, err)
+			}
+			fmt.Printf("Deleted topic %s\n", name)
+		}
+	default:
+		return fmt.Errorf("unknown topics command: %s", args[0])
+	}
+
+	return nil
+}
+
+func runSubsCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: t360 subs create|delete|list [flags] [subscription...]")
+	}
+
+	fs := flag.NewFlagSet("subs "+args[0], flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	topicName := fs.String("topic", "", "Topic of the subscription (required for create, filters list)")
+	ackDeadline := fs.Duration("ack-deadline", 10*time.Second, "Acknowledgement deadline for created subscriptions")
+	retention := fs.String("retention", "", "Message retention of created subscriptions, e.g. 72h (default: 7 days)")
+	deadLetterTopic := fs.String("dead-letter-topic", "", "Topic undeliverable messages of created subscriptions are moved to, created if needed")
+	maxAttempts := fs.Int("max-delivery-attempts", 0, "Delivery attempts before a message is dead-lettered (5-100, default 5)")
+	fs.Parse(args[1:])
+
+	ctx := context.Background()
+	client, err := conn.newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	switch args[0] {
+	case "list":
+		var subs *pubsub.SubscriptionIterator
+		if *topicName != "" {
+			subs = client.Topic(*topicName).Subscriptions(ctx)
+		} else {
+			subs = client.Subscriptions(ctx)
+		}
+		for {
+			sub, err := subs.Next()
+			if err == iterator.Done {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			fmt.Println(sub.ID())
+		}
+	case "create":
+		if *topicName == "" || fs.NArg() == 0 {
+			return fmt.Errorf("usage: t360 subs create -topic topic [flags] subscription...")
+		}
+		settings := SubscriptionConfig{
+			Name:                fs.Arg(0),
+			Retention:           *retention,
+			DeadLetterTopic:     *deadLetterTopic,
+			MaxDeliveryAttempts: *maxAttempts,
+		}
+		if err := settings.parse(); err != nil {
+			return err
+		}
+
+		subConfig := pubsub.SubscriptionConfig{
+			Topic:             client.Topic(*topicName),
+			AckDeadline:       *ackDeadline,
+			RetentionDuration: settings.retention,
+		}
+		if *deadLetterTopic != "" {
+			deadLetter := client.Topic(*deadLetterTopic)
+			exists, err := deadLetter.Exists(ctx)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				if deadLetter, err = client.CreateTopic(ctx, *deadLetterTopic); err != nil {
+					return fmt.Errorf("failed to create dead-letter topic %s: %v", *deadLetterTopic, err)
+				}
+			}
+			subConfig.DeadLetterPolicy = &pubsub.DeadLetterPolicy{
+				DeadLetterTopic:     deadLetter.String(),
+				MaxDeliveryAttempts: *maxAttempts,
+			}
+		}
+		for _, name := range fs.Args() {
+			sub, err := client.CreateSubscription(ctx, name, subConfig)
+			if err != nil {
+				return fmt.Errorf("failed to create subscription %s: %v", name, err)
+			}
+			fmt.Printf("Created subscription %s on topic %s\n", name, *topicName)
+			if *deadLetterTopic != "" && !conn.emulator() {
+				deadLetter := client.Topic(*deadLetterTopic)
+				if err := grantDeadLettering(ctx, conn.projectID, conn.options(), sub, deadLetter); err != nil {
+					return err
+				}
+			}
+		}
+	case "delete":
+		if fs.NArg() == 0 {
+			return fmt.Errorf("usage: t360 subs delete [flags] subscription...")
+		}
+		for _, name := range fs.Args() {
+			if err := client.Subscription(name).Delete(ctx); err != nil {
+				return fmt.Errorf("failed to delete subscription %s: %v", name, err)
+			}
+			fmt.Printf("Deleted subscription %s\n", name)
+		}
+	default:
+		return fmt.Errorf("unknown subs command: %s", args[0])
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base32"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// anonymizeKeyEnv holds the key VRMs are pseudonymized with by -anonymize.
+const anonymizeKeyEnv = "T360_ANONYMIZE_KEY"
+
+// Anonymizer replaces VRMs with pseudonyms in everything a run outputs, so
+// volume tests against sandbox consumers don't carry real plates. Sources are
+// still searched with the real VRM. A pseudonym is Z and nine characters of
+// the HMAC-SHA256 of the VRM, so it is the same in every run with the same
+// key and is never a valid UK registration.
+type Anonymizer struct {
+	key        []byte
+	pseudonyms map[string]string
+	issued     map[string]bool
+	replacer   *strings.Replacer
+	mutex      sync.Mutex
+}
+
+// anonymizer is nil unless -anonymize is set.
+var anonymizer *Anonymizer
+
+func NewAnonymizer(key string) *Anonymizer {
+	return &Anonymizer{key: []byte(key), pseudonyms: make(map[string]string), issued: make(map[string]bool)}
+}
+
+// anonymizeVRM is the pseudonym of a VRM with -anonymize, or the VRM.
+func anonymizeVRM(vrm string) string {
+	if anonymizer == nil {
+		return vrm
+	}
+	return anonymizer.VRM(vrm)
+}
+
+// anonymizeText replaces the VRMs seen so far in a log line or error.
+func anonymizeText(text string) string {
+	if anonymizer == nil {
+		return text
+	}
+	return anonymizer.Text(text)
+}
+
+// VRM returns the pseudonym of a VRM, and remembers the VRM so it is
+// replaced in log lines too. A pseudonym is returned unchanged.
+func (a *Anonymizer) VRM(vrm string) string {
+	normalized := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(vrm), " ", ""))
+	if normalized == "" {
+		return vrm
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if pseudonym, ok := a.pseudonyms[vrm]; ok {
+		return pseudonym
+	}
+	if a.issued[vrm] {
+		return vrm
+	}
+
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(normalized))
+	pseudonym := "Z" + base32.StdEncoding.EncodeToString(mac.Sum(nil))[:9]
+	for _, form := range []string{vrm, strings.TrimSpace(vrm), normalized} {
+		a.pseudonyms[form] = pseudonym
+	}
+	a.issued[pseudonym] = true
+	a.replacer = nil
+	return pseudonym
+}
+
+// Text replaces every VRM seen so far, as given and normalized, with its
+// pseudonym.
+func (a *Anonymizer) Text(text string) string {
+	a.mutex.Lock()
+	if a.replacer == nil {
+		// Longer VRMs first, so "AB12 CDE" isn't replaced as "AB12".
+		forms := make([]string, 0, len(a.pseudonyms))
+		for form := range a.pseudonyms {
+			forms = append(forms, form)
+		}
+		sort.Slice(forms, func(i, j int) bool { return len(forms[i]) > len(forms[j]) })
+		pairs := make([]string, 0, 2*len(forms))
+		for _, form := range forms {
+			pairs = append(pairs, form, a.pseudonyms[form])
+		}
+		a.replacer = strings.NewReplacer(pairs...)
+	}
+	replacer := a.replacer
+	a.mutex.Unlock()
+	return replacer.Replace(text)
+}
+
+// Register adds the VRMs of a batch before anything about them is logged.
+func (a *Anonymizer) Register(requests []SearchRequest) {
+	for _, request := range requests {
+		a.VRM(request.VRM)
+	}
+}
+
+// anonymizedWriter replaces VRMs in the log.
+type anonymizedWriter struct {
+	w io.Writer
+}
+
+func (w anonymizedWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, anonymizeText(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// RunArtifacts is a directory, named after the run ID, that collects
+// everything a run writes: the log, the report and the emulator data.
+type RunArtifacts struct {
+	Dir     string
+	logFile *os.File
+}
+
+// artifacts is nil unless -artifacts is set.
+var artifacts *RunArtifacts
+
+// createRunArtifacts creates the run's directory under root and starts
+// copying the log into it.
+func createRunArtifacts(root string) (*RunArtifacts, error) {
+	dir := filepath.Join(root, runID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create artifacts directory: %v", err)
+	}
+
+	logFile, err := os.Create(filepath.Join(dir, "run.log"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create run log: %v", err)
+	}
+	log.SetOutput(io.MultiWriter(os.Stderr, logFile))
+
+	return &RunArtifacts{Dir: dir, logFile: logFile}, nil
+}
+
+// Path returns the path of an artifact inside the run's directory.
+func (a *RunArtifacts) Path(name string) string {
+	return filepath.Join(a.Dir, name)
+}
+
+func (a *RunArtifacts) Close() error {
+	log.SetOutput(os.Stderr)
+	return a.logFile.Close()
+}
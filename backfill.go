@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// runBackfillCommand checks the vehicles of -vrm, -batch or -batch-sql
+// against every day between -from and -to, for catching up on historical
+// contraventions. The range is checked in windows of -window days, each a
+// record of its own searched as a date range, so sources with date_range
+// support get a search per window and the others a search per day.
+func runBackfillCommand(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ExitOnError)
+	flags := &Flags{}
+	flags.register(fs)
+	from := fs.String("from", "", "First day of the backfill, YYYY-MM-DD (required)")
+	to := fs.String("to", "", "Last day of the backfill, YYYY-MM-DD (required)")
+	window := fs.Int("window", 7, fmt.Sprintf("Days checked per record, at most %d", maxDateRangeDays))
+	checkpointFile := fs.String("checkpoint", "", "Record the checked windows in this file, and skip the windows it already has")
+	fs.Parse(args)
+
+	for _, vrm := range fs.Args() {
+		flags.VRM.Set(vrm)
+	}
+	if *from == "" || *to == "" {
+		return fmt.Errorf("usage: t360 backfill -from 2024-01-01 -to 2024-03-31 [flags] [VRM...]")
+	}
+	if *window < 1 || *window > maxDateRangeDays {
+		return fmt.Errorf("window must be between 1 and %d days", maxDateRangeDays)
+	}
+	if flags.Worker {
+		return fmt.Errorf("backfill cannot be used with worker")
+	}
+	if err := flags.validate(); err != nil {
+		return err
+	}
+
+	fromDate, err := time.Parse(batchDateFormat, *from)
+	if err != nil {
+		return fmt.Errorf("invalid from %q, expected YYYY-MM-DD", *from)
+	}
+	toDate, err := time.Parse(batchDateFormat, *to)
+	if err != nil {
+		return fmt.Errorf("invalid to %q, expected YYYY-MM-DD", *to)
+	}
+	if toDate.Before(fromDate) {
+		return fmt.Errorf("to %s is before from %s", *to, *from)
+	}
+
+	vehicles, err := flags.searchRequests()
+	if err != nil {
+		return fmt.Errorf("failed to read batch: %v", err)
+	}
+	vehicles, _, err = dedupeRequests(vehicles)
+	if err != nil {
+		return err
+	}
+	requests, err := backfillRequests(vehicles, fromDate, toDate, *window)
+	if err != nil {
+		return err
+	}
+
+	if *checkpointFile != "" {
+		backfillCheckpoint, err = OpenBackfillCheckpoint(*checkpointFile)
+		if err != nil {
+			return err
+		}
+		defer backfillCheckpoint.Close()
+
+		total := len(requests)
+		requests = backfillCheckpoint.Remaining(requests)
+		if done := total - len(requests); done > 0 {
+			log.Printf("Skipping %d of %d windows already checked according to %s\n", done, total, *checkpointFile)
+		}
+	}
+	if len(requests) == 0 {
+		log.Printf("Nothing left to backfill\n")
+		return nil
+	}
+
+	// A contravention found in more than one window, or for a vehicle listed
+	// under several companies, is published once.
+	if flags.DedupDB == "" {
+		dedup = newMemoryDedupStore()
+	}
+
+	log.Printf("Backfilling %d vehicles from %s to %s in %d windows\n", len(vehicles), *from, *to, len(requests))
+	return run(flags, requests)
+}
+
+// backfillRequests splits the range into windows of days for every vehicle.
+func backfillRequests(vehicles []SearchRequest, from time.Time, to time.Time, window int) ([]SearchRequest, error) {
+	requests := make([]SearchRequest, 0)
+	for _, vehicle := range vehicles {
+		if vehicle.ContraventionDate != "" || vehicle.DateFrom != "" || vehicle.DateTo != "" {
+			return nil, fmt.Errorf("record %s has dates, which backfill sets from -from and -to", vehicle.VRM)
+		}
+		for start := from; !start.After(to); start = start.AddDate(0, 0, window) {
+			end := start.AddDate(0, 0, window-1)
+			if end.After(to) {
+				end = to
+			}
+			request := vehicle
+			request.DateFrom = start.Format(batchDateFormat)
+			request.DateTo = end.Format(batchDateFormat)
+			requests = append(requests, request)
+		}
+	}
+	return requests, nil
+}
+
+// BackfillCheckpoint is a file with a line for every window that was
+// checked, so an interrupted backfill can be started again where it stopped.
+// Windows that timed out, failed or were not reached are checked again.
+type BackfillCheckpoint struct {
+	file  *os.File
+	done  map[string]bool
+	mutex sync.Mutex
+}
+
+// backfillCheckpoint is nil unless backfill -checkpoint is set.
+var backfillCheckpoint *BackfillCheckpoint
+
+func OpenBackfillCheckpoint(path string) (*BackfillCheckpoint, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open checkpoint: %v", err)
+	}
+
+	done := make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			done[line] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to read checkpoint: %v", err)
+	}
+	return &BackfillCheckpoint{file: file, done: done}, nil
+}
+
+// checkpointKey identifies a window of a vehicle as a line of the file.
+func checkpointKey(request SearchRequest) string {
+	vrm := strings.ToUpper(strings.ReplaceAll(request.VRM, " ", ""))
+	return strings.Join([]string{vrm, request.Company, request.dateKey()}, "\t")
+}
+
+// Remaining returns the windows that are not checked yet.
+func (c *BackfillCheckpoint) Remaining(requests []SearchRequest) []SearchRequest {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	remaining := make([]SearchRequest, 0, len(requests))
+	for _, request := range requests {
+		if !c.done[checkpointKey(request)] {
+			remaining = append(remaining, request)
+		}
+	}
+	return remaining
+}
+
+// Record adds a window to the file once its outcome is final.
+func (c *BackfillCheckpoint) Record(request SearchRequest, outcome string) {
+	switch outcome {
+	case outcomeHit, outcomeMiss, outcomeDuplicate:
+	default:
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key := checkpointKey(request)
+	if c.done[key] {
+		return
+	}
+	if _, err := c.file.WriteString(key + "\n"); err != nil {
+		log.Printf("Failed to write checkpoint: %v\n", err)
+		return
+	}
+	c.done[key] = true
+}
+
+func (c *BackfillCheckpoint) Close() error {
+	return c.file.Close()
+}
+
+// memoryDedupStore is a DedupStore for a single run.
+type memoryDedupStore struct {
+	keys  map[string]bool
+	mutex sync.Mutex
+}
+
+func newMemoryDedupStore() *memoryDedupStore {
+	return &memoryDedupStore{keys: make(map[string]bool)}
+}
+
+func (s *memoryDedupStore) Reserve(key string) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.keys[key] {
+		return false, nil
+	}
+	s.keys[key] = true
+	return true, nil
+}
+
+func (s *memoryDedupStore) Release(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.keys, key)
+	return nil
+}
+
+// Confirm does nothing: the keys only live as long as the run.
+func (s *memoryDedupStore) Confirm(key string) error {
+	return nil
+}
+
+func (s *memoryDedupStore) Close() error {
+	return nil
+}
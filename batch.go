@@ -0,0 +1,233 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+// batchSchema is the JSON Schema of the batch file format.
+//
+//go:embed batch.schema.json
+var batchSchema []byte
+
+// pointerEscaper escapes a key for use in a JSON Pointer.
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+const (
+	severityError   = "error"
+	severityWarning = "warning"
+)
+
+// Diagnostic is a problem found in a batch file. Path is a JSON Pointer to
+// the offending value.
+type Diagnostic struct {
+	Severity string `json:"severity"`
+	Code     string `json:"code"`
+	Path     string `json:"path"`
+	Message  string `json:"message"`
+}
+
+func runBatchCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: t360 batch run|enqueue|validate|schema [flags] [file]")
+	}
+
+	switch args[0] {
+	case "run":
+		return runBatchRun(args[1:])
+	case "enqueue":
+		return runBatchEnqueue(args[1:])
+	case "schema":
+		_, err := os.Stdout.Write(batchSchema)
+		return err
+	case "validate":
+		return runBatchValidate(args[1:])
+	default:
+		return fmt.Errorf("unknown batch command: %s", args[0])
+	}
+}
+
+// runBatchValidate prints one JSON diagnostic per line and fails when the
+// file has errors. Warnings do not stop a run and don't fail validation.
+func runBatchValidate(args []string) error {
+	fs := flag.NewFlagSet("batch validate", flag.ExitOnError)
+	configFile := fs.String("config", "", "Also accept the companies of the sources in this config file")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: t360 batch validate [-config file] file.json")
+	}
+	path := fs.Arg(0)
+
+	initDataSources()
+	if *configFile != "" {
+		config, err := loadConfig(*configFile)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %v", err)
+		}
+		if err := registerConfiguredSources(config); err != nil {
+			return err
+		}
+	}
+
+	body, err := readBatchBody(path)
+	if err != nil {
+		return err
+	}
+
+	diagnostics := validateBatch(body)
+	encoder := json.NewEncoder(os.Stdout)
+	errorCount := 0
+	for _, diagnostic := range diagnostics {
+		if diagnostic.Severity == severityError {
+			errorCount++
+		}
+		if err := encoder.Encode(diagnostic); err != nil {
+			return err
+		}
+	}
+
+	log.Printf("%s: %d errors, %d warnings\n", path, errorCount, len(diagnostics)-errorCount)
+	if errorCount > 0 {
+		return fmt.Errorf("%s is not a valid batch file", path)
+	}
+	return nil
+}
+
+// validateBatch checks a batch file against the schema and reports records
+// the run would handle differently than intended: duplicates, which are
+// checked and published twice, and companies without a source, which are
+// searched in every source.
+func validateBatch(body []byte) []Diagnostic {
+	diagnostics := make([]Diagnostic, 0)
+	add := func(severity string, code string, path string, format string, args ...interface{}) {
+		diagnostics = append(diagnostics, Diagnostic{
+			Severity: severity,
+			Code:     code,
+			Path:     path,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	var records []json.RawMessage
+	if err := json.Unmarshal(body, &records); err != nil {
+		add(severityError, "invalid_json", "", "batch file must be a JSON array: %v", err)
+		return diagnostics
+	}
+
+	seen := make(map[string]int)
+	for i, raw := range records {
+		path := fmt.Sprintf("/%d", i)
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil || fields == nil {
+			add(severityError, "invalid_type", path, "record must be an object")
+			continue
+		}
+
+		names := make([]string, 0, len(fields))
+		for name := range fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		var request SearchRequest
+		valid := true
+		for _, name := range names {
+			value := fields[name]
+			var target *string
+			switch name {
+			case "metadata":
+				if err := json.Unmarshal(value, &request.Metadata); err != nil {
+					add(severityError, "invalid_type", path+"/metadata", "metadata must be an object of strings")
+					valid = false
+				} else if err := validateMetadata(request.Metadata); err != nil {
+					add(severityError, "invalid_metadata", path+"/metadata", "%v", err)
+					valid = false
+				}
+				continue
+			case "vrm":
+				target = &request.VRM
+			case "company":
+				target = &request.Company
+			case "contravention_date":
+				target = &request.ContraventionDate
+			case "date_from":
+				target = &request.DateFrom
+			case "date_to":
+				target = &request.DateTo
+			case "priority":
+				target = &request.Priority
+			case "callback_url":
+				target = &request.CallbackURL
+			case "reference":
+				target = &request.Reference
+			default:
+				add(severityError, "unknown_field", path+"/"+pointerEscaper.Replace(name), "unknown field %q", name)
+				valid = false
+				continue
+			}
+			if err := json.Unmarshal(value, target); err != nil {
+				add(severityError, "invalid_type", path+"/"+name, "%s must be a string", name)
+				valid = false
+			}
+		}
+
+		if _, ok := fields["vrm"]; !ok {
+			add(severityError, "missing_field", path+"/vrm", "vrm is required")
+			valid = false
+		} else if strings.TrimSpace(request.VRM) == "" && valid {
+			add(severityError, "empty_vrm", path+"/vrm", "vrm must not be empty")
+			valid = false
+		}
+
+		if request.ContraventionDate != "" {
+			if _, err := request.searchDate(); err != nil {
+				add(severityError, "invalid_date", path+"/contravention_date", "%v", err)
+				valid = false
+			}
+		}
+		if valid {
+			if _, _, _, err := request.dateRange(); err != nil {
+				add(severityError, "invalid_date_range", path, "%v", err)
+				valid = false
+			}
+		}
+
+		if err := validatePriority(request.Priority); err != nil && valid {
+			add(severityError, "invalid_priority", path+"/priority", "%v", err)
+			valid = false
+		}
+		if err := validateCallbackURL(request.CallbackURL); err != nil && valid {
+			add(severityError, "invalid_callback_url", path+"/callback_url", "%v", err)
+			valid = false
+		}
+		if err := validateReference(request.Reference); err != nil && valid {
+			add(severityError, "invalid_reference", path+"/reference", "%v", err)
+			valid = false
+		}
+
+		if !valid {
+			continue
+		}
+
+		if request.Company != "" && getDataSource(request.Company) == nil {
+			add(severityWarning, "unknown_company", path+"/company", "no source for company %q, the record will be searched in every source", request.Company)
+		}
+
+		key := requestKey(request)
+		if first, ok := seen[key]; ok {
+			add(severityWarning, "duplicate_vrm", path+"/vrm", "%s is a duplicate of record %d", request.VRM, first)
+			continue
+		}
+		seen[key] = i
+	}
+
+	return diagnostics
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	kms "cloud.google.com/go/kms/apiv1"
+	"cloud.google.com/go/kms/apiv1/kmspb"
+	"filippo.io/age"
+	agearmor "filippo.io/age/armor"
+	"github.com/ProtonMail/go-crypto/openpgp"
+	pgparmor "github.com/ProtonMail/go-crypto/openpgp/armor"
+)
+
+// Keys for encrypted batch files are read from the environment, never from
+// flags, so they don't end up in shell history or process listings.
+const (
+	envAgeIdentity     = "T360_AGE_IDENTITY"
+	envAgeIdentityFile = "T360_AGE_IDENTITY_FILE"
+	envGPGKey          = "T360_GPG_KEY"
+	envGPGKeyFile      = "T360_GPG_KEY_FILE"
+	envGPGPassphrase   = "T360_GPG_PASSPHRASE"
+	// envKeyKMS names a Cloud KMS key that the key material above is
+	// encrypted with. Values read from variables are then base64.
+	envKeyKMS = "T360_BATCH_KEY_KMS"
+)
+
+// readBatchBody reads a batch file, decrypting it in memory when it is age
+// or GPG encrypted.
+func readBatchBody(path string) ([]byte, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(body, []byte("age-encryption.org/")), bytes.HasPrefix(body, []byte(agearmor.Header)):
+		return decryptAge(body)
+	case bytes.HasPrefix(body, []byte("-----BEGIN PGP MESSAGE-----")), isBinaryPGPMessage(body):
+		return decryptGPG(body)
+	}
+	return body, nil
+}
+
+// isBinaryPGPMessage reports whether body starts with the session key packet
+// (public key or symmetric, old or new packet format) of an encrypted message.
+func isBinaryPGPMessage(body []byte) bool {
+	if len(body) == 0 {
+		return false
+	}
+	switch body[0] {
+	case 0x84, 0x85, 0x86, 0x87, 0x8c, 0x8d, 0x8e, 0x8f, 0xc1, 0xc3:
+		return true
+	}
+	return false
+}
+
+// batchKey returns key material from an environment variable or the file
+// named by another, unwrapping it with Cloud KMS when T360_BATCH_KEY_KMS is set.
+func batchKey(valueEnv string, fileEnv string) ([]byte, error) {
+	var key []byte
+	fromEnv := false
+	if value := os.Getenv(valueEnv); value != "" {
+		key = []byte(value)
+		fromEnv = true
+	} else if path := os.Getenv(fileEnv); path != "" {
+		var err error
+		if key, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	} else {
+		return nil, nil
+	}
+
+	kmsKey := os.Getenv(envKeyKMS)
+	if kmsKey == "" {
+		return key, nil
+	}
+	if fromEnv {
+		decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(key)))
+		if err != nil {
+			return nil, fmt.Errorf("%s must be base64 when %s is set: %v", valueEnv, envKeyKMS, err)
+		}
+		key = decoded
+	}
+	return kmsDecrypt(kmsKey, key)
+}
+
+func kmsDecrypt(keyName string, ciphertext []byte) ([]byte, error) {
+	ctx := context.Background()
+	client, err := kms.NewKeyManagementClient(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create KMS client: %v", err)
+	}
+	defer client.Close()
+
+	resp, err := client.Decrypt(ctx, &kmspb.DecryptRequest{
+		Name:       keyName,
+		Ciphertext: ciphertext,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt key with KMS: %v", err)
+	}
+	return resp.Plaintext, nil
+}
+
+func decryptAge(body []byte) ([]byte, error) {
+	key, err := batchKey(envAgeIdentity, envAgeIdentityFile)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("batch file is age encrypted: set %s or %s", envAgeIdentity, envAgeIdentityFile)
+	}
+	identities, err := age.ParseIdentities(bytes.NewReader(key))
+	if err != nil {
+		return nil, fmt.Errorf("invalid age identity: %v", err)
+	}
+
+	var src io.Reader = bytes.NewReader(body)
+	if bytes.HasPrefix(body, []byte(agearmor.Header)) {
+		src = agearmor.NewReader(src)
+	}
+	plaintext, err := age.Decrypt(src, identities...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt batch file: %v", err)
+	}
+	return io.ReadAll(plaintext)
+}
+
+// decryptGPG decrypts with a private key, or with only a passphrase for
+// symmetrically encrypted files.
+func decryptGPG(body []byte) ([]byte, error) {
+	key, err := batchKey(envGPGKey, envGPGKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	passphrase := []byte(os.Getenv(envGPGPassphrase))
+	if key == nil && len(passphrase) == 0 {
+		return nil, fmt.Errorf("batch file is GPG encrypted: set %s, %s or %s", envGPGKey, envGPGKeyFile, envGPGPassphrase)
+	}
+
+	var keyring openpgp.EntityList
+	if key != nil {
+		if bytes.Contains(key, []byte("-----BEGIN PGP")) {
+			keyring, err = openpgp.ReadArmoredKeyRing(bytes.NewReader(key))
+		} else {
+			keyring, err = openpgp.ReadKeyRing(bytes.NewReader(key))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid GPG key: %v", err)
+		}
+	}
+
+	var src io.Reader = bytes.NewReader(body)
+	if bytes.HasPrefix(body, []byte("-----BEGIN PGP MESSAGE-----")) {
+		block, err := pgparmor.Decode(src)
+		if err != nil {
+			return nil, fmt.Errorf("invalid armored batch file: %v", err)
+		}
+		src = block.Body
+	}
+
+	prompted := false
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if prompted || len(passphrase) == 0 {
+			return nil, fmt.Errorf("wrong or missing %s", envGPGPassphrase)
+		}
+		prompted = true
+		if symmetric {
+			return passphrase, nil
+		}
+		for _, k := range keys {
+			if k.PrivateKey != nil && k.PrivateKey.Encrypted {
+				k.PrivateKey.Decrypt(passphrase)
+			}
+		}
+		return nil, nil
+	}
+
+	message, err := openpgp.ReadMessage(src, keyring, prompt, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt batch file: %v", err)
+	}
+	plaintext, err := io.ReadAll(message.UnverifiedBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt batch file: %v", err)
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"maps"
+)
+
+// dedupeRequests collapses records of the same vehicle, company and date, so
+// a batch that lists a vehicle more than once searches it once. The first
+// record is kept, with the highest priority of its duplicates. Records of the
+// same vehicle and company on different dates are different searches and are
+// all kept. Duplicates whose callback_url, reference or metadata differ from
+// the first record's can't be collapsed without losing them, and fail.
+func dedupeRequests(requests []SearchRequest) ([]SearchRequest, int, error) {
+	seen := make(map[string]int, len(requests))
+	deduped := make([]SearchRequest, 0, len(requests))
+	indexes := make([]int, 0, len(requests))
+	for i, request := range requests {
+		key := requestKey(request)
+		if first, ok := seen[key]; ok {
+			if field := conflictingField(deduped[first], request); field != "" {
+				return nil, 0, fmt.Errorf("record %d duplicates record %d with a different %s", i, indexes[first], field)
+			}
+			if priorityRanks[request.Priority] < priorityRanks[deduped[first].Priority] {
+				deduped[first].Priority = request.Priority
+			}
+			continue
+		}
+		seen[key] = len(deduped)
+		deduped = append(deduped, request)
+		indexes = append(indexes, i)
+	}
+	return deduped, len(requests) - len(deduped), nil
+}
+
+// conflictingField names the first field a duplicate record sets differently
+// from the record it would be collapsed into, or returns "".
+func conflictingField(first SearchRequest, duplicate SearchRequest) string {
+	switch {
+	case first.CallbackURL != duplicate.CallbackURL:
+		return "callback_url"
+	case first.Reference != duplicate.Reference:
+		return "reference"
+	case !maps.Equal(first.Metadata, duplicate.Metadata):
+		return "metadata"
+	}
+	return ""
+}
+
+// dedupeBatch removes the duplicate records of a batch before it is checked.
+func dedupeBatch(requests []SearchRequest) ([]SearchRequest, error) {
+	deduped, removed, err := dedupeRequests(requests)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Removed %d duplicate records from the batch, %d left\n", removed, len(deduped))
+	return deduped, nil
+}
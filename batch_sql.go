@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/jackc/pgx/v5/stdlib"
+)
+
+// sqlDriver picks the database/sql driver for a DSN. Postgres DSNs are URLs
+// (postgres://...) and MySQL DSNs use the driver's own format, optionally
+// prefixed with mysql://.
+func sqlDriver(dsn string) (string, string, error) {
+	switch {
+	case strings.HasPrefix(dsn, "postgres://"), strings.HasPrefix(dsn, "postgresql://"):
+		return "pgx", dsn, nil
+	case strings.HasPrefix(dsn, "mysql://"):
+		return "mysql", strings.TrimPrefix(dsn, "mysql://"), nil
+	}
+	return "", "", fmt.Errorf("unsupported batch DSN, use postgres://... or mysql://...")
+}
+
+// readBatchSQL reads the records to check from a query. The vrm column is
+// required; company and contravention_date are optional, and any other
+// column is passed through as record metadata.
+func readBatchSQL(ctx context.Context, dsn string, query string) ([]SearchRequest, error) {
+	requests := make([]SearchRequest, 0)
+	_, err := scanBatchSQL(ctx, dsn, query, func(request SearchRequest) error {
+		requests = append(requests, request)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("Read %d records from the batch query\n", len(requests))
+	return requests, nil
+}
+
+// scanBatchSQL runs the query and passes each record to record as its row is
+// read. It returns the number of records read.
+func scanBatchSQL(ctx context.Context, dsn string, query string, record func(SearchRequest) error) (int, error) {
+	driver, source, err := sqlDriver(dsn)
+	if err != nil {
+		return 0, err
+	}
+	db, err := sql.Open(driver, source)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	log.Printf("Reading batch from %s query\n", driver)
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return 0, fmt.Errorf("batch query failed: %v", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, err
+	}
+	hasVRM := false
+	for _, column := range columns {
+		hasVRM = hasVRM || column == "vrm"
+	}
+	if !hasVRM {
+		return 0, fmt.Errorf("batch query must return a vrm column")
+	}
+
+	read := 0
+	values := make([]sql.NullString, len(columns))
+	targets := make([]interface{}, len(columns))
+	for i := range values {
+		targets[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(targets...); err != nil {
+			return read, fmt.Errorf("row %d: %v", read, err)
+		}
+
+		var request SearchRequest
+		for i, column := range columns {
+			if !values[i].Valid {
+				continue
+			}
+			value := values[i].String
+			switch column {
+			case "vrm":
+				request.VRM = value
+			case "company":
+				request.Company = value
+			case "contravention_date":
+				request.ContraventionDate = sqlDate(value)
+			case "date_from":
+				request.DateFrom = sqlDate(value)
+			case "date_to":
+				request.DateTo = sqlDate(value)
+			case "priority":
+				request.Priority = value
+			case "callback_url":
+				request.CallbackURL = value
+			case "reference":
+				request.Reference = value
+			default:
+				if request.Metadata == nil {
+					request.Metadata = make(map[string]string)
+				}
+				request.Metadata[column] = value
+			}
+		}
+
+		if err := request.validateDates(); err != nil {
+			return read, fmt.Errorf("row %d: %v", read, err)
+		}
+		if err := validateMetadata(request.Metadata); err != nil {
+			return read, fmt.Errorf("row %d: %v", read, err)
+		}
+		if err := validatePriority(request.Priority); err != nil {
+			return read, fmt.Errorf("row %d: %v", read, err)
+		}
+		if err := validateCallbackURL(request.CallbackURL); err != nil {
+			return read, fmt.Errorf("row %d: %v", read, err)
+		}
+		if err := validateReference(request.Reference); err != nil {
+			return read, fmt.Errorf("row %d: %v", read, err)
+		}
+		if err := record(request); err != nil {
+			return read, err
+		}
+		read++
+	}
+	if err := rows.Err(); err != nil {
+		return read, fmt.Errorf("batch query failed: %v", err)
+	}
+	return read, nil
+}
+
+// streamsBatchSQL reports whether the records of -batch-sql are checked as
+// their rows are read. -dedupe-batch, -max-records, -strict, -warmup and
+// -budget need the whole batch before the first record is checked, so it is
+// read first with them.
+func (f *Flags) streamsBatchSQL() bool {
+	return f.BatchSQL != "" && !f.DedupeBatch && f.MaxRecords == 0 && !f.Strict && !f.Warmup && f.Budget == 0
+}
+
+// streamBatchSQL checks the records of -batch-sql as the rows are read, so
+// checking starts with the first row and the batch never has to fit in
+// memory. Rows are read as fast as the sources take the records, and each
+// record gets the checks run reads a whole batch with.
+func streamBatchSQL(sink Sink, ctx context.Context, flags *Flags) error {
+	read := 0
+	err := processStream(sink, ctx, func(ctx context.Context, next func(SearchRequest) error) error {
+		_, err := scanBatchSQL(ctx, flags.batchDSN(), flags.BatchSQL, func(request SearchRequest) error {
+			if err := requireCallbacks(request); err != nil {
+				return fmt.Errorf("record %d: %v", read, err)
+			}
+			if err := requireReference(request); err != nil {
+				return err
+			}
+			if anonymizer != nil {
+				anonymizer.VRM(request.VRM)
+			}
+			summary.AddInput(request)
+			read++
+			return next(request)
+		})
+		return err
+	})
+	log.Printf("Read %d records from the batch query\n", read)
+	if manifest != nil {
+		manifest.Input.Records = read
+	}
+	return err
+}
+
+// sqlDate converts a date or timestamp column to the batch date format.
+// Drivers return DATE columns as a date or as an RFC3339 timestamp.
+func sqlDate(value string) string {
+	if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+		return t.Format(batchDateFormat)
+	}
+	if len(value) > len(batchDateFormat) {
+		return value[:len(batchDateFormat)]
+	}
+	return value
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// BlackoutWindow is a daily period, in UTC, during which a source is known to
+// be unavailable. A window may wrap past midnight, e.g. 23:30 to 00:30.
+type BlackoutWindow struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	start time.Duration
+	end   time.Duration
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, expected HH:MM", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+func (w *BlackoutWindow) parse() error {
+	var err error
+	if w.start, err = parseTimeOfDay(w.Start); err != nil {
+		return fmt.Errorf("blackout window: %v", err)
+	}
+	if w.end, err = parseTimeOfDay(w.End); err != nil {
+		return fmt.Errorf("blackout window: %v", err)
+	}
+	if w.start == w.end {
+		return fmt.Errorf("blackout window %s-%s is empty", w.Start, w.End)
+	}
+	return nil
+}
+
+// activeUntil returns the end of the window if now falls inside it.
+func (w *BlackoutWindow) activeUntil(now time.Time) (time.Time, bool) {
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	offset := now.Sub(midnight)
+
+	if w.start < w.end {
+		if offset >= w.start && offset < w.end {
+			return midnight.Add(w.end), true
+		}
+		return time.Time{}, false
+	}
+
+	if offset >= w.start {
+		return midnight.Add(24 * time.Hour).Add(w.end), true
+	}
+	if offset < w.end {
+		return midnight.Add(w.end), true
+	}
+	return time.Time{}, false
+}
+
+func sourceBlackoutUntil(source DataSource, now time.Time) (time.Time, bool) {
+	configured, ok := source.(ConfiguredSource)
+	if !ok {
+		return time.Time{}, false
+	}
+
+	for i := range configured.SourceConfig().BlackoutWindows {
+		if until, ok := configured.SourceConfig().BlackoutWindows[i].activeUntil(now); ok {
+			return until, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// blackoutUntil reports whether a record has to wait for a blackout window to
+// end. Records without a known company are searched in every source, so they
+// wait while any source is unavailable.
+func blackoutUntil(company string, now time.Time) (time.Time, bool) {
+	if source := getDataSource(company); source != nil {
+		return sourceBlackoutUntil(source, now)
+	}
+
+	var latest time.Time
+	for _, source := range allDataSources() {
+		if until, ok := sourceBlackoutUntil(source, now); ok && until.After(latest) {
+			latest = until
+		}
+	}
+	return latest, !latest.IsZero()
+}
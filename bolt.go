@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// boltLockTimeout is how long opening a local database waits for another
+// process to release it. bbolt files are locked by the run that has them
+// open, so they can't be shared by runs at the same time.
+const boltLockTimeout = time.Second
+
+// openBolt opens the local database of a feature, described by what, and
+// fails fast when another run has it open.
+func openBolt(path string, what string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: boltLockTimeout})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, fmt.Errorf("%s %s is in use by another t360 run; a local file can only be used by one run at a time", what, path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s %s: %v", what, path, err)
+	}
+	return db, nil
+}
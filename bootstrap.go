@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"cloud.google.com/go/iam"
+	"cloud.google.com/go/pubsub"
+	"google.golang.org/api/cloudresourcemanager/v1"
+	"google.golang.org/api/option"
+)
+
+// PubSubBootstrap sets up a new environment: the retention of the
+// positive_searches topic when a run creates it, and subscriptions on it,
+// with their dead-letter topics, that are created when missing.
+type PubSubBootstrap struct {
+	Retention     string               `json:"retention,omitempty"`
+	Subscriptions []SubscriptionConfig `json:"subscriptions,omitempty"`
+	// Fields limits the fields of the messages published to the
+	// positive_searches topic.
+	Fields    *PayloadFields `json:"fields,omitempty"`
+	retention time.Duration
+}
+
+type SubscriptionConfig struct {
+	Name                string `json:"name"`
+	AckDeadline         string `json:"ack_deadline,omitempty"`
+	Retention           string `json:"retention,omitempty"`
+	DeadLetterTopic     string `json:"dead_letter_topic,omitempty"`
+	MaxDeliveryAttempts int    `json:"max_delivery_attempts,omitempty"`
+	ackDeadline         time.Duration
+	retention           time.Duration
+}
+
+// Pub/Sub accepts message retention between 10 minutes and 7 days for
+// subscriptions (31 days for topics), and 5 to 100 delivery attempts before
+// a message is dead-lettered.
+const (
+	minRetention             = 10 * time.Minute
+	maxSubscriptionRetention = 7 * 24 * time.Hour
+	maxTopicRetention        = 31 * 24 * time.Hour
+	minDeliveryAttempts      = 5
+	maxDeliveryAttempts      = 100
+)
+
+// parse checks the settings and parses their durations.
+func (b *PubSubBootstrap) parse() error {
+	var err error
+	if b.retention, err = parseRetention(b.Retention, maxTopicRetention); err != nil {
+		return fmt.Errorf("pubsub: %v", err)
+	}
+
+	names := make(map[string]bool)
+	for i := range b.Subscriptions {
+		sub := &b.Subscriptions[i]
+		if sub.Name == "" {
+			return fmt.Errorf("pubsub: subscription name is required")
+		}
+		if names[sub.Name] {
+			return fmt.Errorf("pubsub: subscription %s is defined more than once", sub.Name)
+		}
+		names[sub.Name] = true
+
+		if err := sub.parse(); err != nil {
+			return err
+		}
+	}
+	if b.Fields != nil {
+		return b.Fields.validate("pubsub")
+	}
+	return nil
+}
+
+func (c *SubscriptionConfig) parse() error {
+	var err error
+	if c.AckDeadline != "" {
+		if c.ackDeadline, err = time.ParseDuration(c.AckDeadline); err != nil {
+			return fmt.Errorf("subscription %s: invalid ack_deadline %q", c.Name, c.AckDeadline)
+		}
+	}
+	if c.retention, err = parseRetention(c.Retention, maxSubscriptionRetention); err != nil {
+		return fmt.Errorf("subscription %s: %v", c.Name, err)
+	}
+	if c.MaxDeliveryAttempts != 0 && c.DeadLetterTopic == "" {
+		return fmt.Errorf("subscription %s: max_delivery_attempts requires a dead_letter_topic", c.Name)
+	}
+	if c.MaxDeliveryAttempts != 0 && (c.MaxDeliveryAttempts < minDeliveryAttempts || c.MaxDeliveryAttempts > maxDeliveryAttempts) {
+		return fmt.Errorf("subscription %s: max_delivery_attempts must be between %d and %d", c.Name, minDeliveryAttempts, maxDeliveryAttempts)
+	}
+	return nil
+}
+
+func parseRetention(value string, max time.Duration) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+	retention, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid retention %q", value)
+	}
+	if retention < minRetention || retention > max {
+		return 0, fmt.Errorf("retention must be between %s and %s", minRetention, max)
+	}
+	return retention, nil
+}
+
+// bootstrapPubSub creates the results topic with the configured retention,
+// if it doesn't exist yet and is in the client project, and the configured subscriptions on it
+// that are missing. Existing topics and subscriptions are left as they are.
+func bootstrapPubSub(ctx context.Context, bootstrap *PubSubBootstrap) error {
+	client, err := clientFactory.Client(ctx)
+	if err != nil {
+		return err
+	}
+
+	topic, own, err := topicRef(client, resultsTopic)
+	if err != nil {
+		return err
+	}
+	exists, err := topic.Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check topic: %v", err)
+	}
+	if !exists {
+		if !own {
+			return fmt.Errorf("topic %s does not exist, and topics in other projects are not created", resultsTopic)
+		}
+		topicConfig := &pubsub.TopicConfig{}
+		if bootstrap.retention > 0 {
+			topicConfig.RetentionDuration = bootstrap.retention
+		}
+		if _, err := client.CreateTopicWithConfig(ctx, topic.ID(), topicConfig); err != nil {
+			return fmt.Errorf("failed to create topic: %v", err)
+		}
+		log.Printf("Created topic %s\n", topic.ID())
+	}
+
+	for _, sub := range bootstrap.Subscriptions {
+		exists, err := client.Subscription(sub.Name).Exists(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to check subscription %s: %v", sub.Name, err)
+		}
+		if exists {
+			continue
+		}
+
+		subConfig := pubsub.SubscriptionConfig{
+			Topic:       topic,
+			AckDeadline: sub.ackDeadline,
+		}
+		if sub.retention > 0 {
+			subConfig.RetentionDuration = sub.retention
+		}
+		var deadLetter *pubsub.Topic
+		if sub.DeadLetterTopic != "" {
+			deadLetter, err = clientFactory.Topic(ctx, sub.DeadLetterTopic)
+			if err != nil {
+				return fmt.Errorf("failed to create dead-letter topic %s: %v", sub.DeadLetterTopic, err)
+			}
+			subConfig.DeadLetterPolicy = &pubsub.DeadLetterPolicy{
+				DeadLetterTopic:     deadLetter.String(),
+				MaxDeliveryAttempts: sub.MaxDeliveryAttempts,
+			}
+		}
+
+		created, err := client.CreateSubscription(ctx, sub.Name, subConfig)
+		if err != nil {
+			return fmt.Errorf("failed to create subscription %s: %v", sub.Name, err)
+		}
+		log.Printf("Created subscription %s on %s\n", sub.Name, topic.ID())
+		if deadLetter != nil && !clientFactory.emulator {
+			if err := grantDeadLettering(ctx, client.Project(), clientFactory.opts, created, deadLetter); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// grantDeadLettering lets the Pub/Sub service agent of project, which moves
+// messages to dead-letter topics, publish to the dead-letter topic and
+// acknowledge the messages it moves off the subscription. Without these
+// grants, messages are delivered again forever. The emulator has no IAM, so
+// it isn't called there.
+func grantDeadLettering(ctx context.Context, project string, opts []option.ClientOption, sub *pubsub.Subscription, deadLetter *pubsub.Topic) error {
+	agent, err := pubsubServiceAgent(ctx, project, opts)
+	if err == nil {
+		err = addBinding(ctx, deadLetter.IAM(), agent, "roles/pubsub.publisher")
+	}
+	if err == nil {
+		err = addBinding(ctx, sub.IAM(), agent, "roles/pubsub.subscriber")
+	}
+	if err != nil {
+		if agent == "" {
+			agent = "serviceAccount:service-<project number>@gcp-sa-pubsub.iam.gserviceaccount.com"
+		}
+		return fmt.Errorf("failed to grant the Pub/Sub service agent the roles dead-lettering needs on subscription %s: %v\n"+
+			"Grant them with:\n"+
+			"  gcloud pubsub topics add-iam-policy-binding %s --member=%s --role=roles/pubsub.publisher\n"+
+			"  gcloud pubsub subscriptions add-iam-policy-binding %s --project=%s --member=%s --role=roles/pubsub.subscriber",
+			sub.ID(), err, deadLetter, agent, sub.ID(), project, agent)
+	}
+	log.Printf("Granted %s the roles for dead-lettering on %s and %s\n", agent, sub.ID(), deadLetter.ID())
+	return nil
+}
+
+// pubsubServiceAgent returns the IAM member of the Pub/Sub service agent of a
+// project, which is named after the project number.
+func pubsubServiceAgent(ctx context.Context, project string, opts []option.ClientOption) (string, error) {
+	service, err := cloudresourcemanager.NewService(ctx, opts...)
+	if err != nil {
+		return "", err
+	}
+	details, err := service.Projects.Get(project).Context(ctx).Do()
+	if err != nil {
+		return "", fmt.Errorf("failed to look up the number of project %s: %v", project, err)
+	}
+	return fmt.Sprintf("serviceAccount:service-%d@gcp-sa-pubsub.iam.gserviceaccount.com", details.ProjectNumber), nil
+}
+
+// addBinding grants member a role on a resource, unless it already has it.
+func addBinding(ctx context.Context, handle *iam.Handle, member string, role iam.RoleName) error {
+	policy, err := handle.Policy(ctx)
+	if err != nil {
+		return err
+	}
+	if policy.HasRole(member, role) {
+		return nil
+	}
+	policy.Add(member, role)
+	return handle.SetPolicy(ctx, policy)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// LatencyBudget fits a run into a wall-clock budget. Records of a known
+// company, which take a single search, are checked before records of an
+// unknown company, which are searched in every source, and the records of
+// each source are checked cheapest first. A record is not started when the
+// time its searches are expected to take, from the latency seen so far for
+// each source, would run past the budget; it is reported as deferred
+// instead, to be checked by a later run.
+type LatencyBudget struct {
+	deadline  time.Time
+	mutex     sync.Mutex
+	latencies map[string]time.Duration
+}
+
+// budget is nil unless -budget is set.
+var budget *LatencyBudget
+
+// budgetLatencyWeight is the weight of the newest search in a source's
+// average latency.
+const budgetLatencyWeight = 0.2
+
+func NewLatencyBudget(total time.Duration) *LatencyBudget {
+	return &LatencyBudget{
+		deadline:  time.Now().Add(total),
+		latencies: make(map[string]time.Duration),
+	}
+}
+
+// ObserveSearch updates the average latency of a source.
+func (b *LatencyBudget) ObserveSearch(source string, latency time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	average, ok := b.latencies[source]
+	if !ok {
+		b.latencies[source] = latency
+		return
+	}
+	b.latencies[source] = average + time.Duration(budgetLatencyWeight*float64(latency-average))
+}
+
+// Estimate is how long checking a record is expected to take. Sources that
+// haven't been searched yet count as the slowest source seen.
+func (b *LatencyBudget) Estimate(request SearchRequest) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	var slowest time.Duration
+	for _, latency := range b.latencies {
+		slowest = max(slowest, latency)
+	}
+
+	var estimate time.Duration
+	for _, source := range recordSources(request) {
+		latency, ok := b.latencies[source.ID()]
+		if !ok {
+			latency = slowest
+		}
+		estimate += time.Duration(recordSearches(source, request)) * latency
+	}
+	return estimate
+}
+
+// Allows reports whether a record is expected to be checked within the
+// budget.
+func (b *LatencyBudget) Allows(request SearchRequest) bool {
+	return !time.Now().Add(b.Estimate(request)).After(b.deadline)
+}
+
+// recordSources are the sources a record is searched in.
+func recordSources(request SearchRequest) []DataSource {
+	if source := getDataSource(request.Company); source != nil {
+		return []DataSource{source}
+	}
+	return allDataSources()
+}
+
+// recordSearches is the number of searches a record takes in a source: one,
+// or one per day of its date range for sources without date_range.
+func recordSearches(source DataSource, request SearchRequest) int {
+	from, to, isRange, err := request.dateRange()
+	if err != nil || !isRange {
+		return 1
+	}
+	if settings := sourceSettings(source); settings != nil && settings.DateRange {
+		return 1
+	}
+	return int(to.Sub(from).Hours()/24) + 1
+}
+
+// recordCost is the number of searches a record takes in all its sources.
+func recordCost(request SearchRequest) int {
+	cost := 0
+	for _, source := range recordSources(request) {
+		cost += recordSearches(source, request)
+	}
+	return cost
+}
+
+// sortByCost moves the cheapest records of each priority to the front.
+func sortByCost(requests []SearchRequest) {
+	sort.SliceStable(requests, func(i, j int) bool {
+		ri, rj := priorityRanks[requests[i].Priority], priorityRanks[requests[j].Priority]
+		if ri != rj {
+			return ri < rj
+		}
+		return recordCost(requests[i]) < recordCost(requests[j])
+	})
+}
+
+// processKnownFirst checks the groups of known sources side by side, and the
+// records of unknown companies once they are done.
+func processKnownFirst(sink Sink, ctx context.Context, groups []*requestGroup) error {
+	var unknown *requestGroup
+	g, groupCtx := errgroup.WithContext(ctx)
+	for _, group := range groups {
+		if group.source == nil {
+			unknown = group
+			continue
+		}
+		g.Go(func() error {
+			return processGroup(sink, groupCtx, group)
+		})
+	}
+	if err := g.Wait(); err != nil || unknown == nil {
+		return err
+	}
+	return processGroup(sink, ctx, unknown)
+}
+
+// deferRecord reports a record that doesn't fit in the budget.
+func deferRecord(request SearchRequest) {
+	log.Printf("Deferring %s: not expected to finish within the budget\n", request.VRM)
+	summary.Record(request, outcomeDeferred, nil)
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// callbackSecretEnv holds the secret callbacks are signed with.
+const callbackSecretEnv = "T360_CALLBACK_SECRET"
+
+const (
+	callbackSignatureHeader   = "X-T360-Signature"
+	callbackTimestampHeader   = "X-T360-Timestamp"
+	callbackIdempotencyHeader = "X-T360-Idempotency-Key"
+	callbackAttempts          = 3
+)
+
+// CallbackPayload is POSTed to the callback_url of a record once its outcome
+// is known.
+type CallbackPayload struct {
+	RunID             string            `json:"run_id"`
+	VRM               string            `json:"vrm"`
+	Company           string            `json:"company"`
+	ContraventionDate string            `json:"contravention_date,omitempty"`
+	DateFrom          string            `json:"date_from,omitempty"`
+	DateTo            string            `json:"date_to,omitempty"`
+	Outcome           string            `json:"outcome"`
+	Error             string            `json:"error,omitempty"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+}
+
+// CallbackSender reports the outcome of each record with a callback_url back
+// to the system it came from. Payloads are signed like source requests:
+// HMAC-SHA256 of the timestamp and the body, joined by a dot. Callbacks are
+// sent in the background and tried again on network errors and 5xx
+// responses; a callback that still fails is logged and counted in the run
+// summary, but doesn't fail the record. Callbacks only go to the hosts of
+// -callback-hosts, and redirects are not followed, so records can't make t360
+// send requests anywhere else.
+type CallbackSender struct {
+	ctx    context.Context
+	secret []byte
+	hosts  []string
+	client *http.Client
+	wg     sync.WaitGroup
+}
+
+// callbacks is nil unless T360_CALLBACK_SECRET is set.
+var callbacks *CallbackSender
+
+// NewCallbackSender sends callbacks until ctx is cancelled. hosts is a comma
+// separated list of host names; *.example.com allows the subdomains of
+// example.com.
+func NewCallbackSender(ctx context.Context, secret string, hosts string) *CallbackSender {
+	c := &CallbackSender{
+		ctx:    ctx,
+		secret: []byte(secret),
+		client: &http.Client{
+			Timeout: 10 * time.Second,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	for _, host := range strings.Split(hosts, ",") {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			c.hosts = append(c.hosts, host)
+		}
+	}
+	return c
+}
+
+// allowed reports whether callbacks may be sent to the host of callbackURL.
+func (c *CallbackSender) allowed(callbackURL string) bool {
+	u, err := url.Parse(callbackURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range c.hosts {
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok {
+			if strings.HasSuffix(host, suffix) {
+				return true
+			}
+		} else if host == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// validateCallbackURL checks the callback_url of a record.
+func validateCallbackURL(value string) error {
+	if value == "" {
+		return nil
+	}
+	u, err := url.Parse(value)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid callback_url %q, expected an http or https URL", value)
+	}
+	return nil
+}
+
+// requireCallbacks fails for a record with a callback_url when callbacks
+// can't be signed, or its host isn't allowed.
+func requireCallbacks(request SearchRequest) error {
+	if request.CallbackURL == "" {
+		return nil
+	}
+	if callbacks == nil {
+		return fmt.Errorf("callback_url requires %s to be set to sign callbacks", callbackSecretEnv)
+	}
+	if !callbacks.allowed(request.CallbackURL) {
+		return fmt.Errorf("the host of callback_url %q is not in -callback-hosts", request.CallbackURL)
+	}
+	return nil
+}
+
+// Send posts the outcome of a record in the background.
+func (c *CallbackSender) Send(runID string, result RecordResult) {
+	body, err := json.Marshal(CallbackPayload{
+		RunID:             runID,
+		VRM:               result.VRM,
+		Company:           result.Company,
+		ContraventionDate: result.ContraventionDate,
+		DateFrom:          result.DateFrom,
+		DateTo:            result.DateTo,
+		Outcome:           result.Outcome,
+		Error:             result.Error,
+		Metadata:          result.Metadata,
+	})
+	if err != nil {
+		log.Printf("Failed to encode callback for %s: %v\n", result.VRM, err)
+		return
+	}
+
+	// A record delivered to a worker again reports the same outcome with
+	// the same key, so receivers can drop the repeat.
+	key := callbackIdempotencyKey(result)
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		if err := c.post(result.CallbackURL, key, body); err != nil {
+			log.Printf("Callback for %s to %s failed: %v\n", result.VRM, result.CallbackURL, err)
+			summary.RecordCallbackFailure()
+		}
+	}()
+}
+
+func (c *CallbackSender) post(callbackURL string, key string, body []byte) error {
+	var err error
+	for attempt := 1; attempt <= callbackAttempts; attempt++ {
+		if attempt > 1 {
+			select {
+			case <-time.After(time.Duration(attempt-1) * time.Second):
+			case <-c.ctx.Done():
+				return c.ctx.Err()
+			}
+		}
+
+		var req *http.Request
+		req, err = http.NewRequestWithContext(c.ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", userAgent())
+		req.Header.Set(callbackTimestampHeader, timestamp)
+		req.Header.Set(callbackSignatureHeader, hmacSignature(c.secret, timestamp, body))
+		req.Header.Set(callbackIdempotencyHeader, key)
+
+		var resp *http.Response
+		resp, err = c.client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+			return nil
+		case resp.StatusCode >= 500:
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		default:
+			return fmt.Errorf("status %d", resp.StatusCode)
+		}
+	}
+	return err
+}
+
+// Wait blocks until every callback has been sent or has failed.
+func (c *CallbackSender) Wait() {
+	c.wg.Wait()
+}
+
+// callbackIdempotencyKey identifies the outcome of a record independently of
+// the run and the worker that checked it.
+func callbackIdempotencyKey(result RecordResult) string {
+	sum := sha256.Sum256([]byte(recordKey(result.VRM, result.Company, datesKey(result.ContraventionDate, result.DateFrom, result.DateTo)) +
+		"\x00" + result.Reference + "\x00" + result.Outcome))
+	return hex.EncodeToString(sum[:])
+}
+
+// hmacSignature is the hex HMAC-SHA256 of the timestamp and body, joined by
+// a dot.
+func hmacSignature(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
+	"reflect"
+	"slices"
+	"sort"
+)
+
+// Canary searches a share of the records of changed sources a second time,
+// with the source definitions of a new config file, and reports where the
+// results diverge. Only the results of the current sources are published, so
+// a new source definition can be tried on live traffic before cutting over.
+type Canary struct {
+	percent int
+	sources map[string]DataSource
+}
+
+// CanaryReport is the outcome of the canary searches of a run.
+type CanaryReport struct {
+	Compared    int                `json:"compared"`
+	Divergences []CanaryDivergence `json:"divergences"`
+}
+
+type CanaryDivergence struct {
+	VRM           string   `json:"vrm"`
+	Company       string   `json:"company"`
+	Outcome       string   `json:"outcome"`
+	CanaryOutcome string   `json:"canary_outcome"`
+	Fields        []string `json:"fields,omitempty"`
+	Error         string   `json:"error,omitempty"`
+}
+
+// canary is nil unless -canary-config is set.
+var canary *Canary
+
+// NewCanary loads the sources of the canary config that are new or differ
+// from the ones in the current config.
+func NewCanary(path string, percent int, current *Config) (*Canary, error) {
+	config, err := loadConfig(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load canary config: %v", err)
+	}
+
+	currentSources := make(map[string]SourceConfig)
+	if current != nil {
+		for _, source := range current.Sources {
+			currentSources[source.Company] = source
+		}
+	}
+
+	changed := &Config{}
+	for _, source := range config.Sources {
+		if existing, ok := currentSources[source.Company]; ok && reflect.DeepEqual(existing, source) {
+			continue
+		}
+		changed.Sources = append(changed.Sources, source)
+	}
+
+	sources := builtinDataSources()
+	if err := addConfiguredSources(sources, changed); err != nil {
+		closeSources(sources, nil)
+		return nil, fmt.Errorf("canary config: %v", err)
+	}
+
+	c := &Canary{percent: percent, sources: make(map[string]DataSource)}
+	companies := make([]string, 0)
+	for _, source := range changed.Sources {
+		c.sources[source.Company] = sources[source.Company]
+		companies = append(companies, source.Company)
+	}
+	sort.Strings(companies)
+	log.Printf("Canary: searching %d%% of the records of %v with the new source definitions\n", percent, companies)
+	return c, nil
+}
+
+// Close closes the connections of the canary's sources.
+func (c *Canary) Close() {
+	closeSources(c.sources, nil)
+}
+
+// selected decides whether a record is searched by the canary. The choice
+// depends only on the record, so re-runs compare the same records.
+func (c *Canary) selected(request SearchRequest) bool {
+	hash := fnv.New32a()
+	hash.Write([]byte(request.Company + "\x00" + request.VRM))
+	return int(hash.Sum32()%100) < c.percent
+}
+
+// Compare searches a record with its new source definition, if it has one and
+// is selected, and records whether the result matches the current one.
+func (c *Canary) Compare(ctx context.Context, request SearchRequest, outcome string, contraventions []*VehicleContravention) {
+	source, ok := c.sources[request.Company]
+	if !ok || outcome == outcomeTimeout || !c.selected(request) {
+		return
+	}
+	canaryContraventions, canaryOutcome, err := c.search(ctx, source, request)
+	divergence := CanaryDivergence{
+		VRM:           anonymizeVRM(request.VRM),
+		Company:       request.Company,
+		Outcome:       outcome,
+		CanaryOutcome: canaryOutcome,
+	}
+	if err != nil {
+		divergence.Error = anonymizeText(err.Error())
+	}
+	if canaryOutcome == outcome {
+		if outcome != outcomeHit {
+			summary.RecordCanary(nil)
+			return
+		}
+		divergence.Fields = changedResults(contraventions, canaryContraventions)
+		if len(divergence.Fields) == 0 {
+			summary.RecordCanary(nil)
+			return
+		}
+	}
+
+	log.Printf("Canary result for %s differs: %s, canary %s %v\n", request.VRM, outcome, canaryOutcome, divergence.Fields)
+	summary.RecordCanary(&divergence)
+}
+
+// search mirrors searchVehicle for a single source.
+func (c *Canary) search(ctx context.Context, source DataSource, request SearchRequest) ([]*VehicleContravention, string, error) {
+	results, err := searchRecord(ctx, source, request)
+	if err != nil {
+		if os.IsTimeout(err) {
+			return nil, outcomeTimeout, err
+		}
+		return nil, outcomeError, err
+	}
+	contraventions, err := qualifyingContraventions(source, request, results)
+	if err != nil {
+		return nil, outcomeError, err
+	}
+	if len(contraventions) == 0 {
+		return nil, outcomeMiss, nil
+	}
+	return contraventions, outcomeHit, nil
+}
+
+// changedResults lists the fields that differ between the results of two
+// searches, compared in order. A different number of results is reported as
+// "results".
+func changedResults(before []*VehicleContravention, after []*VehicleContravention) []string {
+	if len(before) != len(after) {
+		return []string{"results"}
+	}
+	fields := make([]string, 0)
+	for i := range before {
+		for _, field := range changedFields(before[i], after[i]) {
+			if !slices.Contains(fields, field) {
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields
+}
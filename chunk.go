@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// chunkRequests splits records into consecutive chunks of at most size
+// records.
+func chunkRequests(requests []SearchRequest, size int) [][]SearchRequest {
+	chunks := make([][]SearchRequest, 0, (len(requests)+size-1)/size)
+	for start := 0; start < len(requests); start += size {
+		end := min(start+size, len(requests))
+		chunks = append(chunks, requests[start:end])
+	}
+	return chunks
+}
+
+// chunkReportFile names the report of a chunk after the run's report, e.g.
+// report.json becomes report-2.json for the second chunk.
+func chunkReportFile(path string, chunk int) string {
+	if path == "" {
+		return ""
+	}
+	ext := filepath.Ext(path)
+	return fmt.Sprintf("%s-%d%s", strings.TrimSuffix(path, ext), chunk, ext)
+}
+
+// splitRequests applies -max-records. Batches over the limit are refused
+// unless -chunk is set, in which case they are run as sequential chunks.
+func splitRequests(flags *Flags, requests []SearchRequest) ([][]SearchRequest, error) {
+	if flags.MaxRecords <= 0 || len(requests) <= flags.MaxRecords {
+		return [][]SearchRequest{requests}, nil
+	}
+	if !flags.Chunk {
+		return nil, fmt.Errorf("%d records exceed -max-records %d; use -chunk to run them in chunks of %d", len(requests), flags.MaxRecords, flags.MaxRecords)
+	}
+	return chunkRequests(requests, flags.MaxRecords), nil
+}
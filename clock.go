@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// defaultTimeSource is checked for the time when -time-source isn't set: the
+// Date header of the Pub/Sub API, so our timestamps agree with its own.
+const defaultTimeSource = "https://pubsub.googleapis.com"
+
+// clockSamples is how many times the time source is asked; the answer with
+// the shortest round trip is used.
+const clockSamples = 3
+
+// clockOffset is how far the time source's clock is ahead of ours. It is
+// only set with -authoritative-time, so timestamps are stamped from the
+// time source instead of the local clock.
+var clockOffset time.Duration
+
+// stampTime is the time to stamp on published results: the local clock,
+// corrected by the offset from the time source with -authoritative-time.
+func stampTime() time.Time {
+	return time.Now().Add(clockOffset).UTC()
+}
+
+// sendsToConsumers reports whether results reach real consumers: a sink
+// other than stdout, a file or Pub/Sub on the emulator. Local results don't
+// need the clock checked.
+func sendsToConsumers(flags *Flags) bool {
+	emulator := flags.UseEmulator || runningEmulatorHost() != ""
+	for _, sink := range sinkNames(flags.Sink) {
+		switch {
+		case sink == sinkStdout || sink == sinkFile:
+		case sink == sinkPubSub && emulator:
+		default:
+			return true
+		}
+	}
+	return false
+}
+
+// measureClockOffset asks the time source for the time, taken from the Date
+// header of a HEAD request. The Date header is truncated to the second, so
+// the offset is only accurate to half a second.
+func measureClockOffset(ctx context.Context, url string) (time.Duration, error) {
+	client := &http.Client{Timeout: 3 * time.Second}
+	var offset time.Duration
+	var best time.Duration = -1
+	for i := 0; i < clockSamples; i++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+		if err != nil {
+			return 0, err
+		}
+		start := time.Now()
+		resp, err := client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		end := time.Now()
+		resp.Body.Close()
+
+		date, err := http.ParseTime(resp.Header.Get("Date"))
+		if err != nil {
+			return 0, fmt.Errorf("no valid Date header")
+		}
+		if rtt := end.Sub(start); best < 0 || rtt < best {
+			best = rtt
+			offset = date.Add(500 * time.Millisecond).Sub(start.Add(rtt / 2))
+		}
+	}
+	return offset.Round(time.Millisecond), nil
+}
+
+// checkClock compares the local clock with the time source before a run,
+// since the timestamps of results feed legal notices downstream. A skew
+// beyond -max-clock-skew is logged as a warning, or fails the run with
+// -strict. With -authoritative-time, results are stamped with the time
+// source's time and the run fails if it can't be reached.
+func checkClock(ctx context.Context, flags *Flags) error {
+	// Demo runs stay off the network.
+	if flags.MaxClockSkew == 0 && !flags.AuthoritativeTime || flags.Demo {
+		return nil
+	}
+	if !flags.AuthoritativeTime && !sendsToConsumers(flags) {
+		return nil
+	}
+
+	offset, err := measureClockOffset(ctx, flags.TimeSource)
+	if err != nil {
+		if flags.AuthoritativeTime {
+			return fmt.Errorf("failed to read the time from %s: %v", flags.TimeSource, err)
+		}
+		log.Printf("Warning: could not check the clock against %s: %v\n", flags.TimeSource, err)
+		return nil
+	}
+
+	if flags.MaxClockSkew > 0 && offset.Abs() > flags.MaxClockSkew {
+		if flags.Strict {
+			return fmt.Errorf("strict mode: the local clock is %s off %s, more than %s", offset.Abs(), flags.TimeSource, flags.MaxClockSkew)
+		}
+		log.Printf("Warning: the local clock is %s off %s, more than %s; published timestamps may be wrong\n", offset.Abs(), flags.TimeSource, flags.MaxClockSkew)
+	}
+	if flags.AuthoritativeTime {
+		clockOffset = offset
+		log.Printf("Stamping results with the time of %s (local clock offset %s)\n", flags.TimeSource, offset)
+	}
+	return nil
+}
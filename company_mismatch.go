@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"unicode"
+)
+
+// strictCompanies is set by -strict: a record whose source returns another
+// lease company than the one requested fails instead of being published.
+var strictCompanies bool
+
+// checkLeaseCompanies compares the lease company of each contravention found
+// for a record with the company it was requested for. A source returning
+// another company's vehicles would otherwise put the liability on the wrong
+// company. Mismatches are logged and counted; with -strict they fail the
+// record. Results without a company name are not checked.
+func checkLeaseCompanies(datasource DataSource, request SearchRequest, contraventions []*VehicleContravention) error {
+	for _, contravention := range contraventions {
+		returned := contravention.LeaseCompany.CompanyName
+		if returned == "" || sameCompany(request.Company, returned) {
+			continue
+		}
+		summary.RecordCompanyMismatch()
+		if strictCompanies {
+			return fmt.Errorf("source %s returned lease company %q for %s, not the requested %q", datasource.ID(), returned, request.VRM, request.Company)
+		}
+		log.Printf("Warning: source %s returned lease company %q for %s, not the requested %q\n", datasource.ID(), returned, request.VRM, request.Company)
+	}
+	return nil
+}
+
+// sameCompany compares company names ignoring case, spacing and punctuation,
+// so "ACME Company Ltd." matches "acme company ltd".
+func sameCompany(a string, b string) bool {
+	return companyKey(a) == companyKey(b)
+}
+
+func companyKey(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			return unicode.ToLower(r)
+		}
+		return -1
+	}, name)
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// commandCompletion describes what can follow a subcommand.
+type commandCompletion struct {
+	actions []string
+	flags   []string
+}
+
+func init() {
+	// Registered here rather than in the commands map because the completion
+	// command itself reads that map.
+	commands["completion"] = runCompletionCommand
+}
+
+func flagNames(register func(fs *flag.FlagSet)) []string {
+	fs := flag.NewFlagSet("", flag.ContinueOnError)
+	register(fs)
+
+	names := make([]string, 0)
+	fs.VisitAll(func(f *flag.Flag) {
+		names = append(names, "-"+f.Name)
+	})
+	return names
+}
+
+func checkFlagNames() []string {
+	return flagNames(func(fs *flag.FlagSet) {
+		(&Flags{}).register(fs)
+	})
+}
+
+func connectionFlagNames() []string {
+	return flagNames(func(fs *flag.FlagSet) {
+		addConnectionFlags(fs)
+	})
+}
+
+// completionCommands lists the subcommands with their actions and flags.
+// Keep it in sync when adding commands or command-specific flags.
+func completionCommands() map[string]commandCompletion {
+	specs := map[string]commandCompletion{
+		"topics": {
+			actions: []string{"create", "delete", "list"},
+			flags:   append(connectionFlagNames(), "-retention"),
+		},
+		"subs": {
+			actions: []string{"create", "delete", "list"},
+			flags:   append(connectionFlagNames(), "-topic", "-ack-deadline", "-retention", "-dead-letter-topic", "-max-delivery-attempts"),
+		},
+		"drain": {
+			flags: append(connectionFlagNames(), "-subscription", "-out", "-idle", "-max-messages"),
+		},
+		"emulator": {
+			actions: []string{"clean", "sessions"},
+			flags:   []string{"-days"},
+		},
+		"batch": {
+			actions: []string{"run", "enqueue", "validate", "schema"},
+			flags:   append(checkFlagNames(), "-work-topic", "-emulator-host"),
+		},
+		"check": {
+			flags: checkFlagNames(),
+		},
+		"gen": {
+			flags: []string{"-count", "-companies", "-config", "-out", "-days", "-seed"},
+		},
+		"replay": {
+			flags: append(checkFlagNames(), "-out-report", "-only-failures"),
+		},
+		"backfill": {
+			flags: append(checkFlagNames(), "-from", "-to", "-window", "-checkpoint"),
+		},
+		"completion": {
+			actions: []string{"bash", "zsh", "fish", "powershell"},
+		},
+	}
+
+	for name := range commands {
+		if _, ok := specs[name]; !ok {
+			specs[name] = commandCompletion{}
+		}
+	}
+	return specs
+}
+
+// knownCompanies returns the companies of the registered sources plus the
+// ones in config, without duplicates.
+func knownCompanies(config *Config) []string {
+	seen := make(map[string]bool)
+	companies := make([]string, 0, len(dataSources))
+	for company := range dataSources {
+		seen[company] = true
+		companies = append(companies, company)
+	}
+	if config != nil {
+		for _, source := range config.Sources {
+			if !seen[source.Company] {
+				seen[source.Company] = true
+				companies = append(companies, source.Company)
+			}
+		}
+	}
+	sort.Strings(companies)
+	return companies
+}
+
+func runCompletionCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: t360 completion bash|zsh|fish|powershell [-config file]")
+	}
+
+	fs := flag.NewFlagSet("completion "+args[0], flag.ExitOnError)
+	configFile := fs.String("config", "", "Also complete the companies of the sources in this config file")
+	fs.Parse(args[1:])
+
+	initDataSources()
+	var config *Config
+	if *configFile != "" {
+		var err error
+		config, err = loadConfig(*configFile)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %v", err)
+		}
+	}
+	companies := knownCompanies(config)
+
+	switch args[0] {
+	case "bash":
+		writeBashCompletion(os.Stdout, companies, false)
+	case "zsh":
+		writeBashCompletion(os.Stdout, companies, true)
+	case "fish":
+		writeFishCompletion(os.Stdout, companies)
+	case "powershell":
+		writePowerShellCompletion(os.Stdout, companies)
+	default:
+		return fmt.Errorf("unsupported shell: %s", args[0])
+	}
+	return nil
+}
+
+// shellQuote single-quotes a value for bash and zsh.
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+func sortedCommandNames(specs map[string]commandCompletion) []string {
+	names := make([]string, 0, len(specs))
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// writeBashCompletion writes a bash completion function. zsh uses the same
+// function through bashcompinit.
+func writeBashCompletion(w io.Writer, companies []string, zsh bool) {
+	specs := completionCommands()
+	names := sortedCommandNames(specs)
+
+	if zsh {
+		fmt.Fprintln(w, "#compdef t360")
+		fmt.Fprintln(w, "autoload -U +X bashcompinit && bashcompinit")
+	}
+
+	fmt.Fprintln(w, "_t360() {")
+	fmt.Fprintln(w, `    local cur="${COMP_WORDS[COMP_CWORD]}"`)
+	fmt.Fprintln(w, `    local prev="${COMP_WORDS[COMP_CWORD-1]}"`)
+	fmt.Fprintf(w, "    local commands=%s\n", shellQuote(strings.Join(names, " ")))
+	fmt.Fprintf(w, "    local flags=%s\n", shellQuote(strings.Join(checkFlagNames(), " ")))
+	quoted := make([]string, 0)
+	for _, company := range companies {
+		quoted = append(quoted, shellQuote(company))
+	}
+	fmt.Fprintf(w, "    local companies=(%s)\n", strings.Join(quoted, " "))
+	fmt.Fprintln(w, `    if [[ "$prev" == "-company" || "$prev" == "--company" ]]; then`)
+	fmt.Fprintln(w, `        local IFS=$'\n'`)
+	io.WriteString(w, `        COMPREPLY=( $(compgen -W "$(printf '%s\n' "${companies[@]}")" -- "$cur") )`+"\n")
+	fmt.Fprintln(w, `        COMPREPLY=( "${COMPREPLY[@]// /\\ }" )`)
+	fmt.Fprintln(w, "        return")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, `    if [[ $COMP_CWORD -eq 1 && "$cur" != -* ]]; then`)
+	fmt.Fprintln(w, `        COMPREPLY=( $(compgen -W "$commands" -- "$cur") )`)
+	fmt.Fprintln(w, "        return")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, `    case "${COMP_WORDS[1]}" in`)
+	for _, name := range names {
+		spec := specs[name]
+		fmt.Fprintf(w, "        %s)\n", name)
+		if len(spec.actions) > 0 {
+			fmt.Fprintln(w, "            if [[ $COMP_CWORD -eq 2 ]]; then")
+			fmt.Fprintf(w, "                COMPREPLY=( $(compgen -W %s -- \"$cur\") )\n", shellQuote(strings.Join(spec.actions, " ")))
+			fmt.Fprintln(w, "                return")
+			fmt.Fprintln(w, "            fi")
+		}
+		fmt.Fprintf(w, "            flags=%s\n", shellQuote(strings.Join(spec.flags, " ")))
+		fmt.Fprintln(w, "            ;;")
+	}
+	fmt.Fprintln(w, "    esac")
+	fmt.Fprintln(w, `    COMPREPLY=( $(compgen -W "$flags" -- "$cur") )`)
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -o default -F _t360 t360")
+}
+
+func writeFishCompletion(w io.Writer, companies []string) {
+	specs := completionCommands()
+	names := sortedCommandNames(specs)
+
+	fmt.Fprintf(w, "complete -c t360 -f -n '__fish_use_subcommand' -a '%s'\n", strings.Join(names, " "))
+	for _, name := range checkFlagNames() {
+		fmt.Fprintf(w, "complete -c t360 -n '__fish_use_subcommand' -o %s\n", strings.TrimPrefix(name, "-"))
+	}
+
+	quoted := make([]string, 0)
+	for _, company := range companies {
+		quoted = append(quoted, `"`+strings.ReplaceAll(company, `"`, `\"`)+`"`)
+	}
+	fmt.Fprintf(w, "complete -c t360 -o company -x -a '(printf \"%%s\\n\" %s)'\n", strings.Join(quoted, " "))
+
+	for _, name := range names {
+		spec := specs[name]
+		if len(spec.actions) > 0 {
+			fmt.Fprintf(w, "complete -c t360 -f -n '__fish_seen_subcommand_from %s; and not __fish_seen_subcommand_from %s' -a '%s'\n",
+				name, strings.Join(spec.actions, " "), strings.Join(spec.actions, " "))
+		}
+		for _, flagName := range spec.flags {
+			fmt.Fprintf(w, "complete -c t360 -n '__fish_seen_subcommand_from %s' -o %s\n", name, strings.TrimPrefix(flagName, "-"))
+		}
+	}
+}
+
+func writePowerShellCompletion(w io.Writer, companies []string) {
+	specs := completionCommands()
+	names := sortedCommandNames(specs)
+
+	psList := func(values []string) string {
+		quoted := make([]string, 0, len(values))
+		for _, value := range values {
+			quoted = append(quoted, "'"+strings.ReplaceAll(value, "'", "''")+"'")
+		}
+		return "@(" + strings.Join(quoted, ", ") + ")"
+	}
+
+	fmt.Fprintln(w, "Register-ArgumentCompleter -Native -CommandName t360 -ScriptBlock {")
+	fmt.Fprintln(w, "    param($wordToComplete, $commandAst, $cursorPosition)")
+	fmt.Fprintln(w, "    $words = @($commandAst.CommandElements | ForEach-Object { $_.ToString() })")
+	fmt.Fprintln(w, "    if ($wordToComplete -ne '') { $words = $words[0..($words.Count - 2)] }")
+	fmt.Fprintf(w, "    $commands = %s\n", psList(names))
+	fmt.Fprintf(w, "    $companies = %s\n", psList(companies))
+	fmt.Fprintln(w, "    $actions = @{}")
+	fmt.Fprintln(w, "    $flags = @{}")
+	fmt.Fprintf(w, "    $flags[''] = %s\n", psList(checkFlagNames()))
+	for _, name := range names {
+		spec := specs[name]
+		fmt.Fprintf(w, "    $actions['%s'] = %s\n", name, psList(spec.actions))
+		fmt.Fprintf(w, "    $flags['%s'] = %s\n", name, psList(spec.flags))
+	}
+	fmt.Fprintln(w, "    $command = ''")
+	fmt.Fprintln(w, "    if ($words.Count -gt 1 -and $commands -contains $words[1]) { $command = $words[1] }")
+	fmt.Fprintln(w, "    if ($words[-1] -eq '-company') {")
+	fmt.Fprintln(w, "        $candidates = $companies | ForEach-Object { \"'$_'\" }")
+	fmt.Fprintln(w, "    } elseif ($words.Count -eq 1) {")
+	fmt.Fprintln(w, "        $candidates = $commands + $flags['']")
+	fmt.Fprintln(w, "    } elseif ($command -ne '' -and $words.Count -eq 2 -and $actions[$command].Count -gt 0) {")
+	fmt.Fprintln(w, "        $candidates = $actions[$command]")
+	fmt.Fprintln(w, "    } else {")
+	fmt.Fprintln(w, "        $candidates = $flags[$command]")
+	fmt.Fprintln(w, "    }")
+	fmt.Fprintln(w, "    $candidates | Where-Object { $_ -like \"$wordToComplete*\" } | ForEach-Object {")
+	fmt.Fprintln(w, "        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)")
+	fmt.Fprintln(w, "    }")
+	fmt.Fprintln(w, "}")
+}
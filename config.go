@@ -0,0 +1,226 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+type Config struct {
+	Sources []SourceConfig   `json:"sources"`
+	Sinks   []SinkConfig     `json:"sinks,omitempty"`
+	PubSub  *PubSubBootstrap `json:"pubsub,omitempty"`
+}
+
+type SourceConfig struct {
+	Company             string            `json:"company"`
+	ID                  string            `json:"id"`
+	URL                 string            `json:"url"`
+	Protocol            string            `json:"protocol,omitempty"`
+	Mapping             map[string]string `json:"mapping,omitempty"`
+	ResultsPath         string            `json:"results_path,omitempty"`
+	DateRange           bool              `json:"date_range,omitempty"`
+	RequestTemplate     string            `json:"request_template,omitempty"`
+	RequestTemplateFile string            `json:"request_template_file,omitempty"`
+	SOAPAction          string            `json:"soap_action,omitempty"`
+	GRPC                *GRPCConfig       `json:"grpc,omitempty"`
+	BlackoutWindows     []BlackoutWindow  `json:"blackout_windows,omitempty"`
+	Concurrency         int               `json:"concurrency,omitempty"`
+	RateLimit           float64           `json:"rate_limit,omitempty"`
+	Burst               int               `json:"burst,omitempty"`
+	Headers             map[string]string `json:"headers,omitempty"`
+	Signing             *SigningConfig    `json:"signing,omitempty"`
+	StatusCodes         map[string]string `json:"status_codes,omitempty"`
+	Cache               *CacheConfig      `json:"cache,omitempty"`
+}
+
+type GRPCConfig struct {
+	Target        string            `json:"target"`
+	TLS           bool              `json:"tls"`
+	Method        string            `json:"method"`
+	DescriptorSet string            `json:"descriptor_set"`
+	RequestFields map[string]string `json:"request_fields,omitempty"`
+}
+
+func loadConfig(path string) (*Config, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var config Config
+	if err := json.Unmarshal(body, &config); err != nil {
+		return nil, fmt.Errorf("invalid config file %s: %v", path, err)
+	}
+
+	for i := range config.Sources {
+		source := &config.Sources[i]
+		if source.Company == "" {
+			return nil, fmt.Errorf("source %d: company is required", i)
+		}
+		if source.RequestTemplateFile != "" {
+			template, err := os.ReadFile(source.RequestTemplateFile)
+			if err != nil {
+				return nil, fmt.Errorf("source %s: %v", source.Company, err)
+			}
+			source.RequestTemplate = string(template)
+		}
+
+		if err := source.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	names := make(map[string]bool)
+	for i := range config.Sinks {
+		if err := config.Sinks[i].validate(); err != nil {
+			return nil, err
+		}
+		if names[config.Sinks[i].Name] {
+			return nil, fmt.Errorf("sink %s is defined more than once", config.Sinks[i].Name)
+		}
+		names[config.Sinks[i].Name] = true
+	}
+
+	if config.PubSub != nil {
+		if err := config.PubSub.parse(); err != nil {
+			return nil, err
+		}
+	}
+
+	return &config, nil
+}
+
+// validate checks a source's settings and parses its blackout windows. An
+// entry without a url or protocol only adds settings to a built-in source, so
+// it needs neither an id nor a url.
+func (s *SourceConfig) validate() error {
+	settingsOnly := s.URL == "" && s.Protocol == ""
+	if s.ID == "" && !settingsOnly {
+		return fmt.Errorf("source %s: id is required", s.Company)
+	}
+
+	switch s.Protocol {
+	case "", "json":
+		if s.URL == "" && !settingsOnly {
+			return fmt.Errorf("source %s: url is required", s.Company)
+		}
+	case "soap":
+		if s.URL == "" {
+			return fmt.Errorf("source %s: url is required", s.Company)
+		}
+		if s.RequestTemplate == "" {
+			return fmt.Errorf("source %s: soap sources require a request template", s.Company)
+		}
+	case "grpc":
+		if s.GRPC == nil || s.GRPC.Target == "" || s.GRPC.Method == "" || s.GRPC.DescriptorSet == "" {
+			return fmt.Errorf("source %s: grpc sources require target, method and descriptor_set", s.Company)
+		}
+	default:
+		return fmt.Errorf("source %s: unknown protocol %q", s.Company, s.Protocol)
+	}
+
+	if s.RequestTemplate != "" && s.Protocol == "grpc" {
+		return fmt.Errorf("source %s: request templates are only available for HTTP sources, use request_fields", s.Company)
+	}
+
+	if s.DateRange && s.Protocol == "grpc" {
+		return fmt.Errorf("source %s: date_range is only available for HTTP sources", s.Company)
+	}
+
+	if s.Concurrency < 0 || s.RateLimit < 0 || s.Burst < 0 {
+		return fmt.Errorf("source %s: concurrency, rate_limit and burst cannot be negative", s.Company)
+	}
+
+	if s.Signing != nil {
+		if s.Protocol == "grpc" {
+			return fmt.Errorf("source %s: signing is only available for HTTP sources", s.Company)
+		}
+		if err := s.Signing.validate(s.Company); err != nil {
+			return err
+		}
+	}
+
+	if len(s.StatusCodes) > 0 {
+		if s.Protocol == "grpc" {
+			return fmt.Errorf("source %s: status_codes is only available for HTTP sources", s.Company)
+		}
+		if err := validateStatusCodes(s.Company, s.StatusCodes); err != nil {
+			return err
+		}
+	}
+
+	if s.Cache != nil {
+		if err := s.Cache.parse(s.Company); err != nil {
+			return err
+		}
+	}
+
+	for i := range s.BlackoutWindows {
+		if err := s.BlackoutWindows[i].parse(); err != nil {
+			return fmt.Errorf("source %s: %v", s.Company, err)
+		}
+	}
+
+	if s.ResultsPath != "" {
+		if _, err := parseJSONPath(s.ResultsPath); err != nil {
+			return fmt.Errorf("source %s: invalid results_path: %v", s.Company, err)
+		}
+	}
+
+	for field, path := range s.Mapping {
+		if _, err := parseJSONPath(path); err != nil {
+			return fmt.Errorf("source %s: invalid mapping for %s: %v", s.Company, field, err)
+		}
+	}
+	return nil
+}
+
+func newConfiguredSource(config SourceConfig) (DataSource, error) {
+	switch config.Protocol {
+	case "soap":
+		return newSoapSource(config)
+	case "grpc":
+		return newGrpcSource(config)
+	default:
+		tmpl, err := parseJSONRequestTemplate(config)
+		if err != nil {
+			return nil, err
+		}
+		return &configuredSource{config: config, template: tmpl}, nil
+	}
+}
+
+// registerConfiguredSources adds the sources from the config file to the
+// registry. A configured source replaces a built-in one for the same company.
+// An entry without a url or protocol only adds settings to the built-in source
+// for its company.
+func registerConfiguredSources(config *Config) error {
+	sources := builtinDataSources()
+	if err := addConfiguredSources(sources, config); err != nil {
+		closeSources(sources, nil)
+		return err
+	}
+	setDataSources(sources)
+	return nil
+}
+
+func addConfiguredSources(sources map[string]DataSource, config *Config) error {
+	for _, sourceConfig := range config.Sources {
+		if sourceConfig.URL == "" && sourceConfig.Protocol == "" {
+			builtin := sources[sourceConfig.Company]
+			if builtin == nil {
+				return fmt.Errorf("source %s: url is required", sourceConfig.Company)
+			}
+			sourceConfig.ID = builtin.ID()
+			sourceConfig.URL = builtin.SearchURL()
+		}
+
+		source, err := newConfiguredSource(sourceConfig)
+		if err != nil {
+			return fmt.Errorf("source %s: %v", sourceConfig.ID, err)
+		}
+		sources[sourceConfig.Company] = source
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+)
+
+// auditEnv are the environment variables that change what a run does, and
+// whether their values are secrets. Secrets are only shown as set.
+var auditEnv = map[string]bool{
+	emulatorHostEnv:      false,
+	firestoreEmulatorEnv: false,
+	faultsEnv:            false,
+	"NO_COLOR":           false,
+	"T360_BATCH_DSN":     true,
+	callbackSecretEnv:    true,
+	anonymizeKeyEnv:      true,
+	redisPasswordEnv:     true,
+	dvlaAPIKeyEnv:        true,
+	"SMTP_USERNAME":      false,
+	"SMTP_PASSWORD":      true,
+	envAgeIdentity:       true,
+	envAgeIdentityFile:   false,
+	envGPGKey:            true,
+	envGPGKeyFile:        false,
+	envGPGPassphrase:     true,
+	envKeyKMS:            false,
+}
+
+// ConfigAudit is the effective configuration of a run, after flags, the
+// environment and the config file are merged, with secrets redacted.
+type ConfigAudit struct {
+	Flags       map[string]string `json:"flags"`
+	Environment map[string]string `json:"environment,omitempty"`
+	Config      *Config           `json:"config,omitempty"`
+}
+
+func NewConfigAudit(flags *Flags, config *Config) *ConfigAudit {
+	audit := &ConfigAudit{
+		Flags:       flags.values(),
+		Environment: environmentValues(config),
+	}
+	if config != nil {
+		audit.Config = redactedConfig(config)
+	}
+	return audit
+}
+
+// Log writes the audit as a single JSON line.
+func (a *ConfigAudit) Log() {
+	data, err := json.Marshal(a)
+	if err != nil {
+		log.Printf("Failed to log the effective configuration: %v\n", err)
+		return
+	}
+	log.Printf("Effective configuration: %s\n", data)
+}
+
+// environmentValues returns the variables of auditEnv, and those the config
+// reads secrets from, that are set.
+func environmentValues(config *Config) map[string]string {
+	secrets := make(map[string]bool, len(auditEnv))
+	for name, secret := range auditEnv {
+		secrets[name] = secret
+	}
+	if config != nil {
+		for _, source := range config.Sources {
+			if source.Signing != nil {
+				secrets[source.Signing.SecretEnv] = true
+			}
+		}
+		for _, sink := range config.Sinks {
+			if sink.Kafka != nil && sink.Kafka.SASL != nil {
+				secrets[sink.Kafka.SASL.PasswordEnv] = true
+			}
+			if sink.RabbitMQ != nil {
+				secrets[sink.RabbitMQ.URLEnv] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	values := make(map[string]string)
+	for _, name := range names {
+		value, ok := os.LookupEnv(name)
+		if !ok || name == "" {
+			continue
+		}
+		if secrets[name] && value != "" {
+			value = redacted
+		}
+		values[name] = value
+	}
+	if len(values) == 0 {
+		return nil
+	}
+	return values
+}
+
+// redactedConfig returns a copy of the config with header values, which
+// often carry API keys, and passwords in URLs redacted.
+func redactedConfig(config *Config) *Config {
+	snapshot := *config
+	snapshot.Sources = make([]SourceConfig, len(config.Sources))
+	for i, source := range config.Sources {
+		source.Headers = redactValues(source.Headers)
+		source.URL = redactURL(source.URL)
+		snapshot.Sources[i] = source
+	}
+	snapshot.Sinks = make([]SinkConfig, len(config.Sinks))
+	for i, sink := range config.Sinks {
+		sink.Headers = redactValues(sink.Headers)
+		sink.URL = redactURL(sink.URL)
+		snapshot.Sinks[i] = sink
+	}
+	return &snapshot
+}
+
+func redactValues(values map[string]string) map[string]string {
+	if values == nil {
+		return nil
+	}
+	masked := make(map[string]string, len(values))
+	for key := range values {
+		masked[key] = redacted
+	}
+	return masked
+}
+
+// redactURL masks the password of a URL with user info.
+func redactURL(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return raw
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+)
+
+// watchConfig reloads the config file whenever it changes, until ctx is
+// cancelled. Records checked after a reload use the new sources, headers and
+// rate limits. A config that fails to load is logged and the previous one
+// stays in effect.
+//
+// Directory answers are normally kept for the whole run; while watching they
+// are looked up again once they are older than the directory TTL.
+func watchConfig(ctx context.Context, path string, interval time.Duration) {
+	lastModified := func() time.Time {
+		info, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}
+		}
+		return info.ModTime()
+	}
+	modified := lastModified()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if directory != nil {
+			directory.Expire()
+		}
+
+		current := lastModified()
+		if current.IsZero() || current.Equal(modified) {
+			continue
+		}
+		modified = current
+
+		config, err := loadConfig(path)
+		if err != nil {
+			log.Printf("Ignoring changed config: %v\n", err)
+			continue
+		}
+		if err := registerConfiguredSources(config); err != nil {
+			log.Printf("Ignoring changed config: %v\n", err)
+			continue
+		}
+		log.Printf("Reloaded config from %s (%d sources)\n", path, len(config.Sources))
+	}
+}
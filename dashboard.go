@@ -0,0 +1,244 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dashboardLogLines is how many of the latest log lines the dashboard shows.
+const dashboardLogLines = 8
+
+// Dashboard redraws a live view of a batch run in the terminal every second:
+// progress and outcomes, the records queued and in progress for each source
+// with its search counts, and publish throughput. The log is shown under it,
+// and still written to stderr when stderr isn't the terminal.
+type Dashboard struct {
+	w         io.Writer
+	logOut    io.Writer
+	prevLog   io.Writer
+	lines     []string
+	partial   string
+	queued    map[string]int
+	active    map[string]int
+	published int
+	drawnAt   time.Time
+	rate      float64
+	stop      chan struct{}
+	done      chan struct{}
+	mutex     sync.Mutex
+}
+
+// dashboard is nil unless -dashboard is set and stdout is a terminal.
+var dashboard *Dashboard
+
+// NewDashboard returns nil when f is not a terminal.
+func NewDashboard(f *os.File) *Dashboard {
+	if !isTerminal(f) {
+		return nil
+	}
+	return &Dashboard{
+		w:      f,
+		queued: make(map[string]int),
+		active: make(map[string]int),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Start takes over the log and starts redrawing. Log lines go to the run log
+// of -artifacts directly rather than through the log writer, which also
+// writes to the terminal, so Write anonymizes them for both.
+func (d *Dashboard) Start() {
+	d.prevLog = log.Writer()
+	switch {
+	case !isTerminal(os.Stderr):
+		d.logOut = d.prevLog
+	case artifacts != nil:
+		d.logOut = artifacts.logFile
+	}
+	log.SetOutput(d)
+
+	d.drawnAt = time.Now()
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				d.draw()
+			case <-d.stop:
+				d.draw()
+				return
+			}
+		}
+	}()
+}
+
+// Stop draws the final state and gives the log back.
+func (d *Dashboard) Stop() {
+	close(d.stop)
+	<-d.done
+	log.SetOutput(d.prevLog)
+}
+
+// Write keeps the latest log lines for the dashboard.
+func (d *Dashboard) Write(p []byte) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	text := anonymizeText(string(p))
+	if d.logOut != nil {
+		if _, err := io.WriteString(d.logOut, text); err != nil {
+			return 0, err
+		}
+	}
+	lines := strings.Split(d.partial+text, "\n")
+	d.partial = lines[len(lines)-1]
+	d.lines = append(d.lines, lines[:len(lines)-1]...)
+	if len(d.lines) > dashboardLogLines {
+		d.lines = d.lines[len(d.lines)-dashboardLogLines:]
+	}
+	return len(p), nil
+}
+
+// Queue adds records waiting to be checked for a source.
+func (d *Dashboard) Queue(source string, count int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.queued[source] += count
+}
+
+// Begin moves a record of a source from the queue to in progress.
+func (d *Dashboard) Begin(source string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.queued[source]--
+	d.active[source]++
+}
+
+// End marks a record of a source as checked.
+func (d *Dashboard) End(source string) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.active[source]--
+}
+
+// dashboardProgress is what the dashboard shows of the run summary.
+type dashboardProgress struct {
+	input     int
+	total     int
+	outcomes  []int
+	sources   map[string]SourceStats
+	published int
+}
+
+func (s *RunSummary) dashboardProgress() dashboardProgress {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	progress := dashboardProgress{
+		input:     len(s.input),
+		total:     s.Total,
+		outcomes:  []int{s.Hits, s.Misses, s.Timeouts, s.Errors, s.Duplicates, s.Deferred},
+		sources:   make(map[string]SourceStats, len(s.Sources)),
+		published: s.Publish.Count,
+	}
+	for source, stats := range s.Sources {
+		progress.sources[source] = *stats
+	}
+	return progress
+}
+
+func (d *Dashboard) draw() {
+	progress := summary.dashboardProgress()
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	now := time.Now()
+	if elapsed := now.Sub(d.drawnAt).Seconds(); elapsed > 0 {
+		d.rate = float64(progress.published-d.published) / elapsed
+	}
+	d.published, d.drawnAt = progress.published, now
+
+	var b strings.Builder
+	b.WriteString("\033[H\033[2J")
+	fmt.Fprintf(&b, "t360 run %s  %s\n\n", summary.RunID, now.Sub(summary.StartedAt).Round(time.Second))
+
+	percent := 0.0
+	if progress.input > 0 {
+		percent = 100 * float64(progress.total) / float64(progress.input)
+	}
+	fmt.Fprintf(&b, "Records  %d / %d (%.0f%%)\n", progress.total, progress.input, percent)
+	for i, outcome := range []string{outcomeHit, outcomeMiss, outcomeTimeout, outcomeError, outcomeDuplicate, outcomeDeferred} {
+		color := ""
+		if progress.outcomes[i] > 0 {
+			color = outcomeColors[outcome]
+		}
+		fmt.Fprintf(&b, "  %s %d", paint(color, strings.ToUpper(outcome)), progress.outcomes[i])
+	}
+	b.WriteString("\n\n")
+
+	seen := make(map[string]bool)
+	for name := range d.queued {
+		seen[name] = true
+	}
+	for name := range progress.sources {
+		seen[name] = true
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(&b, "%-20s %7s %7s %9s %6s %7s %9s %7s\n", "SOURCE", "QUEUED", "ACTIVE", "SEARCHES", "HITS", "MISSES", "TIMEOUTS", "ERRORS")
+	for _, name := range names {
+		stats := progress.sources[name]
+		fmt.Fprintf(&b, "%-20s %7d %7d %9d %6d %7d %s %s\n", name, d.queued[name], d.active[name],
+			stats.Requests, stats.Hits, stats.Misses,
+			paintCount(colorYellow, stats.Timeouts, 9), paintCount(colorRed, stats.Errors, 7))
+	}
+
+	fmt.Fprintf(&b, "\nPublished  %d (%.1f/s)\n\n", progress.published, d.rate)
+	for _, line := range d.lines {
+		b.WriteString(paint(colorGray, line) + "\n")
+	}
+	io.WriteString(d.w, b.String())
+}
+
+// groupLabel names the records of a group on the dashboard.
+func groupLabel(group *requestGroup) string {
+	if group.source == nil {
+		return "(unknown company)"
+	}
+	return group.source.ID()
+}
+
+func paint(color string, text string) string {
+	if color == "" || os.Getenv("NO_COLOR") != "" {
+		return text
+	}
+	return color + text + colorReset
+}
+
+// paintCount right-aligns a count in width and colors it when it isn't 0.
+func paintCount(color string, count int, width int) string {
+	text := fmt.Sprintf("%*d", width, count)
+	if count == 0 {
+		return text
+	}
+	return paint(color, text)
+}
@@ -2,11 +2,19 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
+	"sync"
+	"text/template"
 	"time"
+
+	"github.com/costinul/transfer360-test/transfer360"
+	"github.com/google/uuid"
 )
 
 type DataSource interface {
@@ -14,31 +22,83 @@ type DataSource interface {
 	SearchURL() string
 }
 
-type LeaseCompany struct {
-	CompanyName  string `json:"companyname"`
-	AddressLine1 string `json:"address_line1"`
-	AddressLine2 string `json:"address_line2"`
-	AddressLine3 string `json:"addres_line3"`
-	AddressLine4 string `json:"addres_line4"`
-	Postcode     string `json:"postcode"`
+// Searcher is implemented by sources that do not speak the default JSON
+// search protocol and build and decode their own requests.
+type Searcher interface {
+	Search(ctx context.Context, search SearchBody) ([]*VehicleContravention, error)
+}
+
+// ConfiguredSource is implemented by sources created from the config file.
+type ConfiguredSource interface {
+	SourceConfig() *SourceConfig
 }
 
+// MappedSource is implemented by sources whose responses need translating
+// into the VehicleContravention shape before they are decoded.
+type MappedSource interface {
+	ResponseMapping() map[string]string
+}
+
+type LeaseCompany = transfer360.LeaseCompany
+
+// VehicleContravention is a result as the transfer360 package publishes it,
+// plus what the command adds.
 type VehicleContravention struct {
-	Reference         string       `json:"reference"`
-	VRM               string       `json:"vrm"`
-	ContraventionDate string       `json:"contravention_date"`
-	IsHirerVehicle    bool         `json:"is_hirer_vehicle"`
-	LeaseCompany      LeaseCompany `json:"lease_company"`
+	transfer360.Contravention
+	// Vehicle holds the DVLA's details of the vehicle, with -dvla.
+	Vehicle *VehicleDetails `json:"vehicle,omitempty"`
+	// Metadata of the searched record, published as message attributes.
+	Metadata map[string]string `json:"-"`
+	// MessageID is the ID Pub/Sub assigned to the published message.
+	MessageID string `json:"-"`
+	// DiscoveredAt is when the search found the contravention, published
+	// as the discovered_at attribute.
+	DiscoveredAt time.Time `json:"-"`
 }
 
 type SearchBody struct {
 	VRM               string    `json:"vrm"`
 	ContraventionDate time.Time `json:"contravention_date"`
+	// DateFrom and DateTo are set when a date range is searched in a single
+	// request, for sources with date_range enabled.
+	DateFrom *time.Time `json:"date_from,omitempty"`
+	DateTo   *time.Time `json:"date_to,omitempty"`
 }
 
 type SearchRequest struct {
-	VRM     string `json:"vrm"`
-	Company string `json:"company"`
+	VRM               string `json:"vrm"`
+	Company           string `json:"company"`
+	ContraventionDate string `json:"contravention_date,omitempty"`
+	// DateFrom and DateTo search a range of days, both included, instead of
+	// a single contravention date.
+	DateFrom string `json:"date_from,omitempty"`
+	DateTo   string `json:"date_to,omitempty"`
+	// Priority is high, normal (the default) or low. High priority records
+	// are checked first and their timed out searches are retried.
+	Priority string `json:"priority,omitempty"`
+	// Metadata is passed through to the attributes of the published message.
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// CallbackURL is sent the outcome of the record once it is checked.
+	CallbackURL string `json:"callback_url,omitempty"`
+	// Reference is published as the reference of the contraventions found,
+	// with -reference record.
+	Reference string `json:"reference,omitempty"`
+}
+
+// batchDateFormat is the format of contravention_date in batch files.
+const batchDateFormat = "2006-01-02"
+
+// searchDate returns the date to search for. Records without a date are
+// searched for today.
+func (r SearchRequest) searchDate() (time.Time, error) {
+	if r.ContraventionDate == "" {
+		return searchClock(), nil
+	}
+	date, err := time.Parse(batchDateFormat, r.ContraventionDate)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid contravention_date %q, expected YYYY-MM-DD", r.ContraventionDate)
+	}
+	return date, nil
 }
 
 type acmelease struct{}
@@ -49,17 +109,84 @@ type fleetcompany struct{}
 
 type hirecompany struct{}
 
-var dataSources = make(map[string]DataSource)
+type configuredSource struct {
+	config   SourceConfig
+	template *template.Template
+}
+
+// dataSources maps company names to sources. It is replaced as a whole when
+// the config is reloaded, so readers take dataSourcesMutex.
+var (
+	dataSourcesMutex sync.RWMutex
+	dataSources      = make(map[string]DataSource)
+)
+
+func builtinDataSources() map[string]DataSource {
+	return map[string]DataSource{
+		"ACME Company Ltd":  &acmelease{},
+		"Lease Company Ltd": &leasecompany{},
+		"Fleet Company Ltd": &fleetcompany{},
+		"Hire Company Ltd":  &hirecompany{},
+	}
+}
 
 func initDataSources() {
-	dataSources["ACME Company Ltd"] = &acmelease{}
-	dataSources["Lease Company Ltd"] = &leasecompany{}
-	dataSources["Fleet Company Ltd"] = &fleetcompany{}
-	dataSources["Hire Company Ltd"] = &hirecompany{}
+	setDataSources(builtinDataSources())
+}
+
+// setDataSources replaces the registered sources, and closes the connections
+// of the ones that are no longer registered.
+func setDataSources(sources map[string]DataSource) {
+	dataSourcesMutex.Lock()
+	replaced := dataSources
+	dataSources = sources
+	dataSourcesMutex.Unlock()
+	closeSources(replaced, sources)
+}
+
+// closeDataSources closes the connections of every registered source at the
+// end of a run.
+func closeDataSources() {
+	setDataSources(make(map[string]DataSource))
+}
+
+// closeSources closes the sources that hold a connection, such as gRPC
+// sources, unless keep still has them.
+func closeSources(sources map[string]DataSource, keep map[string]DataSource) {
+	for company, source := range sources {
+		closer, ok := source.(io.Closer)
+		if !ok || keep[company] == source {
+			continue
+		}
+		if err := closer.Close(); err != nil {
+			log.Printf("Failed to close source %s: %v\n", source.ID(), err)
+		}
+	}
+}
+
+// allDataSources returns every registered source.
+func allDataSources() []DataSource {
+	dataSourcesMutex.RLock()
+	defer dataSourcesMutex.RUnlock()
+
+	sources := make([]DataSource, 0, len(dataSources))
+	for _, source := range dataSources {
+		sources = append(sources, source)
+	}
+	return sources
 }
 
 func getDataSource(id string) DataSource {
-	return dataSources[id]
+	dataSourcesMutex.RLock()
+	source, ok := dataSources[id]
+	dataSourcesMutex.RUnlock()
+	if ok {
+		return source
+	}
+	if directory != nil && id != "" {
+		return directory.Lookup(id)
+	}
+	return nil
 }
 
 func (d *acmelease) ID() string {
@@ -67,7 +194,7 @@ func (d *acmelease) ID() string {
 }
 
 func (d *acmelease) SearchURL() string {
-	return "https://sandbox-update.transfer360.dev/test_search/acmelease"
+	return transfer360.SandboxURL + "acmelease"
 }
 
 func (d *leasecompany) ID() string {
@@ -75,7 +202,7 @@ func (d *leasecompany) ID() string {
 }
 
 func (d *leasecompany) SearchURL() string {
-	return "https://sandbox-update.transfer360.dev/test_search/leasecompany"
+	return transfer360.SandboxURL + "leasecompany"
 }
 
 func (d *fleetcompany) ID() string {
@@ -83,7 +210,7 @@ func (d *fleetcompany) ID() string {
 }
 
 func (d *fleetcompany) SearchURL() string {
-	return "https://sandbox-update.transfer360.dev/test_search/fleetcompany"
+	return transfer360.SandboxURL + "fleetcompany"
 }
 
 func (d *hirecompany) ID() string {
@@ -91,45 +218,236 @@ func (d *hirecompany) ID() string {
 }
 
 func (d *hirecompany) SearchURL() string {
-	return "https://sandbox-update.transfer360.dev/test_search/hirecompany"
+	return transfer360.SandboxURL + "hirecompany"
 }
 
-func SearchContravention(source DataSource, vrm string, contraventionDate time.Time) (*VehicleContravention, error) {
-	log.Printf("Searching for %s in %s\n", vrm, source.ID())
-	client := &http.Client{
-		Timeout: 2 * time.Second,
+func (d *configuredSource) ID() string {
+	return d.config.ID
+}
+
+func (d *configuredSource) SearchURL() string {
+	return d.config.URL
+}
+
+func (d *configuredSource) ResponseMapping() map[string]string {
+	return d.config.Mapping
+}
+
+func (d *configuredSource) SourceConfig() *SourceConfig {
+	return &d.config
+}
+
+// SearchContraventions searches a source and counts the search in the
+// source's statistics. A source may return several contraventions for a VRM.
+func SearchContraventions(ctx context.Context, source DataSource, search SearchBody) ([]*VehicleContravention, error) {
+	logRecordf(ctx, "Searching for %s in %s\n", search.VRM, source.ID())
+
+	if responseCache != nil {
+		if contraventions, ok := responseCache.Get(source, search); ok {
+			logRecordf(ctx, "Using the cached result of %s for %s\n", source.ID(), search.VRM)
+			return contraventions, nil
+		}
+	}
+
+	start := time.Now()
+	contraventions, err := searchContraventions(ctx, source, search)
+	if err == errStatusMiss {
+		logRecordf(ctx, "%s does not know %s\n", source.ID(), search.VRM)
+		contraventions, err = nil, nil
 	}
+	summary.RecordSearch(source.ID(), time.Since(start), contraventions, err)
+	if budget != nil {
+		budget.ObserveSearch(source.ID(), time.Since(start))
+	}
+	if responseCache != nil && err == nil {
+		if err := responseCache.Put(source, search, contraventions); err != nil {
+			log.Printf("Failed to cache the result of %s: %v\n", source.ID(), err)
+		}
+	}
+	return contraventions, err
+}
 
-	searchBody := SearchBody{
-		VRM:               vrm,
-		ContraventionDate: contraventionDate,
+func searchContraventions(ctx context.Context, source DataSource, searchBody SearchBody) ([]*VehicleContravention, error) {
+	if demoMode {
+		return demoContraventions(ctx, source, searchBody)
+	}
+	if searcher, ok := source.(Searcher); ok {
+		return searcher.Search(ctx, searchBody)
 	}
 
-	jsonBody, err := json.Marshal(searchBody)
+	jsonBody, err := searchRequestBody(source, searchBody)
 	if err != nil {
 		return nil, err
 	}
 
-	req, err := http.NewRequest("POST", source.SearchURL(), bytes.NewBuffer(jsonBody))
+	req, err := http.NewRequestWithContext(ctx, "POST", source.SearchURL(), bytes.NewBuffer(jsonBody))
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
 
-	resp, err := client.Do(req)
+	body, err := doSearchRequest(source, req)
 	if err != nil {
 		return nil, err
 	}
+
+	return decodeContraventions(source, body)
+}
+
+func doSearchRequest(source DataSource, req *http.Request) ([]byte, error) {
+	if err := waitForRateLimit(req.Context(), source); err != nil {
+		return nil, err
+	}
+
+	setRequestHeaders(req, source)
+
+	var etagKey []byte
+	var cached *etagEntry
+	if etags != nil {
+		body, err := requestBody(req)
+		if err != nil {
+			return nil, err
+		}
+		etagKey = etagCacheKey(source, body)
+		if cached = etags.Get(etagKey); cached != nil {
+			req.Header.Set("If-None-Match", cached.ETag)
+		}
+	}
+
+	ctx := req.Context()
+	if adaptiveTimeout != nil {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, searchTimeout(source))
+		defer cancel()
+	}
+	trace, ctx := newRequestTrace(ctx)
+	req = req.WithContext(ctx)
+	start := time.Now()
+
+	resp, err := sendSearchRequest(source, req)
+	if err != nil {
+		if os.IsTimeout(err) {
+			return nil, trace.timeoutError(err)
+		}
+		return nil, err
+	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		observeSearchLatency(source, time.Since(start))
+		return cached.Body, nil
+	}
 	if resp.StatusCode != http.StatusOK {
+		if statusMeaning(source, resp.StatusCode) == statusMiss {
+			observeSearchLatency(source, time.Since(start))
+			return nil, errStatusMiss
+		}
 		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
 	}
 
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		if os.IsTimeout(err) {
+			return nil, trace.timeoutError(err)
+		}
+		return nil, err
+	}
+	observeSearchLatency(source, time.Since(start))
+	if etag := resp.Header.Get("ETag"); etag != "" && etagKey != nil {
+		if err := etags.Put(etagKey, etag, body); err != nil {
+			log.Printf("Failed to cache the response of %s: %v\n", source.ID(), err)
+		}
+	}
+	return body, nil
+}
+
+// requestBody returns a copy of the body of a request that can be sent again.
+func requestBody(req *http.Request) ([]byte, error) {
+	if req.GetBody == nil {
+		return nil, nil
+	}
+	reader, err := req.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return io.ReadAll(reader)
+}
+
+// decodeContraventions decodes a search response. A response holding an
+// array, either as a whole or at the source's results_path, has a result per
+// element; any other response is a single result.
+func decodeContraventions(source DataSource, body []byte) ([]*VehicleContravention, error) {
+	var elements []json.RawMessage
+	if settings := sourceSettings(source); settings != nil && settings.ResultsPath != "" {
+		var doc interface{}
+		if err := json.Unmarshal(body, &doc); err != nil {
+			return nil, err
+		}
+		value, found, err := lookupJSONPath(doc, settings.ResultsPath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid results_path for %s: %v", source.ID(), err)
+		}
+		if !found || value == nil {
+			return nil, nil
+		}
+		list, ok := value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("results_path of %s is not an array", source.ID())
+		}
+		for _, item := range list {
+			element, err := json.Marshal(item)
+			if err != nil {
+				return nil, err
+			}
+			elements = append(elements, element)
+		}
+	} else if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &elements); err != nil {
+			return nil, err
+		}
+	} else {
+		elements = []json.RawMessage{body}
+	}
+
+	contraventions := make([]*VehicleContravention, 0, len(elements))
+	for _, element := range elements {
+		contravention, err := decodeContravention(source, element)
+		if err != nil {
+			return nil, err
+		}
+		contraventions = append(contraventions, contravention)
+	}
+	return contraventions, nil
+}
+
+func decodeContravention(source DataSource, body []byte) (*VehicleContravention, error) {
+	if mapped, ok := source.(MappedSource); ok && len(mapped.ResponseMapping()) > 0 {
+		var err error
+		body, err = applyResponseMapping(body, mapped.ResponseMapping())
+		if err != nil {
+			return nil, fmt.Errorf("failed to map response from %s: %v", source.ID(), err)
+		}
+	}
+
 	var contravention VehicleContravention
-	err = json.NewDecoder(resp.Body).Decode(&contravention)
+	err := json.Unmarshal(body, &contravention)
 	if err != nil {
 		return nil, err
 	}
 	return &contravention, nil
 }
+
+// setRequestHeaders identifies our traffic to providers: a User-Agent with the
+// tool version and run ID, a correlation ID per request and any static
+// headers configured for the source.
+func setRequestHeaders(req *http.Request, source DataSource) {
+	req.Header.Set("User-Agent", userAgent())
+	req.Header.Set("X-Correlation-ID", uuid.New().String())
+
+	if settings := sourceSettings(source); settings != nil {
+		for name, value := range settings.Headers {
+			req.Header.Set(name, value)
+		}
+	}
+}
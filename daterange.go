@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// maxDateRangeDays caps the length of a record's date range, as sources
+// without date_range support are searched once per day.
+const maxDateRangeDays = 31
+
+// dateRange returns the first and last day of the record's date range. ok is
+// false for records searched for a single date.
+func (r SearchRequest) dateRange() (from time.Time, to time.Time, ok bool, err error) {
+	if r.DateFrom == "" && r.DateTo == "" {
+		return time.Time{}, time.Time{}, false, nil
+	}
+	if r.DateFrom == "" || r.DateTo == "" {
+		return time.Time{}, time.Time{}, false, fmt.Errorf("date_from and date_to must be given together")
+	}
+	if r.ContraventionDate != "" {
+		return time.Time{}, time.Time{}, false, fmt.Errorf("contravention_date cannot be combined with date_from and date_to")
+	}
+
+	from, err = time.Parse(batchDateFormat, r.DateFrom)
+	if err != nil {
+		return time.Time{}, time.Time{}, false, fmt.Errorf("invalid date_from %q, expected YYYY-MM-DD", r.DateFrom)
+	}
+	to, err = time.Parse(batchDateFormat, r.DateTo)
+	if err != nil {
+		return time.Time{}, time.Time{}, false, fmt.Errorf("invalid date_to %q, expected YYYY-MM-DD", r.DateTo)
+	}
+	if to.Before(from) {
+		return time.Time{}, time.Time{}, false, fmt.Errorf("date_to %s is before date_from %s", r.DateTo, r.DateFrom)
+	}
+	if days := int(to.Sub(from).Hours()/24) + 1; days > maxDateRangeDays {
+		return time.Time{}, time.Time{}, false, fmt.Errorf("date range of %d days is longer than %d days", days, maxDateRangeDays)
+	}
+	return from, to, true, nil
+}
+
+// validateDates checks the contravention date or date range of a record.
+func (r SearchRequest) validateDates() error {
+	if _, err := r.searchDate(); err != nil {
+		return err
+	}
+	_, _, _, err := r.dateRange()
+	return err
+}
+
+// dateKey identifies the days searched for a record.
+func (r SearchRequest) dateKey() string {
+	return datesKey(r.ContraventionDate, r.DateFrom, r.DateTo)
+}
+
+func datesKey(date string, from string, to string) string {
+	if from == "" && to == "" {
+		return date
+	}
+	return from + ".." + to
+}
+
+// searchRecord searches a source for the date or date range of a record. A
+// range is sent as a single search to sources with date_range enabled, and
+// searched a day at a time otherwise.
+func searchRecord(ctx context.Context, source DataSource, request SearchRequest) ([]*VehicleContravention, error) {
+	from, to, isRange, err := request.dateRange()
+	if err != nil {
+		return nil, err
+	}
+	if !isRange {
+		date, err := request.searchDate()
+		if err != nil {
+			return nil, err
+		}
+		return SearchContraventions(ctx, source, SearchBody{VRM: request.VRM, ContraventionDate: date})
+	}
+
+	if settings := sourceSettings(source); settings != nil && settings.DateRange {
+		return SearchContraventions(ctx, source, SearchBody{
+			VRM:               request.VRM,
+			ContraventionDate: from,
+			DateFrom:          &from,
+			DateTo:            &to,
+		})
+	}
+
+	contraventions := make([]*VehicleContravention, 0)
+	for date := from; !date.After(to); date = date.AddDate(0, 0, 1) {
+		results, err := SearchContraventions(ctx, source, SearchBody{VRM: request.VRM, ContraventionDate: date})
+		if err != nil {
+			return nil, err
+		}
+		contraventions = append(contraventions, results...)
+	}
+	return contraventions, nil
+}
+
+// inDateRange tells whether a normalized result falls inside the record's
+// date range. Results without a date, and records without a range, always
+// match.
+func inDateRange(request SearchRequest, contravention *VehicleContravention) bool {
+	from, to, ok, err := request.dateRange()
+	if !ok || err != nil || contravention.ContraventionDate == "" {
+		return true
+	}
+	date, err := time.Parse(time.RFC3339, contravention.ContraventionDate)
+	if err != nil {
+		return true
+	}
+	return !date.Before(from) && date.Before(to.AddDate(0, 0, 1))
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRedactedFields are the address fields of a search response.
+const defaultRedactedFields = "address_line1,address_line2,addres_line3,addres_line4,address_line3,address_line4,postcode"
+
+const redacted = "[REDACTED]"
+
+// sensitiveHeaders are always redacted, whatever -debug-redact says, along
+// with the source's configured headers and signature header.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", defaultSignatureHeader}
+
+// HTTPDebugLog writes every data source HTTP exchange, with full bodies, to
+// its own file as JSON lines. Fields named in redact are masked in JSON and
+// XML bodies.
+type HTTPDebugLog struct {
+	file   *os.File
+	redact map[string]bool
+	xml    *regexp.Regexp
+	mutex  sync.Mutex
+}
+
+type httpExchange struct {
+	Time            time.Time   `json:"time"`
+	Source          string      `json:"source"`
+	Method          string      `json:"method"`
+	URL             string      `json:"url"`
+	RequestHeaders  http.Header `json:"request_headers"`
+	RequestBody     string      `json:"request_body,omitempty"`
+	Status          int         `json:"status,omitempty"`
+	ResponseHeaders http.Header `json:"response_headers,omitempty"`
+	ResponseBody    string      `json:"response_body,omitempty"`
+	DurationMs      int64       `json:"duration_ms"`
+	Error           string      `json:"error,omitempty"`
+}
+
+// httpDebugLog is nil unless -debug-http is set.
+var httpDebugLog *HTTPDebugLog
+
+func OpenHTTPDebugLog(path string, fields string) (*HTTPDebugLog, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open HTTP debug log: %v", err)
+	}
+
+	d := &HTTPDebugLog{file: file, redact: make(map[string]bool)}
+	names := make([]string, 0)
+	for _, field := range strings.Split(fields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			d.redact[strings.ToLower(field)] = true
+			names = append(names, regexp.QuoteMeta(field))
+		}
+	}
+	if len(names) > 0 {
+		d.xml = regexp.MustCompile(`(?i)(<(?:[\w-]+:)?(?:` + strings.Join(names, "|") + `)(?:\s[^>]*)?>)[^<]*(</)`)
+	}
+	return d, nil
+}
+
+func (d *HTTPDebugLog) Close() error {
+	return d.file.Close()
+}
+
+func (d *HTTPDebugLog) Transport(source DataSource, next http.RoundTripper) http.RoundTripper {
+	headers := append([]string(nil), sensitiveHeaders...)
+	if settings := sourceSettings(source); settings != nil {
+		for name := range settings.Headers {
+			headers = append(headers, name)
+		}
+		if settings.Signing != nil && settings.Signing.Header != "" {
+			headers = append(headers, settings.Signing.Header)
+		}
+	}
+	return &debugTransport{log: d, source: source.ID(), headers: headers, next: next}
+}
+
+func (d *HTTPDebugLog) add(exchange httpExchange) {
+	line, err := json.Marshal(exchange)
+	if err != nil {
+		return
+	}
+	line = []byte(anonymizeText(string(line)))
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	d.file.Write(append(line, '\n'))
+}
+
+// redactBody masks the configured fields anywhere in a JSON body, or in the
+// elements of that name in an XML (SOAP) body.
+func (d *HTTPDebugLog) redactBody(body []byte) string {
+	var value interface{}
+	if json.Unmarshal(body, &value) == nil {
+		if redactedJSON, err := json.Marshal(d.redactValue(value)); err == nil {
+			return string(redactedJSON)
+		}
+	}
+	if d.xml != nil {
+		return d.xml.ReplaceAllString(string(body), "${1}"+redacted+"${2}")
+	}
+	return string(body)
+}
+
+func (d *HTTPDebugLog) redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			if d.redact[strings.ToLower(key)] {
+				v[key] = redacted
+			} else {
+				v[key] = d.redactValue(field)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = d.redactValue(v[i])
+		}
+	}
+	return value
+}
+
+func redactHeaders(header http.Header, names []string) http.Header {
+	header = header.Clone()
+	for _, name := range names {
+		if header.Get(name) != "" {
+			header.Set(name, redacted)
+		}
+	}
+	return header
+}
+
+type debugTransport struct {
+	log     *HTTPDebugLog
+	source  string
+	headers []string
+	next    http.RoundTripper
+}
+
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	exchange := httpExchange{
+		Time:   time.Now(),
+		Source: t.source,
+		Method: req.Method,
+		URL:    req.URL.String(),
+	}
+
+	if req.Body != nil {
+		requestBody, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(requestBody))
+		exchange.RequestBody = t.log.redactBody(requestBody)
+	}
+	exchange.RequestHeaders = redactHeaders(req.Header, t.headers)
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		exchange.DurationMs = time.Since(exchange.Time).Milliseconds()
+		exchange.Error = err.Error()
+		t.log.add(exchange)
+		return nil, err
+	}
+
+	responseBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	exchange.DurationMs = time.Since(exchange.Time).Milliseconds()
+	exchange.Status = resp.StatusCode
+	exchange.ResponseHeaders = redactHeaders(resp.Header, t.headers)
+	exchange.ResponseBody = t.log.redactBody(responseBody)
+	if err != nil {
+		exchange.Error = err.Error()
+		t.log.add(exchange)
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(responseBody))
+
+	t.log.add(exchange)
+	return resp, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// DedupStore remembers which contraventions were published recently, so
+// overlapping or repeated runs don't publish the same one twice.
+type DedupStore interface {
+	// Reserve claims a key for publishing. It returns false when the key
+	// was already published within the dedup window. The reservation only
+	// lasts dedupPendingTTL until it is confirmed, so a run that crashes
+	// before publishing doesn't hold the key for the whole window.
+	Reserve(key string) (bool, error)
+	// Confirm keeps a reserved key for the whole dedup window once its
+	// publish succeeded.
+	Confirm(key string) error
+	// Release gives up a reservation whose publish failed.
+	Release(key string) error
+	Close() error
+}
+
+// dedup is nil unless -dedup-db is set.
+var dedup DedupStore
+
+// dedupPendingTTL is how long a key stays reserved before its publish is
+// confirmed. It is longer than a publish can take, quota waits included.
+const dedupPendingTTL = 15 * time.Minute
+
+// pendingTTL is dedupPendingTTL, or the window if that is shorter.
+func pendingTTL(window time.Duration) time.Duration {
+	return min(dedupPendingTTL, window)
+}
+
+var dedupBucket = []byte("published")
+
+// boltDedupStore keeps the keys in a local bbolt file, with the time each
+// key expires as its value.
+type boltDedupStore struct {
+	db     *bolt.DB
+	window time.Duration
+}
+
+func OpenBoltDedupStore(path string, window time.Duration) (*boltDedupStore, error) {
+	db, err := openBolt(path, "dedup store")
+	if err != nil {
+		return nil, err
+	}
+
+	store := &boltDedupStore{db: db, window: window}
+	if err := store.prune(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open dedup store %s: %v", path, err)
+	}
+	return store, nil
+}
+
+// prune removes expired keys so the file doesn't grow forever.
+func (s *boltDedupStore) prune() error {
+	now := time.Now().UnixNano()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(dedupBucket)
+		if err != nil {
+			return err
+		}
+		expired := make([][]byte, 0)
+		bucket.ForEach(func(key, value []byte) error {
+			if len(value) != 8 || int64(binary.BigEndian.Uint64(value)) < now {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *boltDedupStore) Reserve(key string) (bool, error) {
+	reserved := false
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(dedupBucket)
+		now := time.Now()
+		if value := bucket.Get([]byte(key)); len(value) == 8 && int64(binary.BigEndian.Uint64(value)) >= now.UnixNano() {
+			return nil
+		}
+		reserved = true
+		return bucket.Put([]byte(key), expiresAt(now.Add(pendingTTL(s.window))))
+	})
+	return reserved, err
+}
+
+func (s *boltDedupStore) Confirm(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dedupBucket).Put([]byte(key), expiresAt(time.Now().Add(s.window)))
+	})
+}
+
+func (s *boltDedupStore) Release(key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(dedupBucket).Delete([]byte(key))
+	})
+}
+
+func (s *boltDedupStore) Close() error {
+	return s.db.Close()
+}
+
+// expiresAt encodes the time a key expires as the value kept for it.
+func expiresAt(t time.Time) []byte {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, uint64(t.UnixNano()))
+	return value
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/costinul/transfer360-test/transfer360"
+)
+
+// demoMode is set by -demo: every source, built in or configured, answers
+// from the fixtures below without touching the network, so the pipeline can
+// be shown anywhere.
+var demoMode bool
+
+// demoFixture is how the sources answer a demo VRM.
+type demoFixture struct {
+	// Sources lists the IDs of the sources that know the vehicle; empty
+	// means every source.
+	Sources []string
+	Hirer   bool
+	// Confidence is reported by the sources when set.
+	Confidence  float64
+	Timeout     bool
+	Description string
+}
+
+// demoFixtures are the demo VRMs. Any other VRM is unknown to every source.
+var demoFixtures = map[string]demoFixture{
+	"DEMO001": {Hirer: true, Description: "hirer vehicle in every source"},
+	"DEMO002": {Sources: []string{"acmelease"}, Hirer: true, Description: "hirer vehicle of ACME Company Ltd only"},
+	"DEMO003": {Description: "known to every source, but not a hirer vehicle"},
+	"DEMO004": {Hirer: true, Confidence: 0.4, Description: "hirer vehicle matched with a confidence of 0.4"},
+	"DEMO005": {Timeout: true, Description: "every source times out"},
+}
+
+// validateDemo keeps demo results, which are made up, away from real
+// consumers, and demo runs away from the network.
+func (f *Flags) validateDemo(sinks map[string]bool) error {
+	if f.Worker || f.BatchSQL != "" {
+		return fmt.Errorf("demo cannot be used with worker or batch-sql")
+	}
+	if f.RecordFile != "" || f.ReplayFile != "" || f.ResponseCache != "" || f.Directory != "" || f.DVLA || f.Warmup || f.AuthoritativeTime || f.Lock != "" {
+		return fmt.Errorf("demo cannot be used with record, replay, response-cache, directory, dvla, warmup, authoritative-time or lock")
+	}
+	for sink := range sinks {
+		switch sink {
+		case sinkStdout, sinkFile:
+		case sinkPubSub:
+			if !f.UseEmulator && runningEmulatorHost() == "" {
+				return fmt.Errorf("demo only publishes to the emulator, set -emulator or %s", emulatorHostEnv)
+			}
+		default:
+			return fmt.Errorf("demo cannot be used with the %s sink, only with stdout, file or pubsub on the emulator", sink)
+		}
+	}
+	return nil
+}
+
+// logDemoFixtures tells the audience which VRMs to try.
+func logDemoFixtures() {
+	log.Printf("Demo mode: sources answer from built-in fixtures, without the network\n")
+	for _, vrm := range demoVRMs() {
+		log.Printf("  %s: %s\n", vrm, demoFixtures[vrm].Description)
+	}
+}
+
+// demoVRMs returns the demo VRMs in order.
+func demoVRMs() []string {
+	vrms := make([]string, 0, len(demoFixtures))
+	for i := 1; i <= len(demoFixtures); i++ {
+		vrms = append(vrms, fmt.Sprintf("DEMO%03d", i))
+	}
+	return vrms
+}
+
+// demoRequests are checked with -demo when no records are given.
+func demoRequests(company string) []SearchRequest {
+	requests := make([]SearchRequest, 0, len(demoFixtures))
+	for _, vrm := range demoVRMs() {
+		requests = append(requests, SearchRequest{VRM: vrm, Company: company})
+	}
+	return requests
+}
+
+// demoContraventions answers a search from the demo fixtures. The lease
+// company is the one the source is registered for, so each source returns
+// its own result.
+func demoContraventions(ctx context.Context, source DataSource, search SearchBody) ([]*VehicleContravention, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	vrm := strings.ToUpper(strings.ReplaceAll(search.VRM, " ", ""))
+	fixture, ok := demoFixtures[vrm]
+	if !ok || (len(fixture.Sources) > 0 && !slices.Contains(fixture.Sources, source.ID())) {
+		return nil, nil
+	}
+	if fixture.Timeout {
+		return nil, demoTimeout{source: source.ID()}
+	}
+
+	date := search.ContraventionDate
+	if search.DateFrom != nil {
+		date = *search.DateFrom
+	}
+	contravention := &VehicleContravention{Contravention: transfer360.Contravention{
+		Reference:         fmt.Sprintf("DEMO-%s-%s", strings.ToUpper(source.ID()), vrm),
+		VRM:               search.VRM,
+		ContraventionDate: date.UTC().Truncate(24 * time.Hour).Format(time.RFC3339),
+		IsHirerVehicle:    fixture.Hirer,
+		LeaseCompany: LeaseCompany{
+			CompanyName:  demoCompany(source),
+			AddressLine1: "Unit 1, Demo Business Park",
+			AddressLine2: "Demo Way",
+			AddressLine3: "Demoton",
+			Postcode:     "DM1 1AA",
+		},
+	}}
+	if fixture.Confidence > 0 {
+		confidence := fixture.Confidence
+		contravention.Confidence = &confidence
+	}
+	return []*VehicleContravention{contravention}, nil
+}
+
+// demoTimeout looks like a network timeout to os.IsTimeout.
+type demoTimeout struct {
+	source string
+}
+
+func (e demoTimeout) Error() string { return "demo source " + e.source + " timed out" }
+func (demoTimeout) Timeout() bool   { return true }
+
+// demoCompany is the company a source is registered for, or its ID for
+// sources resolved through the directory.
+func demoCompany(source DataSource) string {
+	dataSourcesMutex.RLock()
+	defer dataSourcesMutex.RUnlock()
+	for company, registered := range dataSources {
+		if registered == source {
+			return company
+		}
+	}
+	return source.ID()
+}
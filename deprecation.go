@@ -0,0 +1,101 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Checks used to be run with flags alone: t360 -vrm=ABC123, t360
+// -batch=batch.json. They are now the check and batch run commands. The flat
+// form keeps working for existing scripts, with a warning naming the command
+// to use instead.
+
+// runCheckCommand checks the VRMs given as arguments, or the ones selected by
+// the flags.
+func runCheckCommand(args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	flags := &Flags{}
+	flags.register(fs)
+	fs.Parse(args)
+
+	for _, vrm := range fs.Args() {
+		flags.VRM.Set(vrm)
+	}
+	if err := flags.validate(); err != nil {
+		return err
+	}
+	return run(flags, nil)
+}
+
+// runBatchRun checks the records of a batch file.
+func runBatchRun(args []string) error {
+	fs := flag.NewFlagSet("batch run", flag.ExitOnError)
+	flags := &Flags{}
+	flags.register(fs)
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || flags.BatchFile != "" {
+		return fmt.Errorf("usage: t360 batch run [flags] file.json")
+	}
+	flags.BatchFile = fs.Arg(0)
+	if err := flags.validate(); err != nil {
+		return err
+	}
+	return run(flags, nil)
+}
+
+// warnFlatInvocation logs that checks run without a command are deprecated,
+// with the equivalent command line.
+func warnFlatInvocation(flags *Flags, fs *flag.FlagSet) {
+	log.Printf("Warning: running checks without a command is deprecated and will be removed. Use instead: %s\n", migratedCommand(flags, fs))
+}
+
+// migratedCommand translates the flags of a flat invocation into the check or
+// batch run command. Secrets and the passwords of Redis URLs are not
+// repeated.
+func migratedCommand(flags *Flags, fs *flag.FlagSet) string {
+	parts := []string{"t360", "check"}
+	if flags.BatchFile != "" {
+		parts = []string{"t360", "batch", "run"}
+	}
+
+	fs.Visit(func(f *flag.Flag) {
+		switch {
+		case f.Name == "vrm" || (f.Name == "batch" && flags.BatchFile != ""):
+			return
+		case secretFlags[f.Name]:
+			parts = append(parts, "-"+f.Name+"="+redacted)
+		case isRedisURL(f.Value.String()):
+			// Redis URLs can carry a password, as in the manifest.
+			parts = append(parts, "-"+f.Name+"="+quoteArg(redactURL(f.Value.String())))
+		case isBoolFlag(f) && f.Value.String() == "true":
+			parts = append(parts, "-"+f.Name)
+		default:
+			parts = append(parts, "-"+f.Name+"="+quoteArg(f.Value.String()))
+		}
+	})
+
+	if flags.BatchFile != "" {
+		parts = append(parts, quoteArg(flags.BatchFile))
+	} else {
+		for _, vrm := range flags.VRM {
+			parts = append(parts, quoteArg(vrm))
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	b, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && b.IsBoolFlag()
+}
+
+// quoteArg quotes a value for the shell only when it needs it.
+func quoteArg(value string) string {
+	if value != "" && !strings.ContainsAny(value, " \t\"'$`\\*?;&|<>()") {
+		return value
+	}
+	return shellQuote(value)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+func init() {
+	expvar.Publish("goroutines", expvar.Func(func() interface{} {
+		return runtime.NumGoroutine()
+	}))
+	expvar.Publish("run", expvar.Func(func() interface{} {
+		summary.mutex.Lock()
+		defer summary.mutex.Unlock()
+		return map[string]interface{}{
+			"run_id":     summary.RunID,
+			"started_at": summary.StartedAt,
+			"checked":    summary.Total,
+			"hits":       summary.Hits,
+			"misses":     summary.Misses,
+			"timeouts":   summary.Timeouts,
+			"errors":     summary.Errors,
+			"published":  summary.Publish.Count,
+		}
+	}))
+}
+
+// diagnosticsAddr binds a bare port to localhost, so profiles are not
+// exposed to the network unless a host is given explicitly.
+func diagnosticsAddr(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		// Not host:port, take it as a port.
+		return net.JoinHostPort("localhost", addr)
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// startDiagnostics serves net/http/pprof under /debug/pprof/ and runtime and
+// run counters under /debug/vars for profiling long runs.
+func startDiagnostics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	listener, err := net.Listen("tcp", diagnosticsAddr(addr))
+	if err != nil {
+		return fmt.Errorf("failed to start diagnostics server: %v", err)
+	}
+	log.Printf("Diagnostics on http://%s/debug/pprof/\n", listener.Addr())
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Printf("Diagnostics server stopped: %v\n", err)
+		}
+	}()
+	return nil
+}
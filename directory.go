@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Directory resolves companies that are neither built in nor in the config
+// file through a central directory service, so new sources can be onboarded
+// without a new release. The service answers GET <url>?company=<name> with a
+// source in the config file format, or 404 when it doesn't know the company.
+//
+// Answers, including unknown companies, are cached on disk for the TTL. When
+// the service can't be reached an expired answer is used rather than none.
+type Directory struct {
+	url       string
+	ttl       time.Duration
+	cacheFile string
+	client    *http.Client
+	mutex     sync.Mutex
+	entries   map[string]*directoryEntry
+	sources   map[string]DataSource
+}
+
+type directoryEntry struct {
+	Source    *SourceConfig `json:"source"`
+	FetchedAt time.Time     `json:"fetched_at"`
+}
+
+var directory *Directory
+
+// defaultDirectoryCache is used when -directory-cache is not set.
+func defaultDirectoryCache() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "t360", "directory.json")
+}
+
+func NewDirectory(url string, ttl time.Duration, cacheFile string) *Directory {
+	d := &Directory{
+		url:       url,
+		ttl:       ttl,
+		cacheFile: cacheFile,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		entries:   make(map[string]*directoryEntry),
+		sources:   make(map[string]DataSource),
+	}
+	d.loadCache()
+	return d
+}
+
+func (d *Directory) loadCache() {
+	if d.cacheFile == "" {
+		return
+	}
+	body, err := os.ReadFile(d.cacheFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Failed to read directory cache: %v\n", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(body, &d.entries); err != nil {
+		log.Printf("Ignoring invalid directory cache %s: %v\n", d.cacheFile, err)
+		d.entries = make(map[string]*directoryEntry)
+	}
+}
+
+func (d *Directory) saveCache() error {
+	if d.cacheFile == "" {
+		return nil
+	}
+	body, err := json.MarshalIndent(d.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(d.cacheFile), 0755); err != nil {
+		return err
+	}
+	tmp := d.cacheFile + ".tmp"
+	if err := os.WriteFile(tmp, body, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.cacheFile)
+}
+
+// Lookup returns the source for a company, or nil when the directory doesn't
+// know it.
+func (d *Directory) Lookup(company string) DataSource {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if source, ok := d.sources[company]; ok {
+		return source
+	}
+
+	entry := d.entries[company]
+	if entry == nil || time.Since(entry.FetchedAt) > d.ttl {
+		fetched, err := d.fetch(company)
+		if err != nil {
+			log.Printf("Directory lookup of %s failed: %v\n", company, err)
+		} else {
+			entry = fetched
+			d.entries[company] = entry
+			if err := d.saveCache(); err != nil {
+				log.Printf("Failed to write directory cache: %v\n", err)
+			}
+		}
+	}
+
+	var source DataSource
+	if entry != nil && entry.Source != nil {
+		var err error
+		source, err = d.newSource(company, *entry.Source)
+		if err != nil {
+			log.Printf("Ignoring directory source for %s: %v\n", company, err)
+			source = nil
+		}
+	}
+	// Remember the answer for the rest of the run, so every record of a
+	// company uses the same source.
+	d.sources[company] = source
+	return source
+}
+
+// Close closes the connections of the sources the directory created.
+func (d *Directory) Close() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	closeSources(d.sources, nil)
+}
+
+func (d *Directory) newSource(company string, config SourceConfig) (DataSource, error) {
+	config.Company = company
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	if config.URL == "" && config.Protocol == "" {
+		return nil, fmt.Errorf("source %s: url is required", company)
+	}
+	return newConfiguredSource(config)
+}
+
+func (d *Directory) fetch(company string) (*directoryEntry, error) {
+	req, err := http.NewRequest(http.MethodGet, d.url+"?company="+url.QueryEscape(company), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent())
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	entry := &directoryEntry{FetchedAt: time.Now()}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return entry, nil
+	default:
+		return nil, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var source SourceConfig
+	if err := json.Unmarshal(body, &source); err != nil {
+		return nil, fmt.Errorf("invalid directory response: %v", err)
+	}
+	entry.Source = &source
+	return entry, nil
+}
+
+// Expire forgets the sources whose answers are older than the TTL, so the
+// next lookup asks the directory again.
+func (d *Directory) Expire() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for company := range d.sources {
+		entry := d.entries[company]
+		if entry == nil || time.Since(entry.FetchedAt) > d.ttl {
+			delete(d.sources, company)
+		}
+	}
+}
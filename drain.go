@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// drainedMessage is a line of the drain output. Data that is JSON is kept
+// as is; other encodings are written as base64.
+type drainedMessage struct {
+	ID          string            `json:"id"`
+	PublishTime time.Time         `json:"publish_time"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	Data        json.RawMessage   `json:"data,omitempty"`
+	DataBase64  []byte            `json:"data_base64,omitempty"`
+}
+
+// runDrainCommand pulls messages from a subscription and appends them to an
+// NDJSON file, acknowledging each message once it is written.
+func runDrainCommand(args []string) error {
+	fs := flag.NewFlagSet("drain", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	subscription := fs.String("subscription", "", "Subscription to pull messages from (required)")
+	out := fs.String("out", "-", "NDJSON file the messages are appended to (- for stdout)")
+	idle := fs.Duration("idle", 0, "Stop when no message arrives for this long (0 keeps pulling until interrupted)")
+	maxMessages := fs.Int("max-messages", 0, "Stop after this many messages (0 means no limit)")
+	fs.Parse(args)
+
+	if *subscription == "" {
+		return fmt.Errorf("missing required flag: -subscription")
+	}
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		file, err := os.OpenFile(*out, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+	buffered := bufio.NewWriter(w)
+	defer buffered.Flush()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	client, err := conn.newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	sub := client.Subscription(*subscription)
+	exists, err := sub.Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read subscription %s: %v", *subscription, err)
+	}
+	if !exists {
+		return fmt.Errorf("subscription %s does not exist", *subscription)
+	}
+
+	receiveCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	var mutex sync.Mutex
+	count := 0
+	lastMessage := time.Now()
+	if *idle > 0 {
+		go func() {
+			ticker := time.NewTicker(*idle / 4)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-receiveCtx.Done():
+					return
+				case <-ticker.C:
+					mutex.Lock()
+					idleFor := time.Since(lastMessage)
+					mutex.Unlock()
+					if idleFor >= *idle {
+						stop()
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	var writeErr error
+	log.Printf("Draining %s to %s\n", *subscription, *out)
+	err = sub.Receive(receiveCtx, func(ctx context.Context, msg *pubsub.Message) {
+		mutex.Lock()
+		defer mutex.Unlock()
+
+		if writeErr != nil || (*maxMessages > 0 && count >= *maxMessages) {
+			msg.Nack()
+			return
+		}
+
+		line, err := json.Marshal(newDrainedMessage(msg))
+		if err == nil {
+			line = append(line, '\n')
+			_, err = buffered.Write(line)
+		}
+		if err == nil {
+			// Flush before acking so an acked message is never lost.
+			err = buffered.Flush()
+		}
+		if err != nil {
+			writeErr = err
+			msg.Nack()
+			stop()
+			return
+		}
+
+		msg.Ack()
+		count++
+		lastMessage = time.Now()
+		if *maxMessages > 0 && count >= *maxMessages {
+			stop()
+		}
+	})
+	if err != nil {
+		return fmt.Errorf("failed to receive from %s: %v", *subscription, err)
+	}
+	if writeErr != nil {
+		return fmt.Errorf("failed to write %s: %v", *out, writeErr)
+	}
+
+	log.Printf("Drained %d messages from %s\n", count, *subscription)
+	return nil
+}
+
+func newDrainedMessage(msg *pubsub.Message) drainedMessage {
+	drained := drainedMessage{
+		ID:          msg.ID,
+		PublishTime: msg.PublishTime,
+		Attributes:  msg.Attributes,
+	}
+	if json.Valid(msg.Data) {
+		drained.Data = msg.Data
+	} else {
+		drained.DataBase64 = msg.Data
+	}
+	return drained
+}
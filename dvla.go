@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// dvlaAPIKeyEnv holds the key of the DVLA Vehicle Enquiry Service API.
+const dvlaAPIKeyEnv = "DVLA_API_KEY"
+
+const dvlaEndpoint = "https://driver-vehicle-licensing.api.gov.uk/vehicle-enquiry/v1/vehicles"
+
+// VehicleDetails is what the DVLA holds about a vehicle, published with a
+// contravention under vehicle.
+type VehicleDetails struct {
+	Make              string `json:"make,omitempty"`
+	Colour            string `json:"colour,omitempty"`
+	YearOfManufacture int    `json:"year_of_manufacture,omitempty"`
+	FuelType          string `json:"fuel_type,omitempty"`
+	TaxStatus         string `json:"tax_status,omitempty"`
+	TaxDueDate        string `json:"tax_due_date,omitempty"`
+	MOTStatus         string `json:"mot_status,omitempty"`
+	MOTExpiryDate     string `json:"mot_expiry_date,omitempty"`
+}
+
+// DVLAEnricher adds the DVLA's vehicle details to positive results before
+// they are published. A vehicle the DVLA doesn't know, or a failed enquiry,
+// leaves the result as it is.
+type DVLAEnricher struct {
+	apiKey   string
+	endpoint string
+	client   *http.Client
+}
+
+// dvlaEnricher is nil unless -dvla is set.
+var dvlaEnricher *DVLAEnricher
+
+func NewDVLAEnricher(apiKey string) *DVLAEnricher {
+	return &DVLAEnricher{
+		apiKey:   apiKey,
+		endpoint: dvlaEndpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Lookup returns the DVLA's details of a vehicle, or nil when the DVLA has
+// no vehicle with that registration.
+func (e *DVLAEnricher) Lookup(ctx context.Context, vrm string) (*VehicleDetails, error) {
+	body, err := json.Marshal(map[string]string{
+		"registrationNumber": strings.ToUpper(strings.ReplaceAll(vrm, " ", "")),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("x-api-key", e.apiKey)
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("DVLA enquiry failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound:
+		return nil, nil
+	default:
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("DVLA enquiry failed: status %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	var vehicle struct {
+		Make              string `json:"make"`
+		Colour            string `json:"colour"`
+		YearOfManufacture int    `json:"yearOfManufacture"`
+		FuelType          string `json:"fuelType"`
+		TaxStatus         string `json:"taxStatus"`
+		TaxDueDate        string `json:"taxDueDate"`
+		MOTStatus         string `json:"motStatus"`
+		MOTExpiryDate     string `json:"motExpiryDate"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vehicle); err != nil {
+		return nil, fmt.Errorf("invalid DVLA response: %v", err)
+	}
+	return &VehicleDetails{
+		Make:              vehicle.Make,
+		Colour:            vehicle.Colour,
+		YearOfManufacture: vehicle.YearOfManufacture,
+		FuelType:          vehicle.FuelType,
+		TaxStatus:         vehicle.TaxStatus,
+		TaxDueDate:        vehicle.TaxDueDate,
+		MOTStatus:         vehicle.MOTStatus,
+		MOTExpiryDate:     vehicle.MOTExpiryDate,
+	}, nil
+}
+
+// Enrich sets the vehicle details of a result, looked up by its real VRM.
+func (e *DVLAEnricher) Enrich(ctx context.Context, contravention *VehicleContravention, vrm string) {
+	vehicle, err := e.Lookup(ctx, vrm)
+	if err != nil {
+		log.Printf("Publishing %s without vehicle details: %v\n", contravention.VRM, err)
+		return
+	}
+	if vehicle == nil {
+		logRecordf(ctx, "DVLA has no vehicle %s\n", contravention.VRM)
+		return
+	}
+	contravention.Vehicle = vehicle
+}
@@ -1,3 +1,5 @@
+//go:build !noemulator
+
 package main
 
 import (
@@ -8,7 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"runtime"
+	"regexp"
 	"strings"
 	"sync"
 	"time"
@@ -18,15 +20,39 @@ type PubSubEmulator struct {
 	ProjectID string
 	Port      int
 	DataDir   string
-	hostPort  string
-	cmd       *exec.Cmd
-	mutex     sync.Mutex
-	isRunning bool
-	errChan   chan error
+	// ReadyPatterns match the output line announcing the emulator is ready.
+	// The known patterns are used when it is empty.
+	ReadyPatterns []*regexp.Regexp
+	// Limits cap the priority, CPU and memory of the emulator.
+	Limits EmulatorLimits
+	// MaxRestarts is how many times an emulator that crashes is relaunched,
+	// RestartBackoff the wait before the first relaunch (doubled for each
+	// next one), and OnRestart sets up the relaunched emulator again.
+	MaxRestarts    int
+	RestartBackoff time.Duration
+	OnRestart      func(ctx context.Context) error
+	limiter        *emulatorLimiter
+	restarts       int
+	closed         bool
+	hostPort       string
+	cmd            *exec.Cmd
+	mutex          sync.Mutex
+	isRunning      bool
+	errChan        chan error
+	exited         chan struct{}
+	events         emulatorEvents
 }
 
+// emulatorStopTimeout is how long a stopping emulator gets to shut down
+// cleanly before it is killed.
+const emulatorStopTimeout = 10 * time.Second
+
+// emulatorDataPrefix names the data directories of emulator instances in the
+// temp directory. Each instance gets its own, suffixed with its start time.
+const emulatorDataPrefix = "pubsub-emulator-data"
+
 func NewPubSubEmulator(projectID string, port int) *PubSubEmulator {
-	dataDir := filepath.Join(os.TempDir(), "pubsub-emulator-data")
+	dataDir := filepath.Join(os.TempDir(), fmt.Sprintf("%s-%s-%d", emulatorDataPrefix, time.Now().Format("20060102-150405"), os.Getpid()))
 
 	return &PubSubEmulator{
 		ProjectID: projectID,
@@ -54,13 +80,16 @@ func (em *PubSubEmulator) Start(ctx context.Context) error {
 	}
 
 	readyCh, errorCh := em.startMonitoring(ctx)
+	if readyCh == nil {
+		return fmt.Errorf("failed to launch emulator")
+	}
 
 	err := em.waitForEmulator(ctx, readyCh, errorCh)
 	if err != nil {
 		return err
 	}
 
-	os.Setenv("PUBSUB_EMULATOR_HOST", em.Host())
+	os.Setenv(emulatorHostEnv, em.Host())
 
 	return nil
 }
@@ -75,11 +104,21 @@ func (em *PubSubEmulator) initializeDirectory() error {
 func (em *PubSubEmulator) prepareCommand() error {
 	hostPort := fmt.Sprintf("localhost:%d", em.Port)
 	em.hostPort = hostPort
+	if err := checkPortFree(hostPort); err != nil {
+		return err
+	}
 
 	em.cmd = exec.Command("gcloud", "beta", "emulators", "pubsub", "start",
 		"--project="+em.ProjectID,
 		"--host-port="+hostPort,
 		"--data-dir="+em.DataDir)
+	startInProcessGroup(em.cmd)
+	limiter, err := limitEmulator(em.cmd, em.Limits)
+	if err != nil {
+		return err
+	}
+	em.limiter = limiter
+	em.exited = make(chan struct{})
 
 	return nil
 }
@@ -96,11 +135,20 @@ func (em *PubSubEmulator) startMonitoring(ctx context.Context) (chan struct{}, c
 	}
 
 	if err := em.cmd.Start(); err != nil {
+		em.limiter.close()
+		return nil, nil
+	}
+	if err := em.limiter.started(em.cmd); err != nil {
+		fmt.Printf("Failed to limit emulator resources: %v\n", err)
+		killEmulator(em.cmd)
+		em.cmd.Wait()
+		em.limiter.close()
 		return nil, nil
 	}
+	em.emit(EmulatorStarted, nil)
 
 	// Channel to signal when the emulator is ready
-	readyCh := make(chan struct{})
+	readyCh := make(chan struct{}, 1)
 
 	// Channel to collect errors from monitoring goroutines
 	errorCh := make(chan error, 2)
@@ -120,7 +168,7 @@ func (em *PubSubEmulator) startMonitoring(ctx context.Context) (chan struct{}, c
 		case <-ctx.Done():
 			return
 		default:
-			em.monitorOutput(stdout, nil, errorCh, false)
+			em.monitorOutput(stdout, readyCh, errorCh, true)
 		}
 	}()
 
@@ -133,6 +181,10 @@ func (em *PubSubEmulator) startMonitoring(ctx context.Context) (chan struct{}, c
 		}
 	}()
 
+	// The emulator may log its ready line in a language or format no
+	// pattern matches, so it is also ready once its port accepts connections.
+	go em.probePort(readyCh, em.exited)
+
 	return readyCh, errorCh
 }
 
@@ -149,7 +201,7 @@ func (em *PubSubEmulator) monitorOutput(
 		fmt.Println(line)
 
 		// Check for ready signal if this is the stream we're monitoring for it
-		if checkReady && readyCh != nil && strings.Contains(line, "Server started") {
+		if checkReady && readyCh != nil && em.isReadyLine(line) {
 			select {
 			case readyCh <- struct{}{}:
 			default:
@@ -179,6 +231,8 @@ func (em *PubSubEmulator) monitorOutput(
 func (em *PubSubEmulator) monitorProcess(errorCh chan error) {
 	startTime := time.Now()
 	err := em.cmd.Wait()
+	em.limiter.close()
+	close(em.exited)
 
 	// Check if this is an early exit
 	if time.Since(startTime) < 3*time.Second {
@@ -191,10 +245,13 @@ func (em *PubSubEmulator) monitorProcess(errorCh chan error) {
 
 	if em.isRunning {
 		em.isRunning = false
+		crash := fmt.Errorf("emulator process exited unexpectedly: %v", err)
 		select {
-		case em.errChan <- fmt.Errorf("emulator process exited unexpectedly: %v", err):
+		case em.errChan <- crash:
 		default:
 		}
+		em.emit(EmulatorCrashed, crash)
+		em.restartAfterCrash()
 	}
 }
 
@@ -209,6 +266,7 @@ func (em *PubSubEmulator) waitForEmulator(
 	select {
 	case <-readyCh:
 		em.isRunning = true
+		em.emit(EmulatorReady, nil)
 		return nil
 	case err := <-errorCh:
 		em.stopUnlocked()
@@ -228,13 +286,14 @@ func (em *PubSubEmulator) waitForEmulator(
 	select {
 	case <-readyCh:
 		em.isRunning = true
+		em.emit(EmulatorReady, nil)
 		return nil
 	case err := <-errorCh:
 		em.stopUnlocked()
 		return err
 	case <-timeoutCtx.Done():
 		em.stopUnlocked()
-		return fmt.Errorf("timeout waiting for emulator to start (no 'Server started' message detected within 30 seconds)")
+		return fmt.Errorf("timeout waiting for emulator to start (no ready message detected and port %d not open within 30 seconds)", em.Port)
 	case <-ctx.Done():
 		em.stopUnlocked()
 		return ctx.Err()
@@ -249,61 +308,64 @@ func (em *PubSubEmulator) stopUnlocked() {
 
 	fmt.Println("Stopping Pub/Sub emulator...")
 
-	// Try multiple approaches to ensure all processes are terminated
-
-	// 1. Try to kill the main process if we still have a reference
+	// Interrupt the emulator first so it can flush its data directory, and
+	// only kill it when it doesn't exit in time.
 	if em.cmd != nil && em.cmd.Process != nil {
-		fmt.Println("Killing main emulator process...")
-		em.cmd.Process.Kill()
-	}
+		if err := interruptEmulator(em.cmd); err != nil {
+			fmt.Printf("Failed to interrupt emulator: %v\n", err)
+		} else if em.waitForExit(emulatorStopTimeout) {
+			em.stopped()
+			return
+		}
 
-	// 2. Kill processes by port
-	fmt.Printf("Killing processes using port %d...\n", em.Port)
-	if runtime.GOOS == "windows" {
-		exec.Command("cmd", "/c", fmt.Sprintf("for /f \"tokens=5\" %%a in ('netstat -aon ^| findstr :%d') do taskkill /F /PID %%a", em.Port)).Run()
-	} else {
-		exec.Command("lsof", "-ti", fmt.Sprintf(":%d", em.Port)).Output()
-		exec.Command("kill", "-9", fmt.Sprintf("$(lsof -ti :%d)", em.Port)).Run()
+		fmt.Println("Emulator did not stop in time, killing it...")
+		killEmulator(em.cmd)
+		if em.waitForExit(5 * time.Second) {
+			em.stopped()
+			return
+		}
 	}
 
-	// 3. Kill Java processes
-	fmt.Println("Killing Java processes...")
-	if runtime.GOOS == "windows" {
-		exec.Command("taskkill", "/F", "/IM", "java.exe").Run()
-	} else {
-		exec.Command("pkill", "-f", "java").Run()
-	}
+	em.forceKill()
+	em.stopped()
+}
 
-	// 4. Kill emulator processes
-	fmt.Println("Killing emulator processes...")
-	if runtime.GOOS == "windows" {
-		exec.Command("taskkill", "/F", "/FI", "WINDOWTITLE eq *emulator*").Run()
-		exec.Command("taskkill", "/F", "/FI", "WINDOWTITLE eq *pubsub*").Run()
-		exec.Command("taskkill", "/F", "/FI", "WINDOWTITLE eq *gcloud*").Run()
-	} else {
-		exec.Command("pkill", "-f", "emulator").Run()
-		exec.Command("pkill", "-f", "pubsub").Run()
-		exec.Command("pkill", "-f", "gcloud").Run()
+// waitForExit reports whether the emulator process exits within timeout.
+func (em *PubSubEmulator) waitForExit(timeout time.Duration) bool {
+	select {
+	case <-em.exited:
+		return true
+	case <-time.After(timeout):
+		return false
 	}
+}
 
-	// 5. Kill by parent PID if available
-	if em.cmd != nil && em.cmd.Process != nil {
-		fmt.Printf("Killing process tree with parent PID %d...\n", em.cmd.Process.Pid)
-		if runtime.GOOS == "windows" {
-			exec.Command("taskkill", "/F", "/T", "/PID", fmt.Sprintf("%d", em.cmd.Process.Pid)).Run()
-		} else {
-			exec.Command("pkill", "-P", fmt.Sprintf("%d", em.cmd.Process.Pid)).Run()
-		}
+// forceKill is the last resort when the emulator doesn't exit: it kills the
+// emulator's process group again, its process tree on Windows, and the
+// process itself. Other Java or gcloud processes on the machine, such as a
+// second emulator or another developer's tools, are left alone.
+func (em *PubSubEmulator) forceKill() {
+	if em.cmd == nil || em.cmd.Process == nil {
+		return
+	}
+	fmt.Printf("Killing emulator process group %d...\n", em.cmd.Process.Pid)
+	if err := killEmulator(em.cmd); err != nil {
+		fmt.Printf("Failed to kill emulator process group: %v\n", err)
 	}
+	em.cmd.Process.Kill()
+}
 
-	os.Unsetenv("PUBSUB_EMULATOR_HOST")
+func (em *PubSubEmulator) stopped() {
+	os.Unsetenv(emulatorHostEnv)
 	em.isRunning = false
 	fmt.Println("Pub/Sub emulator stopped")
+	em.emit(EmulatorStopped, nil)
 }
 
 func (em *PubSubEmulator) Stop() {
 	em.mutex.Lock()
 	defer em.mutex.Unlock()
+	em.closed = true
 	em.stopUnlocked()
 }
 
@@ -317,6 +379,8 @@ func (em *PubSubEmulator) IsRunning() bool {
 	return em.isRunning
 }
 
+// Error receives the error of an emulator that exits unexpectedly. Subscribe
+// reports every state transition.
 func (em *PubSubEmulator) Error() <-chan error {
 	return em.errChan
 }
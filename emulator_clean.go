@@ -0,0 +1,87 @@
+//go:build !noemulator
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cleanEmulatorData removes emulator data directories in the temp directory
+// that were last modified more than maxAge ago, including the directory
+// shared by all instances in earlier versions. Directories of t360 processes
+// still running are kept, as their emulators may be using them, whatever
+// maxAge is. It returns the removed paths.
+func cleanEmulatorData(maxAge time.Duration) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(os.TempDir(), emulatorDataPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+
+	removed := make([]string, 0)
+	for _, path := range matches {
+		info, err := os.Stat(path)
+		if err != nil || !info.IsDir() || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if pid, ok := emulatorDataPID(path); ok && processRunning(pid) {
+			continue
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return removed, fmt.Errorf("failed to remove %s: %v", path, err)
+		}
+		removed = append(removed, path)
+	}
+	return removed, nil
+}
+
+// emulatorDataPID returns the process ID of the t360 run that created a data
+// directory, the last part of its name.
+func emulatorDataPID(path string) (int, bool) {
+	name := filepath.Base(path)
+	i := strings.LastIndex(name, "-")
+	if i < 0 || name == emulatorDataPrefix {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(name[i+1:])
+	return pid, err == nil && pid > 0
+}
+
+func runEmulatorCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: t360 emulator clean [-days n] | sessions list|delete <name>")
+	}
+	if args[0] == "sessions" {
+		return runSessionsCommand(args[1:])
+	}
+
+	fs := flag.NewFlagSet("emulator "+args[0], flag.ExitOnError)
+	days := fs.Int("days", 7, "Remove data directories not used for this many days")
+	fs.Parse(args[1:])
+
+	switch args[0] {
+	case "clean":
+		if *days < 0 {
+			return fmt.Errorf("days cannot be negative")
+		}
+		removed, err := cleanEmulatorData(time.Duration(*days) * 24 * time.Hour)
+		for _, path := range removed {
+			fmt.Printf("Removed %s\n", path)
+		}
+		if err != nil {
+			return err
+		}
+		if len(removed) == 0 {
+			log.Printf("No emulator data directories older than %d days\n", *days)
+		}
+	default:
+		return fmt.Errorf("unknown emulator command: %s", args[0])
+	}
+	return nil
+}
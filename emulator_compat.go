@@ -0,0 +1,126 @@
+//go:build !noemulator
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// emulatorIncompatibility is a range of client library and emulator
+// versions that don't work together. Empty bounds are open.
+type emulatorIncompatibility struct {
+	clientFrom    string
+	clientBelow   string
+	emulatorFrom  string
+	emulatorBelow string
+	problem       string
+}
+
+// emulatorIncompatibilities are the combinations we have run into. They
+// fail silently: publishes hang until the deadline instead of failing, so
+// they are worth catching before a run starts. Add new ones here.
+var emulatorIncompatibilities = []emulatorIncompatibility{
+	{
+		clientFrom:    "1.30.0",
+		emulatorBelow: "0.6.0",
+		problem:       "publishes hang without an error",
+	},
+}
+
+func (i emulatorIncompatibility) matches(client string, emulator string) bool {
+	return versionInRange(client, i.clientFrom, i.clientBelow) && versionInRange(emulator, i.emulatorFrom, i.emulatorBelow)
+}
+
+// emulatorVersion asks gcloud for the version of its Pub/Sub emulator
+// component.
+func emulatorVersion() (string, error) {
+	out, err := exec.Command("gcloud", "version", "--format=json").Output()
+	if err != nil {
+		return "", fmt.Errorf("gcloud version failed: %v", err)
+	}
+	var components map[string]any
+	if err := json.Unmarshal(out, &components); err != nil {
+		return "", fmt.Errorf("invalid gcloud version output: %v", err)
+	}
+	version, ok := components["pubsub-emulator"].(string)
+	if !ok {
+		return "", fmt.Errorf("gcloud doesn't report a pubsub-emulator component")
+	}
+	return version, nil
+}
+
+// checkEmulatorCompatibility warns about a client library and emulator that
+// are known not to work together, and fails with -strict. Versions that
+// can't be found are logged and not checked.
+func checkEmulatorCompatibility(strict bool) error {
+	client := pubsubClientVersion()
+	emulatorVer, err := emulatorVersion()
+	if err != nil {
+		log.Printf("Could not check the emulator version: %v\n", err)
+		return nil
+	}
+	if client == "" {
+		log.Printf("Could not check the emulator version: the Pub/Sub client version is unknown\n")
+		return nil
+	}
+	log.Printf("Pub/Sub client %s, emulator %s\n", client, emulatorVer)
+
+	for _, incompatibility := range emulatorIncompatibilities {
+		if !incompatibility.matches(client, emulatorVer) {
+			continue
+		}
+		if strict {
+			return fmt.Errorf("strict mode: Pub/Sub client %s is incompatible with emulator %s: %s; update the emulator with gcloud components update", client, emulatorVer, incompatibility.problem)
+		}
+		log.Printf("Warning: Pub/Sub client %s is incompatible with emulator %s: %s; update the emulator with gcloud components update\n", client, emulatorVer, incompatibility.problem)
+	}
+	return nil
+}
+
+// versionInRange reports whether from <= version < below.
+func versionInRange(version string, from string, below string) bool {
+	if from != "" && compareVersions(version, from) < 0 {
+		return false
+	}
+	return below == "" || compareVersions(version, below) < 0
+}
+
+// compareVersions compares dotted numeric versions, ignoring a leading v
+// and any pre-release or build suffix.
+func compareVersions(a string, b string) int {
+	pa, pb := versionParts(a), versionParts(b)
+	for i := 0; i < max(len(pa), len(pb)); i++ {
+		var x, y int
+		if i < len(pa) {
+			x = pa[i]
+		}
+		if i < len(pb) {
+			y = pb[i]
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+func versionParts(version string) []int {
+	version = strings.TrimPrefix(version, "v")
+	if i := strings.IndexAny(version, "-+"); i >= 0 {
+		version = version[:i]
+	}
+	parts := make([]int, 0, 3)
+	for _, part := range strings.Split(version, ".") {
+		n, _ := strconv.Atoi(part)
+		parts = append(parts, n)
+	}
+	return parts
+}
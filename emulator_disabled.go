@@ -0,0 +1,46 @@
+//go:build noemulator
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+)
+
+// errNoEmulator is returned for -emulator in builds with the noemulator tag,
+// which leave out starting and managing an emulator. An emulator that is
+// already running can still be used through PUBSUB_EMULATOR_HOST.
+var errNoEmulator = errors.New("this build has no emulator support (built with -tags noemulator); set " + emulatorHostEnv + " to use an emulator that is already running")
+
+type emulatorFlags struct {
+	UseEmulator bool
+}
+
+func (f *emulatorFlags) registerEmulator(fs *flag.FlagSet) {
+	fs.BoolVar(&f.UseEmulator, "emulator", false, "Use Pub/Sub emulator (not available in this build)")
+}
+
+func (f *emulatorFlags) validateEmulator() error {
+	if f.UseEmulator {
+		return errNoEmulator
+	}
+	return nil
+}
+
+// PubSubEmulator is never started in this build.
+type PubSubEmulator struct{}
+
+func (em *PubSubEmulator) Host() string {
+	return ""
+}
+
+func (em *PubSubEmulator) RecreateOnRestart(config *Config) {}
+
+func startEmulator(ctx context.Context, flags *Flags) (*PubSubEmulator, func(), error) {
+	return nil, nil, errNoEmulator
+}
+
+func runEmulatorCommand(args []string) error {
+	return errNoEmulator
+}
@@ -0,0 +1,92 @@
+//go:build !noemulator
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// EmulatorState is a step in the life of an emulator process.
+type EmulatorState int
+
+const (
+	// EmulatorStarted is sent when the emulator process has been launched.
+	EmulatorStarted EmulatorState = iota + 1
+	// EmulatorReady is sent when the emulator accepts connections.
+	EmulatorReady
+	// EmulatorCrashed is sent when the emulator process exits while running,
+	// with the reason in Err.
+	EmulatorCrashed
+	// EmulatorStopped is sent when Stop has shut the emulator down.
+	EmulatorStopped
+)
+
+func (s EmulatorState) String() string {
+	switch s {
+	case EmulatorStarted:
+		return "started"
+	case EmulatorReady:
+		return "ready"
+	case EmulatorCrashed:
+		return "crashed"
+	case EmulatorStopped:
+		return "stopped"
+	}
+	return "unknown"
+}
+
+// EmulatorEvent is a state transition of an emulator.
+type EmulatorEvent struct {
+	State EmulatorState
+	Err   error
+	At    time.Time
+}
+
+// emulatorEventBuffer is how many events a subscriber can fall behind by
+// before newer events are dropped for it.
+const emulatorEventBuffer = 16
+
+// emulatorEvents fans the events of an emulator out to its subscribers.
+type emulatorEvents struct {
+	mutex       sync.Mutex
+	subscribers map[chan EmulatorEvent]struct{}
+}
+
+// Subscribe returns a channel receiving the emulator's state transitions from
+// now on, and a function that ends the subscription and closes the channel.
+// Events are dropped for a subscriber that doesn't keep up.
+func (em *PubSubEmulator) Subscribe() (<-chan EmulatorEvent, func()) {
+	events := &em.events
+	ch := make(chan EmulatorEvent, emulatorEventBuffer)
+
+	events.mutex.Lock()
+	if events.subscribers == nil {
+		events.subscribers = make(map[chan EmulatorEvent]struct{})
+	}
+	events.subscribers[ch] = struct{}{}
+	events.mutex.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			events.mutex.Lock()
+			delete(events.subscribers, ch)
+			events.mutex.Unlock()
+			close(ch)
+		})
+	}
+}
+
+func (em *PubSubEmulator) emit(state EmulatorState, err error) {
+	event := EmulatorEvent{State: state, Err: err, At: time.Now()}
+
+	em.events.mutex.Lock()
+	defer em.events.mutex.Unlock()
+	for ch := range em.events.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
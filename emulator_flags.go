@@ -0,0 +1,124 @@
+//go:build !noemulator
+
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+)
+
+// emulatorFlags are the flags of the emulator started by a run. Builds with
+// the noemulator tag only keep -emulator, to reject it.
+type emulatorFlags struct {
+	UseEmulator      bool
+	EmulatorDays     int
+	EmulatorSession  string
+	EmulatorRestarts int
+	RestartBackoff   time.Duration
+	ReadyPatterns    readyPatternList
+	EmulatorLimits   EmulatorLimits
+}
+
+func (f *emulatorFlags) registerEmulator(fs *flag.FlagSet) {
+	fs.BoolVar(&f.UseEmulator, "emulator", false, "Use Pub/Sub emulator")
+	fs.IntVar(&f.EmulatorDays, "emulator-keep-days", 7, "Remove emulator data directories not used for this many days when starting the emulator")
+	fs.StringVar(&f.EmulatorSession, "emulator-session", "", "Keep the emulator's topics, subscriptions and messages in this named session for the next run")
+	fs.IntVar(&f.EmulatorRestarts, "emulator-restarts", 0, "Relaunch the emulator up to this many times when it crashes, creating its topics and subscriptions again")
+	fs.DurationVar(&f.RestartBackoff, "emulator-restart-backoff", 2*time.Second, "Wait before relaunching a crashed emulator, doubled for each next restart")
+	fs.Var(&f.ReadyPatterns, "emulator-ready-pattern", "Regular expression matching the emulator's ready line, replacing the known ones; may be repeated")
+	fs.IntVar(&f.EmulatorLimits.Nice, "emulator-nice", 0, "Lower the CPU and IO priority of the emulator by this nice level (1-19), so it can't starve the workers on the same machine")
+	fs.Float64Var(&f.EmulatorLimits.CPUs, "emulator-cpus", 0, "Cap the emulator at this many CPU cores, with cgroups on Linux and a job object on Windows (0 means unlimited)")
+	fs.IntVar(&f.EmulatorLimits.MemoryMB, "emulator-memory-mb", 0, "Cap the memory of the emulator at this many megabytes, with cgroups on Linux and a job object on Windows (0 means unlimited)")
+}
+
+func (f *emulatorFlags) validateEmulator() error {
+	if f.EmulatorSession != "" {
+		if !f.UseEmulator {
+			return fmt.Errorf("emulator-session requires emulator")
+		}
+		if runningEmulatorHost() != "" {
+			return fmt.Errorf("emulator-session cannot be used with %s: the emulator is already running", emulatorHostEnv)
+		}
+		if err := validateSessionName(f.EmulatorSession); err != nil {
+			return err
+		}
+	}
+
+	if f.EmulatorRestarts < 0 || f.RestartBackoff < 0 {
+		return fmt.Errorf("emulator-restarts and emulator-restart-backoff cannot be negative")
+	}
+	if f.EmulatorRestarts > 0 && !f.UseEmulator {
+		return fmt.Errorf("emulator-restarts requires emulator")
+	}
+
+	if len(f.ReadyPatterns) > 0 && !f.UseEmulator {
+		return fmt.Errorf("emulator-ready-pattern requires emulator")
+	}
+
+	if err := f.EmulatorLimits.validate(); err != nil {
+		return err
+	}
+	if f.EmulatorLimits.isSet() && !f.UseEmulator {
+		return fmt.Errorf("emulator-nice, emulator-cpus and emulator-memory-mb require emulator")
+	}
+
+	if f.EmulatorDays < 0 {
+		return fmt.Errorf("emulator-keep-days cannot be negative")
+	}
+	return nil
+}
+
+// startEmulator starts the emulator for a run with -emulator. The returned
+// function stops it.
+func startEmulator(ctx context.Context, flags *Flags) (*PubSubEmulator, func(), error) {
+	removed, err := cleanEmulatorData(time.Duration(flags.EmulatorDays) * 24 * time.Hour)
+	if err != nil {
+		log.Printf("Failed to clean emulator data: %v\n", err)
+	}
+	if len(removed) > 0 {
+		log.Printf("Removed %d stale emulator data directories\n", len(removed))
+	}
+
+	emulator := NewPubSubEmulator(flags.ProjectID, 8085)
+	emulator.ReadyPatterns = flags.ReadyPatterns
+	emulator.MaxRestarts = flags.EmulatorRestarts
+	emulator.RestartBackoff = flags.RestartBackoff
+	emulator.Limits = flags.EmulatorLimits
+	if flags.EmulatorLimits.isSet() {
+		log.Printf("Limiting the emulator to %s\n", flags.EmulatorLimits)
+	}
+	if flags.EmulatorSession != "" {
+		emulator.DataDir, err = emulatorSessionDir(flags.EmulatorSession)
+		if err != nil {
+			return nil, nil, err
+		}
+		log.Printf("Using emulator session %s\n", flags.EmulatorSession)
+	} else if artifacts != nil {
+		emulator.DataDir = artifacts.Path("emulator")
+	}
+
+	if err := checkEmulatorCompatibility(flags.Strict); err != nil {
+		return nil, nil, err
+	}
+
+	events, unsubscribe := emulator.Subscribe()
+	go func() {
+		for event := range events {
+			if event.State == EmulatorCrashed {
+				log.Printf("Emulator crashed: %v\n", event.Err)
+			}
+		}
+	}()
+
+	if err := emulator.Start(ctx); err != nil {
+		unsubscribe()
+		return nil, nil, fmt.Errorf("failed to start emulator: %v", err)
+	}
+	return emulator, func() {
+		emulator.Stop()
+		unsubscribe()
+	}, nil
+}
@@ -0,0 +1,14 @@
+package main
+
+import "os"
+
+// emulatorHostEnv is the variable Google's client libraries and tools read
+// the address of a running emulator from. Using a running emulator needs no
+// emulator support, so it also works in builds with the noemulator tag.
+const emulatorHostEnv = "PUBSUB_EMULATOR_HOST"
+
+// runningEmulatorHost returns the address of an emulator started outside
+// this run, if PUBSUB_EMULATOR_HOST is set.
+func runningEmulatorHost() string {
+	return os.Getenv(emulatorHostEnv)
+}
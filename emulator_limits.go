@@ -0,0 +1,48 @@
+//go:build !noemulator
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EmulatorLimits keep a local emulator that runs away from starving the
+// batch workers on the same machine. The zero value leaves it unlimited.
+type EmulatorLimits struct {
+	// Nice lowers the emulator's CPU priority, from 1 to 19 like nice(1).
+	// On Linux its IO priority follows, unless the IO scheduler ignores it.
+	Nice int
+	// CPUs caps the CPU time of the emulator, in cores.
+	CPUs float64
+	// MemoryMB caps the memory of the emulator.
+	MemoryMB int
+}
+
+func (l EmulatorLimits) validate() error {
+	if l.Nice < 0 || l.Nice > 19 {
+		return fmt.Errorf("emulator-nice must be between 0 and 19")
+	}
+	if l.CPUs < 0 || l.MemoryMB < 0 {
+		return fmt.Errorf("emulator-cpus and emulator-memory-mb cannot be negative")
+	}
+	return nil
+}
+
+func (l EmulatorLimits) isSet() bool {
+	return l.Nice > 0 || l.CPUs > 0 || l.MemoryMB > 0
+}
+
+func (l EmulatorLimits) String() string {
+	var limits []string
+	if l.Nice > 0 {
+		limits = append(limits, fmt.Sprintf("nice %d", l.Nice))
+	}
+	if l.CPUs > 0 {
+		limits = append(limits, fmt.Sprintf("%g CPUs", l.CPUs))
+	}
+	if l.MemoryMB > 0 {
+		limits = append(limits, fmt.Sprintf("%d MB of memory", l.MemoryMB))
+	}
+	return strings.Join(limits, ", ")
+}
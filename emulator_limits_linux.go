@@ -0,0 +1,153 @@
+//go:build !noemulator
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// cgroupRoot is where the cgroup v2 hierarchy is mounted.
+const cgroupRoot = "/sys/fs/cgroup"
+
+// emulatorLimiter starts the emulator in a cgroup of its own, next to a leaf
+// cgroup t360 moves to, capping the CPU and memory of the gcloud wrapper and the
+// Java server it starts together.
+type emulatorLimiter struct {
+	cgroup string
+	dir    *os.File
+}
+
+func limitEmulator(cmd *exec.Cmd, limits EmulatorLimits) (*emulatorLimiter, error) {
+	lowerPriority(cmd, limits.Nice)
+	if limits.CPUs == 0 && limits.MemoryMB == 0 {
+		return nil, nil
+	}
+
+	cgroup, err := createEmulatorCgroup(limits)
+	if err != nil {
+		return nil, fmt.Errorf("failed to limit the emulator's CPU and memory: %v", err)
+	}
+	dir, err := os.Open(cgroup)
+	if err != nil {
+		os.Remove(cgroup)
+		return nil, fmt.Errorf("failed to limit the emulator's CPU and memory: %v", err)
+	}
+	cmd.SysProcAttr.UseCgroupFD = true
+	cmd.SysProcAttr.CgroupFD = int(dir.Fd())
+	return &emulatorLimiter{cgroup: cgroup, dir: dir}, nil
+}
+
+func createEmulatorCgroup(limits EmulatorLimits) (string, error) {
+	own, err := ownCgroup()
+	if err != nil {
+		return "", err
+	}
+	parent := filepath.Join(cgroupRoot, own)
+	// A cgroup that holds processes can't enable controllers for its
+	// children, except the root, so the processes move to a leaf first.
+	if own != "/" {
+		if err := moveToLeaf(parent); err != nil {
+			return "", fmt.Errorf("cannot move t360 to a leaf cgroup below %s, t360 needs a delegated cgroup: %v", parent, err)
+		}
+	}
+
+	var controllers []string
+	if limits.CPUs > 0 {
+		controllers = append(controllers, "+cpu")
+	}
+	if limits.MemoryMB > 0 {
+		controllers = append(controllers, "+memory")
+	}
+	if err := os.WriteFile(filepath.Join(parent, "cgroup.subtree_control"), []byte(strings.Join(controllers, " ")), 0644); err != nil {
+		return "", fmt.Errorf("cannot enable the cpu and memory controllers below %s, t360 needs a delegated cgroup: %v", parent, err)
+	}
+
+	cgroup := filepath.Join(parent, fmt.Sprintf("t360-emulator-%d", os.Getpid()))
+	if err := os.Mkdir(cgroup, 0755); err != nil && !os.IsExist(err) {
+		return "", err
+	}
+	if limits.CPUs > 0 {
+		const period = 100000
+		quota := max(int(limits.CPUs*period), 1000)
+		if err := os.WriteFile(filepath.Join(cgroup, "cpu.max"), []byte(fmt.Sprintf("%d %d", quota, period)), 0644); err != nil {
+			os.Remove(cgroup)
+			return "", err
+		}
+	}
+	if limits.MemoryMB > 0 {
+		if err := os.WriteFile(filepath.Join(cgroup, "memory.max"), []byte(fmt.Sprintf("%d", limits.MemoryMB<<20)), 0644); err != nil {
+			os.Remove(cgroup)
+			return "", err
+		}
+	}
+	return cgroup, nil
+}
+
+// moveToLeaf moves the processes of a cgroup, t360 and any started with it,
+// to its child cgroup "leaf".
+func moveToLeaf(parent string) error {
+	procs, err := os.ReadFile(filepath.Join(parent, "cgroup.procs"))
+	if err != nil {
+		return err
+	}
+	pids := strings.Fields(string(procs))
+	if len(pids) == 0 {
+		return nil
+	}
+	leaf := filepath.Join(parent, "leaf")
+	if err := os.Mkdir(leaf, 0755); err != nil && !os.IsExist(err) {
+		return err
+	}
+	for _, pid := range pids {
+		err := os.WriteFile(filepath.Join(leaf, "cgroup.procs"), []byte(pid), 0644)
+		// Processes that exited meanwhile can't be moved.
+		if err != nil && !errors.Is(err, syscall.ESRCH) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownCgroup returns the cgroup v2 path of t360.
+func ownCgroup() (string, error) {
+	if _, err := os.Stat(filepath.Join(cgroupRoot, "cgroup.controllers")); err != nil {
+		return "", fmt.Errorf("cgroup v2 is not mounted at %s", cgroupRoot)
+	}
+	file, err := os.Open("/proc/self/cgroup")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if path, ok := strings.CutPrefix(scanner.Text(), "0::"); ok {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("t360 is not in a cgroup v2 cgroup")
+}
+
+// started is called once the emulator runs in its cgroup.
+func (l *emulatorLimiter) started(cmd *exec.Cmd) error {
+	if l != nil && l.dir != nil {
+		l.dir.Close()
+		l.dir = nil
+	}
+	return nil
+}
+
+// close removes the cgroup after the emulator exited.
+func (l *emulatorLimiter) close() {
+	if l == nil {
+		return
+	}
+	l.started(nil)
+	os.Remove(l.cgroup)
+}
@@ -0,0 +1,26 @@
+//go:build !linux && !windows && !noemulator
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// emulatorLimiter only lowers the emulator's priority: capping its CPU and
+// memory needs the cgroups of Linux.
+type emulatorLimiter struct{}
+
+func limitEmulator(cmd *exec.Cmd, limits EmulatorLimits) (*emulatorLimiter, error) {
+	if limits.CPUs > 0 || limits.MemoryMB > 0 {
+		return nil, fmt.Errorf("emulator-cpus and emulator-memory-mb are only supported on Linux and Windows")
+	}
+	lowerPriority(cmd, limits.Nice)
+	return nil, nil
+}
+
+func (l *emulatorLimiter) started(cmd *exec.Cmd) error {
+	return nil
+}
+
+func (l *emulatorLimiter) close() {}
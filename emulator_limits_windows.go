@@ -0,0 +1,136 @@
+//go:build !noemulator
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// jobObjectCPURateControl is JOBOBJECT_CPU_RATE_CONTROL_INFORMATION, with a
+// hard cap on the CPU rate of the job.
+type jobObjectCPURateControl struct {
+	ControlFlags uint32
+	CPURate      uint32
+}
+
+const (
+	jobObjectCPURateControlInformation = 15
+	jobObjectCPURateControlEnable      = 0x1
+	jobObjectCPURateControlHardCap     = 0x4
+)
+
+// emulatorLimiter puts the emulator in a job object, which limits the
+// gcloud wrapper and the Java server it starts together.
+type emulatorLimiter struct {
+	job windows.Handle
+}
+
+func limitEmulator(cmd *exec.Cmd, limits EmulatorLimits) (*emulatorLimiter, error) {
+	if !limits.isSet() {
+		return nil, nil
+	}
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create job object for the emulator: %v", err)
+	}
+	l := &emulatorLimiter{job: job}
+	// The emulator starts suspended and only runs once it is in the job, so
+	// nothing it starts can escape the limits.
+	cmd.SysProcAttr.CreationFlags |= windows.CREATE_SUSPENDED
+
+	var info windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION
+	if limits.Nice > 0 {
+		// Windows has no nice levels: the lower half gets the below
+		// normal priority class, the upper half idle.
+		info.BasicLimitInformation.LimitFlags |= windows.JOB_OBJECT_LIMIT_PRIORITY_CLASS
+		info.BasicLimitInformation.PriorityClass = windows.BELOW_NORMAL_PRIORITY_CLASS
+		if limits.Nice >= 10 {
+			info.BasicLimitInformation.PriorityClass = windows.IDLE_PRIORITY_CLASS
+		}
+	}
+	if limits.MemoryMB > 0 {
+		info.BasicLimitInformation.LimitFlags |= windows.JOB_OBJECT_LIMIT_JOB_MEMORY
+		info.JobMemoryLimit = uintptr(limits.MemoryMB) << 20
+	}
+	if info.BasicLimitInformation.LimitFlags != 0 {
+		if _, err := windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation, uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info))); err != nil {
+			l.close()
+			return nil, fmt.Errorf("failed to limit the emulator: %v", err)
+		}
+	}
+
+	if limits.CPUs > 0 {
+		// The rate is in hundredths of a percent of all processors.
+		rate := jobObjectCPURateControl{
+			ControlFlags: jobObjectCPURateControlEnable | jobObjectCPURateControlHardCap,
+			CPURate:      uint32(min(max(limits.CPUs/float64(runtime.NumCPU())*10000, 1), 10000)),
+		}
+		if _, err := windows.SetInformationJobObject(job, jobObjectCPURateControlInformation, uintptr(unsafe.Pointer(&rate)), uint32(unsafe.Sizeof(rate))); err != nil {
+			l.close()
+			return nil, fmt.Errorf("failed to limit the emulator's CPU: %v", err)
+		}
+	}
+	return l, nil
+}
+
+// started assigns the suspended emulator to the job and resumes it. The Java
+// server it starts is then assigned with it.
+func (l *emulatorLimiter) started(cmd *exec.Cmd) error {
+	if l == nil {
+		return nil
+	}
+	pid := uint32(cmd.Process.Pid)
+	process, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE, false, pid)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(process)
+	if err := windows.AssignProcessToJobObject(l.job, process); err != nil {
+		return err
+	}
+	return resumeProcess(pid)
+}
+
+// resumeProcess resumes the threads of a process started suspended.
+func resumeProcess(pid uint32) error {
+	snapshot, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPTHREAD, 0)
+	if err != nil {
+		return err
+	}
+	defer windows.CloseHandle(snapshot)
+
+	entry := windows.ThreadEntry32{Size: uint32(unsafe.Sizeof(windows.ThreadEntry32{}))}
+	resumed := 0
+	for err = windows.Thread32First(snapshot, &entry); err == nil; err = windows.Thread32Next(snapshot, &entry) {
+		if entry.OwnerProcessID != pid {
+			continue
+		}
+		thread, err := windows.OpenThread(windows.THREAD_SUSPEND_RESUME, false, entry.ThreadID)
+		if err != nil {
+			return err
+		}
+		_, err = windows.ResumeThread(thread)
+		windows.CloseHandle(thread)
+		if err != nil {
+			return err
+		}
+		resumed++
+	}
+	if resumed == 0 {
+		return fmt.Errorf("no thread of process %d to resume", pid)
+	}
+	return nil
+}
+
+func (l *emulatorLimiter) close() {
+	if l == nil || l.job == 0 {
+		return
+	}
+	windows.CloseHandle(l.job)
+	l.job = 0
+}
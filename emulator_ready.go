@@ -0,0 +1,108 @@
+//go:build !noemulator
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// defaultReadyPatterns match the line the emulator logs once it accepts
+// connections, in the languages and SDK versions it is known to log it in.
+var defaultReadyPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`Server started`),
+	regexp.MustCompile(`(?i)listening on (port )?\d+`),
+	regexp.MustCompile(`Servidor iniciado`),
+	regexp.MustCompile(`Serveur démarré`),
+	regexp.MustCompile(`Server gestartet`),
+	regexp.MustCompile(`Server avviato`),
+	regexp.MustCompile(`サーバーが起動しました`),
+}
+
+// readyPatternList collects -emulator-ready-pattern flags.
+type readyPatternList []*regexp.Regexp
+
+func (l *readyPatternList) String() string {
+	patterns := make([]string, len(*l))
+	for i, pattern := range *l {
+		patterns[i] = pattern.String()
+	}
+	return strings.Join(patterns, ",")
+}
+
+func (l *readyPatternList) Set(value string) error {
+	pattern, err := regexp.Compile(value)
+	if err != nil {
+		return fmt.Errorf("invalid ready pattern: %v", err)
+	}
+	*l = append(*l, pattern)
+	return nil
+}
+
+// emulatorProbeDelay is how long the port probe waits after the emulator
+// starts, so the ready line is used when it is recognized.
+const emulatorProbeDelay = 2 * time.Second
+
+// checkPortFree fails when another process already listens on the
+// emulator's port. The port probe would otherwise take that process for our
+// emulator, and the run would publish to it and kill it when stopping.
+func checkPortFree(hostPort string) error {
+	listener, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		return fmt.Errorf("emulator port %s is already in use by another process: %v", hostPort, err)
+	}
+	return listener.Close()
+}
+
+// isReadyLine reports whether an output line announces the emulator is ready.
+func (em *PubSubEmulator) isReadyLine(line string) bool {
+	patterns := em.ReadyPatterns
+	if len(patterns) == 0 {
+		patterns = defaultReadyPatterns
+	}
+	for _, pattern := range patterns {
+		if pattern.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// probePort signals readyCh once the emulator's port accepts connections,
+// for emulators whose ready line doesn't match any pattern. The port was free
+// when the emulator was launched, so while our process runs, whatever
+// accepts on it is our emulator.
+func (em *PubSubEmulator) probePort(readyCh chan struct{}, stop <-chan struct{}) {
+	select {
+	case <-time.After(emulatorProbeDelay):
+	case <-stop:
+		return
+	}
+
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		conn, err := net.DialTimeout("tcp", em.hostPort, time.Second)
+		if err == nil {
+			conn.Close()
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			select {
+			case readyCh <- struct{}{}:
+			default:
+			}
+			return
+		}
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
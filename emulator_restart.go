@@ -0,0 +1,97 @@
+//go:build !noemulator
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// maxRestartBackoff caps the wait before relaunching a crashed emulator.
+const maxRestartBackoff = time.Minute
+
+// restartAfterCrash relaunches a crashed emulator when MaxRestarts allows
+// it, waiting RestartBackoff before the first attempt and twice as long
+// before each next one, and runs OnRestart once it is ready again. It is
+// called with the mutex held.
+func (em *PubSubEmulator) restartAfterCrash() {
+	if em.closed || em.restarts >= em.MaxRestarts {
+		return
+	}
+	em.restarts++
+	attempt := em.restarts
+
+	backoff := em.RestartBackoff << (attempt - 1)
+	if backoff <= 0 || backoff > maxRestartBackoff {
+		backoff = maxRestartBackoff
+	}
+	go func() {
+		fmt.Printf("Restarting Pub/Sub emulator in %s (restart %d of %d)...\n", backoff, attempt, em.MaxRestarts)
+		time.Sleep(backoff)
+		onRestart, err := em.restart()
+		if err != nil {
+			fmt.Printf("Failed to restart Pub/Sub emulator: %v\n", err)
+			em.mutex.Lock()
+			em.restartAfterCrash()
+			em.mutex.Unlock()
+			return
+		}
+		if onRestart != nil {
+			if err := onRestart(context.Background()); err != nil {
+				fmt.Printf("Failed to set up the restarted Pub/Sub emulator: %v\n", err)
+			}
+		}
+	}()
+}
+
+// restart relaunches the emulator and returns its OnRestart.
+func (em *PubSubEmulator) restart() (func(ctx context.Context) error, error) {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+
+	if em.closed {
+		return nil, nil
+	}
+	if err := em.prepareCommand(); err != nil {
+		return nil, err
+	}
+	readyCh, errorCh := em.startMonitoring(context.Background())
+	if readyCh == nil {
+		return nil, fmt.Errorf("failed to launch emulator")
+	}
+	if err := em.waitForEmulator(context.Background(), readyCh, errorCh); err != nil {
+		return nil, err
+	}
+	return em.OnRestart, nil
+}
+
+// setUpRestartedEmulator creates the topics of the run, and the configured
+// subscriptions, in an emulator relaunched after a crash, which has lost them.
+// Fixture messages are not published again.
+func setUpRestartedEmulator(ctx context.Context, config *Config) error {
+	if err := clientFactory.recreateTopics(ctx); err != nil {
+		return err
+	}
+	if config != nil && config.PubSub != nil {
+		return bootstrapPubSub(ctx, config.PubSub)
+	}
+	return nil
+}
+
+// RecreateOnRestart sets up an emulator relaunched after a crash with the
+// topics of the run and the subscriptions of config.
+func (em *PubSubEmulator) RecreateOnRestart(config *Config) {
+	if em.MaxRestarts > 0 {
+		em.SetOnRestart(func(ctx context.Context) error {
+			return setUpRestartedEmulator(ctx, config)
+		})
+	}
+}
+
+// SetOnRestart sets OnRestart on an emulator that is already running.
+func (em *PubSubEmulator) SetOnRestart(onRestart func(ctx context.Context) error) {
+	em.mutex.Lock()
+	defer em.mutex.Unlock()
+	em.OnRestart = onRestart
+}
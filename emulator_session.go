@@ -0,0 +1,146 @@
+//go:build !noemulator
+
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// Named emulator sessions keep their data in the user cache directory rather
+// than the temp directory, so topics, subscriptions and messages survive
+// between runs and are not removed by emulator clean.
+
+var sessionName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]*$`)
+
+type emulatorSession struct {
+	Name     string
+	Path     string
+	LastUsed time.Time
+	Size     int64
+}
+
+func emulatorSessionsDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", fmt.Errorf("no cache directory for emulator sessions: %v", err)
+	}
+	return filepath.Join(dir, "t360", "emulator-sessions"), nil
+}
+
+func validateSessionName(name string) error {
+	if !sessionName.MatchString(name) {
+		return fmt.Errorf("invalid emulator session name %q: use letters, digits, '.', '_' and '-'", name)
+	}
+	return nil
+}
+
+// emulatorSessionDir returns the data directory of a session and marks the
+// session as used now.
+func emulatorSessionDir(name string) (string, error) {
+	if err := validateSessionName(name); err != nil {
+		return "", err
+	}
+	dir, err := emulatorSessionsDir()
+	if err != nil {
+		return "", err
+	}
+
+	path := filepath.Join(dir, name)
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return "", fmt.Errorf("failed to create emulator session: %v", err)
+	}
+	now := time.Now()
+	os.Chtimes(path, now, now)
+	return path, nil
+}
+
+func listEmulatorSessions() ([]emulatorSession, error) {
+	dir, err := emulatorSessionsDir()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []emulatorSession{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]emulatorSession, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+		session := emulatorSession{
+			Name:     entry.Name(),
+			Path:     filepath.Join(dir, entry.Name()),
+			LastUsed: info.ModTime(),
+		}
+		filepath.WalkDir(session.Path, func(path string, d fs.DirEntry, err error) error {
+			if err == nil && !d.IsDir() {
+				if info, err := d.Info(); err == nil {
+					session.Size += info.Size()
+				}
+			}
+			return nil
+		})
+		sessions = append(sessions, session)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].Name < sessions[j].Name })
+	return sessions, nil
+}
+
+func deleteEmulatorSession(name string) error {
+	if err := validateSessionName(name); err != nil {
+		return err
+	}
+	dir, err := emulatorSessionsDir()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return fmt.Errorf("no emulator session named %s", name)
+	}
+	return os.RemoveAll(path)
+}
+
+func runSessionsCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: t360 emulator sessions list|delete <name>")
+	}
+
+	switch args[0] {
+	case "list":
+		sessions, err := listEmulatorSessions()
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "NAME\tLAST USED\tSIZE\tPATH")
+		for _, session := range sessions {
+			fmt.Fprintf(w, "%s\t%s\t%.1f MB\t%s\n", session.Name, session.LastUsed.Format("2006-01-02 15:04"),
+				float64(session.Size)/(1<<20), session.Path)
+		}
+		return w.Flush()
+	case "delete":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: t360 emulator sessions delete <name>")
+		}
+		if err := deleteEmulatorSession(args[1]); err != nil {
+			return err
+		}
+		fmt.Printf("Deleted emulator session %s\n", args[1])
+		return nil
+	}
+	return fmt.Errorf("unknown sessions command: %s", args[0])
+}
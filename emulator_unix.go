@@ -0,0 +1,47 @@
+//go:build !windows && !noemulator
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"strconv"
+	"syscall"
+)
+
+// startInProcessGroup runs the emulator in its own process group, so the
+// gcloud wrapper and the Java server it starts can be signalled together.
+func startInProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// interruptEmulator asks the emulator to shut down cleanly, like Ctrl+C in
+// the terminal it was started from.
+func interruptEmulator(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGINT)
+}
+
+func killEmulator(cmd *exec.Cmd) error {
+	return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+}
+
+// lowerPriority runs the emulator through nice(1), so the Java server the
+// gcloud wrapper starts is niced too.
+func lowerPriority(cmd *exec.Cmd, nice int) {
+	if nice == 0 || cmd.Err != nil {
+		return
+	}
+	path, err := exec.LookPath("nice")
+	if err != nil {
+		fmt.Printf("Warning: nice not found, the emulator runs at normal priority: %v\n", err)
+		return
+	}
+	cmd.Args = append([]string{"nice", "-n", strconv.Itoa(nice), cmd.Path}, cmd.Args[1:]...)
+	cmd.Path = path
+}
+
+// processRunning reports whether a process with the ID exists.
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
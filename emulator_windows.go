@@ -0,0 +1,52 @@
+//go:build windows && !noemulator
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/windows"
+)
+
+// startInProcessGroup runs the emulator in its own process group, so it can
+// be sent a Ctrl+Break without also stopping t360.
+func startInProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: syscall.CREATE_NEW_PROCESS_GROUP}
+}
+
+// interruptEmulator asks the emulator to shut down cleanly by sending its
+// process group a Ctrl+Break.
+func interruptEmulator(cmd *exec.Cmd) error {
+	kernel32, err := syscall.LoadDLL("kernel32.dll")
+	if err != nil {
+		return err
+	}
+	proc, err := kernel32.FindProc("GenerateConsoleCtrlEvent")
+	if err != nil {
+		return err
+	}
+	if r, _, err := proc.Call(syscall.CTRL_BREAK_EVENT, uintptr(cmd.Process.Pid)); r == 0 {
+		return err
+	}
+	return nil
+}
+
+func killEmulator(cmd *exec.Cmd) error {
+	return exec.Command("taskkill", "/F", "/T", "/PID", fmt.Sprintf("%d", cmd.Process.Pid)).Run()
+}
+
+// processRunning reports whether a process with the ID is running.
+func processRunning(pid int) bool {
+	process, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		return false
+	}
+	defer windows.CloseHandle(process)
+	var code uint32
+	return windows.GetExitCodeProcess(process, &code) == nil && code == stillActive
+}
+
+// stillActive is the exit code of a process that hasn't exited.
+const stillActive = 259
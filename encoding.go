@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+	"github.com/costinul/transfer360-test/transfer360"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	encodingJSON  = "json"
+	encodingAvro  = "avro"
+	encodingProto = "proto"
+)
+
+// messageEncoding is how contraventions are serialized. The Avro and
+// Protobuf encodings follow the schemas in the schemas directory.
+var messageEncoding = encodingJSON
+
+func contentTypeAttribute() string {
+	switch messageEncoding {
+	case encodingAvro:
+		return "avro/binary"
+	case encodingProto:
+		return "application/x-protobuf"
+	}
+	return "application/json"
+}
+
+// encodeAvro writes a contravention in the Avro binary encoding of
+// schemas/contravention.avsc.
+func encodeAvro(contravention *VehicleContravention) []byte {
+	b := make([]byte, 0, 256)
+
+	writeLong := func(n int64) {
+		b = binary.AppendVarint(b, n)
+	}
+	writeString := func(s string) {
+		writeLong(int64(len(s)))
+		b = append(b, s...)
+	}
+
+	writeString(contravention.Reference)
+	writeString(contravention.VRM)
+	writeString(contravention.ContraventionDate)
+	if contravention.IsHirerVehicle {
+		b = append(b, 1)
+	} else {
+		b = append(b, 0)
+	}
+
+	lease := contravention.LeaseCompany
+	writeString(lease.CompanyName)
+	writeString(lease.AddressLine1)
+	writeString(lease.AddressLine2)
+	writeString(lease.AddressLine3)
+	writeString(lease.AddressLine4)
+	writeString(lease.Postcode)
+
+	b = binary.LittleEndian.AppendUint64(b, math.Float64bits(contravention.Score()))
+	return b
+}
+
+// contraventionDescriptor describes the message in schemas/contravention.proto.
+var contraventionDescriptor = sync.OnceValues(func() (protoreflect.MessageDescriptor, error) {
+	stringField := func(name string, number int32) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:     proto.String(name),
+			JsonName: proto.String(name),
+			Number:   proto.Int32(number),
+			Label:    descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+			Type:     descriptorpb.FieldDescriptorProto_TYPE_STRING.Enum(),
+		}
+	}
+	field := func(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		f := stringField(name, number)
+		f.Type = kind.Enum()
+		return f
+	}
+
+	leaseCompany := field("lease_company", 5, descriptorpb.FieldDescriptorProto_TYPE_MESSAGE)
+	leaseCompany.TypeName = proto.String(".t360.v1.LeaseCompany")
+
+	file := &descriptorpb.FileDescriptorProto{
+		Name:    proto.String("contravention.proto"),
+		Package: proto.String("t360.v1"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{
+			{
+				Name: proto.String("LeaseCompany"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					stringField("companyname", 1),
+					stringField("address_line1", 2),
+					stringField("address_line2", 3),
+					stringField("address_line3", 4),
+					stringField("address_line4", 5),
+					stringField("postcode", 6),
+				},
+			},
+			{
+				Name: proto.String("VehicleContravention"),
+				Field: []*descriptorpb.FieldDescriptorProto{
+					stringField("reference", 1),
+					stringField("vrm", 2),
+					stringField("contravention_date", 3),
+					field("is_hirer_vehicle", 4, descriptorpb.FieldDescriptorProto_TYPE_BOOL),
+					leaseCompany,
+					field("confidence", 6, descriptorpb.FieldDescriptorProto_TYPE_DOUBLE),
+				},
+			},
+		},
+	}
+
+	descriptor, err := protodesc.NewFile(file, nil)
+	if err != nil {
+		return nil, err
+	}
+	return descriptor.Messages().ByName("VehicleContravention"), nil
+})
+
+func encodeProto(contravention *VehicleContravention) ([]byte, error) {
+	descriptor, err := contraventionDescriptor()
+	if err != nil {
+		return nil, fmt.Errorf("invalid contravention descriptor: %v", err)
+	}
+
+	message := dynamicpb.NewMessage(descriptor)
+	fields := descriptor.Fields()
+	message.Set(fields.ByName("reference"), protoreflect.ValueOfString(contravention.Reference))
+	message.Set(fields.ByName("vrm"), protoreflect.ValueOfString(contravention.VRM))
+	message.Set(fields.ByName("contravention_date"), protoreflect.ValueOfString(contravention.ContraventionDate))
+	message.Set(fields.ByName("is_hirer_vehicle"), protoreflect.ValueOfBool(contravention.IsHirerVehicle))
+	message.Set(fields.ByName("confidence"), protoreflect.ValueOfFloat64(contravention.Score()))
+
+	leaseField := fields.ByName("lease_company")
+	lease := message.Mutable(leaseField).Message()
+	leaseFields := leaseField.Message().Fields()
+	leaseValues := map[protoreflect.Name]string{
+		"companyname":   contravention.LeaseCompany.CompanyName,
+		"address_line1": contravention.LeaseCompany.AddressLine1,
+		"address_line2": contravention.LeaseCompany.AddressLine2,
+		"address_line3": contravention.LeaseCompany.AddressLine3,
+		"address_line4": contravention.LeaseCompany.AddressLine4,
+		"postcode":      contravention.LeaseCompany.Postcode,
+	}
+	for name, value := range leaseValues {
+		lease.Set(leaseFields.ByName(name), protoreflect.ValueOfString(value))
+	}
+
+	return proto.Marshal(message)
+}
+
+// checkTopicSchema makes sure the messages we publish will be accepted when
+// the topic enforces a schema. A sample message is validated against the
+// schema so that a schema that doesn't match ours fails before the run
+// rather than on the first hit.
+func checkTopicSchema(ctx context.Context, topic *pubsub.Topic) error {
+	topicName := topic.ID()
+	config, err := topic.Config(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read topic %s: %v", topicName, err)
+	}
+	settings := config.SchemaSettings
+	if settings == nil || settings.Schema == "" {
+		return nil
+	}
+
+	schemaID := settings.Schema[strings.LastIndex(settings.Schema, "/")+1:]
+	if messageEncoding == encodingJSON {
+		return fmt.Errorf("topic %s enforces schema %s, use -encoding avro or proto", topicName, schemaID)
+	}
+	if settings.Encoding != pubsub.EncodingBinary {
+		return fmt.Errorf("topic %s must use binary schema encoding for -encoding %s", topicName, messageEncoding)
+	}
+
+	// The schema may belong to the project of the topic.
+	schemaProject := ""
+	if parts := strings.Split(settings.Schema, "/"); len(parts) == 4 && parts[0] == "projects" {
+		schemaProject = parts[1]
+	}
+	schemaClient, err := clientFactory.CreateSchemaClient(ctx, schemaProject)
+	if err != nil {
+		return fmt.Errorf("failed to create schema client: %v", err)
+	}
+	defer schemaClient.Close()
+
+	schema, err := schemaClient.Schema(ctx, schemaID, pubsub.SchemaViewBasic)
+	if err != nil {
+		return fmt.Errorf("failed to read schema %s: %v", schemaID, err)
+	}
+	expected := pubsub.SchemaAvro
+	if messageEncoding == encodingProto {
+		expected = pubsub.SchemaProtocolBuffer
+	}
+	if schema.Type != expected {
+		return fmt.Errorf("schema %s of topic %s does not match -encoding %s", schemaID, topicName, messageEncoding)
+	}
+
+	sample, err := encodeMessage(&VehicleContravention{Contravention: transfer360.Contravention{
+		Reference:         "00000000-0000-0000-0000-000000000000",
+		VRM:               "AB12CDE",
+		ContraventionDate: "2024-01-01T00:00:00Z",
+		IsHirerVehicle:    true,
+	}})
+	if err != nil {
+		return err
+	}
+	if _, err := schemaClient.ValidateMessageWithID(ctx, sample, pubsub.EncodingBinary, schemaID); err != nil {
+		return fmt.Errorf("messages are not compatible with schema %s of topic %s: %v", schemaID, topicName, err)
+	}
+	return nil
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/costinul/transfer360-test/transfer360"
+)
+
+const (
+	envelopeV1 = "v1"
+	envelopeV2 = "v2"
+
+	producerName = transfer360.ProducerName
+)
+
+// MessageEnvelope is the v2 message format. v1 messages are the bare
+// VehicleContravention, which is what existing consumers expect.
+type MessageEnvelope struct {
+	SchemaVersion int                   `json:"schema_version"`
+	ProducedAt    time.Time             `json:"produced_at"`
+	Producer      string                `json:"producer"`
+	Data          *VehicleContravention `json:"data"`
+}
+
+var envelopeVersion = envelopeV1
+
+func encodeMessage(contravention *VehicleContravention) ([]byte, error) {
+	switch messageEncoding {
+	case encodingAvro:
+		return encodeAvro(contravention), nil
+	case encodingProto:
+		return encodeProto(contravention)
+	}
+
+	if envelopeVersion == envelopeV2 {
+		return json.Marshal(MessageEnvelope{
+			SchemaVersion: 2,
+			ProducedAt:    stampTime(),
+			Producer:      producerName,
+			Data:          contravention,
+		})
+	}
+	return json.Marshal(contravention)
+}
+
+func schemaVersionAttribute() string {
+	if envelopeVersion == envelopeV2 {
+		return "2"
+	}
+	return "1"
+}
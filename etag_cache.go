@@ -0,0 +1,112 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ETagCache keeps the responses of sources that send an ETag, keyed by the
+// source and the request body (so by VRM and date). Later searches for the
+// same vehicle send the ETag in If-None-Match, and a 304 Not Modified is
+// answered from the cache, so repeated backfills don't make providers build
+// the same response again. Responses are kept for maxAge after they were
+// stored, so the file doesn't grow forever.
+type ETagCache struct {
+	db     *bolt.DB
+	maxAge time.Duration
+}
+
+type etagEntry struct {
+	ETag     string    `json:"etag"`
+	Body     []byte    `json:"body"`
+	StoredAt time.Time `json:"stored_at"`
+}
+
+// etags is nil unless -etag-cache is set.
+var etags *ETagCache
+
+var etagBucket = []byte("etags")
+
+func OpenETagCache(path string, maxAge time.Duration) (*ETagCache, error) {
+	db, err := openBolt(path, "ETag cache")
+	if err != nil {
+		return nil, err
+	}
+	cache := &ETagCache{db: db, maxAge: maxAge}
+	if err := cache.prune(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open ETag cache %s: %v", path, err)
+	}
+	return cache, nil
+}
+
+// prune removes the responses stored more than maxAge ago.
+func (c *ETagCache) prune() error {
+	return c.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(etagBucket)
+		if err != nil {
+			return err
+		}
+		expired := make([][]byte, 0)
+		bucket.ForEach(func(key, value []byte) error {
+			var cached etagEntry
+			if json.Unmarshal(value, &cached) != nil || c.expired(cached) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (c *ETagCache) expired(entry etagEntry) bool {
+	return time.Since(entry.StoredAt) > c.maxAge
+}
+
+// etagCacheKey identifies a search request of a source.
+func etagCacheKey(source DataSource, body []byte) []byte {
+	sum := sha256.Sum256(body)
+	return []byte(source.ID() + "\x00" + hex.EncodeToString(sum[:]))
+}
+
+// Get returns the cached response for a key, or nil.
+func (c *ETagCache) Get(key []byte) *etagEntry {
+	var entry *etagEntry
+	c.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(etagBucket).Get(key)
+		if value == nil {
+			return nil
+		}
+		var cached etagEntry
+		if json.Unmarshal(value, &cached) == nil && cached.ETag != "" && !c.expired(cached) {
+			entry = &cached
+		}
+		return nil
+	})
+	return entry
+}
+
+// Put stores a response with its ETag.
+func (c *ETagCache) Put(key []byte, etag string, body []byte) error {
+	value, err := json.Marshal(etagEntry{ETag: etag, Body: body, StoredAt: time.Now()})
+	if err != nil {
+		return err
+	}
+	return c.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(etagBucket).Put(key, value)
+	})
+}
+
+func (c *ETagCache) Close() error {
+	return c.db.Close()
+}
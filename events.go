@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	eventRecordStarted   = "record_started"
+	eventRecordCompleted = "record_completed"
+	eventPublishOK       = "publish_ok"
+	eventPublishFailed   = "publish_failed"
+)
+
+// Event is a line of the event stream.
+type Event struct {
+	Event             string    `json:"event"`
+	Time              time.Time `json:"time"`
+	RunID             string    `json:"run_id"`
+	VRM               string    `json:"vrm"`
+	Company           string    `json:"company,omitempty"`
+	ContraventionDate string    `json:"contravention_date,omitempty"`
+	DateFrom          string    `json:"date_from,omitempty"`
+	DateTo            string    `json:"date_to,omitempty"`
+	LeaseCompany      string    `json:"lease_company,omitempty"`
+	Outcome           string    `json:"outcome,omitempty"`
+	Reference         string    `json:"reference,omitempty"`
+	Error             string    `json:"error,omitempty"`
+}
+
+// EventStream writes progress events as JSON lines, for orchestration
+// systems that track runs without parsing the log. A write that fails is
+// logged once and the stream is turned off, so a reader that went away
+// doesn't fail the run.
+type EventStream struct {
+	w      io.WriteCloser
+	failed bool
+	mutex  sync.Mutex
+}
+
+// events is nil unless -events is set.
+var events *EventStream
+
+// OpenEventStream opens a file, appending to it, or connects to a UNIX socket
+// given as unix:<path>.
+func OpenEventStream(target string) (*EventStream, error) {
+	if path, ok := strings.CutPrefix(target, "unix:"); ok {
+		conn, err := net.Dial("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to event socket %s: %v", path, err)
+		}
+		return &EventStream{w: conn}, nil
+	}
+	file, err := os.OpenFile(target, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event file: %v", err)
+	}
+	return &EventStream{w: file}, nil
+}
+
+func (s *EventStream) emit(event Event) {
+	event.Time = time.Now().UTC()
+	event.RunID = runID
+	event.VRM = anonymizeVRM(event.VRM)
+	event.Error = anonymizeText(event.Error)
+	data, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.failed {
+		return
+	}
+	if _, err := s.w.Write(append(data, '\n')); err != nil {
+		s.failed = true
+		log.Printf("Stopped writing events: %v\n", err)
+	}
+}
+
+func requestEvent(name string, request SearchRequest) Event {
+	return Event{
+		Event:             name,
+		VRM:               request.VRM,
+		Company:           request.Company,
+		ContraventionDate: request.ContraventionDate,
+		DateFrom:          request.DateFrom,
+		DateTo:            request.DateTo,
+	}
+}
+
+// RecordStarted reports that checking a record has started.
+func (s *EventStream) RecordStarted(request SearchRequest) {
+	s.emit(requestEvent(eventRecordStarted, request))
+}
+
+// RecordCompleted reports the outcome of a record.
+func (s *EventStream) RecordCompleted(request SearchRequest, outcome string, err error) {
+	event := requestEvent(eventRecordCompleted, request)
+	event.Outcome = outcome
+	if err != nil {
+		event.Error = err.Error()
+	}
+	s.emit(event)
+}
+
+// Published reports whether the primary sink took a result.
+func (s *EventStream) Published(contravention *VehicleContravention, err error) {
+	event := Event{
+		Event:             eventPublishOK,
+		VRM:               contravention.VRM,
+		LeaseCompany:      contravention.LeaseCompany.CompanyName,
+		ContraventionDate: contravention.ContraventionDate,
+		Reference:         contravention.Reference,
+	}
+	if err != nil {
+		event.Event = eventPublishFailed
+		event.Error = err.Error()
+	}
+	s.emit(event)
+}
+
+func (s *EventStream) Close() error {
+	return s.w.Close()
+}
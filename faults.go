@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// faultsEnv enables fault injection when -faults is not given, so it can be
+// turned on for runs started by scripts that can't be changed.
+const faultsEnv = "T360_FAULTS"
+
+// FaultInjector makes data source requests and publishes fail on purpose, at
+// the configured rates, to try out retries, timeouts, failure thresholds and
+// dead-lettering locally. It is configured with a list such as
+// "latency=0.2,delay=2s,timeout=0.05,5xx=0.1,publish=0.1".
+type FaultInjector struct {
+	latency float64
+	delay   time.Duration
+	timeout float64
+	status  float64
+	publish float64
+}
+
+// faults is nil unless -faults or T360_FAULTS is set.
+var faults *FaultInjector
+
+func ParseFaults(spec string) (*FaultInjector, error) {
+	f := &FaultInjector{delay: time.Second}
+	for _, item := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid fault %q, expected name=value", item)
+		}
+
+		if key == "delay" {
+			delay, err := time.ParseDuration(value)
+			if err != nil || delay <= 0 {
+				return nil, fmt.Errorf("invalid fault delay %q", value)
+			}
+			f.delay = delay
+			continue
+		}
+
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, fmt.Errorf("invalid rate %q for fault %s, expected 0-1", value, key)
+		}
+		switch key {
+		case "latency":
+			f.latency = rate
+		case "timeout":
+			f.timeout = rate
+		case "5xx":
+			f.status = rate
+		case "publish":
+			f.publish = rate
+		default:
+			return nil, fmt.Errorf("unknown fault %q, expected latency, delay, timeout, 5xx or publish", key)
+		}
+	}
+	return f, nil
+}
+
+func (f *FaultInjector) String() string {
+	return fmt.Sprintf("latency %.0f%% (%s), timeout %.0f%%, 5xx %.0f%%, publish %.0f%%",
+		f.latency*100, f.delay, f.timeout*100, f.status*100, f.publish*100)
+}
+
+func roll(rate float64) bool {
+	return rate > 0 && rand.Float64() < rate
+}
+
+// publishFault returns the error of a publish that should fail.
+func (f *FaultInjector) publishFault() error {
+	if f == nil || !roll(f.publish) {
+		return nil
+	}
+	return fmt.Errorf("injected publish failure")
+}
+
+// Transport injects latency, timeouts and 5xx responses into the requests of
+// a source sent through next.
+func (f *FaultInjector) Transport(source string, next http.RoundTripper) http.RoundTripper {
+	return &faultTransport{faults: f, source: source, next: next}
+}
+
+type faultTransport struct {
+	faults *FaultInjector
+	source string
+	next   http.RoundTripper
+}
+
+// injectedTimeout looks like a network timeout to os.IsTimeout once the HTTP
+// client has wrapped it.
+type injectedTimeout struct{}
+
+func (injectedTimeout) Error() string   { return "injected timeout" }
+func (injectedTimeout) Timeout() bool   { return true }
+func (injectedTimeout) Temporary() bool { return true }
+
+func (t *faultTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if roll(t.faults.latency) {
+		if err := sleepContext(req.Context(), t.faults.delay); err != nil {
+			return nil, err
+		}
+	}
+	if roll(t.faults.timeout) {
+		log.Printf("Injecting timeout into request to %s\n", t.source)
+		return nil, injectedTimeout{}
+	}
+	if roll(t.faults.status) {
+		log.Printf("Injecting 503 response into request to %s\n", t.source)
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return &http.Response{
+			Status:     "503 Service Unavailable",
+			StatusCode: http.StatusServiceUnavailable,
+			Proto:      "HTTP/1.1",
+			ProtoMajor: 1,
+			ProtoMinor: 1,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			Body:       io.NopCloser(bytes.NewReader([]byte("injected fault"))),
+			Request:    req,
+		}, nil
+	}
+	return t.next.RoundTrip(req)
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// faultsSpec returns -faults, or T360_FAULTS when the flag is not set.
+func (f *Flags) faultsSpec() string {
+	if f.Faults != "" {
+		return f.Faults
+	}
+	return os.Getenv(faultsEnv)
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FirestoreConfig are the settings of a firestore sink. Project defaults to
+// -project and Database to the default database.
+type FirestoreConfig struct {
+	Project    string `json:"project,omitempty"`
+	Database   string `json:"database,omitempty"`
+	Collection string `json:"collection"`
+}
+
+const (
+	firestoreScope       = "https://www.googleapis.com/auth/datastore"
+	firestoreEmulatorEnv = "FIRESTORE_EMULATOR_HOST"
+)
+
+func (c *FirestoreConfig) validate(name string) error {
+	if c.Collection == "" {
+		return fmt.Errorf("sink %s: firestore sinks require a collection", name)
+	}
+	if strings.Contains(c.Collection, "/") {
+		return fmt.Errorf("sink %s: collection must be a top-level collection", name)
+	}
+	return nil
+}
+
+// firestoreSink stores each result as a document keyed by its reference,
+// in the background and with as many requests in flight as the webhook sink.
+// It uses the Firestore REST API, or the emulator when FIRESTORE_EMULATOR_HOST
+// is set.
+type firestoreSink struct {
+	// ctx is the run's context, which requests are bound to.
+	ctx       context.Context
+	client    *http.Client
+	documents string
+	emulator  bool
+	slots     chan struct{}
+	wg        sync.WaitGroup
+}
+
+func newFirestoreSink(ctx context.Context, config *FirestoreConfig, flags *Flags) (*firestoreSink, error) {
+	project := config.Project
+	if project == "" {
+		project = flags.ProjectID
+	}
+	if project == "" {
+		return nil, fmt.Errorf("firestore sink requires a project, in the sink settings or -project")
+	}
+	database := config.Database
+	if database == "" {
+		database = "(default)"
+	}
+
+	base := "https://firestore.googleapis.com"
+	var client *http.Client
+	host := os.Getenv(firestoreEmulatorEnv)
+	if host != "" {
+		base = "http://" + host
+		client = &http.Client{Timeout: 10 * time.Second}
+	} else {
+		var err error
+		client, err = googleClient(ctx, flags.CredFile, firestoreScope)
+		if err != nil {
+			return nil, fmt.Errorf("firestore sink: %v", err)
+		}
+	}
+
+	documents := fmt.Sprintf("%s/v1/projects/%s/databases/%s/documents/%s",
+		base, url.PathEscape(project), url.PathEscape(database), url.PathEscape(config.Collection))
+	return &firestoreSink{
+		ctx:       ctx,
+		client:    client,
+		documents: documents,
+		emulator:  host != "",
+		slots:     make(chan struct{}, sinkRequests),
+	}, nil
+}
+
+func (s *firestoreSink) Publish(ctx context.Context, contravention *VehicleContravention, done func(error)) error {
+	body, err := json.Marshal(map[string]any{"fields": firestoreFields(contravention)})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := s.write(contravention.Reference, body)
+		<-s.slots
+		done(err)
+	}()
+	return nil
+}
+
+// write creates or replaces the document.
+func (s *firestoreSink) write(id string, body []byte) error {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPatch, s.documents+"/"+url.PathEscape(id), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.emulator {
+		// The emulator's admin token, which bypasses security rules.
+		req.Header.Set("Authorization", "Bearer owner")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to write firestore document: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("failed to write firestore document: status %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+func (s *firestoreSink) Close() error {
+	s.wg.Wait()
+	return nil
+}
+
+// firestoreFields are the fields of a result's document: the message fields,
+// with the contravention date as a timestamp so it can be queried by range,
+// and the message attributes under attributes.
+func firestoreFields(contravention *VehicleContravention) map[string]any {
+	company := contravention.LeaseCompany
+	fields := map[string]any{
+		"reference":          stringValue(contravention.Reference),
+		"vrm":                stringValue(contravention.VRM),
+		"contravention_date": stringValue(contravention.ContraventionDate),
+		"is_hirer_vehicle":   map[string]any{"booleanValue": contravention.IsHirerVehicle},
+		"confidence":         map[string]any{"doubleValue": contravention.Score()},
+		"lease_company": map[string]any{"mapValue": map[string]any{"fields": map[string]any{
+			"companyname":   stringValue(company.CompanyName),
+			"address_line1": stringValue(company.AddressLine1),
+			"address_line2": stringValue(company.AddressLine2),
+			"addres_line3":  stringValue(company.AddressLine3),
+			"addres_line4":  stringValue(company.AddressLine4),
+			"postcode":      stringValue(company.Postcode),
+		}}},
+	}
+	if vehicle := contravention.Vehicle; vehicle != nil {
+		fields["vehicle"] = map[string]any{"mapValue": map[string]any{"fields": map[string]any{
+			"make":                stringValue(vehicle.Make),
+			"colour":              stringValue(vehicle.Colour),
+			"year_of_manufacture": map[string]any{"integerValue": strconv.Itoa(vehicle.YearOfManufacture)},
+			"fuel_type":           stringValue(vehicle.FuelType),
+			"tax_status":          stringValue(vehicle.TaxStatus),
+			"tax_due_date":        stringValue(vehicle.TaxDueDate),
+			"mot_status":          stringValue(vehicle.MOTStatus),
+			"mot_expiry_date":     stringValue(vehicle.MOTExpiryDate),
+		}}}
+	}
+	if date, err := time.Parse(time.RFC3339, contravention.ContraventionDate); err == nil {
+		fields["contravention_date"] = map[string]any{"timestampValue": date.UTC().Format(time.RFC3339Nano)}
+	}
+
+	attributes := make(map[string]any)
+	for key, value := range messageAttributes(contravention) {
+		attributes[key] = stringValue(value)
+	}
+	fields["attributes"] = map[string]any{"mapValue": map[string]any{"fields": attributes}}
+	return fields
+}
+
+func stringValue(value string) map[string]any {
+	return map[string]any{"stringValue": value}
+}
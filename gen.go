@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// weightedCompany is a company of a generated batch and its share of the
+// records.
+type weightedCompany struct {
+	name   string
+	weight int
+}
+
+// runGenCommand writes a synthetic batch file for load testing, so
+// performance runs don't need an export of real cases.
+func runGenCommand(args []string) error {
+	fs := flag.NewFlagSet("gen", flag.ExitOnError)
+	count := fs.Int("count", 1000, "Number of records to generate")
+	companies := fs.String("companies", "", "Comma-separated companies, by name or source ID, each optionally weighted as company:weight (default every built-in source, equally weighted)")
+	configFile := fs.String("config", "", "Also accept the companies of the sources in this config file")
+	out := fs.String("out", "-", "File the batch is written to, - for stdout")
+	days := fs.Int("days", 90, "Spread contravention dates over this many days before today")
+	seed := fs.Int64("seed", 0, "Random seed, to generate the same batch again (0 picks one)")
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		return fmt.Errorf("usage: t360 gen [-count n] [-companies a:3,b:1] [-out file.json]")
+	}
+	if *count <= 0 {
+		return fmt.Errorf("count must be positive")
+	}
+	if *days < 1 {
+		return fmt.Errorf("days must be at least 1")
+	}
+
+	initDataSources()
+	var config *Config
+	if *configFile != "" {
+		var err error
+		config, err = loadConfig(*configFile)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %v", err)
+		}
+	}
+	weighted, err := parseWeightedCompanies(*companies, config)
+	if err != nil {
+		return err
+	}
+
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	rng := rand.New(rand.NewSource(*seed))
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	buffered := bufio.NewWriter(w)
+
+	if err := writeSyntheticBatch(buffered, rng, *count, weighted, *days); err != nil {
+		return fmt.Errorf("failed to write batch: %v", err)
+	}
+	if err := buffered.Flush(); err != nil {
+		return fmt.Errorf("failed to write batch: %v", err)
+	}
+	if *out != "-" {
+		log.Printf("Wrote %d records to %s (seed %d)\n", *count, *out, *seed)
+	}
+	return nil
+}
+
+// parseWeightedCompanies parses -companies. Source IDs are replaced by the
+// company name of the source, which is what batch records hold.
+func parseWeightedCompanies(value string, config *Config) ([]weightedCompany, error) {
+	known := knownCompanies(config)
+	if value == "" {
+		companies := make([]weightedCompany, 0, len(known))
+		for _, name := range known {
+			companies = append(companies, weightedCompany{name: name, weight: 1})
+		}
+		return companies, nil
+	}
+
+	byID := make(map[string]string)
+	for name, source := range dataSources {
+		byID[source.ID()] = name
+	}
+	if config != nil {
+		for _, source := range config.Sources {
+			if source.ID != "" {
+				byID[source.ID] = source.Company
+			}
+		}
+	}
+
+	var companies []weightedCompany
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, weight := item, 1
+		if i := strings.LastIndex(item, ":"); i >= 0 {
+			var err error
+			weight, err = strconv.Atoi(item[i+1:])
+			if err != nil || weight <= 0 {
+				return nil, fmt.Errorf("invalid weight in %q, expected a positive whole number", item)
+			}
+			name = strings.TrimSpace(item[:i])
+		}
+		if company, ok := byID[name]; ok {
+			name = company
+		}
+		if !slices.Contains(known, name) {
+			log.Printf("Warning: %s is not a known company, its records will be searched in every source\n", name)
+		}
+		companies = append(companies, weightedCompany{name: name, weight: weight})
+	}
+	if len(companies) == 0 {
+		return nil, fmt.Errorf("no companies given")
+	}
+	return companies, nil
+}
+
+// writeSyntheticBatch writes count records as a JSON array, one record per
+// line.
+func writeSyntheticBatch(w io.Writer, rng *rand.Rand, count int, companies []weightedCompany, days int) error {
+	total := 0
+	for _, company := range companies {
+		total += company.weight
+	}
+	today := time.Now()
+
+	if _, err := io.WriteString(w, "[\n"); err != nil {
+		return err
+	}
+	for i := 0; i < count; i++ {
+		pick := rng.Intn(total)
+		company := companies[0].name
+		for _, candidate := range companies {
+			if pick < candidate.weight {
+				company = candidate.name
+				break
+			}
+			pick -= candidate.weight
+		}
+
+		record := SearchRequest{
+			VRM:               syntheticVRM(rng, today),
+			Company:           company,
+			ContraventionDate: today.AddDate(0, 0, -rng.Intn(days)).Format(batchDateFormat),
+			Metadata:          map[string]string{"client_ref": fmt.Sprintf("GEN-%07d", i+1)},
+		}
+		line, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			if _, err := io.WriteString(w, ",\n"); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(line); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "\n]\n")
+	return err
+}
+
+// Letters used on UK number plates. I, Q and Z are not used in the area code
+// and I and Q are not used in the random letters.
+const (
+	areaLetters   = "ABCDEFGHJKLMNOPRSTUVWXY"
+	randomLetters = "ABCDEFGHJKLMNOPRSTUVWXYZ"
+)
+
+// syntheticVRM returns a registration in the current UK format: a two letter
+// area code, the age identifier of a registration period since 2002 (the
+// year for March, the year plus 50 for September) and three random letters.
+func syntheticVRM(rng *rand.Rand, now time.Time) string {
+	periods := (now.Year() - 2002) * 2
+	if now.Month() >= time.March {
+		periods++
+	}
+	if now.Month() >= time.September {
+		periods++
+	}
+	period := rng.Intn(periods)
+	age := 2 + period/2
+	if period%2 == 1 {
+		age += 50
+	}
+
+	var b strings.Builder
+	b.WriteByte(areaLetters[rng.Intn(len(areaLetters))])
+	b.WriteByte(areaLetters[rng.Intn(len(areaLetters))])
+	fmt.Fprintf(&b, "%02d", age%100)
+	for i := 0; i < 3; i++ {
+		b.WriteByte(randomLetters[rng.Intn(len(randomLetters))])
+	}
+	return b.String()
+}
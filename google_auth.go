@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// googleClient returns an HTTP client authorized for scope with the -creds
+// file, or the application default credentials, for the Google APIs that
+// are called over REST.
+func googleClient(ctx context.Context, credFile string, scope string) (*http.Client, error) {
+	var creds *google.Credentials
+	if credFile != "" {
+		body, err := os.ReadFile(credFile)
+		if err != nil {
+			return nil, err
+		}
+		creds, err = google.CredentialsFromJSON(ctx, body, scope)
+		if err != nil {
+			return nil, fmt.Errorf("invalid credentials: %v", err)
+		}
+	} else {
+		var err error
+		creds, err = google.FindDefaultCredentials(ctx, scope)
+		if err != nil {
+			return nil, fmt.Errorf("failed to find credentials: %v", err)
+		}
+	}
+
+	client := oauth2.NewClient(ctx, creds.TokenSource)
+	client.Timeout = 30 * time.Second
+	return client, nil
+}
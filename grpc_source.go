@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+type grpcSource struct {
+	config SourceConfig
+	conn   *grpc.ClientConn
+	method protoreflect.MethodDescriptor
+	// active counts the searches in progress. A source closed while it has
+	// some, after a config reload, closes its connection once they are done.
+	mutex   sync.Mutex
+	active  int
+	closing bool
+}
+
+// searchTimeoutError marks a search that ran out of time so that callers can
+// keep using os.IsTimeout regardless of the transport. HTTP searches also
+// record the phase of the request that timed out.
+type searchTimeoutError struct {
+	err   error
+	phase string
+}
+
+func (e *searchTimeoutError) Error() string {
+	return e.err.Error()
+}
+
+func (e *searchTimeoutError) Timeout() bool {
+	return true
+}
+
+func newGrpcSource(config SourceConfig) (*grpcSource, error) {
+	method, err := loadGrpcMethod(config.GRPC.DescriptorSet, config.GRPC.Method)
+	if err != nil {
+		return nil, err
+	}
+
+	creds := insecure.NewCredentials()
+	if config.GRPC.TLS {
+		creds = credentials.NewTLS(&tls.Config{})
+	}
+
+	conn, err := grpc.NewClient(config.GRPC.Target,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithUserAgent(userAgent()))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create gRPC client: %v", err)
+	}
+
+	return &grpcSource{
+		config: config,
+		conn:   conn,
+		method: method,
+	}, nil
+}
+
+// loadGrpcMethod finds the method descriptor in a FileDescriptorSet produced
+// with `protoc --include_imports --descriptor_set_out`.
+func loadGrpcMethod(descriptorSet string, method string) (protoreflect.MethodDescriptor, error) {
+	body, err := os.ReadFile(descriptorSet)
+	if err != nil {
+		return nil, err
+	}
+
+	var set descriptorpb.FileDescriptorSet
+	if err := proto.Unmarshal(body, &set); err != nil {
+		return nil, fmt.Errorf("invalid descriptor set %s: %v", descriptorSet, err)
+	}
+
+	files, err := protodesc.NewFiles(&set)
+	if err != nil {
+		return nil, fmt.Errorf("invalid descriptor set %s: %v", descriptorSet, err)
+	}
+
+	serviceName, methodName, ok := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+	if !ok {
+		return nil, fmt.Errorf("invalid method %q, expected package.Service/Method", method)
+	}
+
+	descriptor, err := files.FindDescriptorByName(protoreflect.FullName(serviceName))
+	if err != nil {
+		return nil, fmt.Errorf("service %s not found in descriptor set", serviceName)
+	}
+	service, ok := descriptor.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a service", serviceName)
+	}
+
+	methodDescriptor := service.Methods().ByName(protoreflect.Name(methodName))
+	if methodDescriptor == nil {
+		return nil, fmt.Errorf("method %s not found in service %s", methodName, serviceName)
+	}
+	if methodDescriptor.IsStreamingClient() || methodDescriptor.IsStreamingServer() {
+		return nil, fmt.Errorf("streaming method %s is not supported", method)
+	}
+
+	return methodDescriptor, nil
+}
+
+func (d *grpcSource) ID() string {
+	return d.config.ID
+}
+
+func (d *grpcSource) SearchURL() string {
+	return d.config.GRPC.Target
+}
+
+func (d *grpcSource) ResponseMapping() map[string]string {
+	return d.config.Mapping
+}
+
+func (d *grpcSource) SourceConfig() *SourceConfig {
+	return &d.config
+}
+
+// Warmup connects to the target and waits until the connection is ready.
+func (d *grpcSource) Warmup(ctx context.Context) error {
+	d.conn.Connect()
+	for {
+		state := d.conn.GetState()
+		if state == connectivity.Ready {
+			return nil
+		}
+		if !d.conn.WaitForStateChange(ctx, state) {
+			return ctx.Err()
+		}
+	}
+}
+
+// requestField returns the provider's field name for a SearchBody field.
+func (d *grpcSource) requestField(name string) string {
+	if field, ok := d.config.GRPC.RequestFields[name]; ok {
+		return field
+	}
+	return name
+}
+
+func (d *grpcSource) Search(ctx context.Context, search SearchBody) ([]*VehicleContravention, error) {
+	request := dynamicpb.NewMessage(d.method.Input())
+	if err := setProtoField(request, d.requestField("vrm"), search.VRM); err != nil {
+		return nil, err
+	}
+	if err := setProtoField(request, d.requestField("contravention_date"), search.ContraventionDate); err != nil {
+		return nil, err
+	}
+
+	// The search counts as active while it waits for the rate limit too, so
+	// a Close in the meantime leaves the connection open until it is done.
+	// A source that is already closing was replaced by a reload or the run is
+	// ending; the search fails as a timeout so it is retried.
+	d.mutex.Lock()
+	if d.closing {
+		d.mutex.Unlock()
+		return nil, &searchTimeoutError{err: fmt.Errorf("source %s is closing", d.config.ID)}
+	}
+	d.active++
+	d.mutex.Unlock()
+	defer d.release()
+
+	if err := waitForRateLimit(ctx, d); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, searchTimeout(d))
+	defer cancel()
+	start := time.Now()
+
+	ctx = metadata.AppendToOutgoingContext(ctx, "x-correlation-id", uuid.New().String())
+	for name, value := range d.config.Headers {
+		ctx = metadata.AppendToOutgoingContext(ctx, strings.ToLower(name), value)
+	}
+
+	response := dynamicpb.NewMessage(d.method.Output())
+	fullMethod := fmt.Sprintf("/%s/%s", d.method.Parent().FullName(), d.method.Name())
+	err := d.conn.Invoke(ctx, fullMethod, request, response)
+	if err != nil {
+		if status.Code(err) == codes.DeadlineExceeded {
+			return nil, &searchTimeoutError{err: err}
+		}
+		return nil, err
+	}
+	observeSearchLatency(d, time.Since(start))
+
+	body, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeContraventions(d, body)
+}
+
+// release ends a search, and closes the connection if the source was closed
+// during it.
+func (d *grpcSource) release() {
+	d.mutex.Lock()
+	d.active--
+	closeNow := d.closing && d.active == 0
+	d.mutex.Unlock()
+	if closeNow {
+		d.conn.Close()
+	}
+}
+
+// Close closes the connection, or has the last search in progress close it.
+func (d *grpcSource) Close() error {
+	d.mutex.Lock()
+	idle := d.active == 0 && !d.closing
+	d.closing = true
+	d.mutex.Unlock()
+	if idle {
+		return d.conn.Close()
+	}
+	return nil
+}
+
+// setProtoField sets a string or time value on a request field. Times are
+// written as google.protobuf.Timestamp or as an RFC3339 string.
+func setProtoField(message *dynamicpb.Message, name string, value interface{}) error {
+	field := message.Descriptor().Fields().ByName(protoreflect.Name(name))
+	if field == nil {
+		return fmt.Errorf("request message %s has no field %s", message.Descriptor().FullName(), name)
+	}
+
+	switch v := value.(type) {
+	case string:
+		if field.Kind() != protoreflect.StringKind {
+			return fmt.Errorf("field %s must be a string", name)
+		}
+		message.Set(field, protoreflect.ValueOfString(v))
+	case time.Time:
+		switch {
+		case field.Kind() == protoreflect.StringKind:
+			message.Set(field, protoreflect.ValueOfString(v.Format(time.RFC3339)))
+		case field.Kind() == protoreflect.MessageKind && field.Message().FullName() == "google.protobuf.Timestamp":
+			timestamp := message.Mutable(field).Message()
+			fields := field.Message().Fields()
+			timestamp.Set(fields.ByName("seconds"), protoreflect.ValueOfInt64(v.Unix()))
+			timestamp.Set(fields.ByName("nanos"), protoreflect.ValueOfInt32(int32(v.Nanosecond())))
+		default:
+			return fmt.Errorf("field %s must be a string or google.protobuf.Timestamp", name)
+		}
+	default:
+		return fmt.Errorf("unsupported value for field %s", name)
+	}
+
+	return nil
+}
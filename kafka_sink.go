@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// KafkaConfig are the settings of a kafka sink.
+type KafkaConfig struct {
+	Brokers []string    `json:"brokers"`
+	Topic   string      `json:"topic"`
+	TLS     bool        `json:"tls,omitempty"`
+	SASL    *SASLConfig `json:"sasl,omitempty"`
+}
+
+// SASLConfig authenticates to the brokers. The password is read from an
+// environment variable so it stays out of the config file.
+type SASLConfig struct {
+	Mechanism   string `json:"mechanism"`
+	Username    string `json:"username"`
+	PasswordEnv string `json:"password_env"`
+}
+
+func (c *KafkaConfig) validate(name string) error {
+	if len(c.Brokers) == 0 || c.Topic == "" {
+		return fmt.Errorf("sink %s: kafka sinks require brokers and topic", name)
+	}
+	if c.SASL != nil {
+		if c.SASL.Username == "" || c.SASL.PasswordEnv == "" {
+			return fmt.Errorf("sink %s: sasl requires username and password_env", name)
+		}
+		if os.Getenv(c.SASL.PasswordEnv) == "" {
+			return fmt.Errorf("sink %s: sasl password %s is not set", name, c.SASL.PasswordEnv)
+		}
+		if _, err := c.SASL.mechanism(); err != nil {
+			return fmt.Errorf("sink %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (c *SASLConfig) mechanism() (sasl.Mechanism, error) {
+	password := os.Getenv(c.PasswordEnv)
+	switch strings.ToLower(c.Mechanism) {
+	case "", "plain":
+		return plain.Mechanism{Username: c.Username, Password: password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, c.Username, password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, c.Username, password)
+	}
+	return nil, fmt.Errorf("unknown sasl mechanism %q", c.Mechanism)
+}
+
+// kafkaSink produces results to a Kafka topic with the message attributes
+// as headers. Results are keyed by VRM so the results for a vehicle stay in
+// order within a partition.
+type kafkaSink struct {
+	writer *kafka.Writer
+	wg     sync.WaitGroup
+}
+
+func newKafkaSink(config *KafkaConfig) (*kafkaSink, error) {
+	transport := &kafka.Transport{}
+	if config.TLS {
+		transport.TLS = &tls.Config{}
+	}
+	if config.SASL != nil {
+		mechanism, err := config.SASL.mechanism()
+		if err != nil {
+			return nil, err
+		}
+		transport.SASL = mechanism
+	}
+
+	return &kafkaSink{
+		writer: &kafka.Writer{
+			Addr:         kafka.TCP(config.Brokers...),
+			Topic:        config.Topic,
+			Balancer:     &kafka.Hash{},
+			RequiredAcks: kafka.RequireAll,
+			BatchTimeout: 10 * time.Millisecond,
+			Transport:    transport,
+		},
+	}, nil
+}
+
+func (s *kafkaSink) Publish(ctx context.Context, contravention *VehicleContravention, done func(error)) error {
+	data, err := encodeMessage(contravention)
+	if err != nil {
+		return err
+	}
+
+	message := kafka.Message{Key: []byte(contravention.VRM), Value: data}
+	for key, value := range messageAttributes(contravention) {
+		message.Headers = append(message.Headers, kafka.Header{Key: key, Value: []byte(value)})
+	}
+
+	// Concurrent writes are batched together by the writer.
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := s.writer.WriteMessages(ctx, message); err != nil {
+			done(fmt.Errorf("failed to produce message: %v", err))
+			return
+		}
+		done(nil)
+	}()
+	return nil
+}
+
+func (s *kafkaSink) Close() error {
+	s.wg.Wait()
+	return s.writer.Close()
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RunLock lets one of several replicas started for the same scheduled run
+// check the batch, while the others skip it. The lock is an object in Cloud
+// Storage, created only if it doesn't exist (a generation precondition), so
+// exactly one replica wins. It holds the time it expires: the holder extends
+// it while running, and leaves it to expire after the run, so replicas
+// starting late for the same schedule still skip. A lock left by a replica
+// that died is taken over once it expires.
+type RunLock struct {
+	client     *http.Client
+	bucket     string
+	object     string
+	ttl        time.Duration
+	holder     string
+	generation string
+	cancel     context.CancelFunc
+	lost       context.CancelCauseFunc
+	done       chan struct{}
+}
+
+type lockContent struct {
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+const storageScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// lockHeldError is returned by Acquire when another replica holds the lock.
+type lockHeldError struct {
+	content lockContent
+}
+
+func (e lockHeldError) Error() string {
+	return fmt.Sprintf("lock held by %s until %s", e.content.Holder, e.content.ExpiresAt.Format(time.RFC3339))
+}
+
+// parseLockURL splits gs://bucket/object.
+func parseLockURL(value string) (string, string, error) {
+	rest, ok := strings.CutPrefix(value, "gs://")
+	bucket, object, found := strings.Cut(rest, "/")
+	if !ok || !found || bucket == "" || object == "" {
+		return "", "", fmt.Errorf("invalid lock %q, expected gs://bucket/object", value)
+	}
+	return bucket, object, nil
+}
+
+// lockObject is the lock object of the schedule slot starting now. With an
+// interval, each slot has an object of its own, named after the slot's start,
+// so a lock kept past the next slot can't make its run skip.
+func lockObject(object string, interval time.Duration, now time.Time) string {
+	if interval <= 0 {
+		return object
+	}
+	return object + "-" + now.UTC().Truncate(interval).Format("20060102T150405Z")
+}
+
+func NewRunLock(ctx context.Context, lockURL string, ttl time.Duration, interval time.Duration, credFile string) (*RunLock, error) {
+	bucket, object, err := parseLockURL(lockURL)
+	if err != nil {
+		return nil, err
+	}
+	object = lockObject(object, interval, time.Now())
+
+	client, err := googleClient(ctx, credFile, storageScope)
+	if err != nil {
+		return nil, err
+	}
+
+	holder := runID
+	if producerHostname != "" {
+		holder = producerHostname + "/" + runID
+	}
+	return &RunLock{
+		client: client,
+		bucket: bucket,
+		object: object,
+		ttl:    ttl,
+		holder: holder,
+	}, nil
+}
+
+// Acquire takes the lock and keeps extending it until Release. It returns
+// lockHeldError when another replica holds it. The returned context is
+// cancelled if the lock is lost to another replica, with errLockLost as its
+// cause, so the run stops instead of publishing alongside that replica.
+func (l *RunLock) Acquire(ctx context.Context) (context.Context, error) {
+	generation, err := l.write(ctx, "0")
+	if err == errPreconditionFailed {
+		var current lockContent
+		var currentGeneration string
+		current, currentGeneration, err = l.read(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if time.Now().Before(current.ExpiresAt) {
+			return nil, lockHeldError{content: current}
+		}
+		log.Printf("Taking over the lock of %s, expired at %s\n", current.Holder, current.ExpiresAt.Format(time.RFC3339))
+		generation, err = l.write(ctx, currentGeneration)
+		if err == errPreconditionFailed {
+			current, _, err = l.read(ctx)
+			if err != nil {
+				return nil, err
+			}
+			return nil, lockHeldError{content: current}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	l.generation = generation
+
+	renewCtx, cancel := context.WithCancel(context.Background())
+	l.cancel = cancel
+	l.done = make(chan struct{})
+	runCtx, lost := context.WithCancelCause(ctx)
+	l.lost = lost
+	go l.renew(renewCtx)
+	return runCtx, nil
+}
+
+// renew extends the lock while the run goes on.
+func (l *RunLock) renew(ctx context.Context) {
+	defer close(l.done)
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		generation, err := l.write(ctx, l.generation)
+		if err == errPreconditionFailed {
+			log.Printf("Lost the lock gs://%s/%s to another replica, stopping the run\n", l.bucket, l.object)
+			l.lost(errLockLost)
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to extend the lock: %v\n", err)
+			continue
+		}
+		l.generation = generation
+	}
+}
+
+// Release stops extending the lock. The lock is kept until it expires.
+func (l *RunLock) Release() {
+	if l.cancel == nil {
+		return
+	}
+	l.cancel()
+	<-l.done
+	l.lost(nil)
+}
+
+var errPreconditionFailed = fmt.Errorf("precondition failed")
+
+var errLockLost = fmt.Errorf("lost the run lock to another replica")
+
+// write stores the lock with a new expiry time if the object's generation is
+// still ifGeneration ("0" for an object that must not exist yet), and
+// returns the new generation.
+func (l *RunLock) write(ctx context.Context, ifGeneration string) (string, error) {
+	body, err := json.Marshal(lockContent{Holder: l.holder, ExpiresAt: time.Now().Add(l.ttl).UTC()})
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{
+		"uploadType":        {"media"},
+		"name":              {l.object},
+		"ifGenerationMatch": {ifGeneration},
+	}
+	endpoint := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?%s", url.PathEscape(l.bucket), query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to write lock: %v", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusPreconditionFailed:
+		return "", errPreconditionFailed
+	default:
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("failed to write lock: status %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	var object struct {
+		Generation string `json:"generation"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&object); err != nil {
+		return "", fmt.Errorf("failed to write lock: %v", err)
+	}
+	return object.Generation, nil
+}
+
+// read returns the lock's content and generation.
+func (l *RunLock) read(ctx context.Context) (lockContent, string, error) {
+	var content lockContent
+	endpoint := fmt.Sprintf("https://storage.googleapis.com/storage/v1/b/%s/o/%s?alt=media", url.PathEscape(l.bucket), url.PathEscape(l.object))
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return content, "", err
+	}
+
+	resp, err := l.client.Do(req)
+	if err != nil {
+		return content, "", fmt.Errorf("failed to read lock: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return content, "", fmt.Errorf("failed to read lock: status %d", resp.StatusCode)
+	}
+
+	// A lock that can't be parsed counts as expired.
+	json.NewDecoder(resp.Body).Decode(&content)
+	return content, resp.Header.Get("X-Goog-Generation"), nil
+}
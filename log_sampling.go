@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync/atomic"
+)
+
+// LogSampler keeps the log of large batches readable: only one record in
+// every N has its routine lines (searching, sending, published) logged.
+// Timeouts and errors are always logged, and the run summary still counts
+// every record.
+type LogSampler struct {
+	every   uint64
+	records atomic.Uint64
+}
+
+// logSampler is nil unless -log-sample is set.
+var logSampler *LogSampler
+
+type unsampledRecordKey struct{}
+
+func NewLogSampler(every int) *LogSampler {
+	return &LogSampler{every: uint64(every)}
+}
+
+// withRecord picks whether the routine lines of the record checked with ctx
+// are logged.
+func (s *LogSampler) withRecord(ctx context.Context) context.Context {
+	if s == nil || s.records.Add(1)%s.every == 1%s.every {
+		return ctx
+	}
+	return context.WithValue(ctx, unsampledRecordKey{}, true)
+}
+
+// logRecordf logs a routine line about a record, unless the record was not
+// sampled.
+func logRecordf(ctx context.Context, format string, args ...any) {
+	if ctx.Value(unsampledRecordKey{}) != nil {
+		return
+	}
+	log.Printf(format, args...)
+}
+
+// logFailedRecord logs the error of a record, which may have had no other
+// line logged.
+func logFailedRecord(result RecordResult) {
+	if logSampler == nil || result.Outcome != outcomeError {
+		return
+	}
+	log.Printf("Failed to check %s, %s: %s\n", result.VRM, result.Company, result.Error)
+}
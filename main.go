@@ -7,14 +7,29 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"os/signal"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"cloud.google.com/go/pubsub"
+	"golang.org/x/time/rate"
 	"google.golang.org/api/option"
 )
 
+// ClientFactory owns the Pub/Sub client of a run. The client is created on
+// first use and shared by topic administration and publishing, and topic
+// handles are cached so each topic is checked, created and batched once.
+// Close releases them when the run ends.
 type ClientFactory struct {
 	projectID string
 	opts      []option.ClientOption
+	emulator  bool
+	client    *pubsub.Client
+	topics    map[string]*pubsub.Topic
+	mutex     sync.Mutex
 }
 
 type VehicleRegistrationRequest struct {
@@ -24,148 +39,1144 @@ type VehicleRegistrationRequest struct {
 
 var clientFactory *ClientFactory
 
-func (f *ClientFactory) CreateClient(ctx context.Context) (*pubsub.Client, error) {
-	return pubsub.NewClient(ctx, f.projectID, f.opts...)
+var outbox *Outbox
+
+var minConfidence float64
+
+// searchOnly is set by -search-only: every source search is written to the
+// sinks as a search row, whether it found a hirer vehicle, another result or
+// nothing, and nothing is published.
+var searchOnly bool
+
+var slowPublishThreshold time.Duration
+
+// orderingKeys is set by -ordering-key: results are published with their VRM
+// as the ordering key, so each vehicle's results are delivered in order.
+var orderingKeys bool
+
+// Client returns the shared client, creating it on first use.
+func (f *ClientFactory) Client(ctx context.Context) (*pubsub.Client, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.clientLocked(ctx)
+}
+
+func (f *ClientFactory) clientLocked(ctx context.Context) (*pubsub.Client, error) {
+	if f.client != nil {
+		return f.client, nil
+	}
+	client, err := pubsub.NewClient(ctx, f.projectID, f.opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create pubsub client: %v", err)
+	}
+	f.client = client
+	return client, nil
+}
+
+// Topic returns the handle of a topic, creating the topic if it doesn't
+// exist yet. Existence is only checked the first time a topic is used.
+// Topics named projects/<project>/topics/<id> in another project must exist
+// already; they are published to with the credentials of this project.
+func (f *ClientFactory) Topic(ctx context.Context, topicName string) (*pubsub.Topic, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if topic, ok := f.topics[topicName]; ok {
+		return topic, nil
+	}
+	client, err := f.clientLocked(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	topic, own, err := topicRef(client, topicName)
+	if err != nil {
+		return nil, err
+	}
+	exists, err := topic.Exists(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		if !own {
+			return nil, fmt.Errorf("topic %s does not exist, and topics in other projects are not created", topicName)
+		}
+		if topic, err = client.CreateTopic(ctx, topic.ID()); err != nil {
+			return nil, err
+		}
+	}
+
+	if f.topics == nil {
+		f.topics = make(map[string]*pubsub.Topic)
+	}
+	f.topics[topicName] = topic
+	return topic, nil
+}
+
+// recreateTopics creates the topics returned by Topic again, when they are
+// missing.
+func (f *ClientFactory) recreateTopics(ctx context.Context) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	client, err := f.clientLocked(ctx)
+	if err != nil {
+		return err
+	}
+	for name, topic := range f.topics {
+		exists, err := topic.Exists(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to check topic %s: %v", name, err)
+		}
+		if !exists {
+			if _, own, _ := topicRef(client, name); !own {
+				return fmt.Errorf("topic %s is missing, and topics in other projects are not created", name)
+			}
+			if _, err := client.CreateTopic(ctx, topic.ID()); err != nil {
+				return fmt.Errorf("failed to create topic %s: %v", name, err)
+			}
+			log.Printf("Created topic %s\n", name)
+		}
+	}
+	return nil
+}
+
+// Close flushes the cached topics and closes the client.
+func (f *ClientFactory) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	for _, topic := range f.topics {
+		topic.Stop()
+	}
+	f.topics = nil
+	if f.client == nil {
+		return nil
+	}
+	err := f.client.Close()
+	f.client = nil
+	return err
+}
+
+// CreateSchemaClient returns a schema client of a project, or of the client
+// project when project is empty.
+func (f *ClientFactory) CreateSchemaClient(ctx context.Context, project string) (*pubsub.SchemaClient, error) {
+	if project == "" {
+		project = f.projectID
+	}
+	return pubsub.NewSchemaClient(ctx, project, f.opts...)
+}
+
+// vrmList collects -vrm flags. Each flag may hold several comma-separated
+// VRMs; a VRM given twice is checked once.
+type vrmList []string
+
+func (l *vrmList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *vrmList) Set(value string) error {
+	for _, vrm := range strings.Split(value, ",") {
+		vrm = strings.TrimSpace(vrm)
+		if vrm == "" || slices.Contains(*l, vrm) {
+			continue
+		}
+		*l = append(*l, vrm)
+	}
+	return nil
 }
 
 type Flags struct {
-	ProjectID   string
-	UseEmulator bool
-	CredFile    string
-	VRM         string
-	Company     string
-	BatchFile   string
+	ProjectID         string
+	Topic             string
+	CredFile          string
+	VRM               vrmList
+	Company           string
+	BatchFile         string
+	BatchSQL          string
+	BatchDSN          string
+	OutboxFile        string
+	OutboxMaxFailures int
+	DedupeBatch       bool
+	DedupDB           string
+	DedupWindow       time.Duration
+	ETagCache         string
+	ETagCacheMaxAge   time.Duration
+	ResponseCache     string
+	CacheHitTTL       time.Duration
+	CacheMissTTL      time.Duration
+	ConfigFile        string
+	RecordFile        string
+	ReplayFile        string
+	DebugHTTP         string
+	DebugRedact       string
+	WatchConfig       time.Duration
+	Directory         string
+	DirectoryTTL      time.Duration
+	DirectoryCache    string
+	QPS               float64
+	MinConfidence     float64
+	SearchOnly        bool
+	ReportFile        string
+	ReportCSV         string
+	ManifestFile      string
+	ArtifactsDir      string
+	SlackWebhook      string
+	NotifyEmail       string
+	SMTPAddr          string
+	SMTPFrom          string
+	SlowPublish       time.Duration
+	OrderingKey       bool
+	Envelope          string
+	Encoding          string
+	Warmup            bool
+	Demo              bool
+	Deadline          time.Duration
+	Budget            time.Duration
+	RampUp            time.Duration
+	StartJitter       time.Duration
+	DVLA              bool
+	MaxInFlight       int
+	MaxFailureRate    float64
+	FailureWindow     int
+	MaxRecords        int
+	Strict            bool
+	Pretty            bool
+	Dashboard         bool
+	Events            string
+	Reference         string
+	Anonymize         bool
+	Ack               bool
+	TimeSource        string
+	MaxClockSkew      time.Duration
+	AuthoritativeTime bool
+	ReferencePrefix   string
+	ReferenceStart    int64
+	LogSample         int
+	PprofAddr         string
+	Faults            string
+	Sample            int
+	CanaryConfig      string
+	CanaryPercent     int
+	Sink              string
+	AdaptiveTimeout   bool
+	TimeoutMin        time.Duration
+	TimeoutMax        time.Duration
+	SeedDir           string
+	Chunk             bool
+	Worker            bool
+	WorkSubscription  string
+	MaxHold           time.Duration
+	WorkerConcurrency int
+	Lock              string
+	LockTTL           time.Duration
+	LockInterval      time.Duration
+	CallbackHosts     string
+
+	emulatorFlags
 }
 
-func parseAndValidateFlags() (*Flags, error) {
-	projectID := flag.String("project", "", "Google Cloud Project ID (required)")
-	useEmulator := flag.Bool("emulator", false, "Use Pub/Sub emulator")
-	credFile := flag.String("creds", "", "Path to service account credentials JSON file")
-	vrm := flag.String("vrm", "", "Vehicle Registration Mark")
-	company := flag.String("company", "", "Company name")
-	batchFile := flag.String("batch", "", "File containing VRM and company pairs")
+// register defines the check flags on fs. Subcommands that run checks
+// register the same flags on their own flag set.
+func (f *Flags) register(fs *flag.FlagSet) {
+	fs.StringVar(&f.ProjectID, "project", "", "Google Cloud Project ID (required)")
+	fs.StringVar(&f.Topic, "topic", defaultResultsTopic, "Topic results are published to: a topic ID, or projects/<project>/topics/<id> for a topic in another project")
+	f.registerEmulator(fs)
+	fs.StringVar(&f.SeedDir, "seed", "", "Directory of fixture messages published to the emulator after it starts, one subdirectory per topic")
+	fs.StringVar(&f.CredFile, "creds", "", "Path to service account credentials JSON file")
+	fs.Var(&f.VRM, "vrm", "Vehicle Registration Mark; repeat the flag or separate with commas to check several")
+	fs.StringVar(&f.Company, "company", "", "Company name")
+	fs.StringVar(&f.BatchFile, "batch", "", "File containing VRM and company pairs")
+	fs.StringVar(&f.BatchSQL, "batch-sql", "", "SQL query returning the records to check (vrm, company, contravention_date columns)")
+	fs.StringVar(&f.BatchDSN, "batch-dsn", "", "Database the -batch-sql query runs against: postgres://... or mysql://... (default $T360_BATCH_DSN)")
+	fs.StringVar(&f.ConfigFile, "config", "", "JSON config file with additional data sources")
+	fs.StringVar(&f.RecordFile, "record", "", "Record the data source HTTP interactions of the run to this cassette file")
+	fs.StringVar(&f.ReplayFile, "replay", "", "Answer data source HTTP requests from this cassette file instead of the network")
+	fs.StringVar(&f.DebugHTTP, "debug-http", "", "Log data source HTTP requests and responses, with bodies, to this file")
+	fs.StringVar(&f.DebugRedact, "debug-redact", defaultRedactedFields, "Comma-separated fields masked in -debug-http bodies (empty disables redaction)")
+	fs.DurationVar(&f.WatchConfig, "watch-config", 0, "Check the config file for changes at this interval and reload it (0 disables)")
+	fs.StringVar(&f.Directory, "directory", "", "URL of a directory service resolving companies without a built-in or configured source")
+	fs.DurationVar(&f.DirectoryTTL, "directory-ttl", time.Hour, "How long directory answers are cached")
+	fs.StringVar(&f.DirectoryCache, "directory-cache", defaultDirectoryCache(), "File the directory answers are cached in (empty disables the cache file)")
+	fs.Float64Var(&f.QPS, "qps", 0, "Maximum search requests per second to all sources together (0 means unlimited)")
+	fs.Float64Var(&f.MinConfidence, "min-confidence", 0, "Minimum match confidence (0-1) required to publish a result")
+	fs.BoolVar(&f.SearchOnly, "search-only", false, "Send every search result, hirer vehicle or not, to stdout or file sinks, for data-quality analysis; nothing is published to Pub/Sub")
+	fs.StringVar(&f.Sink, "sink", sinkPubSub, "Comma-separated sinks positive results are sent to: pubsub, stdout as JSON lines, or sinks named in the config file. The first one decides the outcome of a record")
+	fs.StringVar(&f.OutboxFile, "outbox", "", "Local outbox file; results are stored there before being published")
+	fs.IntVar(&f.OutboxMaxFailures, "outbox-max-failures", 10, "Stop the run once this many outbox publishes in a row have failed")
+	fs.BoolVar(&f.DedupeBatch, "dedupe-batch", false, "Collapse records of the same VRM, company and date before the batch is checked")
+	fs.StringVar(&f.DedupDB, "dedup-db", "", "Local database of published contraventions, or a Redis URL (redis:// or rediss:// for TLS) shared by several workers; skip ones already published within -dedup-window")
+	fs.DurationVar(&f.DedupWindow, "dedup-window", 24*time.Hour, "How long a published contravention is not published again")
+	fs.StringVar(&f.ResponseCache, "response-cache", "", "Local cache of search results, or a Redis URL (redis:// or rediss:// for TLS) shared by several workers; searches of the same vehicle and day are answered from it within the TTLs")
+	fs.DurationVar(&f.CacheHitTTL, "cache-hit-ttl", 0, "How long cached results with a hirer vehicle are used (0 doesn't cache them)")
+	fs.DurationVar(&f.CacheMissTTL, "cache-miss-ttl", 6*time.Hour, "How long cached results without a hirer vehicle are used (0 doesn't cache them)")
+	fs.StringVar(&f.ETagCache, "etag-cache", "", "Local cache of source responses with an ETag; searches send If-None-Match and 304 responses are answered from the cache")
+	fs.DurationVar(&f.ETagCacheMaxAge, "etag-cache-max-age", 30*24*time.Hour, "How long -etag-cache keeps a response; older ones are removed when the cache is opened")
+	fs.DurationVar(&f.SlowPublish, "slow-publish", 2*time.Second, "Warn when a publish takes longer than this to be confirmed (0 disables)")
+	fs.BoolVar(&f.OrderingKey, "ordering-key", false, "Publish results with their VRM as the ordering key, with message ordering enabled on the topic")
+	fs.StringVar(&f.Envelope, "envelope", envelopeV1, "Message format: v1 (bare contravention) or v2 (versioned envelope)")
+	fs.StringVar(&f.Encoding, "encoding", encodingJSON, "Message encoding: json, avro or proto")
+	fs.DurationVar(&f.Deadline, "deadline", 0, "Abort checking records if the run takes longer than this (0 means no limit)")
+	fs.BoolVar(&f.DVLA, "dvla", false, "Add the DVLA's details of the vehicle (make, colour, tax and MOT status) to positive results; the API key is read from "+dvlaAPIKeyEnv)
+	fs.DurationVar(&f.RampUp, "ramp-up", time.Minute, "Raise each source's concurrency from 1 to its full value over this long at the start of a run (0 starts at full concurrency)")
+	fs.DurationVar(&f.StartJitter, "start-jitter", 0, "Wait a random time up to this long before checking the first record, so scheduled runs don't all start at once")
+	fs.DurationVar(&f.Budget, "budget", 0, "Wall-clock budget of the run: check known companies first and cheapest records first, and defer records not expected to finish in time (0 means no budget)")
+	fs.BoolVar(&f.AdaptiveTimeout, "adaptive-timeout", false, "Base each source's search timeout on the latency of its recent searches instead of a fixed 2s")
+	fs.DurationVar(&f.TimeoutMin, "timeout-min", 500*time.Millisecond, "Lower bound of adaptive search timeouts")
+	fs.DurationVar(&f.TimeoutMax, "timeout-max", 10*time.Second, "Upper bound of adaptive search timeouts")
+	fs.IntVar(&f.MaxInFlight, "max-inflight", 1000, "Maximum number of published messages waiting for confirmation")
+	fs.Float64Var(&f.MaxFailureRate, "max-publish-failure-rate", 0, "Stop the run when more than this share (0-1) of the recent publishes failed (0 stops on the first failed Pub/Sub publish)")
+	fs.IntVar(&f.FailureWindow, "publish-failure-window", 100, "Number of recent publishes -max-publish-failure-rate is measured over")
+	fs.IntVar(&f.MaxRecords, "max-records", 0, "Refuse to check more records than this in one run (0 means no limit)")
+	fs.BoolVar(&f.Chunk, "chunk", false, "Check batches over -max-records in sequential chunks with separate reports instead of refusing them")
+	fs.BoolVar(&f.Worker, "worker", false, "Check the records enqueued with t360 batch enqueue, from the work subscription, until stopped")
+	fs.StringVar(&f.WorkSubscription, "work-subscription", defaultWorkSubscription, "Subscription -worker reads records from")
+	fs.DurationVar(&f.MaxHold, "max-hold", 5*time.Minute, "How long -worker may hold a record, extending its ack deadline, before it is delivered to another worker")
+	fs.IntVar(&f.WorkerConcurrency, "worker-concurrency", 10, "Number of records -worker checks at once")
+	fs.StringVar(&f.Lock, "lock", "", "Cloud Storage object, gs://bucket/object, locking the run so only one of several replicas started for it checks the batch")
+	fs.DurationVar(&f.LockTTL, "lock-ttl", 15*time.Minute, "How long -lock is kept after the run, so replicas starting late skip it too")
+	fs.DurationVar(&f.LockInterval, "lock-interval", 0, "Interval between scheduled runs; -lock then takes an object of its own for each slot of this length, so a lock kept past the next slot can't skip its run")
+	fs.BoolVar(&f.Strict, "strict", false, "Fail the run on any invalid record, unknown company or timeout, and fail records whose source returns another lease company than requested")
+	fs.IntVar(&f.Sample, "sample", 0, "Search this many randomly chosen published hits again at the end of the run and report any differences")
+	fs.StringVar(&f.CanaryConfig, "canary-config", "", "Config file with new source definitions to search a share of the records of changed sources with, reporting where results differ")
+	fs.IntVar(&f.CanaryPercent, "canary-percent", 10, "Percentage of the records of changed sources searched with -canary-config")
+	fs.BoolVar(&f.Warmup, "warmup", false, "Open connections to the data sources before checking records")
+	fs.BoolVar(&f.Demo, "demo", false, "Answer every search from built-in fixtures for the demo VRMs DEMO001 to DEMO005, without the network; checks all of them when no records are given")
+	fs.StringVar(&f.TimeSource, "time-source", defaultTimeSource, "HTTPS URL whose Date header the local clock is checked against before the run")
+	fs.DurationVar(&f.MaxClockSkew, "max-clock-skew", 2*time.Second, "Warn, or fail with -strict, when the local clock is further off -time-source (0 skips the check)")
+	fs.BoolVar(&f.AuthoritativeTime, "authoritative-time", false, "Stamp published results with the time of -time-source instead of the local clock; the run fails if it can't be reached")
+	fs.StringVar(&f.CallbackHosts, "callback-hosts", "", "Comma separated hosts records may send callbacks to; *.example.com allows the subdomains of example.com (required for callback_url)")
+	fs.BoolVar(&f.Ack, "ack", false, "Write the disposition and published message IDs of every record, in batch order, to <batch>.ack at the end of the run")
+	fs.BoolVar(&f.Anonymize, "anonymize", false, "Replace VRMs with deterministic pseudonyms, keyed by $T360_ANONYMIZE_KEY, in published messages, reports, events and the log; sources are still searched with the real VRMs")
+	fs.StringVar(&f.Reference, "reference", referenceUUID, "How the reference of published results is set: uuid, sequential (-reference-prefix and a number), hash (-reference-prefix and a hash of the contravention) or record (the reference field of each batch record)")
+	fs.StringVar(&f.ReferencePrefix, "reference-prefix", "", "Prefix of sequential and hash references")
+	fs.Int64Var(&f.ReferenceStart, "reference-start", 1, "First number of sequential references")
+	fs.StringVar(&f.Events, "events", "", "Write progress events as JSON lines to this file, or to a UNIX socket given as unix:<path>")
+	fs.BoolVar(&f.Dashboard, "dashboard", false, "Show a live dashboard of progress, per-source queues and errors, and publish throughput (only when stdout is a terminal)")
+	fs.BoolVar(&f.Pretty, "pretty", false, "Print a colored status line per record and a summary table (only when stdout is a terminal)")
+	fs.IntVar(&f.LogSample, "log-sample", 0, "Log the routine lines of only one record in this many; timeouts and errors are always logged (0 logs every record)")
+	fs.StringVar(&f.Faults, "faults", "", "Inject faults for testing, e.g. latency=0.2,delay=2s,timeout=0.05,5xx=0.1,publish=0.1 (rates 0-1, default $T360_FAULTS)")
+	fs.StringVar(&f.PprofAddr, "pprof", "", "Serve pprof profiles and runtime counters on this address, e.g. 6060 for localhost:6060")
+	fs.StringVar(&f.ReportFile, "report", "", "Write a JSON report with the outcome of every record to this file")
+	fs.StringVar(&f.ReportCSV, "report-csv", "", "Write a CSV report with a row per record, for spreadsheets, to this file")
+	fs.StringVar(&f.ManifestFile, "manifest", "", "Write a JSON manifest of the run's settings, build, input hash and result counts to this file")
+	fs.StringVar(&f.ArtifactsDir, "artifacts", "", "Collect the log, report and emulator data of each run in a directory named by run ID under this directory")
+	fs.StringVar(&f.SlackWebhook, "notify-slack", "", "Slack webhook URL notified with the run summary")
+	fs.StringVar(&f.NotifyEmail, "notify-email", "", "Comma-separated email addresses notified with the run summary")
+	fs.StringVar(&f.SMTPAddr, "smtp-addr", "", "SMTP server host:port used for email notifications")
+	fs.StringVar(&f.SMTPFrom, "smtp-from", "", "Sender address used for email notifications")
+}
 
-	flag.Parse()
+func (f *Flags) validate() error {
+	sinks := sinkNames(f.Sink)
+	if len(sinks) == 0 {
+		return fmt.Errorf("at least one sink is required")
+	}
+	seen := make(map[string]bool)
+	for _, sink := range sinks {
+		if seen[sink] {
+			return fmt.Errorf("sink %s is listed more than once", sink)
+		}
+		seen[sink] = true
 
-	if *projectID == "" {
-		return nil, fmt.Errorf("missing required flag: -project (required for both emulator and production)")
+		switch sink {
+		case sinkPubSub:
+			if f.ProjectID == "" {
+				return fmt.Errorf("missing required flag: -project (required for both emulator and production)")
+			}
+		case sinkStdout:
+			if f.UseEmulator || f.SeedDir != "" || f.Pretty || f.Dashboard {
+				return fmt.Errorf("sink stdout cannot be used with emulator, seed, pretty or dashboard")
+			}
+			if f.Encoding != encodingJSON {
+				return fmt.Errorf("sink stdout requires json encoding")
+			}
+		default:
+			if f.ConfigFile == "" {
+				return fmt.Errorf("sink %s must be defined in the config file (-config)", sink)
+			}
+		}
+	}
+	if (f.UseEmulator || f.SeedDir != "") && !seen[sinkPubSub] {
+		return fmt.Errorf("emulator and seed require the pubsub sink")
+	}
+	if f.SearchOnly && (seen[sinkPubSub] || f.Worker) {
+		return fmt.Errorf("search-only results are not hirer vehicles and cannot be sent to the pubsub sink or used with worker")
 	}
 
-	if *batchFile != "" {
-		if *vrm != "" || *company != "" {
-			return nil, fmt.Errorf("batch file cannot be used together with VRM or company flags")
+	if f.QPS < 0 {
+		return fmt.Errorf("qps cannot be negative")
+	}
+
+	if f.MinConfidence < 0 || f.MinConfidence > 1 {
+		return fmt.Errorf("min-confidence must be between 0 and 1")
+	}
+
+	if f.MaxFailureRate < 0 || f.MaxFailureRate >= 1 {
+		return fmt.Errorf("max-publish-failure-rate must be at least 0 and below 1")
+	}
+	if f.FailureWindow < 1 {
+		return fmt.Errorf("publish-failure-window must be at least 1")
+	}
+
+	if f.MaxInFlight < 1 {
+		return fmt.Errorf("max-inflight must be at least 1")
+	}
+
+	if f.TimeoutMin <= 0 || f.TimeoutMax < f.TimeoutMin {
+		return fmt.Errorf("timeout-min must be positive and no more than timeout-max")
+	}
+
+	if f.SeedDir != "" && !f.UseEmulator && runningEmulatorHost() == "" {
+		return fmt.Errorf("seed requires emulator")
+	}
+
+	if err := f.validateEmulator(); err != nil {
+		return err
+	}
+
+	if f.Sample < 0 {
+		return fmt.Errorf("sample cannot be negative")
+	}
+
+	if f.LogSample < 0 {
+		return fmt.Errorf("log-sample cannot be negative")
+	}
+
+	if spec := f.faultsSpec(); spec != "" {
+		if _, err := ParseFaults(spec); err != nil {
+			return err
 		}
-		if _, err := os.Stat(*batchFile); os.IsNotExist(err) {
-			return nil, fmt.Errorf("batch file does not exist: %s", *batchFile)
+	}
+
+	if f.CanaryConfig != "" && (f.CanaryPercent < 1 || f.CanaryPercent > 100) {
+		return fmt.Errorf("canary-percent must be between 1 and 100")
+	}
+
+	if f.OutboxMaxFailures < 1 {
+		return fmt.Errorf("outbox-max-failures must be at least 1")
+	}
+
+	if f.MaxRecords < 0 {
+		return fmt.Errorf("max-records cannot be negative")
+	}
+	if f.Chunk && f.MaxRecords == 0 {
+		return fmt.Errorf("chunk requires max-records to be set")
+	}
+
+	if f.Envelope != envelopeV1 && f.Envelope != envelopeV2 {
+		return fmt.Errorf("envelope must be %s or %s", envelopeV1, envelopeV2)
+	}
+
+	if _, _, err := parseTopicName(f.Topic); err != nil {
+		return err
+	}
+
+	switch f.Encoding {
+	case encodingJSON:
+	case encodingAvro, encodingProto:
+		if f.Envelope != envelopeV1 {
+			return fmt.Errorf("envelope %s is only available with json encoding", f.Envelope)
 		}
-	} else if *company != "" && *vrm == "" {
-		return nil, fmt.Errorf("company flag requires VRM flag to be set")
+	default:
+		return fmt.Errorf("encoding must be %s, %s or %s", encodingJSON, encodingAvro, encodingProto)
+	}
+
+	if f.RecordFile != "" && f.ReplayFile != "" {
+		return fmt.Errorf("record and replay cannot be used together")
 	}
 
-	return &Flags{
-		ProjectID:   *projectID,
-		UseEmulator: *useEmulator,
-		CredFile:    *credFile,
-		VRM:         *vrm,
-		Company:     *company,
-		BatchFile:   *batchFile,
-	}, nil
+	if f.DedupWindow <= 0 {
+		return fmt.Errorf("dedup-window must be positive")
+	}
+	if f.ETagCacheMaxAge <= 0 {
+		return fmt.Errorf("etag-cache-max-age must be positive")
+	}
+
+	if f.WatchConfig < 0 {
+		return fmt.Errorf("watch-config cannot be negative")
+	}
+	if f.WatchConfig > 0 && f.ConfigFile == "" && f.Directory == "" {
+		return fmt.Errorf("watch-config requires config or directory to be set")
+	}
+
+	if f.NotifyEmail != "" && (f.SMTPAddr == "" || f.SMTPFrom == "") {
+		return fmt.Errorf("notify-email requires smtp-addr and smtp-from to be set")
+	}
+
+	if f.DVLA {
+		if os.Getenv(dvlaAPIKeyEnv) == "" {
+			return fmt.Errorf("dvla requires %s to be set", dvlaAPIKeyEnv)
+		}
+		if f.Encoding != encodingJSON {
+			return fmt.Errorf("dvla requires the json encoding, the avro and proto schemas have no vehicle details")
+		}
+	}
+
+	if f.CacheHitTTL < 0 || f.CacheMissTTL < 0 {
+		return fmt.Errorf("cache-hit-ttl and cache-miss-ttl cannot be negative")
+	}
+
+	if f.Budget < 0 {
+		return fmt.Errorf("budget cannot be negative")
+	}
+
+	if f.Pretty && f.Dashboard {
+		return fmt.Errorf("pretty and dashboard cannot be used together")
+	}
+
+	if f.RampUp < 0 || f.StartJitter < 0 {
+		return fmt.Errorf("ramp-up and start-jitter cannot be negative")
+	}
+
+	if f.MaxClockSkew < 0 {
+		return fmt.Errorf("max-clock-skew cannot be negative")
+	}
+
+	if f.Ack && f.BatchFile == "" {
+		return fmt.Errorf("ack requires a batch file")
+	}
+
+	if f.Anonymize && os.Getenv(anonymizeKeyEnv) == "" {
+		return fmt.Errorf("anonymize requires %s to be set", anonymizeKeyEnv)
+	}
+
+	if err := validateReferenceStrategy(f.Reference); err != nil {
+		return err
+	}
+	if f.ReferencePrefix != "" && f.Reference != referenceSequential && f.Reference != referenceHash {
+		return fmt.Errorf("reference-prefix requires the sequential or hash reference strategy")
+	}
+	if f.ReferenceStart < 0 {
+		return fmt.Errorf("reference-start cannot be negative")
+	}
+	// Every worker would count from -reference-start on its own, and hand
+	// out the same references as the others.
+	if f.Reference == referenceSequential && f.Worker {
+		return fmt.Errorf("sequential references cannot be used with worker, use hash or record")
+	}
+
+	if f.Worker {
+		if f.BatchSQL != "" || f.BatchFile != "" || len(f.VRM) > 0 || f.Company != "" {
+			return fmt.Errorf("worker reads its records from the work subscription and cannot be used with batch, batch-sql, VRM or company flags")
+		}
+		if f.OutboxFile != "" || f.Chunk || f.Sample > 0 || f.Strict || f.Budget > 0 || f.DedupeBatch {
+			return fmt.Errorf("worker cannot be used with outbox, chunk, sample, strict, budget or dedupe-batch")
+		}
+		if f.WorkerConcurrency < 1 {
+			return fmt.Errorf("worker-concurrency must be at least 1")
+		}
+		if f.MaxHold <= 0 {
+			return fmt.Errorf("max-hold must be positive")
+		}
+		if !seen[sinkPubSub] && f.ProjectID == "" {
+			return fmt.Errorf("worker requires -project to read the work subscription")
+		}
+	}
+
+	if f.Demo {
+		if err := f.validateDemo(seen); err != nil {
+			return err
+		}
+	}
+
+	if f.Lock != "" {
+		if _, _, err := parseLockURL(f.Lock); err != nil {
+			return err
+		}
+		if f.LockTTL < time.Minute {
+			return fmt.Errorf("lock-ttl must be at least 1m")
+		}
+		if f.LockInterval < 0 || (f.LockInterval > 0 && f.LockInterval < time.Minute) {
+			return fmt.Errorf("lock-interval must be at least 1m")
+		}
+	}
+
+	if f.BatchSQL != "" {
+		if f.BatchFile != "" || len(f.VRM) > 0 || f.Company != "" {
+			return fmt.Errorf("batch-sql cannot be used together with batch, VRM or company flags")
+		}
+		if f.batchDSN() == "" {
+			return fmt.Errorf("batch-sql requires batch-dsn or T360_BATCH_DSN to be set")
+		}
+	} else if f.BatchFile != "" {
+		if len(f.VRM) > 0 || f.Company != "" {
+			return fmt.Errorf("batch file cannot be used together with VRM or company flags")
+		}
+		if _, err := os.Stat(f.BatchFile); os.IsNotExist(err) {
+			return fmt.Errorf("batch file does not exist: %s", f.BatchFile)
+		}
+	} else if f.Company != "" && len(f.VRM) == 0 && !f.Demo {
+		return fmt.Errorf("company flag requires VRM flag to be set")
+	}
+
+	return nil
+}
+
+func parseAndValidateFlags() (*Flags, error) {
+	flags := &Flags{}
+	flags.register(flag.CommandLine)
+	flag.Parse()
+	warnFlatInvocation(flags, flag.CommandLine)
+
+	if err := flags.validate(); err != nil {
+		return nil, err
+	}
+	return flags, nil
+}
+
+// batchDSN returns -batch-dsn, or T360_BATCH_DSN so the database password
+// doesn't have to be on the command line.
+func (f *Flags) batchDSN() string {
+	if f.BatchDSN != "" {
+		return f.BatchDSN
+	}
+	return os.Getenv("T360_BATCH_DSN")
+}
+
+// searchRequests returns the records selected by -batch, -batch-sql or -vrm.
+func (f *Flags) searchRequests() ([]SearchRequest, error) {
+	if f.BatchSQL != "" {
+		return readBatchSQL(context.Background(), f.batchDSN(), f.BatchSQL)
+	}
+	if f.BatchFile != "" {
+		return readBatchFile(f.BatchFile)
+	}
+	if len(f.VRM) > 0 {
+		requests := make([]SearchRequest, 0, len(f.VRM))
+		for _, vrm := range f.VRM {
+			requests = append(requests, SearchRequest{VRM: vrm, Company: f.Company})
+		}
+		return requests, nil
+	}
+	if f.Demo {
+		return demoRequests(f.Company), nil
+	}
+	return []SearchRequest{}, nil
+}
+
+// commands are the t360 subcommands. Without a subcommand the tool runs a
+// vehicle check configured by the flags in parseAndValidateFlags.
+var commands = map[string]func(args []string) error{
+	"check":    runCheckCommand,
+	"topics":   runTopicsCommand,
+	"subs":     runSubsCommand,
+	"replay":   runReplayCommand,
+	"drain":    runDrainCommand,
+	"emulator": runEmulatorCommand,
+	"batch":    runBatchCommand,
+	"gen":      runGenCommand,
+	"backfill": runBackfillCommand,
+	"version":  runVersionCommand,
 }
 
 func main() {
-	if err := run(); err != nil {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			if err := command(os.Args[2:]); err != nil {
+				log.Fatalf("Error: %v", err)
+			}
+			return
+		}
+	}
+
+	flags, err := parseAndValidateFlags()
+	if err == nil {
+		err = run(flags, nil)
+	}
+	if err != nil {
 		log.Fatalf("Error: %v", err)
 		os.Exit(1)
 	}
 }
 
-func run() error {
+// run checks the given records, or the ones selected by the flags when
+// requests is nil, and publishes the results.
+func run(flags *Flags, requests []SearchRequest) (runErr error) {
 	var emulator *PubSubEmulator
-	flags, err := parseAndValidateFlags()
+	var err error
+
+	// runCtx is cancelled when the run lock is lost.
+	runCtx := context.Background()
+	if flags.Lock != "" {
+		lock, err := NewRunLock(context.Background(), flags.Lock, flags.LockTTL, flags.LockInterval, flags.CredFile)
+		if err != nil {
+			return fmt.Errorf("failed to create lock: %v", err)
+		}
+		runCtx, err = lock.Acquire(context.Background())
+		if err != nil {
+			if _, held := err.(lockHeldError); held {
+				log.Printf("Skipping the run, another replica has it: %v\n", err)
+				return nil
+			}
+			return err
+		}
+		defer lock.Release()
+		log.Printf("Holding lock %s\n", flags.Lock)
+	}
+
+	if secret := os.Getenv(callbackSecretEnv); secret != "" {
+		callbacks = NewCallbackSender(runCtx, secret, flags.CallbackHosts)
+	}
+
+	if flags.ArtifactsDir != "" {
+		artifacts, err = createRunArtifacts(flags.ArtifactsDir)
+		if err != nil {
+			return err
+		}
+		defer artifacts.Close()
+		summary.ArtifactsDir = artifacts.Dir
+
+		if flags.ReportFile == "" {
+			flags.ReportFile = artifacts.Path("report.json")
+		}
+		if flags.ManifestFile == "" {
+			flags.ManifestFile = artifacts.Path("manifest.json")
+		}
+	}
+
+	// The log is anonymized after -artifacts has set its output, so the log
+	// file gets pseudonyms too.
+	if flags.Anonymize {
+		anonymizer = NewAnonymizer(os.Getenv(anonymizeKeyEnv))
+		log.SetOutput(anonymizedWriter{w: log.Writer()})
+	}
+
+	if flags.Pretty {
+		pretty = NewPrettyPrinter(os.Stdout)
+	}
+
+	if flags.Events != "" {
+		events, err = OpenEventStream(flags.Events)
+		if err != nil {
+			return err
+		}
+		defer events.Close()
+	}
+
+	if flags.LogSample > 1 {
+		logSampler = NewLogSampler(flags.LogSample)
+		log.Printf("Logging 1 in %d records; timeouts and errors are always logged\n", flags.LogSample)
+	}
+
+	if spec := flags.faultsSpec(); spec != "" {
+		faults, _ = ParseFaults(spec)
+		log.Printf("Warning: injecting faults: %s\n", faults)
+	}
+
+	if flags.PprofAddr != "" {
+		if err := startDiagnostics(flags.PprofAddr); err != nil {
+			return err
+		}
+	}
+
+	// A -batch-sql query is read while the records are checked, unless the
+	// run needs the whole batch first.
+	streamSQL := requests == nil && flags.streamsBatchSQL()
+	if streamSQL {
+		requests = []SearchRequest{}
+	} else if requests == nil {
+		requests, err = flags.searchRequests()
+		if err != nil {
+			return fmt.Errorf("failed to read batch: %v", err)
+		}
+	}
+	for i, request := range requests {
+		if err := requireCallbacks(request); err != nil {
+			return fmt.Errorf("record %d: %v", i, err)
+		}
+	}
+	if flags.Ack {
+		acks = NewAckFile(flags.BatchFile, requests)
+		defer func() {
+			if err := acks.Write(); err != nil {
+				log.Printf("Failed to write the acknowledgment file: %v\n", err)
+			}
+		}()
+	}
+	if flags.DedupeBatch {
+		requests, err = dedupeBatch(requests)
+		if err != nil {
+			return err
+		}
+	}
+	if anonymizer != nil {
+		anonymizer.Register(requests)
+	}
+	chunks, err := splitRequests(flags, requests)
 	if err != nil {
 		return err
 	}
 
-	if flags.UseEmulator {
+	if flags.ManifestFile != "" {
+		manifest, err = NewRunManifest(flags, requests)
+		if err != nil {
+			return fmt.Errorf("failed to create manifest: %v", err)
+		}
+		defer func() {
+			if err := manifest.Write(flags.ManifestFile); err != nil {
+				log.Printf("%v\n", err)
+			}
+		}()
+	}
+
+	// Each chunk is reported as a run of its own, in a report named after
+	// the run's report.
+	reportFile, reportCSV := flags.ReportFile, flags.ReportCSV
+	startChunk := func(i int) {
+		summary.SetInput(chunks[i])
+		if len(chunks) == 1 {
+			return
+		}
+		summary.Chunk = fmt.Sprintf("%d/%d", i+1, len(chunks))
+		flags.ReportFile = chunkReportFile(reportFile, i+1)
+		flags.ReportCSV = chunkReportFile(reportCSV, i+1)
+		log.Printf("Checking chunk %d of %d (%d records)\n", i+1, len(chunks), len(chunks[i]))
+	}
+	startChunk(0)
+	log.Printf("Run ID: %s\n", runID)
+
+	defer func() {
+		if cause := context.Cause(runCtx); cause != nil {
+			runErr = cause
+		}
+		finishRun(flags, runErr)
+	}()
+
+	// An emulator that is already running, as announced by
+	// PUBSUB_EMULATOR_HOST, is used instead of starting another one.
+	attachHost := ""
+	if slices.Contains(sinkNames(flags.Sink), sinkPubSub) {
+		attachHost = runningEmulatorHost()
+	}
+	if flags.UseEmulator || attachHost != "" {
 		log.Printf("Using emulator with project ID: %s (can be any string when using emulator)", flags.ProjectID)
 	}
 
 	var opts []option.ClientOption
 
-	// Create main context
-	ctx, cancel := context.WithCancel(context.Background())
+	// Create main context, cancelled on Ctrl+C or SIGTERM so in-flight
+	// searches and publishes are aborted and deferred cleanup still runs
+	ctx, cancel := signal.NotifyContext(runCtx, os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	if flags.UseEmulator {
-		emulator = NewPubSubEmulator(flags.ProjectID, 8085)
-		err := emulator.Start(ctx)
+	if err := checkClock(ctx, flags); err != nil {
+		return err
+	}
+
+	if attachHost != "" {
+		log.Printf("Using the running emulator at %s (%s)\n", attachHost, emulatorHostEnv)
+		opts = append(opts, option.WithEndpoint(attachHost))
+		opts = append(opts, option.WithoutAuthentication())
+	} else if flags.UseEmulator {
+		var stopEmulator func()
+		emulator, stopEmulator, err = startEmulator(ctx, flags)
 		if err != nil {
-			return fmt.Errorf("failed to start emulator: %v", err)
+			return err
 		}
-
-		defer emulator.Stop()
+		defer stopEmulator()
 		opts = append(opts, option.WithEndpoint(emulator.Host()))
 		opts = append(opts, option.WithoutAuthentication())
 	} else if flags.CredFile != "" {
 		log.Printf("Using service account credentials from: %s", flags.CredFile)
 		opts = append(opts, option.WithCredentialsFile(flags.CredFile))
 	}
+	if attachHost == "" && !flags.UseEmulator && slices.Contains(sinkNames(flags.Sink), sinkPubSub) {
+		producerIdentity = resolveProducerIdentity(ctx, flags.CredFile)
+	}
+
+	if flags.QPS > 0 {
+		searchLimiter = rate.NewLimiter(rate.Limit(flags.QPS), 1)
+	}
+	minConfidence = flags.MinConfidence
+	searchOnly = flags.SearchOnly
+	demoMode = flags.Demo
+	if demoMode {
+		logDemoFixtures()
+	}
+	strictCompanies = flags.Strict
+	if flags.Reference != referenceUUID {
+		references = NewReferenceGenerator(flags.Reference, flags.ReferencePrefix, flags.ReferenceStart)
+		for _, request := range requests {
+			if err := requireReference(request); err != nil {
+				return err
+			}
+		}
+	}
+	slowPublishThreshold = flags.SlowPublish
+	orderingKeys = flags.OrderingKey
+	envelopeVersion = flags.Envelope
+	messageEncoding = flags.Encoding
+	resultsTopic = flags.Topic
+	inflight = newPublishLimiter(ctx, flags.MaxInFlight)
+	if flags.MaxFailureRate > 0 {
+		publishFailures = NewPublishFailureMonitor(flags.MaxFailureRate, flags.FailureWindow)
+	}
+	if flags.AdaptiveTimeout {
+		adaptiveTimeout = NewAdaptiveTimeout(flags.TimeoutMin, flags.TimeoutMax)
+	}
 
 	clientFactory = &ClientFactory{
 		projectID: flags.ProjectID,
 		opts:      opts,
+		emulator:  flags.UseEmulator || attachHost != "",
 	}
+	defer clientFactory.Close()
 
-	err = createTopic(ctx, "positive_searches")
-	if err != nil {
-		return fmt.Errorf("failed to create topic: %v", err)
+	if flags.RecordFile != "" {
+		cassette = NewCassette(flags.RecordFile)
+		defer func() {
+			if err := cassette.Save(); err != nil {
+				log.Printf("Failed to write cassette: %v\n", err)
+			}
+		}()
+	} else if flags.ReplayFile != "" {
+		cassette, err = LoadCassette(flags.ReplayFile)
+		if err != nil {
+			return fmt.Errorf("failed to load cassette: %v", err)
+		}
+	}
+	if cassette != nil {
+		searchClock = func() time.Time { return cassette.RecordedAt }
 	}
+	if flags.DebugHTTP != "" {
+		httpDebugLog, err = OpenHTTPDebugLog(flags.DebugHTTP, flags.DebugRedact)
+		if err != nil {
+			return err
+		}
+		defer httpDebugLog.Close()
+	}
+
 	initDataSources()
+	defer closeDataSources()
+
+	var config *Config
+	if flags.ConfigFile != "" {
+		config, err = loadConfig(flags.ConfigFile)
+		if err != nil {
+			return fmt.Errorf("failed to load config: %v", err)
+		}
+		if err := registerConfiguredSources(config); err != nil {
+			return fmt.Errorf("failed to register data sources: %v", err)
+		}
+	}
+	audit := NewConfigAudit(flags, config)
+	audit.Log()
+	if manifest != nil {
+		manifest.SetConfig(audit)
+	}
+	if emulator != nil {
+		emulator.RecreateOnRestart(config)
+	}
+	if flags.CanaryConfig != "" {
+		canary, err = NewCanary(flags.CanaryConfig, flags.CanaryPercent, config)
+		if err != nil {
+			return err
+		}
+		defer canary.Close()
+	}
+	if flags.Directory != "" {
+		directory = NewDirectory(flags.Directory, flags.DirectoryTTL, flags.DirectoryCache)
+		defer directory.Close()
+	}
+	if flags.Strict {
+		if err := checkStrict(flags, requests); err != nil {
+			return err
+		}
+	}
+	if flags.WatchConfig > 0 {
+		go watchConfig(ctx, flags.ConfigFile, flags.WatchConfig)
+	}
 
-	client, err := clientFactory.CreateClient(ctx)
+	sink, err := openSinks(ctx, flags, config)
 	if err != nil {
-		return fmt.Errorf("failed to create pubsub client: %v", err)
+		return err
+	}
+	defer sink.Close()
+	if searchOnly {
+		searchRows = sink
 	}
-	defer client.Close()
 
-	if flags.BatchFile != "" {
-		err := processBatchFile(client, ctx, flags.BatchFile)
+	if flags.DedupDB != "" {
+		if isRedisURL(flags.DedupDB) {
+			dedup, err = OpenRedisDedupStore(flags.DedupDB, flags.DedupWindow)
+		} else {
+			dedup, err = OpenBoltDedupStore(flags.DedupDB, flags.DedupWindow)
+		}
 		if err != nil {
-			return fmt.Errorf("failed to process batch file: %v", err)
+			return err
 		}
-	} else if flags.VRM != "" {
-		err := checkVehicle(client, ctx, flags.VRM, flags.Company)
+		defer dedup.Close()
+	}
+
+	if flags.ResponseCache != "" {
+		responseCache, err = OpenResponseCache(flags.ResponseCache, flags.CacheHitTTL, flags.CacheMissTTL)
 		if err != nil {
-			return fmt.Errorf("failed to check vehicle: %v", err)
+			return err
 		}
+		defer responseCache.Close()
 	}
 
-	if flags.UseEmulator {
-		fmt.Println("\nPress Enter to stop emulator...")
-		bufio.NewReader(os.Stdin).ReadBytes('\n')
+	if flags.ETagCache != "" {
+		etags, err = OpenETagCache(flags.ETagCache, flags.ETagCacheMaxAge)
+		if err != nil {
+			return err
+		}
+		defer etags.Close()
 	}
 
-	return nil
-}
+	var outboxDone chan error
+	if flags.OutboxFile != "" {
+		outbox, err = OpenOutbox(flags.OutboxFile, flags.OutboxMaxFailures)
+		if err != nil {
+			return err
+		}
+		defer outbox.Close()
 
-func createTopic(ctx context.Context, topicName string) error {
-	client, err := clientFactory.CreateClient(ctx)
-	if err != nil {
-		return fmt.Errorf("failed to create pubsub client: %v", err)
+		outboxDone = make(chan error, 1)
+		go func() {
+			outboxDone <- outbox.Run(ctx, func(ctx context.Context, contravention *VehicleContravention) error {
+				err := publishContravention(sink, ctx, contravention)
+				if err == nil {
+					// Entries left by a crashed run may have outlived
+					// their reservation.
+					confirmDedup(contravention.IdempotencyKey())
+				}
+				if events != nil {
+					events.Published(contravention, err)
+				}
+				return err
+			})
+		}()
 	}
 
-	topic := client.Topic(topicName)
-	exists, err := topic.Exists(ctx)
-	if err != nil {
+	processCtx := ctx
+	if flags.Deadline > 0 {
+		var cancelProcess context.CancelFunc
+		processCtx, cancelProcess = context.WithTimeout(ctx, flags.Deadline)
+		defer cancelProcess()
+	}
+
+	if err := startJitter(processCtx, flags.StartJitter); err != nil {
 		return err
 	}
+	if flags.Budget > 0 {
+		budget = NewLatencyBudget(flags.Budget)
+	}
+	if flags.DVLA {
+		dvlaEnricher = NewDVLAEnricher(os.Getenv(dvlaAPIKeyEnv))
+	}
+	if flags.Warmup {
+		warmupSources(processCtx, sourcesFor(requests))
+	}
+	if flags.RampUp > 0 {
+		rampUp = NewRampUp(flags.RampUp)
+	}
+	if flags.Dashboard {
+		dashboard = NewDashboard(os.Stdout)
+		if dashboard != nil {
+			dashboard.Start()
+			defer dashboard.Stop()
+		}
+	}
 
-	if !exists {
-		_, err = client.CreateTopic(ctx, topicName)
+	if flags.Worker {
+		return runWorker(processCtx, sink, flags)
+	}
+
+	for i, chunk := range chunks {
+		if i > 0 {
+			finishRun(flags, nil)
+			summary = NewRunSummary()
+			if artifacts != nil {
+				summary.ArtifactsDir = artifacts.Dir
+			}
+			startChunk(i)
+		}
+
+		if flags.Sample > 0 {
+			sampler = NewHitSampler(flags.Sample)
+		}
+
+		if streamSQL {
+			err = streamBatchSQL(sink, processCtx, flags)
+		} else {
+			err = processRequests(sink, processCtx, chunk)
+		}
+		publishErr := inflight.Wait()
+		sink.Wait()
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to process records: %v", err)
+		}
+		if publishErr != nil {
+			return publishErr
+		}
+		if publishFailures != nil {
+			if err := publishFailures.Err(); err != nil {
+				return err
+			}
+		}
+		if sampler != nil {
+			summary.SetSample(sampler.SpotCheck(ctx))
+		}
+		if flags.Strict && summary.Timeouts > 0 {
+			return fmt.Errorf("strict mode: %d records timed out: %s", summary.Timeouts, summary.TimedOut())
+		}
+	}
+
+	if outbox != nil {
+		outbox.Finish()
+		if err := <-outboxDone; err != nil {
+			return fmt.Errorf("failed to publish outbox: %v", err)
 		}
 	}
 
+	if emulator != nil {
+		fmt.Println("\nPress Enter to stop emulator...")
+		waitForEnter(ctx)
+	}
+
 	return nil
 }
+
+// waitForEnter returns when Enter is pressed or the context is cancelled.
+func waitForEnter(ctx context.Context) {
+	pressed := make(chan struct{})
+	go func() {
+		bufio.NewReader(os.Stdin).ReadBytes('\n')
+		close(pressed)
+	}()
+
+	select {
+	case <-pressed:
+	case <-ctx.Done():
+	}
+}
+
+func finishRun(flags *Flags, runErr error) {
+	if callbacks != nil {
+		callbacks.Wait()
+	}
+	summary.Finish(runErr)
+
+	if flags.ReportFile != "" {
+		if err := summary.WriteReport(flags.ReportFile); err != nil {
+			log.Printf("Failed to write report: %v\n", err)
+		}
+	}
+	if flags.ReportCSV != "" {
+		if err := summary.WriteCSVReport(flags.ReportCSV); err != nil {
+			log.Printf("Failed to write CSV report: %v\n", err)
+		}
+	}
+
+	if manifest != nil {
+		manifest.Add(summary)
+	}
+
+	log.Print(summary.Text())
+	if pretty != nil {
+		pretty.Summary(summary)
+	}
+	sendNotifications(buildNotifiers(flags), summary)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"time"
+)
+
+// secretFlags hold credentials and are never written to the manifest.
+var secretFlags = map[string]bool{
+	"batch-dsn":    true,
+	"notify-slack": true,
+}
+
+// RunManifest records what a run did and with which settings, for audits:
+// the build, every flag value, the environment, the config, a hash of the input and the result
+// counts of all chunks. Secrets are redacted.
+type RunManifest struct {
+	RunID        string            `json:"run_id"`
+	Version      string            `json:"version"`
+	Commit       string            `json:"commit"`
+	GoVersion    string            `json:"go_version"`
+	StartedAt    time.Time         `json:"started_at"`
+	FinishedAt   time.Time         `json:"finished_at"`
+	Flags        map[string]string `json:"flags"`
+	Environment  map[string]string `json:"environment,omitempty"`
+	Config       *Config           `json:"config,omitempty"`
+	ConfigSHA256 string            `json:"config_sha256,omitempty"`
+	Input        ManifestInput     `json:"input"`
+	Counts       ManifestCounts    `json:"counts"`
+	Chunks       int               `json:"chunks"`
+	RunError     string            `json:"run_error,omitempty"`
+	mutex        sync.Mutex
+}
+
+type ManifestInput struct {
+	Kind    string `json:"kind"`
+	Path    string `json:"path,omitempty"`
+	Query   string `json:"query,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+	Records int    `json:"records"`
+}
+
+type ManifestCounts struct {
+	Total      int `json:"total"`
+	Hits       int `json:"hits"`
+	Misses     int `json:"misses"`
+	Timeouts   int `json:"timeouts"`
+	Errors     int `json:"errors"`
+	Skipped    int `json:"skipped"`
+	Duplicates int `json:"duplicates"`
+	Published  int `json:"published"`
+}
+
+// manifest is nil unless -manifest (or -artifacts) is set.
+var manifest *RunManifest
+
+func NewRunManifest(flags *Flags, requests []SearchRequest) (*RunManifest, error) {
+	m := &RunManifest{
+		RunID:     runID,
+		Version:   version,
+		Commit:    buildCommit(),
+		GoVersion: runtime.Version(),
+		StartedAt: time.Now(),
+		Flags:     flags.values(),
+		Input:     ManifestInput{Kind: "vrm", Records: len(requests)},
+	}
+
+	switch {
+	case flags.BatchSQL != "":
+		m.Input.Kind = "sql"
+		m.Input.Query = flags.BatchSQL
+	case flags.BatchFile != "":
+		hash, err := fileSHA256(flags.BatchFile)
+		if err != nil {
+			return nil, err
+		}
+		m.Input.Kind = "batch"
+		m.Input.Path = flags.BatchFile
+		m.Input.SHA256 = hash
+	}
+
+	if flags.ConfigFile != "" {
+		hash, err := fileSHA256(flags.ConfigFile)
+		if err != nil {
+			return nil, err
+		}
+		m.ConfigSHA256 = hash
+	}
+	return m, nil
+}
+
+// values returns every check flag with its value, including defaults.
+func (f *Flags) values() map[string]string {
+	// Registering sets the fields to their defaults, so the values are copied
+	// in afterwards; the flags then read the copy's fields.
+	var shadow Flags
+	fs := flag.NewFlagSet("manifest", flag.ContinueOnError)
+	shadow.register(fs)
+	shadow = *f
+
+	values := make(map[string]string)
+	fs.VisitAll(func(fl *flag.Flag) {
+		value := fl.Value.String()
+		if secretFlags[fl.Name] && value != "" {
+			value = redacted
+		}
+		if fl.Name == "vrm" {
+			value = anonymizeText(value)
+		}
+		if isRedisURL(value) {
+			value = redactURL(value)
+		}
+		values[fl.Name] = value
+	})
+	return values
+}
+
+// SetConfig stores the effective configuration of the run, with secrets
+// redacted.
+func (m *RunManifest) SetConfig(audit *ConfigAudit) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.Flags = audit.Flags
+	m.Environment = audit.Environment
+	m.Config = audit.Config
+}
+
+// Add counts the results of a finished run or chunk.
+func (m *RunManifest) Add(s *RunSummary) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.Chunks++
+	m.Counts.Total += s.Total
+	m.Counts.Hits += s.Hits
+	m.Counts.Misses += s.Misses
+	m.Counts.Timeouts += s.Timeouts
+	m.Counts.Errors += s.Errors
+	m.Counts.Skipped += s.Skipped
+	m.Counts.Duplicates += s.Duplicates
+	m.Counts.Published += s.Publish.Count
+	if s.RunError != "" {
+		m.RunError = s.RunError
+	}
+}
+
+func (m *RunManifest) Write(path string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.FinishedAt = time.Now()
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	return nil
+}
+
+func fileSHA256(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
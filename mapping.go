@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type pathToken struct {
+	key     string
+	index   int
+	isIndex bool
+}
+
+// parseJSONPath parses the small JSONPath subset used in response mappings:
+// dotted keys and numeric array indexes, e.g. "$.result.vehicles[0].vrm".
+func parseJSONPath(path string) ([]pathToken, error) {
+	path = strings.TrimPrefix(strings.TrimSpace(path), "$")
+	tokens := make([]pathToken, 0)
+
+	for len(path) > 0 {
+		switch path[0] {
+		case '.':
+			path = path[1:]
+		case '[':
+			end := strings.IndexByte(path, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated index in path")
+			}
+			index, err := strconv.Atoi(path[1:end])
+			if err != nil {
+				return nil, fmt.Errorf("invalid index %q in path", path[1:end])
+			}
+			tokens = append(tokens, pathToken{index: index, isIndex: true})
+			path = path[end+1:]
+		default:
+			end := strings.IndexAny(path, ".[")
+			if end < 0 {
+				end = len(path)
+			}
+			tokens = append(tokens, pathToken{key: path[:end]})
+			path = path[end:]
+		}
+	}
+
+	return tokens, nil
+}
+
+func lookupJSONPath(doc interface{}, path string) (interface{}, bool, error) {
+	tokens, err := parseJSONPath(path)
+	if err != nil {
+		return nil, false, err
+	}
+
+	current := doc
+	for _, token := range tokens {
+		if token.isIndex {
+			list, ok := current.([]interface{})
+			if !ok || token.index < 0 || token.index >= len(list) {
+				return nil, false, nil
+			}
+			current = list[token.index]
+			continue
+		}
+
+		object, ok := current.(map[string]interface{})
+		if !ok {
+			return nil, false, nil
+		}
+		current, ok = object[token.key]
+		if !ok {
+			return nil, false, nil
+		}
+	}
+
+	return current, true, nil
+}
+
+// setField sets a dotted canonical field such as "lease_company.postcode",
+// creating intermediate objects as needed.
+func setField(object map[string]interface{}, field string, value interface{}) {
+	parts := strings.Split(field, ".")
+	for _, part := range parts[:len(parts)-1] {
+		child, ok := object[part].(map[string]interface{})
+		if !ok {
+			child = make(map[string]interface{})
+			object[part] = child
+		}
+		object = child
+	}
+	object[parts[len(parts)-1]] = value
+}
+
+// applyResponseMapping translates a provider response into the canonical
+// VehicleContravention JSON shape. Mapping keys are canonical field names and
+// values are JSONPath expressions into the provider response. Fields that are
+// not mapped are passed through unchanged.
+func applyResponseMapping(body []byte, mapping map[string]string) ([]byte, error) {
+	var doc interface{}
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, err
+	}
+
+	// Paths are looked up in the response as received, so the result doesn't
+	// depend on the order fields are mapped in.
+	canonical := make(map[string]interface{})
+	if object, ok := doc.(map[string]interface{}); ok {
+		canonical = copyJSON(object).(map[string]interface{})
+	}
+
+	for field, path := range mapping {
+		value, found, err := lookupJSONPath(doc, path)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mapping for %s: %v", field, err)
+		}
+		if found {
+			setField(canonical, field, value)
+		}
+	}
+
+	return json.Marshal(canonical)
+}
+
+// copyJSON deep-copies the objects and arrays of a decoded JSON value.
+func copyJSON(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(value))
+		for key, child := range value {
+			copied[key] = copyJSON(child)
+		}
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(value))
+		for i, child := range value {
+			copied[i] = copyJSON(child)
+		}
+		return copied
+	default:
+		return value
+	}
+}
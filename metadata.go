@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/costinul/transfer360-test/transfer360"
+)
+
+// Pub/Sub limits on attribute keys and values, in bytes.
+const (
+	maxAttributeKey   = 256
+	maxAttributeValue = 1024
+)
+
+// validateMetadata checks that record metadata can be published as message
+// attributes.
+func validateMetadata(metadata map[string]string) error {
+	keys := make([]string, 0, len(metadata))
+	for key := range metadata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		switch {
+		case key == "":
+			return fmt.Errorf("metadata keys must not be empty")
+		case transfer360.IsReservedAttribute(key):
+			return fmt.Errorf("metadata key %q is reserved", key)
+		case strings.HasPrefix(strings.ToLower(key), "goog"):
+			return fmt.Errorf("metadata key %q must not start with goog", key)
+		case len(key) > maxAttributeKey:
+			return fmt.Errorf("metadata key %q is longer than %d bytes", key, maxAttributeKey)
+		case len(metadata[key]) > maxAttributeValue:
+			return fmt.Errorf("metadata value of %q is longer than %d bytes", key, maxAttributeValue)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// contraventionDateFormats are the date formats seen from providers. Dates
+// without a zone are taken as UTC.
+var contraventionDateFormats = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04",
+	batchDateFormat,
+	"02/01/2006 15:04:05",
+	"02/01/2006 15:04",
+	"02/01/2006",
+	"02-01-2006",
+	"20060102",
+	time.RFC1123Z,
+	time.RFC1123,
+}
+
+var ukPostcode = regexp.MustCompile(`^([A-Z]{1,2}[0-9][A-Z0-9]?|GIR)([0-9][A-Z]{2})$`)
+
+// normalizeContravention brings a source's result into one format before it
+// is checked and published: the contravention date as RFC3339 in UTC and UK
+// postcodes in their canonical form, e.g. "SW1A 1AA".
+func normalizeContravention(contravention *VehicleContravention) error {
+	date, err := normalizeDate(contravention.ContraventionDate)
+	if err != nil {
+		return err
+	}
+	contravention.ContraventionDate = date
+	contravention.LeaseCompany.Postcode = normalizePostcode(contravention.LeaseCompany.Postcode)
+	return nil
+}
+
+func normalizeDate(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", nil
+	}
+	for _, format := range contraventionDateFormats {
+		if t, err := time.Parse(format, value); err == nil {
+			return t.UTC().Format(time.RFC3339), nil
+		}
+	}
+	// Unix timestamps, in seconds or milliseconds.
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil && len(value) >= 9 {
+		if len(value) > 11 {
+			return time.UnixMilli(seconds).UTC().Format(time.RFC3339), nil
+		}
+		return time.Unix(seconds, 0).UTC().Format(time.RFC3339), nil
+	}
+	return "", fmt.Errorf("unrecognized contravention_date %q from source", value)
+}
+
+// normalizePostcode upper-cases a postcode and puts a single space before
+// the inward code. Values that are not UK postcodes are only trimmed.
+func normalizePostcode(value string) string {
+	compact := strings.ToUpper(strings.Join(strings.Fields(value), ""))
+	if parts := ukPostcode.FindStringSubmatch(compact); parts != nil {
+		return parts[1] + " " + parts[2]
+	}
+	return strings.TrimSpace(value)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+type Notifier interface {
+	Notify(summary *RunSummary) error
+}
+
+type slackNotifier struct {
+	webhookURL string
+}
+
+type smtpNotifier struct {
+	addr     string
+	from     string
+	to       []string
+	username string
+	password string
+}
+
+func (n *slackNotifier) Notify(summary *RunSummary) error {
+	body, err := json.Marshal(map[string]string{
+		"text": "```" + summary.Text() + "```",
+	})
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Timeout: 10 * time.Second,
+	}
+	resp, err := client.Post(n.webhookURL, "application/json", bytes.NewBuffer(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status code from slack: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (n *smtpNotifier) Notify(summary *RunSummary) error {
+	subject := "Vehicle check run completed"
+	if summary.RunError != "" {
+		subject = "Vehicle check run FAILED"
+	}
+
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", n.from)
+	fmt.Fprintf(&message, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&message, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&message, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	message.WriteString(strings.ReplaceAll(summary.Text(), "\n", "\r\n"))
+
+	var auth smtp.Auth
+	if n.username != "" {
+		host := strings.Split(n.addr, ":")[0]
+		auth = smtp.PlainAuth("", n.username, n.password, host)
+	}
+
+	return smtp.SendMail(n.addr, auth, n.from, n.to, message.Bytes())
+}
+
+// buildNotifiers creates the configured notification hooks. SMTP credentials
+// are read from SMTP_USERNAME and SMTP_PASSWORD so they stay off the command line.
+func buildNotifiers(flags *Flags) []Notifier {
+	notifiers := make([]Notifier, 0)
+
+	if flags.SlackWebhook != "" {
+		notifiers = append(notifiers, &slackNotifier{webhookURL: flags.SlackWebhook})
+	}
+
+	if flags.NotifyEmail != "" {
+		notifiers = append(notifiers, &smtpNotifier{
+			addr:     flags.SMTPAddr,
+			from:     flags.SMTPFrom,
+			to:       strings.Split(flags.NotifyEmail, ","),
+			username: os.Getenv("SMTP_USERNAME"),
+			password: os.Getenv("SMTP_PASSWORD"),
+		})
+	}
+
+	return notifiers
+}
+
+func sendNotifications(notifiers []Notifier, summary *RunSummary) {
+	for _, notifier := range notifiers {
+		if err := notifier.Notify(summary); err != nil {
+			log.Printf("Failed to send notification: %v\n", err)
+		}
+	}
+}
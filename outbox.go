@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	outboxPending = "pending"
+	outboxSent    = "sent"
+)
+
+// outboxRetryDelay is how long the publisher loop waits after a failed
+// publish before it tries again, times the number of failures in a row.
+const outboxRetryDelay = time.Second
+
+// OutboxEntry is a single line of the outbox journal. A contravention is
+// written once as pending and later followed by a sent marker with the same ID.
+// IDs are generated for each entry rather than taken from the reference,
+// which a later run can issue again, e.g. with -reference sequential.
+type OutboxEntry struct {
+	ID            string                `json:"id"`
+	Status        string                `json:"status"`
+	Contravention *VehicleContravention `json:"contravention,omitempty"`
+	Metadata      map[string]string     `json:"metadata,omitempty"`
+	// DiscoveredAt is kept apart from the contravention, like Metadata,
+	// since neither is part of the published message.
+	DiscoveredAt time.Time `json:"discovered_at,omitzero"`
+}
+
+// Outbox is an append-only journal of results waiting to be published.
+// Every write is synced to disk before it is acknowledged, so results that
+// were accepted but not yet published survive a crash and are picked up again
+// on the next start, while results already marked as sent are skipped.
+type Outbox struct {
+	path    string
+	file    *os.File
+	mutex   sync.Mutex
+	pending map[string]*VehicleContravention
+	order   []string
+	// keys are the idempotency keys of every contravention in the journal,
+	// sent or not, so a restarted run doesn't add them again.
+	keys   map[string]bool
+	closed bool
+	notify chan struct{}
+	// maxFailures is how many publishes in a row may fail before the
+	// publisher loop gives up, and err why it did.
+	maxFailures int
+	err         error
+}
+
+func OpenOutbox(path string, maxFailures int) (*Outbox, error) {
+	outbox := &Outbox{
+		path:        path,
+		pending:     make(map[string]*VehicleContravention),
+		keys:        make(map[string]bool),
+		notify:      make(chan struct{}, 1),
+		maxFailures: maxFailures,
+	}
+
+	if err := outbox.load(); err != nil {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open outbox: %w", err)
+	}
+	outbox.file = file
+
+	return outbox, nil
+}
+
+func (o *Outbox) load() error {
+	file, err := os.Open(o.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open outbox: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry OutboxEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn last line means we crashed mid-write; the entry was
+			// never acknowledged, so it is safe to ignore.
+			continue
+		}
+
+		switch entry.Status {
+		case outboxPending:
+			if entry.Contravention != nil {
+				if _, ok := o.pending[entry.ID]; !ok {
+					o.order = append(o.order, entry.ID)
+				}
+				entry.Contravention.Metadata = entry.Metadata
+				entry.Contravention.DiscoveredAt = entry.DiscoveredAt
+				o.pending[entry.ID] = entry.Contravention
+				o.keys[entry.Contravention.IdempotencyKey()] = true
+			}
+		case outboxSent:
+			delete(o.pending, entry.ID)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("failed to read outbox: %w", err)
+	}
+
+	if len(o.pending) > 0 {
+		o.notifyPublisher()
+	}
+	return nil
+}
+
+func (o *Outbox) append(entry OutboxEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	if _, err := o.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write outbox: %w", err)
+	}
+	return o.file.Sync()
+}
+
+// Add stores a contravention as pending. The reference is assigned here so
+// that a re-publish after a restart carries the same reference.
+func (o *Outbox) Add(contravention *VehicleContravention) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if contravention.Reference == "" {
+		contravention.Reference = uuid.New().String()
+	}
+
+	id := uuid.New().String()
+	err := o.append(OutboxEntry{
+		ID:            id,
+		Status:        outboxPending,
+		Contravention: contravention,
+		Metadata:      contravention.Metadata,
+		DiscoveredAt:  contravention.DiscoveredAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	o.order = append(o.order, id)
+	o.pending[id] = contravention
+	o.keys[contravention.IdempotencyKey()] = true
+	o.notifyPublisher()
+
+	return nil
+}
+
+// Has reports whether the journal already holds a contravention with the
+// idempotency key, added by this run or an earlier one that crashed, whether
+// it was sent or not.
+func (o *Outbox) Has(key string) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.keys[key]
+}
+
+func (o *Outbox) MarkSent(id string) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	if err := o.append(OutboxEntry{ID: id, Status: outboxSent}); err != nil {
+		return err
+	}
+	delete(o.pending, id)
+	return nil
+}
+
+// Pending returns the unsent entries in the order they were added.
+func (o *Outbox) Pending() []OutboxEntry {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	order := o.order[:0]
+	pending := make([]OutboxEntry, 0, len(o.pending))
+	for _, id := range o.order {
+		if contravention, ok := o.pending[id]; ok {
+			order = append(order, id)
+			pending = append(pending, OutboxEntry{ID: id, Status: outboxPending, Contravention: contravention})
+		}
+	}
+	o.order = order
+
+	return pending
+}
+
+// Finish tells the publisher loop that no more entries will be added, so it
+// returns once everything pending has been sent.
+func (o *Outbox) Finish() {
+	o.mutex.Lock()
+	o.closed = true
+	o.mutex.Unlock()
+	o.notifyPublisher()
+}
+
+func (o *Outbox) notifyPublisher() {
+	select {
+	case o.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Run is the publisher loop. It sends pending entries with publish and marks
+// each one as sent, until Finish has been called and the outbox is empty.
+// A failed publish is logged and counted in the run summary as it happens,
+// and the entry stays pending to be tried again after a pause. Once
+// maxFailures publishes in a row have failed, the loop stops and Err returns
+// why, so the run stops checking records.
+func (o *Outbox) Run(ctx context.Context, publish func(context.Context, *VehicleContravention) error) error {
+	failures := 0
+	for {
+		for _, entry := range o.Pending() {
+			contravention := entry.Contravention
+			if err := publish(ctx, contravention); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				failures++
+				log.Printf("Failed to publish outbox entry %s for %s (%d in a row): %v\n", contravention.Reference, contravention.VRM, failures, err)
+				summary.RecordOutboxFailure()
+				if failures >= o.maxFailures {
+					return o.fail(fmt.Errorf("%d outbox publishes failed in a row, last error: %v", failures, err))
+				}
+				break
+			}
+			failures = 0
+			if err := o.MarkSent(entry.ID); err != nil {
+				return o.fail(err)
+			}
+		}
+
+		o.mutex.Lock()
+		done := o.closed && len(o.pending) == 0
+		o.mutex.Unlock()
+		if done {
+			return nil
+		}
+
+		if failures > 0 {
+			select {
+			case <-time.After(outboxRetryDelay * time.Duration(failures)):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			continue
+		}
+		select {
+		case <-o.notify:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// fail stops the outbox for the rest of the run.
+func (o *Outbox) fail(err error) error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	o.err = err
+	log.Printf("Stopping the run: %v\n", err)
+	return err
+}
+
+// Err returns the error that stopped the publisher loop, if it has.
+func (o *Outbox) Err() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.err
+}
+
+func (o *Outbox) Close() error {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	return o.file.Close()
+}
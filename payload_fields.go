@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// PayloadFields limits the message fields a sink receives, for consumers
+// that must not get some of them, such as the address of the lease company.
+// Either the fields to keep or the fields to drop are listed. Fields are
+// named as in the message, with lease_company.* and vehicle.* naming the
+// fields of those objects; lease_company and vehicle name all of them.
+type PayloadFields struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// payloadFields clear each field that can be left out of a message.
+var payloadFields = map[string]func(c *VehicleContravention){
+	"reference":                   func(c *VehicleContravention) { c.Reference = "" },
+	"vrm":                         func(c *VehicleContravention) { c.VRM = "" },
+	"contravention_date":          func(c *VehicleContravention) { c.ContraventionDate = "" },
+	"is_hirer_vehicle":            func(c *VehicleContravention) { c.IsHirerVehicle = false },
+	"lease_company.companyname":   func(c *VehicleContravention) { c.LeaseCompany.CompanyName = "" },
+	"lease_company.address_line1": func(c *VehicleContravention) { c.LeaseCompany.AddressLine1 = "" },
+	"lease_company.address_line2": func(c *VehicleContravention) { c.LeaseCompany.AddressLine2 = "" },
+	"lease_company.addres_line3":  func(c *VehicleContravention) { c.LeaseCompany.AddressLine3 = "" },
+	"lease_company.addres_line4":  func(c *VehicleContravention) { c.LeaseCompany.AddressLine4 = "" },
+	"lease_company.postcode":      func(c *VehicleContravention) { c.LeaseCompany.Postcode = "" },
+	"confidence":                  func(c *VehicleContravention) { c.Confidence = nil },
+	"vehicle":                     func(c *VehicleContravention) { c.Vehicle = nil },
+}
+
+// requiredPayloadFields are never left out: consumers match results to
+// their contraventions and companies by them, and a missing
+// is_hirer_vehicle would read as false.
+var requiredPayloadFields = []string{"vrm", "contravention_date", "is_hirer_vehicle", "lease_company.companyname"}
+
+// expand returns the payload fields a name stands for.
+func (f *PayloadFields) expand(name string) []string {
+	if _, ok := payloadFields[name]; ok {
+		return []string{name}
+	}
+	fields := make([]string, 0)
+	for field := range payloadFields {
+		if strings.HasPrefix(field, name+".") {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// dropped returns the fields that are left out of messages.
+func (f *PayloadFields) dropped(owner string) (map[string]bool, error) {
+	if len(f.Include) > 0 && len(f.Exclude) > 0 {
+		return nil, fmt.Errorf("%s: fields can list include or exclude, not both", owner)
+	}
+
+	listed := make(map[string]bool)
+	for _, name := range append(f.Include, f.Exclude...) {
+		fields := f.expand(name)
+		if len(fields) == 0 {
+			return nil, fmt.Errorf("%s: unknown payload field %q", owner, name)
+		}
+		for _, field := range fields {
+			listed[field] = true
+		}
+	}
+
+	dropped := make(map[string]bool)
+	for field := range payloadFields {
+		if listed[field] == (len(f.Exclude) > 0) {
+			dropped[field] = true
+		}
+	}
+	for _, field := range requiredPayloadFields {
+		if dropped[field] {
+			return nil, fmt.Errorf("%s: payload field %s is required and cannot be left out", owner, field)
+		}
+	}
+	return dropped, nil
+}
+
+func (f *PayloadFields) validate(owner string) error {
+	_, err := f.dropped(owner)
+	return err
+}
+
+// shapedSink leaves fields out of the results it passes on to a sink.
+type shapedSink struct {
+	Sink
+	dropped map[string]bool
+}
+
+// shapeSink wraps a sink in a shapedSink when fields leave anything out.
+// The fields were validated with the config.
+func shapeSink(sink Sink, fields *PayloadFields) Sink {
+	if fields == nil {
+		return sink
+	}
+	dropped, err := fields.dropped("")
+	if err != nil || len(dropped) == 0 {
+		return sink
+	}
+	return &shapedSink{Sink: sink, dropped: dropped}
+}
+
+func (s *shapedSink) Publish(ctx context.Context, contravention *VehicleContravention, done func(error)) error {
+	// Other sinks get the same result, so the fields are cleared on a copy.
+	shaped := *contravention
+	for field := range s.dropped {
+		payloadFields[field](&shaped)
+	}
+	return s.Sink.Publish(ctx, &shaped, done)
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+	colorCyan   = "\033[36m"
+	colorGray   = "\033[90m"
+)
+
+var outcomeColors = map[string]string{
+	outcomeHit:       colorGreen,
+	outcomeMiss:      colorGray,
+	outcomeTimeout:   colorYellow,
+	outcomeError:     colorRed,
+	outcomeDuplicate: colorCyan,
+	outcomeSkipped:   colorGray,
+	outcomeDeferred:  colorYellow,
+}
+
+// PrettyPrinter writes a status line per checked record and a summary table
+// for people watching a run in a terminal. The log still goes to stderr.
+type PrettyPrinter struct {
+	w     io.Writer
+	color bool
+	mutex sync.Mutex
+}
+
+// pretty is nil unless -pretty is set and stdout is a terminal.
+var pretty *PrettyPrinter
+
+// NewPrettyPrinter returns nil when f is not a terminal, so output piped to a
+// file or another program stays plain. NO_COLOR turns off the colors only.
+func NewPrettyPrinter(f *os.File) *PrettyPrinter {
+	info, err := f.Stat()
+	if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	return &PrettyPrinter{w: f, color: os.Getenv("NO_COLOR") == ""}
+}
+
+// paint pads text to width before coloring it, so colored columns line up.
+func (p *PrettyPrinter) paint(color string, text string, width int) string {
+	text = fmt.Sprintf("%-*s", width, text)
+	if !p.color || color == "" {
+		return text
+	}
+	return color + text + colorReset
+}
+
+func (p *PrettyPrinter) Record(result RecordResult) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	company := result.Company
+	if company == "" {
+		company = "-"
+	}
+	line := fmt.Sprintf("%s %-10s %-24s %-10s",
+		p.paint(outcomeColors[result.Outcome], strings.ToUpper(result.Outcome), 9),
+		result.VRM, company, datesKey(result.ContraventionDate, result.DateFrom, result.DateTo))
+	if result.Error != "" {
+		line += " " + p.paint(colorGray, result.Error, 0)
+	}
+	fmt.Fprintln(p.w, strings.TrimRight(line, " "))
+}
+
+func (p *PrettyPrinter) Summary(s *RunSummary) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	rows := []struct {
+		outcome string
+		count   int
+	}{
+		{outcomeHit, s.Hits},
+		{outcomeMiss, s.Misses},
+		{outcomeTimeout, s.Timeouts},
+		{outcomeError, s.Errors},
+		{outcomeDuplicate, s.Duplicates},
+		{outcomeSkipped, s.Skipped},
+		{outcomeDeferred, s.Deferred},
+	}
+
+	fmt.Fprintln(p.w)
+	fmt.Fprintf(p.w, "%-10s %8s\n", "OUTCOME", "RECORDS")
+	for _, row := range rows {
+		color := ""
+		if row.count > 0 {
+			color = outcomeColors[row.outcome]
+		}
+		fmt.Fprintf(p.w, "%s %8d\n", p.paint(color, strings.ToUpper(row.outcome), 10), row.count)
+	}
+	fmt.Fprintf(p.w, "%-10s %8d\n", "TOTAL", s.Total+s.Skipped)
+	fmt.Fprintf(p.w, "%-10s %8s\n", "DURATION", s.FinishedAt.Sub(s.StartedAt).Round(time.Second))
+	if s.RunError != "" {
+		fmt.Fprintf(p.w, "%s %s\n", p.paint(colorRed, "FAILED", 10), s.RunError)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+const (
+	priorityHigh   = "high"
+	priorityNormal = "normal"
+	priorityLow    = "low"
+)
+
+// priorityRanks orders the priorities of batch records; records without a
+// priority are normal.
+var priorityRanks = map[string]int{
+	priorityHigh:   0,
+	"":             1,
+	priorityNormal: 1,
+	priorityLow:    2,
+}
+
+// searchRetries is how many times a timed out search is tried again, by
+// priority, so urgent records get through a struggling source.
+var searchRetries = map[string]int{
+	priorityHigh: 2,
+}
+
+// searchRetryDelay is the wait before the first retry; it grows with every
+// further retry.
+const searchRetryDelay = time.Second
+
+func validatePriority(priority string) error {
+	if _, ok := priorityRanks[priority]; !ok {
+		return fmt.Errorf("invalid priority %q, expected high, normal or low", priority)
+	}
+	return nil
+}
+
+// sortByPriority moves high priority records to the front and low priority
+// ones to the back, keeping the batch order otherwise.
+func sortByPriority(requests []SearchRequest) {
+	sort.SliceStable(requests, func(i, j int) bool {
+		return priorityRanks[requests[i].Priority] < priorityRanks[requests[j].Priority]
+	})
+}
+
+// searchWithRetries searches a record, retrying timeouts as often as its
+// priority allows.
+func searchWithRetries(ctx context.Context, request SearchRequest) ([]*VehicleContravention, string, error) {
+	retries := searchRetries[request.Priority]
+	for attempt := 0; ; attempt++ {
+		contraventions, outcome, err := searchVehicle(ctx, request)
+		if outcome != outcomeTimeout || attempt == retries || ctx.Err() != nil {
+			return contraventions, outcome, err
+		}
+
+		if source := getDataSource(request.Company); source != nil {
+			summary.RecordRetry(source.ID())
+		}
+		delay := searchRetryDelay * time.Duration(attempt+1)
+		log.Printf("Retrying %s priority record %s in %s (%d of %d)\n", request.Priority, request.VRM, delay, attempt+1, retries)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return contraventions, outcome, err
+		}
+	}
+}
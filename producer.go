@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"time"
+
+	"cloud.google.com/go/compute/metadata"
+	"cloud.google.com/go/pubsub"
+	"golang.org/x/oauth2/google"
+)
+
+// producerHostname is sent as the hostname attribute, so a stale or
+// misrouted message can be traced back to the machine that published it.
+var producerHostname = hostname()
+
+// producerIdentity is the service account the results are published as,
+// sent as the producer_identity attribute. It is empty with the emulator and
+// when the credentials don't name a service account, e.g. user credentials.
+var producerIdentity string
+
+func hostname() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// producerAttributes are the attributes identifying when and by whom a
+// message was produced.
+func producerAttributes(attributes map[string]string) {
+	attributes["produced_at"] = stampTime().Format(time.RFC3339)
+	if producerHostname != "" {
+		attributes["hostname"] = producerHostname
+	}
+	if producerIdentity != "" {
+		attributes["producer_identity"] = producerIdentity
+	}
+}
+
+// resolveProducerIdentity returns the service account email of the -creds
+// file, of the application default credentials, or of the Compute Engine,
+// Cloud Run or GKE metadata server, in that order.
+func resolveProducerIdentity(ctx context.Context, credFile string) string {
+	if credFile != "" {
+		body, err := os.ReadFile(credFile)
+		if err != nil {
+			return ""
+		}
+		return clientEmail(body)
+	}
+
+	if creds, err := google.FindDefaultCredentials(ctx, pubsub.ScopePubSub); err == nil && len(creds.JSON) > 0 {
+		return clientEmail(creds.JSON)
+	}
+
+	if metadata.OnGCE() {
+		email, err := metadata.EmailWithContext(ctx, "default")
+		if err != nil {
+			log.Printf("Failed to read the service account from the metadata server: %v\n", err)
+			return ""
+		}
+		return email
+	}
+	return ""
+}
+
+func clientEmail(credentials []byte) string {
+	var file struct {
+		ClientEmail string `json:"client_email"`
+	}
+	if err := json.Unmarshal(credentials, &file); err != nil {
+		return ""
+	}
+	return file.ClientEmail
+}
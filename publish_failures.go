@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+)
+
+// minPublishesForRate is how many publishes the window must hold before the
+// failure rate is judged, so a single early failure doesn't stop a run.
+const minPublishesForRate = 10
+
+// PublishFailureMonitor stops a run once too many of its recent publishes
+// have failed. It tracks the outcome of the last publishes in a rolling
+// window; when the share of failures in it exceeds the threshold, every
+// later record fails with the same error.
+type PublishFailureMonitor struct {
+	maxRate float64
+	window  []bool
+	next    int
+	count   int
+	failed  int
+	err     error
+	mutex   sync.Mutex
+}
+
+// publishFailures is nil unless -max-publish-failure-rate is set.
+var publishFailures *PublishFailureMonitor
+
+func NewPublishFailureMonitor(maxRate float64, window int) *PublishFailureMonitor {
+	return &PublishFailureMonitor{maxRate: maxRate, window: make([]bool, window)}
+}
+
+// Record adds the outcome of a publish to the window.
+func (m *PublishFailureMonitor) Record(err error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.count == len(m.window) {
+		if m.window[m.next] {
+			m.failed--
+		}
+	} else {
+		m.count++
+	}
+	m.window[m.next] = err != nil
+	if err != nil {
+		m.failed++
+	}
+	m.next = (m.next + 1) % len(m.window)
+
+	if err == nil || m.err != nil || m.count < min(minPublishesForRate, len(m.window)) {
+		return
+	}
+	if rate := float64(m.failed) / float64(m.count); rate > m.maxRate {
+		m.err = fmt.Errorf("publish failure rate %.1f%% over the last %d publishes exceeds %.1f%%, last error: %v",
+			rate*100, m.count, m.maxRate*100, err)
+		log.Printf("Stopping the run: %v\n", m.err)
+	}
+}
+
+// Err returns the error that stopped the run, if the threshold was exceeded.
+func (m *PublishFailureMonitor) Err() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.err
+}
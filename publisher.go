@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Publisher sends messages to a topic. It is what publishAsync needs of a
+// *pubsub.Topic, so publishing can be pointed at something else.
+type Publisher interface {
+	Publish(ctx context.Context, message *pubsub.Message) PublishResult
+}
+
+// PublishResult is the confirmation of a published message.
+type PublishResult interface {
+	Get(ctx context.Context) (serverID string, err error)
+}
+
+// topicPublisher publishes to a Pub/Sub topic.
+type topicPublisher struct {
+	topic *pubsub.Topic
+}
+
+func (p topicPublisher) Publish(ctx context.Context, message *pubsub.Message) PublishResult {
+	result := p.topic.Publish(ctx, message)
+	if message.OrderingKey == "" {
+		return result
+	}
+	return orderedResult{PublishResult: result, topic: p.topic, key: message.OrderingKey}
+}
+
+// orderedResult resumes publishing of an ordering key after a failed
+// publish, which pauses the key until then, so the message can be sent again
+// and later results of the vehicle aren't rejected.
+type orderedResult struct {
+	PublishResult
+	topic *pubsub.Topic
+	key   string
+}
+
+func (r orderedResult) Get(ctx context.Context) (string, error) {
+	id, err := r.PublishResult.Get(ctx)
+	if err != nil {
+		r.topic.ResumePublish(r.key)
+	}
+	return id, err
+}
+
+// publishLimiter bounds the number of published messages still waiting for
+// a confirmation from Pub/Sub, so very large batches don't pile up unbounded
+// publish results in memory. It also remembers the first failed publish so
+// the run can stop and report it.
+type publishLimiter struct {
+	// ctx bounds waiting for confirmations. It is the run's context rather
+	// than the context of the record, which ends as soon as the record's
+	// group is done.
+	ctx   context.Context
+	slots chan struct{}
+	wg    sync.WaitGroup
+	mutex sync.Mutex
+	err   error
+}
+
+var inflight = newPublishLimiter(context.Background(), 1000)
+
+func newPublishLimiter(ctx context.Context, max int) *publishLimiter {
+	return &publishLimiter{
+		ctx:   ctx,
+		slots: make(chan struct{}, max),
+	}
+}
+
+// acquire blocks until a slot is free. It fails if an earlier publish has
+// failed or the context is cancelled.
+func (l *publishLimiter) acquire(ctx context.Context) error {
+	if err := l.Err(); err != nil {
+		return err
+	}
+
+	select {
+	case l.slots <- struct{}{}:
+		l.wg.Add(1)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (l *publishLimiter) release(err error) {
+	if err != nil {
+		l.mutex.Lock()
+		if l.err == nil {
+			l.err = err
+		}
+		l.mutex.Unlock()
+	}
+
+	<-l.slots
+	l.wg.Done()
+}
+
+func (l *publishLimiter) Err() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.err
+}
+
+// Wait blocks until every outstanding publish has been confirmed and returns
+// the first publish error.
+func (l *publishLimiter) Wait() error {
+	l.wg.Wait()
+	return l.Err()
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+	"cloud.google.com/go/pubsub/apiv1/pubsubpb"
+	"cloud.google.com/go/pubsub/pstest"
+	"github.com/costinul/transfer360-test/transfer360"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// newTestTopic returns a topic on a pstest server.
+func newTestTopic(t *testing.T, ordering bool) (*pstest.Server, *pubsub.Topic) {
+	t.Helper()
+	ctx := context.Background()
+	srv := pstest.NewServer()
+	t.Cleanup(func() { srv.Close() })
+
+	client, err := pubsub.NewClient(ctx, "test-project",
+		option.WithEndpoint(srv.Addr),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithTransportCredentials(insecure.NewCredentials())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	topic, err := client.CreateTopic(ctx, "positive_searches")
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic.EnableMessageOrdering = ordering
+	t.Cleanup(topic.Stop)
+	return srv, topic
+}
+
+// useTestLimiter replaces the publish limiter for the length of a test.
+func useTestLimiter(t *testing.T, max int) *publishLimiter {
+	t.Helper()
+	saved := inflight
+	inflight = newPublishLimiter(context.Background(), max)
+	t.Cleanup(func() { inflight = saved })
+	return inflight
+}
+
+func testContravention() *VehicleContravention {
+	return &VehicleContravention{Contravention: transfer360.Contravention{
+		Reference:         "REF-1",
+		VRM:               "AB12CDE",
+		ContraventionDate: "2024-05-01T00:00:00Z",
+		IsHirerVehicle:    true,
+		LeaseCompany:      LeaseCompany{CompanyName: "ACME Company Ltd"},
+	}}
+}
+
+func TestPublishAsync(t *testing.T) {
+	tests := []struct {
+		name     string
+		ordering bool
+		// orderingKey sets -ordering-key, and wantKey is the ordering key
+		// the message must carry.
+		orderingKey bool
+		wantKey     string
+		// respond, when set, answers the publish instead of the server.
+		respond error
+		cancel  bool
+		wantErr string
+		wantRun string
+	}{
+		{name: "success"},
+		{name: "publish error", respond: status.Error(codes.PermissionDenied, "denied"), wantRun: "failed to publish message"},
+		{name: "context cancelled", cancel: true, wantErr: context.Canceled.Error()},
+		{name: "topic with message ordering", ordering: true},
+		{name: "ordering key", ordering: true, orderingKey: true, wantKey: "AB12CDE"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, topic := newTestTopic(t, tt.ordering)
+			limiter := useTestLimiter(t, 1)
+			if tt.orderingKey {
+				orderingKeys = true
+				t.Cleanup(func() { orderingKeys = false })
+			}
+			if tt.respond != nil {
+				srv.SetAutoPublishResponse(false)
+				srv.AddPublishResponse(nil, tt.respond)
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if tt.cancel {
+				// With every slot taken, publishAsync waits for one until the
+				// context is cancelled.
+				if err := limiter.acquire(ctx); err != nil {
+					t.Fatal(err)
+				}
+				defer limiter.release(nil)
+				cancel()
+			}
+
+			contravention := testContravention()
+			done := make(chan error, 1)
+			err := publishAsync(topicPublisher{topic}, ctx, contravention, func(err error) { done <- err })
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("publishAsync() = %v, want %q", err, tt.wantErr)
+				}
+				if n := len(srv.Messages()); n != 0 {
+					t.Fatalf("published %d messages, want none", n)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("publishAsync() = %v", err)
+			}
+
+			select {
+			case err = <-done:
+			case <-time.After(10 * time.Second):
+				t.Fatal("publish was not confirmed")
+			}
+			if tt.wantRun != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantRun) {
+					t.Fatalf("done(%v), want %q", err, tt.wantRun)
+				}
+				if limiter.Wait() == nil {
+					t.Fatal("the failed publish was not recorded by the limiter")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("done(%v)", err)
+			}
+
+			messages := srv.Messages()
+			if len(messages) != 1 {
+				t.Fatalf("published %d messages, want 1", len(messages))
+			}
+			message := messages[0]
+			want, _ := encodeMessage(contravention)
+			if string(message.Data) != string(want) {
+				t.Errorf("data = %s, want %s", message.Data, want)
+			}
+			if message.OrderingKey != tt.wantKey {
+				t.Errorf("ordering key = %q, want %q", message.OrderingKey, tt.wantKey)
+			}
+			if contravention.MessageID != message.ID {
+				t.Errorf("MessageID = %q, want %q", contravention.MessageID, message.ID)
+			}
+			if message.Attributes["idempotency_key"] != contravention.IdempotencyKey() {
+				t.Errorf("idempotency_key = %q", message.Attributes["idempotency_key"])
+			}
+		})
+	}
+}
+
+// TestPublishAsyncBlocksWhenFull checks that a publish waits for a slot of
+// the limiter before it is sent.
+func TestPublishAsyncBlocksWhenFull(t *testing.T) {
+	srv, topic := newTestTopic(t, false)
+	srv.SetAutoPublishResponse(false)
+	useTestLimiter(t, 1)
+
+	ctx := context.Background()
+	first := make(chan error, 1)
+	if err := publishAsync(topicPublisher{topic}, ctx, testContravention(), func(err error) { first <- err }); err != nil {
+		t.Fatal(err)
+	}
+
+	second := testContravention()
+	second.VRM = "CD34EFG"
+	returned := make(chan error, 1)
+	go func() {
+		returned <- publishAsync(topicPublisher{topic}, ctx, second, func(error) {})
+	}()
+	select {
+	case err := <-returned:
+		t.Fatalf("publishAsync() = %v before a slot was free", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	srv.AddPublishResponse(&pubsubpb.PublishResponse{MessageIds: []string{"1"}}, nil)
+	if err := <-first; err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-returned:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("publishAsync() still blocked after a slot was freed")
+	}
+	srv.AddPublishResponse(&pubsubpb.PublishResponse{MessageIds: []string{"2"}}, nil)
+	inflight.Wait()
+}
+
+func TestMessageAttributes(t *testing.T) {
+	tests := []struct {
+		name     string
+		envelope string
+		metadata map[string]string
+		want     map[string]string
+	}{
+		{
+			name: "defaults",
+			want: map[string]string{"schema_version": "1", "producer": producerName, "version": version, "confidence": "1"},
+		},
+		{
+			name:     "v2 envelope",
+			envelope: envelopeV2,
+			want:     map[string]string{"schema_version": "2"},
+		},
+		{
+			name:     "metadata",
+			metadata: map[string]string{"batch": "42", "region": "north"},
+			want:     map[string]string{"batch": "42", "region": "north"},
+		},
+		{
+			name:     "metadata cannot replace reserved attributes",
+			metadata: map[string]string{"idempotency_key": "forged", "producer": "other", "schema_version": "9", "produced_at": "yesterday"},
+			want:     map[string]string{"producer": producerName, "schema_version": "1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.envelope != "" {
+				saved := envelopeVersion
+				envelopeVersion = tt.envelope
+				defer func() { envelopeVersion = saved }()
+			}
+
+			contravention := testContravention()
+			contravention.Metadata = tt.metadata
+			attributes := messageAttributes(contravention)
+
+			for key, value := range tt.want {
+				if attributes[key] != value {
+					t.Errorf("%s = %q, want %q", key, attributes[key], value)
+				}
+			}
+			if attributes["idempotency_key"] != contravention.IdempotencyKey() {
+				t.Errorf("idempotency_key = %q, want %q", attributes["idempotency_key"], contravention.IdempotencyKey())
+			}
+			producedAt, err := time.Parse(time.RFC3339, attributes["produced_at"])
+			if err != nil {
+				t.Fatalf("produced_at = %q: %v", attributes["produced_at"], err)
+			}
+			if time.Since(producedAt).Abs() > time.Minute {
+				t.Errorf("produced_at = %s, want about now", producedAt)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// quotaStartRate is the publish rate (messages per second) after the
+	// first quota error. Each further error halves it, down to quotaMinRate.
+	quotaStartRate = 100
+	quotaMinRate   = 1
+	// quotaMaxRate is where throttling stops again.
+	quotaMaxRate = 1000
+	// quotaRecovery is how long publishing must go without quota errors
+	// before the rate is doubled.
+	quotaRecovery = 10 * time.Second
+	// quotaMaxWait is how long a rejected message is published again
+	// before its record fails.
+	quotaMaxWait = 5 * time.Minute
+)
+
+// QuotaBackoff slows publishing down when Pub/Sub reports that a quota is
+// exhausted, instead of failing the records. The rate is halved on every
+// quota error and doubled again once errors have stopped for a while, until
+// publishing is unthrottled.
+type QuotaBackoff struct {
+	limiter   *rate.Limiter
+	lastError time.Time
+	lastRaise time.Time
+	mutex     sync.Mutex
+}
+
+var quota = NewQuotaBackoff()
+
+func NewQuotaBackoff() *QuotaBackoff {
+	return &QuotaBackoff{limiter: rate.NewLimiter(rate.Inf, 1)}
+}
+
+func isQuotaError(err error) bool {
+	return status.Code(err) == codes.ResourceExhausted
+}
+
+// Wait blocks until the current publish rate allows another message.
+func (q *QuotaBackoff) Wait(ctx context.Context) error {
+	return q.limiter.Wait(ctx)
+}
+
+// Throttle lowers the publish rate after a quota error.
+func (q *QuotaBackoff) Throttle() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	now := time.Now()
+	// Messages published before the last throttle may still fail; they don't
+	// say anything about the new rate.
+	if now.Sub(q.lastError) < time.Second {
+		return
+	}
+	q.lastError = now
+
+	limit := q.limiter.Limit()
+	if limit == rate.Inf {
+		limit = quotaStartRate
+	} else {
+		limit = max(limit/2, quotaMinRate)
+	}
+	q.limiter.SetLimit(limit)
+	log.Printf("Pub/Sub quota exceeded, publishing at %.0f messages/s\n", float64(limit))
+}
+
+// Succeeded raises the publish rate again once quota errors have stopped.
+func (q *QuotaBackoff) Succeeded() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	limit := q.limiter.Limit()
+	now := time.Now()
+	if limit == rate.Inf || now.Sub(q.lastError) < quotaRecovery || now.Sub(q.lastRaise) < quotaRecovery {
+		return
+	}
+	q.lastRaise = now
+
+	limit *= 2
+	if limit >= quotaMaxRate {
+		q.limiter.SetLimit(rate.Inf)
+		log.Printf("Pub/Sub quota errors stopped, publishing at full speed\n")
+		return
+	}
+	q.limiter.SetLimit(limit)
+	log.Printf("Pub/Sub quota errors stopped, publishing at %.0f messages/s\n", float64(limit))
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// RabbitMQConfig are the settings of a rabbitmq sink. The AMQP URL includes
+// the credentials, so it is read from an environment variable.
+type RabbitMQConfig struct {
+	URLEnv           string `json:"url_env"`
+	Exchange         string `json:"exchange"`
+	RoutingKeyPrefix string `json:"routing_key_prefix,omitempty"`
+}
+
+const defaultRoutingKeyPrefix = "positive_searches"
+
+func (c *RabbitMQConfig) validate(name string) error {
+	if c.URLEnv == "" || c.Exchange == "" {
+		return fmt.Errorf("sink %s: rabbitmq sinks require url_env and exchange", name)
+	}
+	if os.Getenv(c.URLEnv) == "" {
+		return fmt.Errorf("sink %s: rabbitmq url %s is not set", name, c.URLEnv)
+	}
+	return nil
+}
+
+// routingKey routes a result by the lease company that was found, e.g.
+// positive_searches.acme-leasing-ltd, so consumers can bind per company.
+func (c *RabbitMQConfig) routingKey(contravention *VehicleContravention) string {
+	prefix := c.RoutingKeyPrefix
+	if prefix == "" {
+		prefix = defaultRoutingKeyPrefix
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(contravention.LeaseCompany.CompanyName), func(r rune) bool {
+		return (r < 'a' || r > 'z') && (r < '0' || r > '9')
+	})
+	company := strings.Join(words, "-")
+	if company == "" {
+		company = "unknown"
+	}
+	return prefix + "." + company
+}
+
+// rabbitmqSink publishes results to an exchange with publisher confirms,
+// with the message attributes as headers.
+type rabbitmqSink struct {
+	config  *RabbitMQConfig
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	wg      sync.WaitGroup
+}
+
+func newRabbitMQSink(config *RabbitMQConfig) (*rabbitmqSink, error) {
+	conn, err := amqp.Dial(os.Getenv(config.URLEnv))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to rabbitmq: %v", err)
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to open rabbitmq channel: %v", err)
+	}
+	if err := channel.Confirm(false); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to enable publisher confirms: %v", err)
+	}
+	// The exchange is managed by the broker's owners; only check it exists.
+	if err := channel.ExchangeDeclarePassive(config.Exchange, "topic", true, false, false, false, nil); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("rabbitmq exchange %s: %v", config.Exchange, err)
+	}
+	return &rabbitmqSink{config: config, conn: conn, channel: channel}, nil
+}
+
+func (s *rabbitmqSink) Publish(ctx context.Context, contravention *VehicleContravention, done func(error)) error {
+	data, err := encodeMessage(contravention)
+	if err != nil {
+		return err
+	}
+
+	headers := amqp.Table{}
+	for key, value := range messageAttributes(contravention) {
+		headers[key] = value
+	}
+
+	confirmation, err := s.channel.PublishWithDeferredConfirmWithContext(ctx, s.config.Exchange, s.config.routingKey(contravention), false, false, amqp.Publishing{
+		ContentType:  contentTypeAttribute(),
+		DeliveryMode: amqp.Persistent,
+		MessageId:    contravention.IdempotencyKey(),
+		Headers:      headers,
+		Body:         data,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to publish to rabbitmq: %v", err)
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		acked, err := confirmation.WaitContext(ctx)
+		if err == nil && !acked {
+			err = fmt.Errorf("rabbitmq did not accept the message")
+		}
+		done(err)
+	}()
+	return nil
+}
+
+func (s *rabbitmqSink) Close() error {
+	s.wg.Wait()
+	return s.conn.Close()
+}
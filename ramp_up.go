@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// RampUp raises the concurrency of each source from 1 to its full value over
+// the first part of a run, so a batch started on the hour together with
+// other scheduled jobs doesn't hit providers with every connection at once.
+type RampUp struct {
+	start    time.Time
+	duration time.Duration
+}
+
+// rampUp is nil unless -ramp-up is set.
+var rampUp *RampUp
+
+// rampUpPoll is how often a record waiting for the ramp checks again.
+const rampUpPoll = 100 * time.Millisecond
+
+func NewRampUp(duration time.Duration) *RampUp {
+	return &RampUp{start: time.Now(), duration: duration}
+}
+
+// Limit is how many of concurrency records may run at once now.
+func (r *RampUp) Limit(concurrency int) int {
+	elapsed := time.Since(r.start)
+	if elapsed >= r.duration {
+		return concurrency
+	}
+	limit := int(float64(concurrency) * float64(elapsed) / float64(r.duration))
+	return max(1, min(concurrency, limit+1))
+}
+
+// Wait blocks until fewer than the ramp's limit of records are running.
+func (r *RampUp) Wait(ctx context.Context, running *atomic.Int32, concurrency int) error {
+	for int(running.Load()) >= r.Limit(concurrency) {
+		select {
+		case <-time.After(rampUpPoll):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// startJitter waits a random time up to jitter, so runs scheduled at the
+// same moment spread out.
+func startJitter(ctx context.Context, jitter time.Duration) error {
+	if jitter <= 0 {
+		return nil
+	}
+	delay := time.Duration(rand.Int63n(int64(jitter)))
+	log.Printf("Waiting %s before starting\n", delay.Round(time.Millisecond))
+	select {
+	case <-time.After(delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
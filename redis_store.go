@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// redisPasswordEnv holds the Redis password when the URL has none.
+const redisPasswordEnv = "T360_REDIS_PASSWORD"
+
+// redisKeyPrefix keeps our keys apart from other users of the same Redis.
+const redisKeyPrefix = "t360:"
+
+// isRedisURL reports whether -dedup-db or -response-cache names a Redis
+// server, redis://host:port/db or rediss:// for TLS, instead of a local file.
+// Workers on several machines sharing one Redis don't search or publish what
+// another worker already did.
+func isRedisURL(value string) bool {
+	return strings.HasPrefix(value, "redis://") || strings.HasPrefix(value, "rediss://")
+}
+
+func openRedis(rawURL string) (*redis.Client, error) {
+	options, err := redis.ParseURL(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid redis URL %s: %v", redactURL(rawURL), err)
+	}
+	if options.Password == "" {
+		options.Password = os.Getenv(redisPasswordEnv)
+	}
+
+	client := redis.NewClient(options)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("failed to connect to redis %s: %v", redactURL(rawURL), err)
+	}
+	return client, nil
+}
+
+// redisDedupStore keeps the keys in Redis, expiring after the dedup window,
+// so a key reserved by one worker is seen by all of them.
+type redisDedupStore struct {
+	client *redis.Client
+	window time.Duration
+}
+
+func OpenRedisDedupStore(rawURL string, window time.Duration) (*redisDedupStore, error) {
+	client, err := openRedis(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return &redisDedupStore{client: client, window: window}, nil
+}
+
+func (s *redisDedupStore) Reserve(key string) (bool, error) {
+	return s.client.SetNX(context.Background(), redisKeyPrefix+"published:"+key, 1, pendingTTL(s.window)).Result()
+}
+
+func (s *redisDedupStore) Confirm(key string) error {
+	return s.client.Set(context.Background(), redisKeyPrefix+"published:"+key, 1, s.window).Err()
+}
+
+func (s *redisDedupStore) Release(key string) error {
+	return s.client.Del(context.Background(), redisKeyPrefix+"published:"+key).Err()
+}
+
+func (s *redisDedupStore) Close() error {
+	return s.client.Close()
+}
+
+// redisResponseStore keeps cached responses in Redis, which expires them
+// with their TTL.
+type redisResponseStore struct {
+	client *redis.Client
+}
+
+func (s *redisResponseStore) Get(key []byte) ([]byte, error) {
+	value, err := s.client.Get(context.Background(), redisKeyPrefix+"responses:"+string(key)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return value, err
+}
+
+func (s *redisResponseStore) Put(key []byte, value []byte, ttl time.Duration) error {
+	return s.client.Set(context.Background(), redisKeyPrefix+"responses:"+string(key), value, ttl).Err()
+}
+
+func (s *redisResponseStore) Close() error {
+	return s.client.Close()
+}
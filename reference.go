@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+const (
+	referenceUUID       = "uuid"
+	referenceSequential = "sequential"
+	referenceHash       = "hash"
+	referenceRecord     = "record"
+)
+
+// maxReferenceLength keeps caller-provided references to what clients store.
+const maxReferenceLength = 64
+
+// ReferenceGenerator sets the Reference of published contraventions for
+// clients with a numbering scheme of their own:
+//
+//   - sequential: the prefix and a number counting up from the start, per run
+//   - hash: the prefix and a hash of the VRM, date and lease company, so the
+//     same contravention always gets the same reference
+//   - record: the reference of the batch record, with -2, -3, ... added for
+//     the second and later contraventions found for it
+type ReferenceGenerator struct {
+	strategy string
+	prefix   string
+	next     atomic.Int64
+}
+
+// references is nil unless -reference is set to something other than uuid.
+var references *ReferenceGenerator
+
+func NewReferenceGenerator(strategy string, prefix string, start int64) *ReferenceGenerator {
+	g := &ReferenceGenerator{strategy: strategy, prefix: prefix}
+	g.next.Store(start)
+	return g
+}
+
+// newReference is the reference of the index-th contravention published
+// for a record.
+func newReference(request SearchRequest, contravention *VehicleContravention, index int) (string, error) {
+	if references == nil {
+		return uuid.New().String(), nil
+	}
+	return references.Next(request, contravention, index)
+}
+
+func (g *ReferenceGenerator) Next(request SearchRequest, contravention *VehicleContravention, index int) (string, error) {
+	switch g.strategy {
+	case referenceSequential:
+		return fmt.Sprintf("%s%06d", g.prefix, g.next.Add(1)-1), nil
+	case referenceHash:
+		return g.prefix + contravention.IdempotencyKey()[:32], nil
+	case referenceRecord:
+		if request.Reference == "" {
+			return "", fmt.Errorf("record has no reference, required by -reference record")
+		}
+		if index == 0 {
+			return request.Reference, nil
+		}
+		return fmt.Sprintf("%s-%d", request.Reference, index+1), nil
+	}
+	return uuid.New().String(), nil
+}
+
+func validateReferenceStrategy(strategy string) error {
+	switch strategy {
+	case referenceUUID, referenceSequential, referenceHash, referenceRecord:
+		return nil
+	}
+	return fmt.Errorf("unknown reference strategy %q, expected uuid, sequential, hash or record", strategy)
+}
+
+// validateReference checks the reference of a batch record.
+func validateReference(value string) error {
+	if value == "" {
+		return nil
+	}
+	if len(value) > maxReferenceLength {
+		return fmt.Errorf("reference %q is longer than %d characters", value, maxReferenceLength)
+	}
+	if strings.IndexFunc(value, func(r rune) bool { return unicode.IsSpace(r) || !unicode.IsPrint(r) }) >= 0 {
+		return fmt.Errorf("reference %q must not contain spaces or control characters", value)
+	}
+	return nil
+}
+
+// requireReference fails for a record without a reference when -reference
+// record is used, before the record is searched.
+func requireReference(request SearchRequest) error {
+	if references != nil && references.strategy == referenceRecord && request.Reference == "" {
+		return fmt.Errorf("record %s has no reference, required by -reference record", request.VRM)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func runReplayCommand(args []string) error {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	flags := &Flags{}
+	flags.register(fs)
+	// In replay mode -report names the report being replayed; the report of
+	// the new run goes to -out-report.
+	fs.Lookup("report").Usage = "Report of a previous run whose records are replayed (required)"
+	outReport := fs.String("out-report", "", "Write a JSON report of the replayed run to this file")
+	onlyFailures := fs.Bool("only-failures", false, "Only replay records that timed out, failed, were skipped or were deferred")
+	fs.Parse(args)
+
+	inputReport := flags.ReportFile
+	flags.ReportFile = *outReport
+
+	if inputReport == "" {
+		return fmt.Errorf("missing required flag: -report")
+	}
+	if flags.BatchFile != "" || flags.BatchSQL != "" || len(flags.VRM) > 0 {
+		return fmt.Errorf("replay cannot be combined with -batch, -batch-sql or -vrm")
+	}
+	if err := flags.validate(); err != nil {
+		return err
+	}
+
+	requests, err := loadReplayRequests(inputReport, *onlyFailures)
+	if err != nil {
+		return err
+	}
+	if len(requests) == 0 {
+		log.Printf("Nothing to replay in %s\n", inputReport)
+		return nil
+	}
+
+	log.Printf("Replaying %d records from %s\n", len(requests), inputReport)
+	return run(flags, requests)
+}
+
+func loadReplayRequests(path string, onlyFailures bool) ([]SearchRequest, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var report RunSummary
+	if err := json.Unmarshal(body, &report); err != nil {
+		return nil, fmt.Errorf("invalid report %s: %v", path, err)
+	}
+	if report.Anonymized {
+		return nil, fmt.Errorf("report %s is of an -anonymize run and has no real VRMs to replay", path)
+	}
+
+	requests := make([]SearchRequest, 0)
+	for _, record := range report.Records {
+		if onlyFailures {
+			switch record.Outcome {
+			case outcomeTimeout, outcomeError, outcomeSkipped, outcomeDeferred:
+			default:
+				continue
+			}
+		}
+		requests = append(requests, SearchRequest{
+			VRM:               record.VRM,
+			Company:           record.Company,
+			ContraventionDate: record.ContraventionDate,
+			DateFrom:          record.DateFrom,
+			DateTo:            record.DateTo,
+			Priority:          record.Priority,
+			Metadata:          record.Metadata,
+			CallbackURL:       record.CallbackURL,
+			Reference:         record.Reference,
+		})
+	}
+
+	return requests, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// reportColumns are the CSV report columns before the metadata columns.
+var reportColumns = []string{
+	"run_id", "chunk", "vrm", "company", "contravention_date", "date_from", "date_to",
+	"priority", "outcome", "timeout_phase", "error", "reference", "callback_url",
+}
+
+// WriteCSVReport writes the records as a CSV file with one row per record,
+// for reviewing results in a spreadsheet. Every metadata key used by any
+// record gets a column of its own, named metadata.<key>.
+func (s *RunSummary) WriteCSVReport(path string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	keys := make(map[string]bool)
+	for _, record := range s.Records {
+		for key := range record.Metadata {
+			keys[key] = true
+		}
+	}
+	metadataKeys := make([]string, 0, len(keys))
+	for key := range keys {
+		metadataKeys = append(metadataKeys, key)
+	}
+	sort.Strings(metadataKeys)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to write CSV report: %v", err)
+	}
+	defer f.Close()
+
+	// The byte order mark makes Excel read the file as UTF-8.
+	if _, err := f.WriteString("\ufeff"); err != nil {
+		return fmt.Errorf("failed to write CSV report: %v", err)
+	}
+
+	w := csv.NewWriter(f)
+	header := append([]string(nil), reportColumns...)
+	for _, key := range metadataKeys {
+		header = append(header, "metadata."+key)
+	}
+	w.Write(header)
+
+	for _, record := range s.Records {
+		row := []string{
+			s.RunID, s.Chunk, record.VRM, record.Company, record.ContraventionDate, record.DateFrom, record.DateTo,
+			record.Priority, record.Outcome, record.TimeoutPhase, record.Error, record.Reference, record.CallbackURL,
+		}
+		for _, key := range metadataKeys {
+			row = append(row, record.Metadata[key])
+		}
+		for i := range row {
+			row[i] = spreadsheetSafe(row[i])
+		}
+		w.Write(row)
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("failed to write CSV report: %v", err)
+	}
+	return f.Close()
+}
+
+// spreadsheetSafe keeps values from providers and batch files from being
+// run as formulas when the report is opened in a spreadsheet.
+func spreadsheetSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
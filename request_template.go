@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"text/template"
+	"time"
+)
+
+// jsonTemplateFuncs are available in the request templates of JSON sources,
+// for providers that expect another request body than SearchBody.
+var jsonTemplateFuncs = template.FuncMap{
+	"json": func(value any) (string, error) {
+		data, err := json.Marshal(value)
+		return string(data), err
+	},
+	"date": func(layout string, value any) (string, error) {
+		switch t := value.(type) {
+		case time.Time:
+			return t.Format(layout), nil
+		case *time.Time:
+			if t == nil {
+				return "", nil
+			}
+			return t.Format(layout), nil
+		}
+		return "", fmt.Errorf("date: %T is not a time", value)
+	},
+}
+
+func parseJSONRequestTemplate(config SourceConfig) (*template.Template, error) {
+	if config.RequestTemplate == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New(config.ID).Funcs(jsonTemplateFuncs).Option("missingkey=error").Parse(config.RequestTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// searchRequestBody is the JSON body of a search: SearchBody, or the request
+// template of the source rendered with it.
+func searchRequestBody(source DataSource, search SearchBody) ([]byte, error) {
+	configured, ok := source.(*configuredSource)
+	if !ok || configured.template == nil {
+		return json.Marshal(search)
+	}
+
+	var body bytes.Buffer
+	if err := configured.template.Execute(&body, search); err != nil {
+		return nil, fmt.Errorf("failed to render request for %s: %v", source.ID(), err)
+	}
+	if !json.Valid(body.Bytes()) {
+		return nil, fmt.Errorf("request template of %s did not render valid JSON: %s", source.ID(), body.String())
+	}
+	return body.Bytes(), nil
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// ResponseCache keeps the results of source searches, so backfills that
+// search the same vehicles every day don't repeat every search. Results
+// without a hirer vehicle are kept for the miss TTL and results with one for
+// the hit TTL, so known non-hirer vehicles can be skipped for a while without
+// holding on to positive results too long. A TTL of 0 doesn't cache that
+// kind of result. Sources can set their own TTLs in the config.
+type ResponseCache struct {
+	store   responseStore
+	hitTTL  time.Duration
+	missTTL time.Duration
+}
+
+// responseStore is where cached responses are kept: a local bbolt file, or
+// Redis to share them between workers.
+type responseStore interface {
+	// Get returns nil when the key isn't stored.
+	Get(key []byte) ([]byte, error)
+	Put(key []byte, value []byte, ttl time.Duration) error
+	Close() error
+}
+
+// CacheConfig overrides the response cache TTLs for a source.
+type CacheConfig struct {
+	HitTTL  string `json:"hit_ttl,omitempty"`
+	MissTTL string `json:"miss_ttl,omitempty"`
+	hitTTL  *time.Duration
+	missTTL *time.Duration
+}
+
+type cachedResponse struct {
+	ExpiresAt      time.Time               `json:"expires_at"`
+	Contraventions []*VehicleContravention `json:"contraventions"`
+}
+
+// responseCache is nil unless -response-cache is set.
+var responseCache *ResponseCache
+
+var responseBucket = []byte("responses")
+
+func (c *CacheConfig) parse(company string) error {
+	parse := func(name string, value string) (*time.Duration, error) {
+		if value == "" {
+			return nil, nil
+		}
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl < 0 {
+			return nil, fmt.Errorf("source %s: invalid cache %s %q", company, name, value)
+		}
+		return &ttl, nil
+	}
+
+	var err error
+	if c.hitTTL, err = parse("hit_ttl", c.HitTTL); err != nil {
+		return err
+	}
+	c.missTTL, err = parse("miss_ttl", c.MissTTL)
+	return err
+}
+
+// OpenResponseCache opens the cache in a local file, or in Redis when path is
+// a redis:// or rediss:// URL.
+func OpenResponseCache(path string, hitTTL time.Duration, missTTL time.Duration) (*ResponseCache, error) {
+	if isRedisURL(path) {
+		client, err := openRedis(path)
+		if err != nil {
+			return nil, err
+		}
+		return &ResponseCache{store: &redisResponseStore{client: client}, hitTTL: hitTTL, missTTL: missTTL}, nil
+	}
+
+	db, err := openBolt(path, "response cache")
+	if err != nil {
+		return nil, err
+	}
+
+	store := &boltResponseStore{db: db}
+	if err := store.prune(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to open response cache %s: %v", path, err)
+	}
+	return &ResponseCache{store: store, hitTTL: hitTTL, missTTL: missTTL}, nil
+}
+
+// boltResponseStore keeps cached responses in a local bbolt file.
+type boltResponseStore struct {
+	db *bolt.DB
+}
+
+// prune removes expired responses so the file doesn't grow forever.
+func (s *boltResponseStore) prune() error {
+	now := time.Now()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.CreateBucketIfNotExists(responseBucket)
+		if err != nil {
+			return err
+		}
+		expired := make([][]byte, 0)
+		bucket.ForEach(func(key, value []byte) error {
+			var cached cachedResponse
+			if json.Unmarshal(value, &cached) != nil || cached.ExpiresAt.Before(now) {
+				expired = append(expired, key)
+			}
+			return nil
+		})
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// responseKey identifies a search of a source by VRM and day, or days.
+func responseKey(source DataSource, search SearchBody) []byte {
+	key := source.ID() + "\x00" + strings.ToUpper(strings.ReplaceAll(search.VRM, " ", "")) + "\x00"
+	if search.DateFrom != nil && search.DateTo != nil {
+		return []byte(key + search.DateFrom.Format(batchDateFormat) + ".." + search.DateTo.Format(batchDateFormat))
+	}
+	return []byte(key + search.ContraventionDate.Format(batchDateFormat))
+}
+
+func (s *boltResponseStore) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(tx *bolt.Tx) error {
+		value = slices.Clone(tx.Bucket(responseBucket).Get(key))
+		return nil
+	})
+	return value, err
+}
+
+func (s *boltResponseStore) Put(key []byte, value []byte, ttl time.Duration) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(responseBucket).Put(key, value)
+	})
+}
+
+func (s *boltResponseStore) Close() error {
+	return s.db.Close()
+}
+
+// Get returns the cached results of a search. ok is false when the search
+// isn't cached or has expired.
+func (c *ResponseCache) Get(source DataSource, search SearchBody) (contraventions []*VehicleContravention, ok bool) {
+	value, err := c.store.Get(responseKey(source, search))
+	if err != nil {
+		log.Printf("Failed to read the cached result of %s: %v\n", source.ID(), err)
+	}
+	var cached cachedResponse
+	if value != nil && json.Unmarshal(value, &cached) == nil && time.Now().Before(cached.ExpiresAt) {
+		contraventions, ok = cached.Contraventions, true
+	}
+	summary.RecordCacheLookup(source.ID(), ok)
+	return contraventions, ok
+}
+
+// Put caches the results of a search for the TTL of their kind.
+func (c *ResponseCache) Put(source DataSource, search SearchBody, contraventions []*VehicleContravention) error {
+	ttl := c.ttl(source, slices.ContainsFunc(contraventions, isHirerVehicle))
+	if ttl <= 0 {
+		return nil
+	}
+
+	value, err := json.Marshal(cachedResponse{ExpiresAt: time.Now().Add(ttl), Contraventions: contraventions})
+	if err != nil {
+		return err
+	}
+	return c.store.Put(responseKey(source, search), value, ttl)
+}
+
+func (c *ResponseCache) ttl(source DataSource, hit bool) time.Duration {
+	var override *time.Duration
+	if settings := sourceSettings(source); settings != nil && settings.Cache != nil {
+		override = settings.Cache.missTTL
+		if hit {
+			override = settings.Cache.hitTTL
+		}
+	}
+	switch {
+	case override != nil:
+		return *override
+	case hit:
+		return c.hitTTL
+	default:
+		return c.missTTL
+	}
+}
+
+func (c *ResponseCache) Close() error {
+	return c.store.Close()
+}
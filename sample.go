@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"sync"
+)
+
+// HitSampler keeps a uniform random sample of the published hits of a run
+// (reservoir sampling), so they can be searched again at the end of the run.
+type HitSampler struct {
+	size    int
+	seen    int
+	samples []sampledHit
+	mutex   sync.Mutex
+}
+
+type sampledHit struct {
+	request       SearchRequest
+	contravention VehicleContravention
+}
+
+// SampleReport is the outcome of searching the sampled hits again.
+type SampleReport struct {
+	Checked       int                 `json:"checked"`
+	Discrepancies []SampleDiscrepancy `json:"discrepancies"`
+}
+
+type SampleDiscrepancy struct {
+	VRM     string   `json:"vrm"`
+	Company string   `json:"company"`
+	Outcome string   `json:"outcome"`
+	Fields  []string `json:"fields,omitempty"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// sampler is nil unless -sample is set.
+var sampler *HitSampler
+
+func NewHitSampler(size int) *HitSampler {
+	return &HitSampler{size: size, samples: make([]sampledHit, 0, size)}
+}
+
+func (s *HitSampler) Add(request SearchRequest, contravention *VehicleContravention) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.seen++
+	hit := sampledHit{request: request, contravention: *contravention}
+	if len(s.samples) < s.size {
+		s.samples = append(s.samples, hit)
+		return
+	}
+	if i := rand.IntN(s.seen); i < s.size {
+		s.samples[i] = hit
+	}
+}
+
+// SpotCheck searches every sampled hit again and reports the ones whose
+// result is no longer the same.
+func (s *HitSampler) SpotCheck(ctx context.Context) *SampleReport {
+	s.mutex.Lock()
+	samples := append([]sampledHit(nil), s.samples...)
+	s.mutex.Unlock()
+
+	log.Printf("Spot checking %d published hits\n", len(samples))
+	report := &SampleReport{Discrepancies: make([]SampleDiscrepancy, 0)}
+	for _, sample := range samples {
+		if ctx.Err() != nil {
+			break
+		}
+		report.Checked++
+
+		contraventions, outcome, err := searchVehicle(ctx, sample.request)
+		discrepancy := SampleDiscrepancy{
+			VRM:     anonymizeVRM(sample.request.VRM),
+			Company: sample.request.Company,
+			Outcome: outcome,
+		}
+		if outcome != outcomeHit {
+			if err != nil {
+				discrepancy.Error = anonymizeText(err.Error())
+			}
+		} else {
+			discrepancy.Fields = changedFields(&sample.contravention, sameContravention(contraventions, &sample.contravention))
+			if len(discrepancy.Fields) == 0 {
+				continue
+			}
+		}
+
+		log.Printf("Spot check of %s differs: %s %v\n", sample.request.VRM, outcome, discrepancy.Fields)
+		report.Discrepancies = append(report.Discrepancies, discrepancy)
+	}
+	return report
+}
+
+// sameContravention picks the result of a new search that corresponds to a
+// sampled hit: the one with the same contravention date, or else the first.
+func sameContravention(contraventions []*VehicleContravention, sampled *VehicleContravention) *VehicleContravention {
+	for _, contravention := range contraventions {
+		if contravention.ContraventionDate == sampled.ContraventionDate {
+			return contravention
+		}
+	}
+	return contraventions[0]
+}
+
+// changedFields lists the fields of a result that changed between two
+// searches. The reference is assigned by us and is not compared.
+func changedFields(before *VehicleContravention, after *VehicleContravention) []string {
+	fields := make([]string, 0)
+	compare := func(name string, a interface{}, b interface{}) {
+		if fmt.Sprint(a) != fmt.Sprint(b) {
+			fields = append(fields, name)
+		}
+	}
+	// With -anonymize, a sampled hit holds the pseudonym and a canary result
+	// the real VRM; both are compared as pseudonyms.
+	compare("vrm", anonymizeVRM(before.VRM), anonymizeVRM(after.VRM))
+	compare("contravention_date", before.ContraventionDate, after.ContraventionDate)
+	compare("is_hirer_vehicle", before.IsHirerVehicle, after.IsHirerVehicle)
+	compare("lease_company", before.LeaseCompany, after.LeaseCompany)
+	compare("confidence", before.Score(), after.Score())
+	return fields
+}
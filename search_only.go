@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+// Search row outcomes, besides hit and miss: a search that returned nothing
+// that qualifies, or that failed.
+const (
+	searchRowEmpty   = "empty"
+	searchRowTimeout = "timeout"
+	searchRowError   = "error"
+)
+
+// SearchRow is a line of -search-only output: one result of a source search,
+// or the search itself when it returned no result or failed.
+type SearchRow struct {
+	VRM               string `json:"vrm"`
+	Company           string `json:"company,omitempty"`
+	ContraventionDate string `json:"contravention_date,omitempty"`
+	DateFrom          string `json:"date_from,omitempty"`
+	DateTo            string `json:"date_to,omitempty"`
+	// Source is the ID of the source searched.
+	Source string `json:"source"`
+	// Outcome is hit for a hirer vehicle, miss for another result, or
+	// empty, timeout or error.
+	Outcome string                `json:"outcome"`
+	Error   string                `json:"error,omitempty"`
+	Result  *VehicleContravention `json:"result,omitempty"`
+}
+
+// searchRows is where search rows are written, set with -search-only.
+var searchRows *SinkSet
+
+// writeSearchRows writes a row for each result of a source search, or one
+// for the search when it has none.
+func writeSearchRows(request SearchRequest, source DataSource, contraventions []*VehicleContravention, searchErr error) error {
+	if searchRows == nil {
+		return nil
+	}
+	row := SearchRow{
+		VRM:               anonymizeVRM(request.VRM),
+		Company:           request.Company,
+		ContraventionDate: request.ContraventionDate,
+		DateFrom:          request.DateFrom,
+		DateTo:            request.DateTo,
+		Source:            source.ID(),
+	}
+
+	switch {
+	case searchErr != nil:
+		row.Outcome = searchRowError
+		if os.IsTimeout(searchErr) {
+			row.Outcome = searchRowTimeout
+		}
+		row.Error = anonymizeText(searchErr.Error())
+		return searchRows.WriteRow(row)
+	case len(contraventions) == 0:
+		row.Outcome = searchRowEmpty
+		return searchRows.WriteRow(row)
+	}
+
+	for _, contravention := range contraventions {
+		result := *contravention
+		result.VRM = anonymizeVRM(result.VRM)
+		row.Result = &result
+		row.Outcome = outcomeMiss
+		if result.IsHirerVehicle {
+			row.Outcome = outcomeHit
+		}
+		if err := searchRows.WriteRow(row); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rowWriter is implemented by the sinks search rows can be written to.
+type rowWriter interface {
+	WriteRow(row SearchRow) error
+}
+
+// WriteRow writes a search row to every sink. A sink that fails fails the
+// row, as search rows are the only output of the run.
+func (s *SinkSet) WriteRow(row SearchRow) error {
+	for i, sink := range s.sinks {
+		writer, ok := sink.(rowWriter)
+		if !ok {
+			return fmt.Errorf("sink %s cannot write search rows", s.names[i])
+		}
+		if err := writer.WriteRow(row); err != nil {
+			log.Printf("Sink %s failed for %s: %v\n", s.names[i], row.VRM, err)
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *lineSink) WriteRow(row SearchRow) error {
+	data, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, err := s.w.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write search row: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// seedTopics publishes fixture messages to the emulator so subscribers under
+// test have data as soon as it is up. Every subdirectory of dir is a topic,
+// created if needed, and every .json file in it a message. A file holding a
+// JSON array is published as one message per element.
+func seedTopics(ctx context.Context, dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("failed to read seed directory: %v", err)
+	}
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		topicName := entry.Name()
+
+		messages, err := readFixtures(filepath.Join(dir, topicName))
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			continue
+		}
+
+		topic, err := clientFactory.Topic(ctx, topicName)
+		if err != nil {
+			return fmt.Errorf("failed to create topic %s: %v", topicName, err)
+		}
+
+		results := make([]*pubsub.PublishResult, 0, len(messages))
+		for _, message := range messages {
+			results = append(results, topic.Publish(ctx, &pubsub.Message{Data: []byte(message)}))
+		}
+		for _, result := range results {
+			if _, err := result.Get(ctx); err != nil {
+				return fmt.Errorf("failed to seed topic %s: %v", topicName, err)
+			}
+		}
+		log.Printf("Seeded %d messages to %s\n", len(messages), topicName)
+	}
+	return nil
+}
+
+// readFixtures reads the messages of the .json files in dir, in file name
+// order.
+func readFixtures(dir string) ([]json.RawMessage, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	messages := make([]json.RawMessage, 0)
+	for _, path := range paths {
+		body, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err := json.Unmarshal(body, &value); err != nil {
+			return nil, fmt.Errorf("invalid fixture %s: %v", path, err)
+		}
+
+		var elements []json.RawMessage
+		if json.Unmarshal(value, &elements) == nil {
+			messages = append(messages, elements...)
+		} else {
+			messages = append(messages, value)
+		}
+	}
+	return messages, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SigningConfig makes a source sign its search requests with HMAC-SHA256.
+// The signature covers the timestamp and the body, joined by a dot, and is
+// sent hex-encoded next to the timestamp in Unix seconds. The shared secret
+// is read from an environment variable so it stays out of the config file.
+type SigningConfig struct {
+	SecretEnv       string `json:"secret_env"`
+	Header          string `json:"header,omitempty"`
+	TimestampHeader string `json:"timestamp_header,omitempty"`
+}
+
+const (
+	defaultSignatureHeader = "X-Signature"
+	defaultTimestampHeader = "X-Timestamp"
+)
+
+// minClockSkew is the smallest difference from a provider's clock that is
+// corrected for. The Date header only has a resolution of one second.
+const minClockSkew = 2 * time.Second
+
+// clockOffsets holds how far ahead of our clock each signing source's clock
+// is, learned from the Date header of its responses.
+var (
+	clockOffsetsMutex sync.Mutex
+	clockOffsets      = make(map[string]time.Duration)
+)
+
+func (c *SigningConfig) validate(company string) error {
+	if c.SecretEnv == "" {
+		return fmt.Errorf("source %s: signing requires secret_env", company)
+	}
+	if os.Getenv(c.SecretEnv) == "" {
+		return fmt.Errorf("source %s: signing secret %s is not set", company, c.SecretEnv)
+	}
+	return nil
+}
+
+func signingConfig(source DataSource) *SigningConfig {
+	if settings := sourceSettings(source); settings != nil {
+		return settings.Signing
+	}
+	return nil
+}
+
+// signRequest adds the signature headers to a request of a signing source.
+func signRequest(req *http.Request, source DataSource) error {
+	signing := signingConfig(source)
+	if signing == nil {
+		return nil
+	}
+
+	body, err := requestBody(req)
+	if err != nil {
+		return err
+	}
+
+	clockOffsetsMutex.Lock()
+	offset := clockOffsets[source.ID()]
+	clockOffsetsMutex.Unlock()
+	timestamp := strconv.FormatInt(time.Now().Add(offset).Unix(), 10)
+
+	header, timestampHeader := signing.Header, signing.TimestampHeader
+	if header == "" {
+		header = defaultSignatureHeader
+	}
+	if timestampHeader == "" {
+		timestampHeader = defaultTimestampHeader
+	}
+	req.Header.Set(timestampHeader, timestamp)
+	req.Header.Set(header, hmacSignature([]byte(os.Getenv(signing.SecretEnv)), timestamp, body))
+	return nil
+}
+
+// observeClock learns the clock offset of a signing source from a response.
+// It reports whether the offset changed, in which case a rejected request is
+// worth signing again.
+func observeClock(source DataSource, resp *http.Response) bool {
+	if signingConfig(source) == nil {
+		return false
+	}
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return false
+	}
+
+	offset := time.Until(date)
+	if offset.Abs() < minClockSkew {
+		offset = 0
+	}
+
+	clockOffsetsMutex.Lock()
+	defer clockOffsetsMutex.Unlock()
+	previous := clockOffsets[source.ID()]
+	if (offset - previous).Abs() < minClockSkew {
+		return false
+	}
+	log.Printf("Clock of %s is %s off, adjusting request timestamps\n", source.ID(), offset.Round(time.Second))
+	clockOffsets[source.ID()] = offset
+	return true
+}
+
+// sendSearchRequest sends a search request, signing it when the source
+// requires it. A signed request that is rejected while our clock was off is
+// signed again with the corrected time and retried once.
+func sendSearchRequest(source DataSource, req *http.Request) (*http.Response, error) {
+	if err := signRequest(req, source); err != nil {
+		return nil, err
+	}
+
+	resp, err := httpClientFor(source).Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if !observeClock(source, resp) || resp.StatusCode != http.StatusUnauthorized || (req.Body != nil && req.GetBody == nil) {
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	if err := signRequest(retry, source); err != nil {
+		return nil, err
+	}
+	return httpClientFor(source).Do(retry)
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sinkPubSub    = "pubsub"
+	sinkStdout    = "stdout"
+	sinkFile      = "file"
+	sinkWebhook   = "webhook"
+	sinkKafka     = "kafka"
+	sinkRabbitMQ  = "rabbitmq"
+	sinkFirestore = "firestore"
+)
+
+// Sink is where positive results are sent.
+type Sink interface {
+	// Publish sends a contravention. done is called, possibly from another
+	// goroutine, once the sink has confirmed it or failed.
+	Publish(ctx context.Context, contravention *VehicleContravention, done func(error)) error
+	Close() error
+}
+
+// SinkConfig is a sink defined in the config file. It is used when its name
+// is listed in -sink.
+type SinkConfig struct {
+	Name      string            `json:"name"`
+	Type      string            `json:"type"`
+	Path      string            `json:"path,omitempty"`
+	URL       string            `json:"url,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Kafka     *KafkaConfig      `json:"kafka,omitempty"`
+	RabbitMQ  *RabbitMQConfig   `json:"rabbitmq,omitempty"`
+	Firestore *FirestoreConfig  `json:"firestore,omitempty"`
+	Fields    *PayloadFields    `json:"fields,omitempty"`
+}
+
+func (c *SinkConfig) validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("sinks: name is required")
+	}
+	if c.Name == sinkPubSub || c.Name == sinkStdout {
+		return fmt.Errorf("sink %s: name is reserved", c.Name)
+	}
+	switch c.Type {
+	case sinkFile:
+		if c.Path == "" {
+			return fmt.Errorf("sink %s: file sinks require a path", c.Name)
+		}
+	case sinkWebhook:
+		if c.URL == "" {
+			return fmt.Errorf("sink %s: webhook sinks require a url", c.Name)
+		}
+	case sinkKafka:
+		if c.Kafka == nil {
+			return fmt.Errorf("sink %s: kafka sinks require kafka settings", c.Name)
+		}
+		if err := c.Kafka.validate(c.Name); err != nil {
+			return err
+		}
+	case sinkRabbitMQ:
+		if c.RabbitMQ == nil {
+			return fmt.Errorf("sink %s: rabbitmq sinks require rabbitmq settings", c.Name)
+		}
+		if err := c.RabbitMQ.validate(c.Name); err != nil {
+			return err
+		}
+	case sinkFirestore:
+		if c.Firestore == nil {
+			return fmt.Errorf("sink %s: firestore sinks require firestore settings", c.Name)
+		}
+		if err := c.Firestore.validate(c.Name); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("sink %s: unknown type %q", c.Name, c.Type)
+	}
+	if c.Fields != nil {
+		return c.Fields.validate("sink " + c.Name)
+	}
+	return nil
+}
+
+// pubsubSink publishes to the positive_searches topic. The topic belongs to
+// the client factory, which flushes it at the end of the run.
+type pubsubSink struct {
+	publisher Publisher
+}
+
+func (s *pubsubSink) Publish(ctx context.Context, contravention *VehicleContravention, done func(error)) error {
+	return publishAsync(s.publisher, ctx, contravention, done)
+}
+
+func (s *pubsubSink) Close() error {
+	return nil
+}
+
+// lineSink writes each result as a line of JSON, in the same format as the
+// Pub/Sub message, to stdout or a file, so results can be piped into jq or
+// other tools.
+type lineSink struct {
+	w      io.Writer
+	closer io.Closer
+	mutex  sync.Mutex
+}
+
+func (s *lineSink) Publish(ctx context.Context, contravention *VehicleContravention, done func(error)) error {
+	data, err := encodeMessage(contravention)
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	_, err = s.w.Write(append(data, '\n'))
+	s.mutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to write result: %v", err)
+	}
+
+	done(nil)
+	return nil
+}
+
+func (s *lineSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+	return s.closer.Close()
+}
+
+// sinkRequests bounds the requests a webhook or firestore sink has in flight.
+// Publishing blocks once they are all taken.
+const sinkRequests = 16
+
+// webhookSink POSTs each result in the message format, in the background so
+// a slow endpoint doesn't hold up checking. Requests are bound to ctx, the
+// run's context, as they can outlive the record.
+type webhookSink struct {
+	ctx     context.Context
+	url     string
+	headers map[string]string
+	client  *http.Client
+	slots   chan struct{}
+	wg      sync.WaitGroup
+}
+
+func (s *webhookSink) Publish(ctx context.Context, contravention *VehicleContravention, done func(error)) error {
+	data, err := encodeMessage(contravention)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case s.slots <- struct{}{}:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := s.post(data)
+		<-s.slots
+		done(err)
+	}()
+	return nil
+}
+
+func (s *webhookSink) post(data []byte) error {
+	req, err := http.NewRequestWithContext(s.ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentTypeAttribute())
+	req.Header.Set("User-Agent", userAgent())
+	for name, value := range s.headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (s *webhookSink) Close() error {
+	s.wg.Wait()
+	return nil
+}
+
+// SinkSet sends every result to several sinks. The first sink is the primary
+// one: its result decides the outcome of the record, and the other sinks only
+// get results it has confirmed, so they never hold a result the primary sink
+// doesn't. Failures of the other sinks are logged and counted in the run
+// summary, but never fail a record, so a broken webhook doesn't stop results
+// reaching Pub/Sub.
+type SinkSet struct {
+	// ctx is the run's context. The other sinks are published to once the
+	// primary sink confirms, when the record may be done.
+	ctx   context.Context
+	names []string
+	sinks []Sink
+	wg    sync.WaitGroup
+}
+
+func (s *SinkSet) Publish(ctx context.Context, contravention *VehicleContravention, done func(error)) error {
+	s.wg.Add(1)
+	err := s.sinks[0].Publish(ctx, contravention, func(err error) {
+		defer s.wg.Done()
+		if err != nil || len(s.sinks) == 1 {
+			done(err)
+			return
+		}
+		// Other sinks get a copy, so the message ID they set isn't taken
+		// for the primary sink's.
+		copied := *contravention
+		copied.MessageID = ""
+		done(nil)
+		s.publishOthers(&copied)
+	})
+	if err != nil {
+		s.wg.Done()
+	}
+	return err
+}
+
+// publishOthers sends a result the primary sink has confirmed to the other
+// sinks.
+func (s *SinkSet) publishOthers(contravention *VehicleContravention) {
+	for i := 1; i < len(s.sinks); i++ {
+		name := s.names[i]
+		failed := func(err error) {
+			log.Printf("Sink %s failed for %s: %v\n", name, contravention.VRM, err)
+			summary.RecordSinkFailure(name)
+		}
+
+		copied := *contravention
+		s.wg.Add(1)
+		err := s.sinks[i].Publish(s.ctx, &copied, func(err error) {
+			if err != nil {
+				failed(err)
+			}
+			s.wg.Done()
+		})
+		if err != nil {
+			failed(err)
+			s.wg.Done()
+		}
+	}
+}
+
+// Wait blocks until every sink is done with every result.
+func (s *SinkSet) Wait() {
+	s.wg.Wait()
+}
+
+func (s *SinkSet) Close() error {
+	s.Wait()
+	var firstErr error
+	for i, sink := range s.sinks {
+		if err := sink.Close(); err != nil {
+			log.Printf("Failed to close sink %s: %v\n", s.names[i], err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// sinkNames splits -sink into sink names.
+func sinkNames(value string) []string {
+	names := make([]string, 0)
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// openSinks creates the sinks listed in -sink, in order. For Pub/Sub the
+// topic and the subscriptions of the config file are created if needed, the
+// topic is checked against our message encoding, and the emulator is seeded.
+func openSinks(ctx context.Context, flags *Flags, config *Config) (*SinkSet, error) {
+	configured := make(map[string]SinkConfig)
+	if config != nil {
+		for _, sinkConfig := range config.Sinks {
+			configured[sinkConfig.Name] = sinkConfig
+		}
+	}
+
+	set := &SinkSet{ctx: ctx}
+	for _, name := range sinkNames(flags.Sink) {
+		sink, err := openSink(ctx, flags, config, name, configured)
+		if err != nil {
+			set.Close()
+			return nil, err
+		}
+		set.names = append(set.names, name)
+		set.sinks = append(set.sinks, shapeSink(sink, sinkFields(config, name, configured)))
+	}
+	return set, nil
+}
+
+// sinkFields returns the payload fields of a sink: those of the
+// positive_searches topic for Pub/Sub, or those of a sink in the config.
+func sinkFields(config *Config, name string, configured map[string]SinkConfig) *PayloadFields {
+	if name == sinkPubSub {
+		if config != nil && config.PubSub != nil {
+			return config.PubSub.Fields
+		}
+		return nil
+	}
+	return configured[name].Fields
+}
+
+func openSink(ctx context.Context, flags *Flags, config *Config, name string, configured map[string]SinkConfig) (Sink, error) {
+	switch name {
+	case sinkPubSub:
+		return openPubSubSink(ctx, flags, config)
+	case sinkStdout:
+		return &lineSink{w: os.Stdout}, nil
+	}
+
+	sinkConfig, ok := configured[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown sink %s: not pubsub, stdout or a sink in the config file", name)
+	}
+	if searchOnly && sinkConfig.Type != sinkFile {
+		return nil, fmt.Errorf("sink %s: search-only results can only be sent to stdout or file sinks", name)
+	}
+	switch sinkConfig.Type {
+	case sinkFile:
+		file, err := os.OpenFile(sinkConfig.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %v", name, err)
+		}
+		return &lineSink{w: file, closer: file}, nil
+	case sinkWebhook:
+		return &webhookSink{
+			ctx:     ctx,
+			url:     sinkConfig.URL,
+			headers: sinkConfig.Headers,
+			client:  &http.Client{Timeout: 10 * time.Second},
+			slots:   make(chan struct{}, sinkRequests),
+		}, nil
+	case sinkKafka:
+		return newKafkaSink(sinkConfig.Kafka)
+	case sinkRabbitMQ:
+		return newRabbitMQSink(sinkConfig.RabbitMQ)
+	case sinkFirestore:
+		return newFirestoreSink(ctx, sinkConfig.Firestore, flags)
+	}
+	return nil, fmt.Errorf("sink %s: unknown type %q", name, sinkConfig.Type)
+}
+
+func openPubSubSink(ctx context.Context, flags *Flags, config *Config) (Sink, error) {
+	if config != nil && config.PubSub != nil {
+		if err := bootstrapPubSub(ctx, config.PubSub); err != nil {
+			return nil, err
+		}
+	}
+
+	topic, err := clientFactory.Topic(ctx, resultsTopic)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create topic: %v", err)
+	}
+
+	if err := checkTopicSchema(ctx, topic); err != nil {
+		return nil, err
+	}
+	topic.EnableMessageOrdering = orderingKeys
+
+	if flags.SeedDir != "" {
+		if err := seedTopics(ctx, flags.SeedDir); err != nil {
+			return nil, err
+		}
+	}
+	return &pubsubSink{publisher: topicPublisher{topic: topic}}, nil
+}
+
+// publishContravention publishes and waits for the confirmation.
+func publishContravention(sink Sink, ctx context.Context, contravention *VehicleContravention) error {
+	confirmed := make(chan error, 1)
+	err := sink.Publish(ctx, contravention, func(err error) {
+		confirmed <- err
+	})
+	if err != nil {
+		return err
+	}
+	return <-confirmed
+}
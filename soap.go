@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+type soapSource struct {
+	config   SourceConfig
+	template *template.Template
+}
+
+type xmlNode struct {
+	XMLName xml.Name
+	Content string    `xml:",chardata"`
+	Nodes   []xmlNode `xml:",any"`
+}
+
+var soapTemplateFuncs = template.FuncMap{
+	"xml": func(value string) (string, error) {
+		var buf bytes.Buffer
+		err := xml.EscapeText(&buf, []byte(value))
+		return buf.String(), err
+	},
+}
+
+func newSoapSource(config SourceConfig) (*soapSource, error) {
+	tmpl, err := template.New(config.ID).Funcs(soapTemplateFuncs).Parse(config.RequestTemplate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid request template: %v", err)
+	}
+
+	return &soapSource{
+		config:   config,
+		template: tmpl,
+	}, nil
+}
+
+func (d *soapSource) ID() string {
+	return d.config.ID
+}
+
+func (d *soapSource) SearchURL() string {
+	return d.config.URL
+}
+
+func (d *soapSource) ResponseMapping() map[string]string {
+	return d.config.Mapping
+}
+
+func (d *soapSource) SourceConfig() *SourceConfig {
+	return &d.config
+}
+
+func (d *soapSource) Search(ctx context.Context, search SearchBody) ([]*VehicleContravention, error) {
+	var envelope bytes.Buffer
+	err := d.template.Execute(&envelope, search)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render SOAP request for %s: %v", d.ID(), err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", d.SearchURL(), &envelope)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "text/xml; charset=utf-8")
+	if d.config.SOAPAction != "" {
+		req.Header.Set("SOAPAction", d.config.SOAPAction)
+	}
+
+	body, err := doSearchRequest(d, req)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := parseSoapResponse(body)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SOAP response from %s: %v", d.ID(), err)
+	}
+
+	jsonBody, err := json.Marshal(response)
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeContraventions(d, jsonBody)
+}
+
+// parseSoapResponse returns the first element inside the SOAP Body converted
+// to a generic JSON-like value, so it can go through the same response
+// mapping as JSON sources.
+func parseSoapResponse(body []byte) (interface{}, error) {
+	var envelope xmlNode
+	if err := xml.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+
+	soapBody := findXMLChild(envelope, "Body")
+	if soapBody == nil {
+		return nil, fmt.Errorf("missing SOAP Body")
+	}
+
+	if fault := findXMLChild(*soapBody, "Fault"); fault != nil {
+		if reason := findXMLChild(*fault, "faultstring"); reason != nil {
+			return nil, fmt.Errorf("SOAP fault: %s", strings.TrimSpace(reason.Content))
+		}
+		return nil, fmt.Errorf("SOAP fault")
+	}
+
+	if len(soapBody.Nodes) == 0 {
+		return nil, fmt.Errorf("empty SOAP Body")
+	}
+
+	return xmlNodeValue(soapBody.Nodes[0]), nil
+}
+
+func findXMLChild(node xmlNode, name string) *xmlNode {
+	for i := range node.Nodes {
+		if node.Nodes[i].XMLName.Local == name {
+			return &node.Nodes[i]
+		}
+	}
+	return nil
+}
+
+// xmlNodeValue converts an element to a string, bool or object. Repeated
+// child elements become arrays.
+func xmlNodeValue(node xmlNode) interface{} {
+	if len(node.Nodes) == 0 {
+		text := strings.TrimSpace(node.Content)
+		switch text {
+		case "true":
+			return true
+		case "false":
+			return false
+		}
+		return text
+	}
+
+	object := make(map[string]interface{})
+	for _, child := range node.Nodes {
+		name := child.XMLName.Local
+		value := xmlNodeValue(child)
+
+		switch existing := object[name].(type) {
+		case nil:
+			object[name] = value
+		case []interface{}:
+			object[name] = append(existing, value)
+		default:
+			object[name] = []interface{}{existing, value}
+		}
+	}
+	return object
+}
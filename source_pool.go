@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// Every source gets its own HTTP connection pool and rate limiter so that a
+// slow or throttled provider cannot hold up requests to the others.
+var (
+	sourcePoolMutex sync.Mutex
+	sourceClients   = make(map[string]*http.Client)
+	sourceLimiters  = make(map[string]*rate.Limiter)
+)
+
+func sourceSettings(source DataSource) *SourceConfig {
+	if configured, ok := source.(ConfiguredSource); ok {
+		return configured.SourceConfig()
+	}
+	return nil
+}
+
+// sourceConcurrency is the number of records of one source checked at once.
+func sourceConcurrency(source DataSource) int {
+	if settings := sourceSettings(source); settings != nil && settings.Concurrency > 0 {
+		return settings.Concurrency
+	}
+	return 1
+}
+
+func httpClientFor(source DataSource) *http.Client {
+	sourcePoolMutex.Lock()
+	defer sourcePoolMutex.Unlock()
+
+	if client, ok := sourceClients[source.ID()]; ok {
+		return client
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = sourceConcurrency(source)
+
+	var roundTripper http.RoundTripper = transport
+	if cassette != nil {
+		roundTripper = cassette.Transport(source.ID(), transport)
+	}
+	if faults != nil {
+		roundTripper = faults.Transport(source.ID(), roundTripper)
+	}
+	if httpDebugLog != nil {
+		roundTripper = httpDebugLog.Transport(source, roundTripper)
+	}
+
+	client := &http.Client{
+		Timeout:   searchClientTimeout(),
+		Transport: roundTripper,
+	}
+	sourceClients[source.ID()] = client
+	return client
+}
+
+// searchLimiter caps the search requests to all sources together. It is nil
+// unless -qps is set.
+var searchLimiter *rate.Limiter
+
+// waitForSearchLimit blocks until -qps allows another search request.
+func waitForSearchLimit(ctx context.Context) error {
+	if searchLimiter == nil {
+		return nil
+	}
+	return searchLimiter.Wait(ctx)
+}
+
+// waitForRateLimit blocks until -qps and the source's rate limit allow
+// another request.
+func waitForRateLimit(ctx context.Context, source DataSource) error {
+	if err := waitForSearchLimit(ctx); err != nil {
+		return err
+	}
+
+	settings := sourceSettings(source)
+	if settings == nil || settings.RateLimit <= 0 {
+		return nil
+	}
+
+	burst := settings.Burst
+	if burst < 1 {
+		burst = 1
+	}
+
+	sourcePoolMutex.Lock()
+	limiter, ok := sourceLimiters[source.ID()]
+	if !ok {
+		limiter = rate.NewLimiter(rate.Limit(settings.RateLimit), burst)
+		sourceLimiters[source.ID()] = limiter
+	} else if limiter.Limit() != rate.Limit(settings.RateLimit) || limiter.Burst() != burst {
+		// The config was reloaded with different limits.
+		limiter.SetLimit(rate.Limit(settings.RateLimit))
+		limiter.SetBurst(burst)
+	}
+	sourcePoolMutex.Unlock()
+
+	return limiter.Wait(ctx)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"os"
+	"slices"
+	"sort"
+	"time"
+)
+
+// SourceStats describes how one data source performed during a run.
+type SourceStats struct {
+	Requests int `json:"requests"`
+	Hits     int `json:"hits"`
+	Misses   int `json:"misses"`
+	Timeouts int `json:"timeouts"`
+	Errors   int `json:"errors"`
+	Retries  int `json:"retries,omitempty"`
+	// CacheHits and CacheMisses count the searches answered from the
+	// response cache and those it didn't have.
+	CacheHits   int     `json:"cache_hits,omitempty"`
+	CacheMisses int     `json:"cache_misses,omitempty"`
+	P50Ms       float64 `json:"p50_ms"`
+	P95Ms       float64 `json:"p95_ms"`
+	latencies   []time.Duration
+}
+
+// RecordSearch counts a search of a source. A hit is a search with a result
+// for a hirer vehicle, whatever its confidence.
+func (s *RunSummary) RecordSearch(source string, latency time.Duration, contraventions []*VehicleContravention, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := s.sourceStats(source)
+	stats.Requests++
+	stats.latencies = append(stats.latencies, latency)
+	switch {
+	case os.IsTimeout(err):
+		stats.Timeouts++
+	case err != nil:
+		stats.Errors++
+	case slices.ContainsFunc(contraventions, isHirerVehicle):
+		stats.Hits++
+	default:
+		stats.Misses++
+	}
+}
+
+// RecordCacheLookup counts a search looked up in the response cache.
+func (s *RunSummary) RecordCacheLookup(source string, hit bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if hit {
+		s.sourceStats(source).CacheHits++
+	} else {
+		s.sourceStats(source).CacheMisses++
+	}
+}
+
+// RecordRetry counts a search of a source that is tried again.
+func (s *RunSummary) RecordRetry(source string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.sourceStats(source).Retries++
+}
+
+func (s *RunSummary) sourceStats(source string) *SourceStats {
+	if s.Sources == nil {
+		s.Sources = make(map[string]*SourceStats)
+	}
+	stats, ok := s.Sources[source]
+	if !ok {
+		stats = &SourceStats{}
+		s.Sources[source] = stats
+	}
+	return stats
+}
+
+// finishSourceStats computes the latency percentiles of every source.
+func (s *RunSummary) finishSourceStats() {
+	for _, stats := range s.Sources {
+		sorted := append([]time.Duration(nil), stats.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		stats.P50Ms = durationMs(percentile(sorted, 0.50))
+		stats.P95Ms = durationMs(percentile(sorted, 0.95))
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Meanings of a response status code in a source's status_codes.
+const (
+	statusMiss  = "miss"
+	statusError = "error"
+)
+
+// errStatusMiss is returned for a response whose status code the source's
+// status_codes map to a miss, like a 404 for a vehicle the provider doesn't
+// know.
+var errStatusMiss = fmt.Errorf("status code means not found")
+
+func validateStatusCodes(company string, codes map[string]string) error {
+	for code, meaning := range codes {
+		status, err := strconv.Atoi(code)
+		if err != nil || status < 100 || status > 599 || status == 200 {
+			return fmt.Errorf("source %s: invalid status code %q in status_codes", company, code)
+		}
+		if meaning != statusMiss && meaning != statusError {
+			return fmt.Errorf("source %s: status code %s must mean miss or error, not %q", company, code, meaning)
+		}
+	}
+	return nil
+}
+
+// statusMeaning is what a non-200 status code from a source means. Status
+// codes not listed in status_codes are errors.
+func statusMeaning(source DataSource, status int) string {
+	if settings := sourceSettings(source); settings != nil {
+		if meaning, ok := settings.StatusCodes[strconv.Itoa(status)]; ok {
+			return meaning
+		}
+	}
+	return statusError
+}
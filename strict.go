@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// strictViolations lists the problems that fail a -strict run before any
+// record is checked: invalid records and companies without a source, which
+// would otherwise be searched in every source. Batch files are checked like
+// `t360 batch validate`, so unknown fields are caught too.
+func strictViolations(flags *Flags, requests []SearchRequest) ([]string, error) {
+	violations := make([]string, 0)
+
+	if flags.BatchFile != "" {
+		body, err := readBatchBody(flags.BatchFile)
+		if err != nil {
+			return nil, err
+		}
+		for _, diagnostic := range validateBatch(body) {
+			if diagnostic.Severity == severityError || diagnostic.Code == "unknown_company" {
+				violations = append(violations, fmt.Sprintf("%s: %s", diagnostic.Path, diagnostic.Message))
+			}
+		}
+		return violations, nil
+	}
+
+	for i, request := range requests {
+		if strings.TrimSpace(request.VRM) == "" {
+			violations = append(violations, fmt.Sprintf("record %d: vrm must not be empty", i))
+		}
+		if request.Company != "" && getDataSource(request.Company) == nil {
+			violations = append(violations, fmt.Sprintf("record %d: no source for company %q", i, request.Company))
+		}
+	}
+	return violations, nil
+}
+
+func checkStrict(flags *Flags, requests []SearchRequest) error {
+	violations, err := strictViolations(flags, requests)
+	if err != nil {
+		return err
+	}
+	if len(violations) == 0 {
+		return nil
+	}
+
+	log.Printf("STRICT: %d problems found, no records were checked\n", len(violations))
+	for _, violation := range violations {
+		log.Printf("STRICT: %s\n", violation)
+	}
+	return fmt.Errorf("strict mode: %d invalid records or unknown companies", len(violations))
+}
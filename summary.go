@@ -0,0 +1,485 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	outcomeHit       = "hit"
+	outcomeMiss      = "miss"
+	outcomeTimeout   = "timeout"
+	outcomeError     = "error"
+	outcomeSkipped   = "skipped"
+	outcomeDuplicate = "duplicate"
+	outcomeDeferred  = "deferred"
+)
+
+type RecordResult struct {
+	VRM               string `json:"vrm"`
+	Company           string `json:"company"`
+	ContraventionDate string `json:"contravention_date,omitempty"`
+	DateFrom          string `json:"date_from,omitempty"`
+	DateTo            string `json:"date_to,omitempty"`
+	Priority          string `json:"priority,omitempty"`
+	Outcome           string `json:"outcome"`
+	TimeoutPhase      string `json:"timeout_phase,omitempty"`
+	Error             string `json:"error,omitempty"`
+	// Metadata is kept so replayed records publish the same attributes.
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	CallbackURL string            `json:"callback_url,omitempty"`
+	Reference   string            `json:"reference,omitempty"`
+}
+
+// RunSummary collects the outcome of every checked record. It is written to
+// the report file and sent to the notification hooks at the end of a run.
+type RunSummary struct {
+	RunID        string         `json:"run_id"`
+	Chunk        string         `json:"chunk,omitempty"`
+	StartedAt    time.Time      `json:"started_at"`
+	FinishedAt   time.Time      `json:"finished_at"`
+	Total        int            `json:"total"`
+	Hits         int            `json:"hits"`
+	Misses       int            `json:"misses"`
+	Timeouts     int            `json:"timeouts"`
+	Errors       int            `json:"errors"`
+	Skipped      int            `json:"skipped"`
+	Duplicates   int            `json:"duplicates"`
+	Deferred     int            `json:"deferred,omitempty"`
+	RunError     string         `json:"run_error,omitempty"`
+	Anonymized   bool           `json:"anonymized,omitempty"`
+	ReportFile   string         `json:"-"`
+	ArtifactsDir string         `json:"-"`
+	Publish      PublishStats   `json:"publish"`
+	Sample       *SampleReport  `json:"sample,omitempty"`
+	SinkFailures map[string]int `json:"sink_failures,omitempty"`
+	// CallbackFailures counts record callbacks that could not be delivered.
+	CallbackFailures int `json:"callback_failures,omitempty"`
+	// OutboxFailures counts failed publishes of outbox entries, which are
+	// tried again.
+	OutboxFailures int `json:"outbox_failures,omitempty"`
+	// CompanyMismatches counts results whose lease company is not the one
+	// the record was requested for.
+	CompanyMismatches int                     `json:"company_mismatches,omitempty"`
+	Canary            *CanaryReport           `json:"canary,omitempty"`
+	Sources           map[string]*SourceStats `json:"sources,omitempty"`
+	Records           []RecordResult          `json:"records"`
+	// RecordsDropped counts the oldest records left out of Records after
+	// KeepLatest.
+	RecordsDropped int `json:"records_dropped,omitempty"`
+	input          []SearchRequest
+	latencies      []time.Duration
+	keep           int
+	mutex          sync.Mutex
+}
+
+// PublishStats describes how long Pub/Sub took to confirm published messages.
+type PublishStats struct {
+	Count int `json:"count"`
+	Slow  int `json:"slow"`
+	// Throttled counts publishes rejected for quota and sent again later.
+	Throttled int     `json:"throttled,omitempty"`
+	P50Ms     float64 `json:"p50_ms"`
+	P95Ms     float64 `json:"p95_ms"`
+}
+
+var summary = NewRunSummary()
+
+func NewRunSummary() *RunSummary {
+	return &RunSummary{
+		RunID:     runID,
+		StartedAt: time.Now(),
+		Records:   make([]RecordResult, 0),
+	}
+}
+
+func (s *RunSummary) Record(request SearchRequest, outcome string, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	result := RecordResult{
+		VRM:               anonymizeVRM(request.VRM),
+		Company:           request.Company,
+		ContraventionDate: request.ContraventionDate,
+		DateFrom:          request.DateFrom,
+		DateTo:            request.DateTo,
+		Priority:          request.Priority,
+		Outcome:           outcome,
+		Metadata:          request.Metadata,
+		CallbackURL:       request.CallbackURL,
+		Reference:         request.Reference,
+	}
+	if err != nil {
+		result.Error = anonymizeText(err.Error())
+		result.TimeoutPhase = timeoutPhase(err)
+	}
+
+	s.Total++
+	switch outcome {
+	case outcomeHit:
+		s.Hits++
+	case outcomeMiss:
+		s.Misses++
+	case outcomeTimeout:
+		s.Timeouts++
+	case outcomeError:
+		s.Errors++
+	case outcomeDuplicate:
+		s.Duplicates++
+	case outcomeDeferred:
+		s.Deferred++
+	}
+	s.Records = append(s.Records, result)
+	if s.keep > 0 && len(s.Records) >= 2*s.keep {
+		s.RecordsDropped += len(s.Records) - s.keep
+		s.Records = dropOldest(s.Records, s.keep)
+	}
+	logFailedRecord(result)
+	if events != nil {
+		events.RecordCompleted(request, outcome, err)
+	}
+	if backfillCheckpoint != nil {
+		backfillCheckpoint.Record(request, outcome)
+	}
+	if acks != nil {
+		acks.Record(request, outcome, err)
+	}
+	if result.CallbackURL != "" && callbacks != nil {
+		callbacks.Send(s.RunID, result)
+	}
+
+	if pretty != nil {
+		pretty.Record(result)
+	}
+}
+
+// KeepLatest bounds the records and publish latencies kept by the summary:
+// once 2n are held, all but the latest n are dropped. The counts still cover
+// every record.
+func (s *RunSummary) KeepLatest(n int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.keep = n
+}
+
+// dropOldest keeps the last n items, copying them so the dropped ones can be
+// freed.
+func dropOldest[T any](items []T, n int) []T {
+	return append(make([]T, 0, n), items[len(items)-n:]...)
+}
+
+// SetInput stores the records the run is going to check. Records that were
+// never checked, because the run stopped early, are reported as skipped.
+func (s *RunSummary) SetInput(requests []SearchRequest) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.input = requests
+}
+
+// AddInput adds a record to the records the run is going to check, for
+// batches that are checked as they are read.
+func (s *RunSummary) AddInput(request SearchRequest) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.input = append(s.input, request)
+}
+
+// SetSample stores the result of the spot check of -sample.
+func (s *RunSummary) SetSample(report *SampleReport) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Sample = report
+}
+
+// RecordCanary counts a record compared by the canary, and keeps the
+// divergence if the results differ.
+func (s *RunSummary) RecordCanary(divergence *CanaryDivergence) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.Canary == nil {
+		s.Canary = &CanaryReport{Divergences: make([]CanaryDivergence, 0)}
+	}
+	s.Canary.Compared++
+	if divergence != nil {
+		s.Canary.Divergences = append(s.Canary.Divergences, *divergence)
+	}
+}
+
+// RecordSinkFailure counts a result that a secondary sink failed to take.
+func (s *RunSummary) RecordSinkFailure(sink string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.SinkFailures == nil {
+		s.SinkFailures = make(map[string]int)
+	}
+	s.SinkFailures[sink]++
+}
+
+// RecordOutboxFailure counts a failed publish of an outbox entry.
+func (s *RunSummary) RecordOutboxFailure() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.OutboxFailures++
+}
+
+// RecordCallbackFailure counts a record callback that could not be delivered.
+func (s *RunSummary) RecordCallbackFailure() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.CallbackFailures++
+}
+
+// RecordCompanyMismatch counts a result for another lease company than the
+// requested one.
+func (s *RunSummary) RecordCompanyMismatch() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.CompanyMismatches++
+}
+
+// RecordThrottle counts a publish rejected because a quota was exhausted.
+func (s *RunSummary) RecordThrottle() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Publish.Throttled++
+}
+
+// RecordPublish stores the confirmation latency of a published message.
+func (s *RunSummary) RecordPublish(latency time.Duration, slow bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.latencies = append(s.latencies, latency)
+	if s.keep > 0 && len(s.latencies) >= 2*s.keep {
+		s.latencies = dropOldest(s.latencies, s.keep)
+	}
+	s.Publish.Count++
+	if slow {
+		s.Publish.Slow++
+	}
+}
+
+func (s *RunSummary) Finish(runErr error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	sorted := append([]time.Duration(nil), s.latencies...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	s.Publish.P50Ms = durationMs(percentile(sorted, 0.50))
+	s.Publish.P95Ms = durationMs(percentile(sorted, 0.95))
+	s.finishSourceStats()
+
+	processed := make(map[string]int)
+	for _, record := range s.Records {
+		processed[recordKey(record.VRM, record.Company, datesKey(record.ContraventionDate, record.DateFrom, record.DateTo))]++
+	}
+	for _, request := range s.input {
+		key := recordKey(anonymizeVRM(request.VRM), request.Company, request.dateKey())
+		if processed[key] > 0 {
+			processed[key]--
+			continue
+		}
+		s.Skipped++
+		s.Records = append(s.Records, RecordResult{
+			VRM:               anonymizeVRM(request.VRM),
+			Company:           request.Company,
+			ContraventionDate: request.ContraventionDate,
+			DateFrom:          request.DateFrom,
+			DateTo:            request.DateTo,
+			Priority:          request.Priority,
+			Outcome:           outcomeSkipped,
+			Metadata:          request.Metadata,
+			CallbackURL:       request.CallbackURL,
+			Reference:         request.Reference,
+		})
+	}
+	s.input = nil
+
+	s.FinishedAt = time.Now()
+	s.Anonymized = anonymizer != nil
+	if runErr != nil {
+		s.RunError = anonymizeText(runErr.Error())
+	}
+}
+
+// Failures returns the records that timed out or failed.
+func (s *RunSummary) Failures() []RecordResult {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	failures := make([]RecordResult, 0)
+	for _, record := range s.Records {
+		if record.Outcome == outcomeTimeout || record.Outcome == outcomeError {
+			failures = append(failures, record)
+		}
+	}
+	return failures
+}
+
+// maxListedTimeouts bounds the records named by TimedOut.
+const maxListedTimeouts = 20
+
+// TimedOut names the records that timed out, VRM and company, for errors.
+func (s *RunSummary) TimedOut() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	names := make([]string, 0)
+	for _, record := range s.Records {
+		switch {
+		case record.Outcome != outcomeTimeout:
+		case record.Company == "":
+			names = append(names, record.VRM)
+		default:
+			names = append(names, fmt.Sprintf("%s (%s)", record.VRM, record.Company))
+		}
+	}
+	if len(names) > maxListedTimeouts {
+		names = append(names[:maxListedTimeouts], fmt.Sprintf("and %d more in the report", len(names)-maxListedTimeouts))
+	}
+	return strings.Join(names, ", ")
+}
+
+func (s *RunSummary) WriteReport(path string) error {
+	s.mutex.Lock()
+	body, err := json.MarshalIndent(s, "", "  ")
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, body, 0644); err != nil {
+		return fmt.Errorf("failed to write report: %w", err)
+	}
+
+	s.mutex.Lock()
+	s.ReportFile = path
+	s.mutex.Unlock()
+	return nil
+}
+
+// Text renders a short plain-text summary for logs and notifications.
+func (s *RunSummary) Text() string {
+	failures := s.Failures()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var b strings.Builder
+	if s.RunError != "" {
+		fmt.Fprintf(&b, "Vehicle check run FAILED: %s\n", s.RunError)
+	} else {
+		fmt.Fprintf(&b, "Vehicle check run completed\n")
+	}
+	fmt.Fprintf(&b, "Run ID: %s\n", s.RunID)
+	if s.Chunk != "" {
+		fmt.Fprintf(&b, "Chunk: %s\n", s.Chunk)
+	}
+	fmt.Fprintf(&b, "Duration: %s\n", s.FinishedAt.Sub(s.StartedAt).Round(time.Second))
+	fmt.Fprintf(&b, "Records: %d, hits: %d, misses: %d, timeouts: %d, errors: %d\n",
+		s.Total, s.Hits, s.Misses, s.Timeouts, s.Errors)
+	if s.Duplicates > 0 {
+		fmt.Fprintf(&b, "Duplicates: %d hits were already published within the dedup window\n", s.Duplicates)
+	}
+	if s.Skipped > 0 {
+		fmt.Fprintf(&b, "Skipped: %d records were not checked\n", s.Skipped)
+	}
+	if s.Deferred > 0 {
+		fmt.Fprintf(&b, "Deferred: %d records did not fit in the latency budget\n", s.Deferred)
+	}
+	if s.Sample != nil {
+		fmt.Fprintf(&b, "Spot check: %d of %d sampled hits differ\n", len(s.Sample.Discrepancies), s.Sample.Checked)
+	}
+	if s.Canary != nil {
+		fmt.Fprintf(&b, "Canary: %d of %d compared records diverge\n", len(s.Canary.Divergences), s.Canary.Compared)
+	}
+	sinks := make([]string, 0, len(s.SinkFailures))
+	for sink := range s.SinkFailures {
+		sinks = append(sinks, sink)
+	}
+	sort.Strings(sinks)
+	for _, sink := range sinks {
+		fmt.Fprintf(&b, "Sink %s: %d results failed\n", sink, s.SinkFailures[sink])
+	}
+	if s.CallbackFailures > 0 {
+		fmt.Fprintf(&b, "Callbacks: %d failed\n", s.CallbackFailures)
+	}
+	if s.OutboxFailures > 0 {
+		fmt.Fprintf(&b, "Outbox: %d publishes failed and were tried again\n", s.OutboxFailures)
+	}
+	if s.CompanyMismatches > 0 {
+		fmt.Fprintf(&b, "Company mismatches: %d results were for another lease company than requested\n", s.CompanyMismatches)
+	}
+	sources := make([]string, 0, len(s.Sources))
+	for source := range s.Sources {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	for _, source := range sources {
+		stats := s.Sources[source]
+		fmt.Fprintf(&b, "Source %s: %d requests, hits: %d, misses: %d, timeouts: %d, errors: %d, retries: %d, p95 %.0fms\n",
+			source, stats.Requests, stats.Hits, stats.Misses, stats.Timeouts, stats.Errors, stats.Retries, stats.P95Ms)
+		if stats.CacheHits+stats.CacheMisses > 0 {
+			fmt.Fprintf(&b, "Source %s cache: %d hits, %d misses\n", source, stats.CacheHits, stats.CacheMisses)
+		}
+	}
+	if s.Publish.Count > 0 {
+		fmt.Fprintf(&b, "Publish latency: p50 %.0fms, p95 %.0fms over %d messages (%d slow)\n",
+			s.Publish.P50Ms, s.Publish.P95Ms, s.Publish.Count, s.Publish.Slow)
+	}
+	if s.Publish.Throttled > 0 {
+		fmt.Fprintf(&b, "Publishing was slowed down %d times by Pub/Sub quota errors\n", s.Publish.Throttled)
+	}
+
+	const maxListed = 20
+	for i, failure := range failures {
+		if i == maxListed {
+			fmt.Fprintf(&b, "... and %d more\n", len(failures)-maxListed)
+			break
+		}
+		fmt.Fprintf(&b, "- %s (%s): %s %s\n", failure.VRM, failure.Company, failure.Outcome, failure.Error)
+	}
+
+	if s.ReportFile != "" {
+		fmt.Fprintf(&b, "Report: %s\n", s.ReportFile)
+	}
+	if s.ArtifactsDir != "" {
+		fmt.Fprintf(&b, "Artifacts: %s\n", s.ArtifactsDir)
+	}
+
+	return b.String()
+}
+
+func recordKey(vrm string, company string, date string) string {
+	return vrm + "\x00" + company + "\x00" + date
+}
+
+// requestKey is the recordKey of a batch record, with its VRM upper-cased
+// and without spaces, so "ab12 cde" and "AB12CDE" are the same record.
+func requestKey(request SearchRequest) string {
+	return recordKey(strings.ToUpper(strings.ReplaceAll(request.VRM, " ", "")), request.Company, request.dateKey())
+}
+
+// percentile returns the nearest-rank percentile of an ascending slice.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	return sorted[rank]
+}
+
+func durationMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
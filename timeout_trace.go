@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Phases of an HTTP search in which a timeout can happen.
+const (
+	phaseDNS      = "dns"
+	phaseConnect  = "connect"
+	phaseTLS      = "tls"
+	phaseRequest  = "request"
+	phaseResponse = "response"
+	phaseBody     = "body"
+)
+
+// requestTrace records when each phase of a request started and finished, so
+// that a timeout can be attributed to the phase that was still running.
+type requestTrace struct {
+	mutex  sync.Mutex
+	start  time.Time
+	events map[string]time.Time
+}
+
+func newRequestTrace(ctx context.Context) (*requestTrace, context.Context) {
+	t := &requestTrace{start: time.Now(), events: make(map[string]time.Time)}
+
+	trace := &httptrace.ClientTrace{
+		GetConn:              func(string) { t.mark("get_conn") },
+		DNSStart:             func(httptrace.DNSStartInfo) { t.mark("dns_start") },
+		DNSDone:              func(httptrace.DNSDoneInfo) { t.mark("dns_done") },
+		ConnectStart:         func(string, string) { t.mark("connect_start") },
+		ConnectDone:          func(string, string, error) { t.mark("connect_done") },
+		TLSHandshakeStart:    func() { t.mark("tls_start") },
+		TLSHandshakeDone:     func(tls.ConnectionState, error) { t.mark("tls_done") },
+		GotConn:              func(httptrace.GotConnInfo) { t.mark("got_conn") },
+		WroteRequest:         func(httptrace.WroteRequestInfo) { t.mark("wrote_request") },
+		GotFirstResponseByte: func() { t.mark("first_byte") },
+	}
+	return t, httptrace.WithClientTrace(ctx, trace)
+}
+
+func (t *requestTrace) mark(event string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.events[event] = time.Now()
+}
+
+func (t *requestTrace) has(event string) bool {
+	_, ok := t.events[event]
+	return ok
+}
+
+// phase returns the phase the request was in, or "" when it never got as far
+// as asking for a connection.
+func (t *requestTrace) phase() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	switch {
+	case t.has("first_byte"):
+		return phaseBody
+	case t.has("wrote_request"):
+		return phaseResponse
+	case t.has("got_conn"):
+		return phaseRequest
+	case t.has("tls_start") && !t.has("tls_done"):
+		return phaseTLS
+	case t.has("dns_start") && !t.has("dns_done"):
+		return phaseDNS
+	case t.has("get_conn"):
+		// Connecting, or waiting for a pooled connection to be free.
+		return phaseConnect
+	}
+	return ""
+}
+
+// durations lists how long the completed phases took, e.g.
+// "dns 3ms, connect 12ms, tls 40ms".
+func (t *requestTrace) durations() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	spans := []struct {
+		name       string
+		start, end string
+	}{
+		{phaseDNS, "dns_start", "dns_done"},
+		{phaseConnect, "connect_start", "connect_done"},
+		{phaseTLS, "tls_start", "tls_done"},
+		{phaseResponse, "wrote_request", "first_byte"},
+	}
+	parts := make([]string, 0, len(spans))
+	for _, span := range spans {
+		start, ok := t.events[span.start]
+		if !ok {
+			continue
+		}
+		end, ok := t.events[span.end]
+		if !ok {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s %s", span.name, end.Sub(start).Round(time.Millisecond)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// timeoutError wraps a timeout with the phase it happened in. The trace
+// durations are part of the message so they reach the logs and the report.
+func (t *requestTrace) timeoutError(err error) error {
+	phase := t.phase()
+	if phase == "" {
+		return err
+	}
+	message := fmt.Sprintf("timeout during %s after %s", phase, time.Since(t.start).Round(time.Millisecond))
+	if durations := t.durations(); durations != "" {
+		message += " (" + durations + ")"
+	}
+	return &searchTimeoutError{err: fmt.Errorf("%s: %v", message, err), phase: phase}
+}
+
+// timeoutPhase returns the phase of a search timeout, if it is known.
+func timeoutPhase(err error) string {
+	if timeout, ok := err.(*searchTimeoutError); ok {
+		return timeout.phase
+	}
+	return ""
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"cloud.google.com/go/pubsub"
+)
+
+const defaultResultsTopic = "positive_searches"
+
+// resultsTopic is the topic positive results are published to, set by
+// -topic. It is a topic ID in the client project or the fully-qualified
+// name of a topic in any project.
+var resultsTopic = defaultResultsTopic
+
+// topicIDPattern is what Pub/Sub accepts as a topic ID.
+var topicIDPattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9\-_.~+%]{2,254}$`)
+
+// parseTopicName splits projects/<project>/topics/<id> into its project and
+// ID. A bare topic ID has no project.
+func parseTopicName(name string) (project string, id string, err error) {
+	id = name
+	if strings.HasPrefix(name, "projects/") {
+		parts := strings.Split(name, "/")
+		if len(parts) != 4 || parts[1] == "" || parts[2] != "topics" {
+			return "", "", fmt.Errorf("invalid topic %q: expected projects/<project>/topics/<topic>", name)
+		}
+		project, id = parts[1], parts[3]
+	}
+	if !topicIDPattern.MatchString(id) {
+		return "", "", fmt.Errorf("invalid topic %q", name)
+	}
+	return project, id, nil
+}
+
+// topicRef returns the handle of a topic, in another project when its name
+// says so, and whether that project is the client's own.
+func topicRef(client *pubsub.Client, name string) (*pubsub.Topic, bool, error) {
+	project, id, err := parseTopicName(name)
+	if err != nil {
+		return nil, false, err
+	}
+	if project == "" || project == client.Project() {
+		return client.Topic(id), true, nil
+	}
+	return client.TopicInProject(id, project), false, nil
+}
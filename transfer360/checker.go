@@ -0,0 +1,213 @@
+// Package transfer360 embeds the vehicle check workflow of the t360 tool:
+// search the source of a record's company for the VRM and publish the hirer
+// vehicle contraventions found.
+//
+//	checker, err := transfer360.NewChecker(
+//		transfer360.WithPublisher(transfer360.NewPubSubPublisher(topic)),
+//		transfer360.WithLogger(log.Default()),
+//	)
+//	result, err := checker.Check(ctx, transfer360.Request{VRM: "AB12CDE", Company: "ACME Company Ltd"})
+//
+// Batch files, config files, sinks other than a Publisher, dedup and the
+// outbox are features of the t360 command, not of this package.
+package transfer360
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Outcomes of a check.
+const (
+	OutcomeHit  = "hit"
+	OutcomeMiss = "miss"
+)
+
+// defaultSearchTimeout matches the search timeout of the t360 command.
+const defaultSearchTimeout = 2 * time.Second
+
+// Request is a vehicle to check.
+type Request struct {
+	VRM     string
+	Company string
+	// ContraventionDate is the date searched for; the zero time searches
+	// for now.
+	ContraventionDate time.Time
+	// Metadata is sent as attributes of the published messages, except
+	// for the keys the package sets itself.
+	Metadata map[string]string
+}
+
+// Result is the outcome of a check and the contraventions published for it.
+type Result struct {
+	Outcome        string
+	Contraventions []*Contravention
+}
+
+// Checker searches sources and publishes what it finds. It is safe for
+// concurrent use.
+type Checker struct {
+	sources       map[string]Source
+	publisher     Publisher
+	client        *http.Client
+	logger        *log.Logger
+	minConfidence float64
+}
+
+type Option func(*Checker)
+
+// WithSources replaces the built-in sandbox sources with sources keyed by
+// company name.
+func WithSources(sources map[string]Source) Option {
+	return func(c *Checker) {
+		c.sources = sources
+	}
+}
+
+// WithPublisher sets where results are published. It is required.
+func WithPublisher(publisher Publisher) Option {
+	return func(c *Checker) {
+		c.publisher = publisher
+	}
+}
+
+// WithHTTPClient sets the client HTTP sources search with. The default has a
+// 2 second timeout.
+func WithHTTPClient(client *http.Client) Option {
+	return func(c *Checker) {
+		c.client = client
+	}
+}
+
+// WithLogger logs each search and publish. Nothing is logged by default.
+func WithLogger(logger *log.Logger) Option {
+	return func(c *Checker) {
+		c.logger = logger
+	}
+}
+
+// WithMinConfidence skips results a source is less confident about than
+// min, between 0 and 1.
+func WithMinConfidence(min float64) Option {
+	return func(c *Checker) {
+		c.minConfidence = min
+	}
+}
+
+func NewChecker(opts ...Option) (*Checker, error) {
+	c := &Checker{
+		sources: DefaultSources(),
+		client:  &http.Client{Timeout: defaultSearchTimeout},
+		logger:  log.New(io.Discard, "", 0),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	if c.publisher == nil {
+		return nil, fmt.Errorf("a publisher is required")
+	}
+	if c.client == nil || c.logger == nil {
+		return nil, fmt.Errorf("http client and logger cannot be nil")
+	}
+	if c.minConfidence < 0 || c.minConfidence > 1 {
+		return nil, fmt.Errorf("min confidence must be between 0 and 1")
+	}
+	return c, nil
+}
+
+// Check searches the source of the request's company, or every source when
+// the company is unknown, and publishes each hirer vehicle contravention
+// found. A failed publish fails the check. When the company is unknown, a
+// source that fails is skipped; the check only fails if none found the
+// vehicle and one of them failed.
+func (c *Checker) Check(ctx context.Context, request Request) (*Result, error) {
+	if request.VRM == "" {
+		return nil, fmt.Errorf("vrm is required")
+	}
+	date := request.ContraventionDate
+	if date.IsZero() {
+		date = time.Now()
+	}
+	search := Search{VRM: request.VRM, ContraventionDate: date}
+
+	c.logger.Printf("Checking vehicle: %s, %s\n", request.VRM, request.Company)
+
+	var contraventions []*Contravention
+	if source, ok := c.sources[request.Company]; ok {
+		results, err := c.search(ctx, source, search)
+		if err != nil {
+			return nil, err
+		}
+		contraventions = c.qualifying(results)
+	} else {
+		companies := make([]string, 0, len(c.sources))
+		for company := range c.sources {
+			companies = append(companies, company)
+		}
+		sort.Strings(companies)
+
+		var errs []error
+		for _, company := range companies {
+			results, err := c.search(ctx, c.sources[company], search)
+			if err != nil {
+				c.logger.Printf("%v\n", err)
+				errs = append(errs, err)
+				continue
+			}
+			if contraventions = c.qualifying(results); len(contraventions) > 0 {
+				break
+			}
+		}
+		if len(contraventions) == 0 && len(errs) > 0 {
+			return nil, errors.Join(errs...)
+		}
+	}
+
+	if len(contraventions) == 0 {
+		c.logger.Printf("Not a hirer vehicle: %s\n", request.VRM)
+		return &Result{Outcome: OutcomeMiss}, nil
+	}
+
+	for _, contravention := range contraventions {
+		contravention.Reference = uuid.New().String()
+		if err := c.publisher.Publish(ctx, contravention, Attributes(contravention, request.Metadata)); err != nil {
+			return nil, fmt.Errorf("failed to publish result for %s: %v", request.VRM, err)
+		}
+		c.logger.Printf("published vrm %s\n", contravention.VRM)
+	}
+	return &Result{Outcome: OutcomeHit, Contraventions: contraventions}, nil
+}
+
+func (c *Checker) search(ctx context.Context, source Source, search Search) ([]*Contravention, error) {
+	c.logger.Printf("Searching for %s in %s\n", search.VRM, source.ID())
+	results, err := source.Search(ctx, c.client, search)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search %s: %v", source.ID(), err)
+	}
+	return results, nil
+}
+
+// qualifying keeps the hirer vehicles matched with enough confidence.
+func (c *Checker) qualifying(results []*Contravention) []*Contravention {
+	contraventions := make([]*Contravention, 0, len(results))
+	for _, contravention := range results {
+		if contravention == nil || !contravention.IsHirerVehicle {
+			continue
+		}
+		if contravention.Score() < c.minConfidence {
+			c.logger.Printf("Skipping low confidence match for %s: %.2f\n", contravention.VRM, contravention.Score())
+			continue
+		}
+		contraventions = append(contraventions, contravention)
+	}
+	return contraventions
+}
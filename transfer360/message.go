@@ -0,0 +1,62 @@
+package transfer360
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProducerName is the producer attribute of the published messages.
+const ProducerName = "t360"
+
+// reservedAttributes are the message attributes set by the package or the
+// t360 command. Request metadata can't replace them.
+var reservedAttributes = map[string]bool{
+	"confidence":        true,
+	"schema_version":    true,
+	"content_type":      true,
+	"idempotency_key":   true,
+	"producer":          true,
+	"version":           true,
+	"produced_at":       true,
+	"hostname":          true,
+	"producer_identity": true,
+	"discovered_at":     true,
+}
+
+// IsReservedAttribute reports whether key is an attribute set for every
+// message, which request metadata can't use.
+func IsReservedAttribute(key string) bool {
+	return reservedAttributes[key]
+}
+
+// IdempotencyKey identifies a contravention independently of its Reference,
+// which is different on every publish.
+func (c *Contravention) IdempotencyKey() string {
+	vrm := strings.ToUpper(strings.ReplaceAll(c.VRM, " ", ""))
+	sum := sha256.Sum256([]byte(vrm + "\x00" + c.ContraventionDate + "\x00" + c.LeaseCompany.CompanyName))
+	return hex.EncodeToString(sum[:])
+}
+
+// Attributes returns the attributes of a result published as a JSON message,
+// the t360 command's default message format: its confidence, schema version,
+// content type, idempotency key, producer and the time it was produced, plus
+// the metadata that doesn't use a reserved key.
+func Attributes(contravention *Contravention, metadata map[string]string) map[string]string {
+	attributes := map[string]string{
+		"confidence":      strconv.FormatFloat(contravention.Score(), 'f', -1, 64),
+		"schema_version":  "1",
+		"content_type":    "application/json",
+		"idempotency_key": contravention.IdempotencyKey(),
+		"producer":        ProducerName,
+		"produced_at":     time.Now().UTC().Format(time.RFC3339),
+	}
+	for key, value := range metadata {
+		if !reservedAttributes[key] {
+			attributes[key] = value
+		}
+	}
+	return attributes
+}
@@ -0,0 +1,70 @@
+package transfer360
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Publisher sends a result on, with attributes to send alongside it.
+type Publisher interface {
+	Publish(ctx context.Context, contravention *Contravention, attributes map[string]string) error
+}
+
+// NewPubSubPublisher publishes results to topic as the JSON messages of the
+// t360 command's default message format, with the attributes the Checker
+// passes, and waits for each publish to be confirmed.
+func NewPubSubPublisher(topic *pubsub.Topic) Publisher {
+	return &pubsubPublisher{topic: topic}
+}
+
+type pubsubPublisher struct {
+	topic *pubsub.Topic
+}
+
+func (p *pubsubPublisher) Publish(ctx context.Context, contravention *Contravention, attributes map[string]string) error {
+	data, err := json.Marshal(contravention)
+	if err != nil {
+		return err
+	}
+	_, err = p.topic.Publish(ctx, &pubsub.Message{Data: data, Attributes: attributes}).Get(ctx)
+	return err
+}
+
+// MemoryPublisher keeps published results in memory instead of sending them,
+// for testing code that embeds a Checker. Err, when set, is returned by every
+// Publish.
+type MemoryPublisher struct {
+	Err       error
+	mutex     sync.Mutex
+	published []PublishedResult
+}
+
+// PublishedResult is a result kept by a MemoryPublisher.
+type PublishedResult struct {
+	Contravention Contravention
+	Attributes    map[string]string
+}
+
+func (p *MemoryPublisher) Publish(ctx context.Context, contravention *Contravention, attributes map[string]string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.Err != nil {
+		return p.Err
+	}
+	copied := make(map[string]string, len(attributes))
+	for key, value := range attributes {
+		copied[key] = value
+	}
+	p.published = append(p.published, PublishedResult{Contravention: *contravention, Attributes: copied})
+	return nil
+}
+
+// Published returns the results published so far, in order.
+func (p *MemoryPublisher) Published() []PublishedResult {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return append([]PublishedResult(nil), p.published...)
+}
@@ -0,0 +1,122 @@
+package transfer360
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+type LeaseCompany struct {
+	CompanyName  string `json:"companyname"`
+	AddressLine1 string `json:"address_line1"`
+	AddressLine2 string `json:"address_line2"`
+	AddressLine3 string `json:"addres_line3"`
+	AddressLine4 string `json:"addres_line4"`
+	Postcode     string `json:"postcode"`
+}
+
+// Contravention is a search result, in the format of the published messages.
+type Contravention struct {
+	Reference         string       `json:"reference"`
+	VRM               string       `json:"vrm"`
+	ContraventionDate string       `json:"contravention_date"`
+	IsHirerVehicle    bool         `json:"is_hirer_vehicle"`
+	LeaseCompany      LeaseCompany `json:"lease_company"`
+	Confidence        *float64     `json:"confidence,omitempty"`
+}
+
+// Score returns how confident the source is that the result matches the
+// searched vehicle. A missing confidence counts as an exact match.
+func (c *Contravention) Score() float64 {
+	if c.Confidence == nil {
+		return 1
+	}
+	return *c.Confidence
+}
+
+// Search is the body of a search request.
+type Search struct {
+	VRM               string    `json:"vrm"`
+	ContraventionDate time.Time `json:"contravention_date"`
+}
+
+// Source searches one provider. HTTP sources use client, so WithHTTPClient
+// applies to them; other sources may ignore it.
+type Source interface {
+	ID() string
+	Search(ctx context.Context, client *http.Client, search Search) ([]*Contravention, error)
+}
+
+// NewHTTPSource returns a source speaking the default JSON search protocol:
+// the search is POSTed to url, and the response is a result or an array of
+// results.
+func NewHTTPSource(id string, url string) Source {
+	return &httpSource{id: id, url: url}
+}
+
+type httpSource struct {
+	id  string
+	url string
+}
+
+// SandboxURL is where the sandbox sources are searched, followed by the ID
+// of the source.
+const SandboxURL = "https://sandbox-update.transfer360.dev/test_search/"
+
+// DefaultSources returns the sandbox sources built into the t360 command.
+func DefaultSources() map[string]Source {
+	return map[string]Source{
+		"ACME Company Ltd":  NewHTTPSource("acmelease", SandboxURL+"acmelease"),
+		"Lease Company Ltd": NewHTTPSource("leasecompany", SandboxURL+"leasecompany"),
+		"Fleet Company Ltd": NewHTTPSource("fleetcompany", SandboxURL+"fleetcompany"),
+		"Hire Company Ltd":  NewHTTPSource("hirecompany", SandboxURL+"hirecompany"),
+	}
+}
+
+func (s *httpSource) ID() string {
+	return s.id
+}
+
+func (s *httpSource) Search(ctx context.Context, client *http.Client, search Search) ([]*Contravention, error) {
+	jsonBody, err := json.Marshal(search)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", s.url, bytes.NewBuffer(jsonBody))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status code: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		var contraventions []*Contravention
+		if err := json.Unmarshal(trimmed, &contraventions); err != nil {
+			return nil, err
+		}
+		return contraventions, nil
+	}
+	var contravention Contravention
+	if err := json.Unmarshal(body, &contravention); err != nil {
+		return nil, err
+	}
+	return []*Contravention{&contravention}, nil
+}
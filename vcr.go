@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Cassette holds the data source HTTP interactions of a run, so the run can
+// be replayed offline with the same responses. Requests are matched on
+// method, URL and body; identical requests are answered in recorded order.
+//
+// Search requests contain the date being searched, which defaults to the
+// current time, so a recorded run searches at RecordedAt and a replayed run
+// uses the same time.
+type Cassette struct {
+	RecordedAt   time.Time     `json:"recorded_at"`
+	Interactions []Interaction `json:"interactions"`
+	path         string
+	replaying    bool
+	queues       map[string][]Interaction
+	mutex        sync.Mutex
+}
+
+type Interaction struct {
+	Source       string      `json:"source"`
+	Method       string      `json:"method"`
+	URL          string      `json:"url"`
+	RequestBody  string      `json:"request_body,omitempty"`
+	Status       int         `json:"status,omitempty"`
+	Header       http.Header `json:"header,omitempty"`
+	ResponseBody string      `json:"response_body,omitempty"`
+	Error        string      `json:"error,omitempty"`
+	Timeout      bool        `json:"timeout,omitempty"`
+}
+
+// cassette is nil unless -record or -replay is set.
+var cassette *Cassette
+
+// searchClock returns the time searched for records without a date.
+var searchClock = time.Now
+
+func NewCassette(path string) *Cassette {
+	return &Cassette{
+		RecordedAt:   time.Now().UTC().Truncate(time.Second),
+		Interactions: make([]Interaction, 0),
+		path:         path,
+	}
+}
+
+func LoadCassette(path string) (*Cassette, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Cassette{path: path, replaying: true, queues: make(map[string][]Interaction)}
+	if err := json.Unmarshal(body, c); err != nil {
+		return nil, fmt.Errorf("invalid cassette %s: %v", path, err)
+	}
+	for _, interaction := range c.Interactions {
+		key := interactionKey(interaction.Method, interaction.URL, interaction.RequestBody)
+		c.queues[key] = append(c.queues[key], interaction)
+	}
+	return c, nil
+}
+
+// Save writes a recorded cassette. Replayed cassettes are left alone.
+func (c *Cassette) Save() error {
+	if c.replaying {
+		return nil
+	}
+	c.mutex.Lock()
+	body, err := json.MarshalIndent(c, "", "  ")
+	c.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(c.path, body, 0644)
+}
+
+func interactionKey(method string, url string, body string) string {
+	return method + " " + url + "\n" + body
+}
+
+// Transport records the requests of a source sent through next, or answers
+// them from the cassette when replaying.
+func (c *Cassette) Transport(source string, next http.RoundTripper) http.RoundTripper {
+	return &cassetteTransport{cassette: c, source: source, next: next}
+}
+
+type cassetteTransport struct {
+	cassette *Cassette
+	source   string
+	next     http.RoundTripper
+}
+
+func (t *cassetteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var requestBody []byte
+	if req.Body != nil {
+		var err error
+		requestBody, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(requestBody))
+	}
+
+	if t.cassette.replaying {
+		return t.cassette.replay(req, string(requestBody))
+	}
+
+	interaction := Interaction{
+		Source:      t.source,
+		Method:      req.Method,
+		URL:         req.URL.String(),
+		RequestBody: string(requestBody),
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		interaction.Error = err.Error()
+		interaction.Timeout = os.IsTimeout(err)
+		t.cassette.add(interaction)
+		return nil, err
+	}
+
+	responseBody, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(responseBody))
+
+	interaction.Status = resp.StatusCode
+	interaction.Header = resp.Header
+	interaction.ResponseBody = string(responseBody)
+	t.cassette.add(interaction)
+	return resp, nil
+}
+
+// add records an interaction. With -anonymize the VRMs in it are replaced,
+// so the cassette can be shared; it is replayed with the same key.
+func (c *Cassette) add(interaction Interaction) {
+	interaction.URL = anonymizeText(interaction.URL)
+	interaction.RequestBody = anonymizeText(interaction.RequestBody)
+	interaction.ResponseBody = anonymizeText(interaction.ResponseBody)
+	interaction.Error = anonymizeText(interaction.Error)
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.Interactions = append(c.Interactions, interaction)
+}
+
+func (c *Cassette) replay(req *http.Request, body string) (*http.Response, error) {
+	key := interactionKey(req.Method, anonymizeText(req.URL.String()), anonymizeText(body))
+
+	c.mutex.Lock()
+	queue := c.queues[key]
+	if len(queue) == 0 {
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("no recorded interaction for %s %s", req.Method, req.URL)
+	}
+	interaction := queue[0]
+	c.queues[key] = queue[1:]
+	c.mutex.Unlock()
+
+	if interaction.Timeout {
+		return nil, &searchTimeoutError{err: fmt.Errorf("%s", interaction.Error)}
+	}
+	if interaction.Error != "" {
+		return nil, fmt.Errorf("%s", interaction.Error)
+	}
+
+	return &http.Response{
+		Status:        http.StatusText(interaction.Status),
+		StatusCode:    interaction.Status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        interaction.Header,
+		Body:          io.NopCloser(bytes.NewReader([]byte(interaction.ResponseBody))),
+		ContentLength: int64(len(interaction.ResponseBody)),
+		Request:       req,
+	}, nil
+}
@@ -6,108 +6,775 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/pubsub"
-	"github.com/google/uuid"
+	"github.com/costinul/transfer360-test/transfer360"
+	"golang.org/x/sync/errgroup"
 )
 
-func checkVehicle(client *pubsub.Client, ctx context.Context, vrm string, company string) error {
-	var contravention *VehicleContravention
-	var err error
+func checkVehicle(sink Sink, ctx context.Context, request SearchRequest) error {
+	return checkRecord(sink, ctx, request, nil)
+}
+
+// checkRecord checks a record like checkVehicle. finished, if not nil, is
+// called with the outcome once the record is recorded in the summary, which
+// for hits is when the publishes are confirmed.
+func checkRecord(sink Sink, ctx context.Context, request SearchRequest, finished func(outcome string, err error)) error {
+	if publishFailures != nil {
+		if err := publishFailures.Err(); err != nil {
+			return err
+		}
+	}
+	if outbox != nil {
+		if err := outbox.Err(); err != nil {
+			return err
+		}
+	}
+
+	if anonymizer != nil {
+		anonymizer.VRM(request.VRM)
+	}
+	if events != nil {
+		events.RecordStarted(request)
+	}
+	ctx = logSampler.withRecord(ctx)
+	contraventions, outcome, err := searchWithRetries(ctx, request)
+	if canary != nil {
+		canary.Compare(ctx, request, outcome, contraventions)
+	}
+	// With -search-only the searches were written as search rows, and
+	// nothing is published.
+	if searchOnly && outcome == outcomeHit && !slices.ContainsFunc(contraventions, isHirerVehicle) {
+		outcome = outcomeMiss
+	}
+	if outcome != outcomeHit || searchOnly {
+		summary.Record(request, outcome, err)
+		if finished != nil {
+			finished(outcome, err)
+		}
+		if outcome == outcomeTimeout {
+			return nil
+		}
+		return err
+	}
+
+	// Every contravention found is published as a message of its own.
+	results := newRecordResults(request, len(contraventions), finished)
+	discoveredAt := stampTime()
+	for i, contravention := range contraventions {
+		contravention.Metadata = request.Metadata
+		contravention.DiscoveredAt = discoveredAt
+		if err := publishHit(sink, ctx, request, i, contravention, results); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func publishHit(sink Sink, ctx context.Context, request SearchRequest, index int, contravention *VehicleContravention, results *recordResults) error {
+	// The DVLA is asked about the real VRM, and what is published only
+	// carries the pseudonym with -anonymize.
+	vrm := contravention.VRM
+	contravention.VRM = anonymizeVRM(vrm)
+	key := contravention.IdempotencyKey()
+	if dedup != nil {
+		reserved, err := dedup.Reserve(key)
+		if err != nil {
+			err = fmt.Errorf("dedup store: %v", err)
+			results.fail(err)
+			return err
+		}
+		if !reserved {
+			logRecordf(ctx, "Already published within the dedup window: %s\n", request.VRM)
+			results.done(outcomeDuplicate, nil)
+			return nil
+		}
+	}
+
+	// A run restarted after a crash finds the results of the crashed run
+	// again, which its outbox has already published or will publish.
+	if outbox != nil && outbox.Has(key) {
+		logRecordf(ctx, "Already in the outbox: %s\n", request.VRM)
+		results.done(outcomeDuplicate, nil)
+		return nil
+	}
+
+	if dvlaEnricher != nil {
+		dvlaEnricher.Enrich(ctx, contravention, vrm)
+	}
+
+	// The reference is set once the hit is known not to be a duplicate, so
+	// sequential references have no gaps.
+	reference, err := newReference(request, contravention, index)
+	if err != nil {
+		releaseDedup(key)
+		results.fail(err)
+		return err
+	}
+	contravention.Reference = reference
+
+	if outbox != nil {
+		if err := outbox.Add(contravention); err != nil {
+			releaseDedup(key)
+			results.fail(err)
+			return err
+		}
+		// The journal holds the result now, so a crash can't lose it.
+		confirmDedup(key)
+		if sampler != nil {
+			sampler.Add(request, contravention)
+		}
+		if acks != nil {
+			acks.Published(request, contravention)
+		}
+		results.done(outcomeHit, nil)
+		return nil
+	}
+
+	// The outcome of a hit is recorded once the sink has confirmed the publish.
+	err = sendResult(sink, ctx, contravention, func(err error) {
+		if publishFailures != nil {
+			publishFailures.Record(err)
+		}
+		if err != nil {
+			releaseDedup(key)
+			results.done(outcomeError, err)
+			return
+		}
+		confirmDedup(key)
+		if sampler != nil {
+			sampler.Add(request, contravention)
+		}
+		if acks != nil {
+			acks.Published(request, contravention)
+		}
+		results.done(outcomeHit, nil)
+	})
+	if err != nil {
+		releaseDedup(key)
+	}
+	return err
+}
+
+// recordResults records the outcome of a record once every contravention
+// found for it is done: an error if any failed, a hit if any was published
+// and a duplicate if all of them were published before.
+type recordResults struct {
+	request  SearchRequest
+	finished func(outcome string, err error)
+	pending  int
+	hit      bool
+	err      error
+	recorded bool
+	mutex    sync.Mutex
+}
+
+func newRecordResults(request SearchRequest, count int, finished func(outcome string, err error)) *recordResults {
+	return &recordResults{request: request, pending: count, finished: finished}
+}
+
+func (r *recordResults) done(outcome string, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	r.pending--
+	if outcome == outcomeHit {
+		r.hit = true
+	}
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+	if r.pending > 0 || r.recorded {
+		return
+	}
+
+	r.recorded = true
+	switch {
+	case r.err != nil:
+		r.record(outcomeError, r.err)
+	case r.hit:
+		r.record(outcomeHit, nil)
+	default:
+		r.record(outcomeDuplicate, nil)
+	}
+}
+
+// fail records the record as failed straight away.
+func (r *recordResults) fail(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if !r.recorded {
+		r.recorded = true
+		r.record(outcomeError, err)
+	}
+}
+
+func (r *recordResults) record(outcome string, err error) {
+	summary.Record(r.request, outcome, err)
+	if r.finished != nil {
+		r.finished(outcome, err)
+	}
+}
+
+// confirmDedup keeps the key of a published contravention for the whole
+// dedup window.
+func confirmDedup(key string) {
+	if dedup == nil {
+		return
+	}
+	if err := dedup.Confirm(key); err != nil {
+		log.Printf("Failed to confirm dedup key: %v\n", err)
+	}
+}
+
+// releaseDedup lets a later run publish a contravention whose publish failed.
+func releaseDedup(key string) {
+	if dedup == nil {
+		return
+	}
+	if err := dedup.Release(key); err != nil {
+		log.Printf("Failed to release dedup key: %v\n", err)
+	}
+}
 
-	log.Printf("Checking vehicle: %s, %s\n", vrm, company)
+// searchVehicle searches the record's source, or every source when the
+// company is unknown, and returns the contraventions that should be
+// published.
+func searchVehicle(ctx context.Context, request SearchRequest) ([]*VehicleContravention, string, error) {
+	var contraventions []*VehicleContravention
+	vrm, company := request.VRM, request.Company
+
+	logRecordf(ctx, "Checking vehicle: %s, %s\n", vrm, company)
+
+	if err := request.validateDates(); err != nil {
+		return nil, outcomeError, err
+	}
 
 	datasource := getDataSource(company)
 
+	var err error
 	if datasource == nil {
-		contravention, err = findContravention(vrm)
+		contraventions, err = findContraventions(ctx, request)
 
 		if err != nil {
-			return err
+			if os.IsTimeout(err) {
+				return nil, outcomeTimeout, err
+			}
+			return nil, outcomeError, err
 		}
 	} else {
-		contravention, err = SearchContravention(datasource, vrm, time.Now())
+		results, err := searchRecord(ctx, datasource, request)
 		if err != nil {
+			writeSearchRows(request, datasource, nil, err)
 			if os.IsTimeout(err) {
-				log.Printf("Timeout searching for %s in %s\n", vrm, company)
-				return nil
+				log.Printf("Timeout searching for %s in %s: %v\n", vrm, company, err)
+				return nil, outcomeTimeout, err
 			}
-			return err
+			return nil, outcomeError, err
 		}
-	}
 
-	if contravention == nil || !contravention.IsHirerVehicle {
-		log.Printf("Not a hirer vehicle: %s\n", contravention.VRM)
-		return nil
+		contraventions, err = qualifyingContraventions(datasource, request, results)
+		if err != nil {
+			return nil, outcomeError, err
+		}
+		if err := writeSearchRows(request, datasource, contraventions, nil); err != nil {
+			return nil, outcomeError, err
+		}
+		if err := checkLeaseCompanies(datasource, request, contraventions); err != nil {
+			return nil, outcomeError, err
+		}
 	}
 
-	err = sendToPubSub(client, ctx, contravention)
+	if len(contraventions) == 0 {
+		logRecordf(ctx, "Not a hirer vehicle: %s\n", vrm)
+		return nil, outcomeMiss, nil
+	}
 
-	return err
+	return contraventions, outcomeHit, nil
 }
 
-func findContravention(vrm string) (*VehicleContravention, error) {
-	for _, datasource := range dataSources {
-		contravention, err := SearchContravention(datasource, vrm, time.Now())
+// findContraventions returns the contraventions of the first source that has
+// any for the VRM. With -search-only, every source is searched and the
+// results of all of them are returned. When nothing is found and a source
+// timed out, the timeout is returned, as that source may know the vehicle.
+func findContraventions(ctx context.Context, request SearchRequest) ([]*VehicleContravention, error) {
+	found := make([]*VehicleContravention, 0)
+	var timeout error
+	for _, datasource := range allDataSources() {
+		results, err := searchRecord(ctx, datasource, request)
 		if err != nil {
+			writeSearchRows(request, datasource, nil, err)
 			if os.IsTimeout(err) {
-				log.Printf("Timeout searching for %s in %s\n", vrm, datasource.ID())
+				log.Printf("Timeout searching for %s in %s: %v\n", request.VRM, datasource.ID(), err)
+				if timeout == nil {
+					timeout = err
+				}
 				continue
 			}
 			return nil, err
 		}
 
-		if contravention != nil && contravention.IsHirerVehicle {
-			return contravention, nil
+		contraventions, err := qualifyingContraventions(datasource, request, results)
+		if err != nil {
+			return nil, err
+		}
+		if err := writeSearchRows(request, datasource, contraventions, nil); err != nil {
+			return nil, err
+		}
+		if searchOnly {
+			found = append(found, contraventions...)
+			continue
+		}
+		if len(contraventions) > 0 {
+			return contraventions, nil
+		}
+	}
+
+	if len(found) == 0 && timeout != nil {
+		return nil, timeout
+	}
+	return found, nil
+}
+
+// qualifyingContraventions normalizes the results of a source and keeps the
+// hirer vehicles, or with -search-only all results, matched with enough
+// confidence, inside the record's date range. A contravention found on
+// several days of a range is kept once.
+func qualifyingContraventions(datasource DataSource, request SearchRequest, results []*VehicleContravention) ([]*VehicleContravention, error) {
+	contraventions := make([]*VehicleContravention, 0, len(results))
+	seen := make(map[string]bool)
+	for _, contravention := range results {
+		if contravention == nil {
+			continue
+		}
+		if err := normalizeContravention(contravention); err != nil {
+			return nil, err
+		}
+		if (!contravention.IsHirerVehicle && !searchOnly) || !inDateRange(request, contravention) {
+			continue
 		}
+		if contravention.Score() < minConfidence {
+			log.Printf("Skipping low confidence match for %s in %s: %.2f\n", request.VRM, datasource.ID(), contravention.Score())
+			continue
+		}
+		key := contravention.IdempotencyKey()
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		contraventions = append(contraventions, contravention)
 	}
+	return contraventions, nil
+}
 
-	return nil, nil
+func isHirerVehicle(contravention *VehicleContravention) bool {
+	return contravention != nil && contravention.IsHirerVehicle
 }
 
-func processBatchFile(client *pubsub.Client, ctx context.Context, filePath string) error {
+func readBatchFile(filePath string) ([]SearchRequest, error) {
 	log.Printf("Processing batch file: %s\n", filePath)
 	requests := make([]SearchRequest, 0)
 
-	fileBody, err := os.ReadFile(filePath)
+	fileBody, err := readBatchBody(filePath)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	err = json.Unmarshal(fileBody, &requests)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	for i, request := range requests {
+		if err := request.validateDates(); err != nil {
+			return nil, fmt.Errorf("record %d: %v", i, err)
+		}
+		if err := validateMetadata(request.Metadata); err != nil {
+			return nil, fmt.Errorf("record %d: %v", i, err)
+		}
+		if err := validatePriority(request.Priority); err != nil {
+			return nil, fmt.Errorf("record %d: %v", i, err)
+		}
+		if err := validateCallbackURL(request.CallbackURL); err != nil {
+			return nil, fmt.Errorf("record %d: %v", i, err)
+		}
+		if err := validateReference(request.Reference); err != nil {
+			return nil, fmt.Errorf("record %d: %v", i, err)
+		}
 	}
 
+	return requests, nil
+}
+
+type requestGroup struct {
+	source   DataSource
+	requests []SearchRequest
+}
+
+// partitionRequests groups records by the data source they resolve to, in
+// the order each source is first seen, with high priority records first in
+// each group. Records without a known company go into a group without a
+// source.
+func partitionRequests(requests []SearchRequest) []*requestGroup {
+	groups := make([]*requestGroup, 0)
+	byID := make(map[string]*requestGroup)
+
 	for _, request := range requests {
-		err := checkVehicle(client, ctx, request.VRM, request.Company)
-		if err != nil {
+		source := getDataSource(request.Company)
+		id := ""
+		if source != nil {
+			id = source.ID()
+		}
+
+		group, ok := byID[id]
+		if !ok {
+			group = &requestGroup{source: source}
+			byID[id] = group
+			groups = append(groups, group)
+		}
+		group.requests = append(group.requests, request)
+	}
+
+	for _, group := range groups {
+		if budget != nil {
+			sortByCost(group.requests)
+		} else {
+			sortByPriority(group.requests)
+		}
+	}
+	return groups
+}
+
+// processRequests checks every request. Records are grouped by source and
+// the groups run side by side, so a slow source only delays its own records.
+// The first error stops all groups.
+func processRequests(sink Sink, ctx context.Context, requests []SearchRequest) error {
+	groups := partitionRequests(requests)
+	if budget != nil {
+		return processKnownFirst(sink, ctx, groups)
+	}
+
+	g, ctx := errgroup.WithContext(ctx)
+	for _, group := range groups {
+		g.Go(func() error {
+			return processGroup(sink, ctx, group)
+		})
+	}
+	return g.Wait()
+}
+
+// processGroup checks the records of one source. Records whose source is
+// inside a blackout window are deferred and retried once the window has ended.
+func processGroup(sink Sink, ctx context.Context, group *requestGroup) error {
+	concurrency := 1
+	if group.source != nil {
+		concurrency = sourceConcurrency(group.source)
+	}
+	label := groupLabel(group)
+	if dashboard != nil {
+		dashboard.Queue(label, len(group.requests))
+	}
+
+	requests := group.requests
+	for len(requests) > 0 {
+		ready := make([]SearchRequest, 0, len(requests))
+		deferred := make([]SearchRequest, 0)
+		var wakeUp time.Time
+
+		for _, request := range requests {
+			if until, ok := blackoutUntil(request.Company, time.Now()); ok {
+				log.Printf("Deferring %s: %s unavailable until %s\n", request.VRM, request.Company, until.Format(time.RFC3339))
+				deferred = append(deferred, request)
+				if wakeUp.IsZero() || until.Before(wakeUp) {
+					wakeUp = until
+				}
+				continue
+			}
+			ready = append(ready, request)
+		}
+
+		if err := checkAll(sink, ctx, ready, concurrency, label); err != nil {
 			return err
 		}
+
+		if len(deferred) == 0 {
+			return nil
+		}
+
+		log.Printf("Waiting until %s to retry %d deferred records\n", wakeUp.Format(time.RFC3339), len(deferred))
+		select {
+		case <-time.After(time.Until(wakeUp)):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		requests = deferred
 	}
 	return nil
 }
 
-func sendToPubSub(client *pubsub.Client, ctx context.Context, contravention *VehicleContravention) error {
-	log.Printf("Sending to pubsub: %s\n", contravention.VRM)
-	contravention.Reference = uuid.New().String()
+func checkAll(sink Sink, ctx context.Context, requests []SearchRequest, concurrency int, label string) error {
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(concurrency)
 
-	messageData, err := json.Marshal(contravention)
-	if err != nil {
-		return err
+	var running atomic.Int32
+	for _, request := range requests {
+		if ctx.Err() != nil {
+			break
+		}
+		if rampUp != nil {
+			if err := rampUp.Wait(ctx, &running, concurrency); err != nil {
+				break
+			}
+		}
+		running.Add(1)
+		g.Go(func() error {
+			defer running.Add(-1)
+			if dashboard != nil {
+				dashboard.Begin(label)
+				defer dashboard.End(label)
+			}
+			// The budget is checked once the record can start.
+			if budget != nil && !budget.Allows(request) {
+				deferRecord(request)
+				return nil
+			}
+			return checkVehicle(sink, ctx, request)
+		})
 	}
+	return g.Wait()
+}
+
+// streamQueue is how many records of a source processStream holds before
+// reading more waits for the source.
+const streamQueue = 100
+
+// processStream checks the records read passes to next as they arrive,
+// grouped by source like processRequests: each source has its own queue and
+// workers, so a slow source only holds up reading once its queue is full.
+// The first error, of reading or of a record, stops everything.
+func processStream(sink Sink, ctx context.Context, read func(ctx context.Context, next func(SearchRequest) error) error) error {
+	g, ctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		queues := make(map[string]chan SearchRequest)
+		defer func() {
+			for _, queue := range queues {
+				close(queue)
+			}
+		}()
+
+		err := read(ctx, func(request SearchRequest) error {
+			source := getDataSource(request.Company)
+			id := ""
+			if source != nil {
+				id = source.ID()
+			}
+			queue, ok := queues[id]
+			if !ok {
+				queue = make(chan SearchRequest, streamQueue)
+				queues[id] = queue
+				group := &requestGroup{source: source}
+				g.Go(func() error {
+					return checkQueue(sink, ctx, group, queue)
+				})
+			}
+			if dashboard != nil {
+				dashboard.Queue(groupLabel(&requestGroup{source: source}), 1)
+			}
 
-	topic := client.Topic("positive_searches")
-	result := topic.Publish(ctx, &pubsub.Message{
-		Data: messageData,
+			select {
+			case queue <- request:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+		// Reading stops early when the run is stopped or a record fails,
+		// which the error of the record reports.
+		if ctx.Err() != nil {
+			return nil
+		}
+		return err
 	})
+	return g.Wait()
+}
+
+// checkQueue checks the records of one source as they are queued, with as
+// many at a time as the source allows. Records whose source is inside a
+// blackout window wait until it has ended.
+func checkQueue(sink Sink, ctx context.Context, group *requestGroup, queue <-chan SearchRequest) error {
+	concurrency := 1
+	if group.source != nil {
+		concurrency = sourceConcurrency(group.source)
+	}
+	label := groupLabel(group)
+
+	g, ctx := errgroup.WithContext(ctx)
+	var running atomic.Int32
+	for range concurrency {
+		g.Go(func() error {
+			for request := range queue {
+				if until, ok := blackoutUntil(request.Company, time.Now()); ok {
+					log.Printf("Deferring %s: %s unavailable until %s\n", request.VRM, request.Company, until.Format(time.RFC3339))
+					select {
+					case <-time.After(time.Until(until)):
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+				if rampUp != nil {
+					if err := rampUp.Wait(ctx, &running, concurrency); err != nil {
+						return nil
+					}
+				}
+				if ctx.Err() != nil {
+					return nil
+				}
+
+				running.Add(1)
+				if dashboard != nil {
+					dashboard.Begin(label)
+				}
+				err := checkVehicle(sink, ctx, request)
+				if dashboard != nil {
+					dashboard.End(label)
+				}
+				running.Add(-1)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	return g.Wait()
+}
+
+func sendResult(sink Sink, ctx context.Context, contravention *VehicleContravention, done func(error)) error {
+	logRecordf(ctx, "Sending result: %s\n", contravention.VRM)
+	if events != nil {
+		published := done
+		done = func(err error) {
+			events.Published(contravention, err)
+			published(err)
+		}
+	}
+
+	if err := faults.publishFault(); err != nil {
+		log.Printf("Injecting publish failure for %s\n", contravention.VRM)
+		done(err)
+		return nil
+	}
+
+	err := sink.Publish(ctx, contravention, done)
+	if err != nil && events != nil {
+		events.Published(contravention, err)
+	}
+	return err
+}
 
-	_, err = result.Get(ctx)
+// messageAttributes are the attributes sent with a result: those of the
+// transfer360 package, for the message format in use, plus the version and
+// producer details of the command. Sinks without attributes send them as
+// headers.
+func messageAttributes(contravention *VehicleContravention) map[string]string {
+	attributes := transfer360.Attributes(&contravention.Contravention, contravention.Metadata)
+	attributes["schema_version"] = schemaVersionAttribute()
+	attributes["content_type"] = contentTypeAttribute()
+	attributes["version"] = version
+	producerAttributes(attributes)
+	if !contravention.DiscoveredAt.IsZero() {
+		attributes["discovered_at"] = contravention.DiscoveredAt.Format(time.RFC3339)
+	}
+	return attributes
+}
+
+// publishAsync publishes without waiting for Pub/Sub to confirm the message.
+// done is called from another goroutine with the outcome. When too many
+// publishes are outstanding it blocks until one is confirmed. Messages
+// rejected because a quota is exhausted are published again at a lower rate.
+func publishAsync(publisher Publisher, ctx context.Context, contravention *VehicleContravention, done func(error)) error {
+	messageData, err := encodeMessage(contravention)
 	if err != nil {
-		return fmt.Errorf("failed to publish message: %v", err)
+		return err
+	}
+
+	limiter := inflight
+	if err := limiter.acquire(ctx); err != nil {
+		return err
+	}
+	if err := quota.Wait(ctx); err != nil {
+		limiter.release(nil)
+		return err
+	}
+
+	message := &pubsub.Message{
+		Data:       messageData,
+		Attributes: messageAttributes(contravention),
 	}
+	if orderingKeys {
+		message.OrderingKey = strings.ToUpper(strings.ReplaceAll(contravention.VRM, " ", ""))
+	}
+	result := publisher.Publish(ctx, message)
+
+	start := time.Now()
+	go func() {
+		id, err := result.Get(limiter.ctx)
+		if isQuotaError(err) {
+			id, err = republishThrottled(publisher, limiter.ctx, message, err)
+		}
+		latency := time.Since(start)
+		if err != nil {
+			err = fmt.Errorf("failed to publish message: %v", err)
+		} else {
+			slow := slowPublishThreshold > 0 && latency > slowPublishThreshold
+			if slow {
+				log.Printf("Slow publish for %s: confirmation took %s\n", contravention.VRM, latency.Round(time.Millisecond))
+			}
+			summary.RecordPublish(latency, slow)
+			quota.Succeeded()
+			contravention.MessageID = id
+			logRecordf(ctx, "published vrm %s\n", contravention.VRM)
+		}
+
+		done(err)
+		// With a failure threshold, a failed publish only stops the run once
+		// the threshold is exceeded.
+		if publishFailures != nil {
+			limiter.release(nil)
+		} else {
+			limiter.release(err)
+		}
+	}()
 
-	log.Printf("published vrm %s\n", contravention.VRM)
 	return nil
 }
+
+// republishThrottled publishes a message rejected because a quota is
+// exhausted again at the throttled rate, until it is accepted or quotaMaxWait
+// has passed, after which it fails with the last quota error.
+func republishThrottled(publisher Publisher, ctx context.Context, message *pubsub.Message, err error) (string, error) {
+	deadline := time.Now().Add(quotaMaxWait)
+	var id string
+	for isQuotaError(err) {
+		quota.Throttle()
+		summary.RecordThrottle()
+
+		waitCtx, cancel := context.WithDeadline(ctx, deadline)
+		waitErr := quota.Wait(waitCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		if waitErr != nil {
+			return "", fmt.Errorf("quota still exhausted after %s: %v", quotaMaxWait, err)
+		}
+		id, err = publisher.Publish(ctx, message).Get(ctx)
+	}
+	return id, err
+}
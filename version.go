@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+
+	"github.com/google/uuid"
+)
+
+// Set at build time with:
+//
+//	go build -ldflags "-X main.version=1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" -o t360 .
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// runID identifies this run in outbound requests, logs and reports.
+var runID = uuid.New().String()
+
+// buildCommit returns the injected commit, falling back to the VCS
+// information Go embeds when building from a git checkout.
+func buildCommit() string {
+	if commit != "" {
+		return commit
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				return setting.Value
+			}
+		}
+	}
+	return "unknown"
+}
+
+func userAgent() string {
+	return fmt.Sprintf("%s/%s (run %s)", producerName, version, runID)
+}
+
+func runVersionCommand(args []string) error {
+	date := buildDate
+	if date == "" {
+		date = "unknown"
+	}
+
+	fmt.Printf("%s %s\n", producerName, version)
+	fmt.Printf("commit:     %s\n", buildCommit())
+	fmt.Printf("build date: %s\n", date)
+	fmt.Printf("go version: %s\n", runtime.Version())
+	fmt.Printf("platform:   %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Printf("pubsub:     %s\n", pubsubClientVersion())
+	return nil
+}
+
+const pubsubModule = "cloud.google.com/go/pubsub"
+
+// pubsubClientVersion returns the version of the Pub/Sub client library
+// built into the binary.
+func pubsubClientVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == pubsubModule {
+			if dep.Replace != nil {
+				return dep.Replace.Version
+			}
+			return dep.Version
+		}
+	}
+	return ""
+}
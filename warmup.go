@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Warmer is implemented by sources that need something other than an HTTP
+// HEAD request to open their connections.
+type Warmer interface {
+	Warmup(ctx context.Context) error
+}
+
+// warmupSources opens connections to the given sources before the batch
+// starts, so DNS lookups and TLS handshakes don't eat into the search timeout
+// of the first records. Failures are logged and otherwise ignored.
+func warmupSources(ctx context.Context, sources []DataSource) {
+	var wg sync.WaitGroup
+	for _, source := range sources {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+			defer cancel()
+
+			start := time.Now()
+			if err := warmupSource(ctx, source); err != nil {
+				log.Printf("Warmup of %s failed: %v\n", source.ID(), err)
+				return
+			}
+			log.Printf("Warmed up %s in %s\n", source.ID(), time.Since(start).Round(time.Millisecond))
+		}()
+	}
+	wg.Wait()
+}
+
+func warmupSource(ctx context.Context, source DataSource) error {
+	if warmer, ok := source.(Warmer); ok {
+		return warmer.Warmup(ctx)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, source.SearchURL(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent())
+
+	// Use the source's transport directly so the connection lands in its pool,
+	// but without the short search timeout of its client.
+	resp, err := httpClientFor(source).Transport.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	return resp.Body.Close()
+}
+
+// sourcesFor returns the sources a set of records will be searched in.
+func sourcesFor(requests []SearchRequest) []DataSource {
+	seen := make(map[string]bool)
+	sources := make([]DataSource, 0)
+
+	add := func(source DataSource) {
+		if !seen[source.ID()] {
+			seen[source.ID()] = true
+			sources = append(sources, source)
+		}
+	}
+
+	for _, request := range requests {
+		source := getDataSource(request.Company)
+		if source == nil {
+			for _, source := range allDataSources() {
+				add(source)
+			}
+			continue
+		}
+		add(source)
+	}
+
+	return sources
+}
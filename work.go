@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Large batches can be spread over several machines: t360 batch enqueue
+// publishes the records of a batch to a work topic, and any number of t360
+// -worker instances take records from its subscription, check them and
+// publish the results. A record is acknowledged once its outcome is final;
+// records that timed out or failed, or whose worker stopped or held them
+// longer than -max-hold, are delivered again, until the subscription moves
+// them to its dead-letter topic.
+
+const (
+	defaultWorkTopic        = "t360_work"
+	defaultWorkSubscription = "t360_work_workers"
+	defaultWorkDeadLetter   = "t360_work_dead"
+	// workerKeptRecords bounds the records a worker keeps for its report, so
+	// a long-lived worker doesn't grow without limit.
+	workerKeptRecords = 1000
+)
+
+// runBatchEnqueue publishes the records of a batch file to the work topic,
+// creating the topic and the workers' subscription when they are missing.
+func runBatchEnqueue(args []string) error {
+	fs := flag.NewFlagSet("batch enqueue", flag.ExitOnError)
+	conn := addConnectionFlags(fs)
+	workTopic := fs.String("work-topic", defaultWorkTopic, "Topic the records are published to")
+	workSubscription := fs.String("work-subscription", defaultWorkSubscription, "Subscription the workers read the records from, created on the work topic if missing")
+	ackDeadline := fs.Duration("ack-deadline", time.Minute, "Ack deadline of a created work subscription")
+	deadLetterTopic := fs.String("dead-letter-topic", defaultWorkDeadLetter, "Topic a created work subscription moves records to after -max-delivery-attempts (empty retries them forever)")
+	maxAttempts := fs.Int("max-delivery-attempts", minDeliveryAttempts, "Delivery attempts before a record is moved to -dead-letter-topic (5-100)")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: t360 batch enqueue [flags] file.json")
+	}
+	if *ackDeadline < 10*time.Second || *ackDeadline > 600*time.Second {
+		return fmt.Errorf("ack-deadline must be between 10s and 10m")
+	}
+	if *deadLetterTopic != "" && (*maxAttempts < minDeliveryAttempts || *maxAttempts > maxDeliveryAttempts) {
+		return fmt.Errorf("max-delivery-attempts must be between %d and %d", minDeliveryAttempts, maxDeliveryAttempts)
+	}
+
+	requests, err := readBatchFile(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to read batch: %v", err)
+	}
+
+	ctx := context.Background()
+	client, err := conn.newClient(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	topic := client.Topic(*workTopic)
+	exists, err := topic.Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check topic: %v", err)
+	}
+	if !exists {
+		if topic, err = client.CreateTopic(ctx, *workTopic); err != nil {
+			return fmt.Errorf("failed to create topic: %v", err)
+		}
+		log.Printf("Created topic %s\n", *workTopic)
+	}
+	defer topic.Stop()
+
+	sub := client.Subscription(*workSubscription)
+	exists, err = sub.Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check subscription: %v", err)
+	}
+	if !exists {
+		subConfig := pubsub.SubscriptionConfig{
+			Topic:       topic,
+			AckDeadline: *ackDeadline,
+		}
+		if *deadLetterTopic != "" {
+			deadLetter := client.Topic(*deadLetterTopic)
+			exists, err := deadLetter.Exists(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to check dead-letter topic: %v", err)
+			}
+			if !exists {
+				if deadLetter, err = client.CreateTopic(ctx, *deadLetterTopic); err != nil {
+					return fmt.Errorf("failed to create dead-letter topic %s: %v", *deadLetterTopic, err)
+				}
+				log.Printf("Created topic %s\n", *deadLetterTopic)
+			}
+			subConfig.DeadLetterPolicy = &pubsub.DeadLetterPolicy{
+				DeadLetterTopic:     deadLetter.String(),
+				MaxDeliveryAttempts: *maxAttempts,
+			}
+		}
+		if sub, err = client.CreateSubscription(ctx, *workSubscription, subConfig); err != nil {
+			return fmt.Errorf("failed to create subscription: %v", err)
+		}
+		log.Printf("Created subscription %s on %s\n", *workSubscription, *workTopic)
+		if *deadLetterTopic != "" && !conn.emulator() {
+			if err := grantDeadLettering(ctx, conn.projectID, conn.options(), sub, client.Topic(*deadLetterTopic)); err != nil {
+				return err
+			}
+		}
+	}
+
+	results := make([]*pubsub.PublishResult, 0, len(requests))
+	for _, request := range requests {
+		data, err := json.Marshal(request)
+		if err != nil {
+			return err
+		}
+		results = append(results, topic.Publish(ctx, &pubsub.Message{Data: data}))
+	}
+	failed := 0
+	for _, result := range results {
+		if _, err := result.Get(ctx); err != nil {
+			log.Printf("Failed to enqueue record: %v\n", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to enqueue %d of %d records", failed, len(requests))
+	}
+	log.Printf("Enqueued %d records to %s\n", len(requests), *workTopic)
+	return nil
+}
+
+// runWorker checks the records delivered on the work subscription until ctx
+// is cancelled.
+func runWorker(ctx context.Context, sink *SinkSet, flags *Flags) error {
+	client, err := clientFactory.Client(ctx)
+	if err != nil {
+		return err
+	}
+
+	sub := client.Subscription(flags.WorkSubscription)
+	exists, err := sub.Exists(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check subscription: %v", err)
+	}
+	if !exists {
+		return fmt.Errorf("work subscription %s does not exist, create it with t360 batch enqueue", flags.WorkSubscription)
+	}
+	config, err := sub.Config(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to read subscription: %v", err)
+	}
+	if config.DeadLetterPolicy == nil {
+		log.Printf("Warning: work subscription %s has no dead-letter topic, records that keep failing are delivered again forever\n", flags.WorkSubscription)
+	}
+	sub.ReceiveSettings.MaxOutstandingMessages = flags.WorkerConcurrency
+	sub.ReceiveSettings.MaxExtension = flags.MaxHold
+	summary.KeepLatest(workerKeptRecords)
+
+	receiveCtx, stop := context.WithCancel(ctx)
+	defer stop()
+
+	var received atomic.Int64
+	log.Printf("Worker reading records from %s\n", flags.WorkSubscription)
+	err = sub.Receive(receiveCtx, func(ctx context.Context, message *pubsub.Message) {
+		received.Add(1)
+
+		var request SearchRequest
+		if err := decodeWorkRecord(message.Data, &request); err != nil {
+			// An invalid record never succeeds, so it is not delivered again.
+			log.Printf("Dropping invalid work record %s: %v\n", message.ID, err)
+			summary.Record(request, outcomeError, err)
+			message.Ack()
+			return
+		}
+
+		err := checkRecord(sink, ctx, request, func(outcome string, err error) {
+			if outcome == outcomeTimeout || outcome == outcomeError {
+				message.Nack()
+				return
+			}
+			message.Ack()
+		})
+		if err != nil {
+			message.Nack()
+		}
+		// A failed publish stops the worker like it stops a run.
+		if inflight.Err() != nil || (publishFailures != nil && publishFailures.Err() != nil) {
+			stop()
+		}
+	})
+
+	publishErr := inflight.Wait()
+	sink.Wait()
+	log.Printf("Worker stopped after %d records\n", received.Load())
+	if err != nil {
+		return fmt.Errorf("failed to receive work: %v", err)
+	}
+	if publishErr != nil {
+		return publishErr
+	}
+	if publishFailures != nil {
+		return publishFailures.Err()
+	}
+	return nil
+}
+
+func decodeWorkRecord(data []byte, request *SearchRequest) error {
+	if err := json.Unmarshal(data, request); err != nil {
+		return err
+	}
+	if request.VRM == "" {
+		return fmt.Errorf("vrm is required")
+	}
+	if err := request.validateDates(); err != nil {
+		return err
+	}
+	if err := validateMetadata(request.Metadata); err != nil {
+		return err
+	}
+	if err := validatePriority(request.Priority); err != nil {
+		return err
+	}
+	if err := validateCallbackURL(request.CallbackURL); err != nil {
+		return err
+	}
+	if err := validateReference(request.Reference); err != nil {
+		return err
+	}
+	if err := requireReference(*request); err != nil {
+		return err
+	}
+	return requireCallbacks(*request)
+}